@@ -1,7 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"bakaray/internal/config"
 	"bakaray/internal/handlers"
@@ -14,6 +21,9 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// shutdownTimeout 收到退出信号后等待进行中请求完成的最长时间
+const shutdownTimeout = 15 * time.Second
+
 func init() {
 	gin.SetMode(gin.ReleaseMode)
 }
@@ -61,20 +71,52 @@ func main() {
 		defer redis.Close()
 	}
 
+	stateStore, err := services.NewStateStore(cfg.State.Backend, db, redis)
+	if err != nil {
+		logger.Error("Failed to initialize state store", err, "backend", cfg.State.Backend)
+		os.Exit(1)
+	}
+	logger.Info("State store initialized", "backend", stateStore.Name())
+
 	userService := services.NewUserService(db, redis)
-	nodeService := services.NewNodeService(db, redis)
+	nodeService := services.NewNodeService(db, stateStore)
 	ruleService := services.NewRuleService(db, redis)
-	paymentService := services.NewPaymentService(db, redis)
+	paymentService := services.NewPaymentService(db, stateStore)
 	paymentConfigService := services.NewPaymentConfigService(db)
 	siteConfigService := services.NewSiteConfigService(db)
 	userGroupService := services.NewUserGroupService(db)
+	nodeGroupService := services.NewNodeGroupService(db)
+	probeHistoryService := services.NewProbeHistoryService(db, services.ProbeRetention{
+		Raw:    time.Duration(cfg.Probe.RawRetentionHours) * time.Hour,
+		Minute: time.Duration(cfg.Probe.MinuteRetentionDays) * 24 * time.Hour,
+		Hour:   time.Duration(cfg.Probe.HourRetentionDays) * 24 * time.Hour,
+	})
+	trafficStatsService := services.NewTrafficStatsService(db, services.TrafficRetention{
+		Raw:  time.Duration(cfg.Traffic.RawRetentionDays) * 24 * time.Hour,
+		Hour: time.Duration(cfg.Traffic.HourRetentionDays) * 24 * time.Hour,
+		Day:  time.Duration(cfg.Traffic.DayRetentionDays) * 24 * time.Hour,
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	scheduler := services.NewScheduler(db)
+	scheduler.Register("node_status_sweep", services.NodeStatusSweepInterval, services.NewNodeStatusSweeper(nodeService, siteConfigService).Run)
+	scheduler.Register("rule_placement", services.RulePlacementSweepInterval, ruleService.RunPlacementSweep)
+	scheduler.Register("rule_schedule", services.RuleScheduleSweepInterval, ruleService.RunScheduleSweep)
+	scheduler.Register("destination_recheck", services.DestinationRecheckSweepInterval, ruleService.RunDestinationRecheck)
+	scheduler.Register("probe_rollup", services.ProbeRollupInterval, probeHistoryService.RunRollup)
+	scheduler.Register("traffic_rollup", services.TrafficRollupInterval, trafficStatsService.RunRollup)
+	scheduler.Register("state_store_prune", services.StateStorePruneInterval, stateStore.PruneExpired)
+	scheduler.Start(ctx)
+	logger.Info("Scheduler started", "holder", scheduler.Holder())
 
 	authHandler := handlers.NewAuthHandler(userService)
 	userHandler := handlers.NewUserHandler(userService, ruleService, userGroupService)
-	nodeHandler := handlers.NewNodeHandler(userService, nodeService, ruleService, siteConfigService)
-	ruleHandler := handlers.NewRuleHandler(ruleService, nodeService, userService)
+	nodeHandler := handlers.NewNodeHandler(userService, nodeService, ruleService, siteConfigService, probeHistoryService)
+	ruleHandler := handlers.NewRuleHandler(ruleService, nodeService, userService, nodeGroupService, trafficStatsService)
 	paymentHandler := handlers.NewPaymentHandler(paymentService, paymentConfigService)
-	adminHandler := handlers.NewAdminHandler(userService, nodeService, ruleService, paymentService, userGroupService, siteConfigService)
+	adminHandler := handlers.NewAdminHandler(userService, nodeService, ruleService, paymentService, userGroupService, siteConfigService, nodeGroupService)
 
 	r := gin.New()
 
@@ -119,11 +161,36 @@ func main() {
 		}
 	})
 
-	routes.Setup(r, authHandler, userHandler, nodeHandler, ruleHandler, paymentHandler, adminHandler, middleware.NewAuthMiddleware(userService))
+	routes.Setup(r, authHandler, userHandler, nodeHandler, ruleHandler, paymentHandler, adminHandler, middleware.NewAuthMiddleware(userService), middleware.NewNodeAuthMiddleware(nodeService, siteConfigService))
 
+	srv := &http.Server{
+		Addr:    cfg.Server.Host + ":" + cfg.Server.Port,
+		Handler: r,
+		// 请求上下文随退出信号取消，进行中的长请求可以及时返回
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
 	logger.Info("Server starting", "host", cfg.Server.Host, "port", cfg.Server.Port)
-	if err := r.Run(cfg.Server.Host + ":" + cfg.Server.Port); err != nil {
-		logger.Error("Failed to start server", err)
-		os.Exit(1)
+
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Failed to start server", err)
+			os.Exit(1)
+		}
+	case <-ctx.Done():
+		logger.Info("Shutting down server")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("Server shutdown incomplete", "error", err)
+		}
 	}
+
+	stop()
+	scheduler.Wait()
+	logger.Info("Server stopped")
 }
@@ -14,6 +14,9 @@ type Config struct {
 	Redis    RedisConfig    `yaml:"redis"`
 	Site     SiteConfig     `yaml:"site"`
 	JWT      JWTConfig      `yaml:"jwt"`
+	Probe    ProbeConfig    `yaml:"probe"`
+	Traffic  TrafficConfig  `yaml:"traffic"`
+	State    StateConfig    `yaml:"state"`
 }
 
 // ServerConfig 服务器配置
@@ -48,7 +51,7 @@ type RedisConfig struct {
 type SiteConfig struct {
 	Name               string `yaml:"name"`
 	Domain             string `yaml:"domain"`
-	NodeSecret         string `yaml:"node_secret"`
+	NodeSecret         string `yaml:"node_secret"` // Deprecated: 已不再使用，节点密钥由注册令牌签发
 	NodeReportInterval int    `yaml:"node_report_interval"`
 }
 
@@ -58,6 +61,26 @@ type JWTConfig struct {
 	Expiration int    `yaml:"expiration"`
 }
 
+// ProbeConfig 探针历史保留策略
+type ProbeConfig struct {
+	RawRetentionHours   int `yaml:"raw_retention_hours"`   // 原始采样保留小时数
+	MinuteRetentionDays int `yaml:"minute_retention_days"` // 1 分钟聚合保留天数
+	HourRetentionDays   int `yaml:"hour_retention_days"`   // 1 小时聚合保留天数
+}
+
+// TrafficConfig 流量日志保留策略
+type TrafficConfig struct {
+	RawRetentionDays  int `yaml:"raw_retention_days"`  // 原始流量日志保留天数
+	HourRetentionDays int `yaml:"hour_retention_days"` // 小时聚合保留天数
+	DayRetentionDays  int `yaml:"day_retention_days"`  // 天聚合保留天数，0 表示永久保留
+}
+
+// StateConfig 运行时状态存储配置
+// backend 可选 auto（有 Redis 用 Redis，否则用数据库）、redis、database、memory
+type StateConfig struct {
+	Backend string `yaml:"backend"`
+}
+
 // Load 加载配置文件
 func Load() (*Config, error) {
 	cfg := &Config{}
@@ -87,13 +110,25 @@ func Load() (*Config, error) {
 	cfg.Site = SiteConfig{
 		Name:               "BakaRay",
 		Domain:             "http://localhost:8080",
-		NodeSecret:         "change-this-secret-in-production",
 		NodeReportInterval: 10,
 	}
 	cfg.JWT = JWTConfig{
 		Secret:     "change-this-secret-in-production",
 		Expiration: 86400,
 	}
+	cfg.Probe = ProbeConfig{
+		RawRetentionHours:   24,
+		MinuteRetentionDays: 7,
+		HourRetentionDays:   90,
+	}
+	cfg.Traffic = TrafficConfig{
+		RawRetentionDays:  30,
+		HourRetentionDays: 90,
+		DayRetentionDays:  730,
+	}
+	cfg.State = StateConfig{
+		Backend: "auto",
+	}
 
 	// 然后从配置文件加载（会覆盖默认值）
 	configFile := getEnv("CONFIG_FILE", "config.yaml")
@@ -196,6 +231,45 @@ func applyEnvOverrides(cfg *Config) {
 			cfg.JWT.Expiration = exp
 		}
 	}
+
+	// State
+	if v := os.Getenv("STATE_BACKEND"); v != "" {
+		cfg.State.Backend = v
+	}
+
+	// Probe
+	if v := os.Getenv("PROBE_RAW_RETENTION_HOURS"); v != "" {
+		if hours, err := strconv.Atoi(v); err == nil {
+			cfg.Probe.RawRetentionHours = hours
+		}
+	}
+	if v := os.Getenv("PROBE_MINUTE_RETENTION_DAYS"); v != "" {
+		if days, err := strconv.Atoi(v); err == nil {
+			cfg.Probe.MinuteRetentionDays = days
+		}
+	}
+	if v := os.Getenv("PROBE_HOUR_RETENTION_DAYS"); v != "" {
+		if days, err := strconv.Atoi(v); err == nil {
+			cfg.Probe.HourRetentionDays = days
+		}
+	}
+
+	// Traffic
+	if v := os.Getenv("TRAFFIC_RAW_RETENTION_DAYS"); v != "" {
+		if days, err := strconv.Atoi(v); err == nil {
+			cfg.Traffic.RawRetentionDays = days
+		}
+	}
+	if v := os.Getenv("TRAFFIC_HOUR_RETENTION_DAYS"); v != "" {
+		if days, err := strconv.Atoi(v); err == nil {
+			cfg.Traffic.HourRetentionDays = days
+		}
+	}
+	if v := os.Getenv("TRAFFIC_DAY_RETENTION_DAYS"); v != "" {
+		if days, err := strconv.Atoi(v); err == nil {
+			cfg.Traffic.DayRetentionDays = days
+		}
+	}
 }
 
 func getEnv(key, defaultValue string) string {
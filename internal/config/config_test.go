@@ -12,6 +12,8 @@ func TestLoad(t *testing.T) {
 		"REDIS_HOST", "REDIS_PORT", "REDIS_PASSWORD", "REDIS_DB", "REDIS_POOL_SIZE",
 		"SITE_NAME", "SITE_DOMAIN", "NODE_REPORT_INTERVAL",
 		"JWT_SECRET", "JWT_EXPIRATION",
+		"STATE_BACKEND", "PROBE_RAW_RETENTION_HOURS", "PROBE_MINUTE_RETENTION_DAYS", "PROBE_HOUR_RETENTION_DAYS",
+		"TRAFFIC_RAW_RETENTION_DAYS", "TRAFFIC_HOUR_RETENTION_DAYS", "TRAFFIC_DAY_RETENTION_DAYS",
 		"CONFIG_FILE",
 	}
 	original := make(map[string]string, len(envKeys))
@@ -58,6 +60,15 @@ func TestLoad(t *testing.T) {
 	if cfg.JWT.Expiration != 86400 {
 		t.Errorf("JWT.Expiration = %v, want 86400", cfg.JWT.Expiration)
 	}
+	if cfg.State.Backend != "auto" {
+		t.Errorf("State.Backend = %v, want auto", cfg.State.Backend)
+	}
+	if cfg.Probe.RawRetentionHours != 24 || cfg.Probe.MinuteRetentionDays != 7 || cfg.Probe.HourRetentionDays != 90 {
+		t.Errorf("Probe = %+v, want 24h/7d/90d", cfg.Probe)
+	}
+	if cfg.Traffic.RawRetentionDays != 30 || cfg.Traffic.HourRetentionDays != 90 || cfg.Traffic.DayRetentionDays != 730 {
+		t.Errorf("Traffic = %+v, want 30d/90d/730d", cfg.Traffic)
+	}
 }
 
 func TestLoadWithEnv(t *testing.T) {
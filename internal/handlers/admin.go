@@ -2,8 +2,11 @@ package handlers
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"time"
 
 	"bakaray/internal/logger"
 	"bakaray/internal/middleware"
@@ -21,10 +24,11 @@ type AdminHandler struct {
 	paymentService    *services.PaymentService
 	userGroupService  *services.UserGroupService
 	siteConfigService *services.SiteConfigService
+	nodeGroupService  *services.NodeGroupService
 }
 
 // NewAdminHandler 创建后台管理处理器
-func NewAdminHandler(userService *services.UserService, nodeService *services.NodeService, ruleService *services.RuleService, paymentService *services.PaymentService, userGroupService *services.UserGroupService, siteConfigService *services.SiteConfigService) *AdminHandler {
+func NewAdminHandler(userService *services.UserService, nodeService *services.NodeService, ruleService *services.RuleService, paymentService *services.PaymentService, userGroupService *services.UserGroupService, siteConfigService *services.SiteConfigService, nodeGroupService *services.NodeGroupService) *AdminHandler {
 	return &AdminHandler{
 		userService:       userService,
 		nodeService:       nodeService,
@@ -32,6 +36,7 @@ func NewAdminHandler(userService *services.UserService, nodeService *services.No
 		paymentService:    paymentService,
 		userGroupService:  userGroupService,
 		siteConfigService: siteConfigService,
+		nodeGroupService:  nodeGroupService,
 	}
 }
 
@@ -62,8 +67,9 @@ func (h *AdminHandler) GetSiteConfig(c *gin.Context) {
 type UpdateSiteConfigRequest struct {
 	SiteName           string `json:"site_name"`
 	SiteDomain         string `json:"site_domain"`
-	NodeSecret         string `json:"node_secret"`
 	NodeReportInterval *int   `json:"node_report_interval"`
+	NodeLegacyAuth     *bool  `json:"node_legacy_auth"`
+	BillExitMultiplier *bool  `json:"bill_exit_multiplier"`
 }
 
 func (h *AdminHandler) UpdateSiteConfig(c *gin.Context) {
@@ -91,9 +97,6 @@ func (h *AdminHandler) UpdateSiteConfig(c *gin.Context) {
 	if req.SiteDomain != "" {
 		updates["site_domain"] = req.SiteDomain
 	}
-	if req.NodeSecret != "" {
-		updates["node_secret"] = req.NodeSecret
-	}
 	if req.NodeReportInterval != nil {
 		if *req.NodeReportInterval <= 0 {
 			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "node_report_interval 必须 > 0"})
@@ -101,6 +104,12 @@ func (h *AdminHandler) UpdateSiteConfig(c *gin.Context) {
 		}
 		updates["node_report_interval"] = *req.NodeReportInterval
 	}
+	if req.NodeLegacyAuth != nil {
+		updates["node_legacy_auth"] = *req.NodeLegacyAuth
+	}
+	if req.BillExitMultiplier != nil {
+		updates["bill_exit_multiplier"] = *req.BillExitMultiplier
+	}
 	if len(updates) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "没有可更新的内容"})
 		return
@@ -155,6 +164,43 @@ func (h *AdminHandler) GetAdminNodeDetail(c *gin.Context) {
 	})
 }
 
+// GetNodeStatusEvents 获取节点上下线记录
+func (h *AdminHandler) GetNodeStatusEvents(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "admin")
+
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+
+	log.Debug("GetNodeStatusEvents request", "node_id", id, "limit", limit)
+
+	if _, err := h.nodeService.GetNodeByID(uint(id)); err != nil {
+		logger.Warn("GetNodeStatusEvents: node not found", "node_id", id, "request_id", requestID)
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "message": "节点不存在"})
+		return
+	}
+
+	events, err := h.nodeService.ListNodeStatusEvents(uint(id), limit)
+	if err != nil {
+		logger.Error("GetNodeStatusEvents: failed to list events", err, "node_id", id, "request_id", requestID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "获取失败"})
+		return
+	}
+
+	flaps, _ := h.nodeService.CountNodeStatusEvents(uint(id), time.Now().Add(-time.Hour))
+
+	log.Info("GetNodeStatusEvents success", "node_id", id, "event_count", len(events))
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 0,
+		"data": gin.H{
+			"list":            events,
+			"changes_last_1h": flaps,
+		},
+	})
+}
+
 // UpdateNode 更新节点
 func (h *AdminHandler) UpdateNode(c *gin.Context) {
 	requestID := c.GetString("request_id")
@@ -174,8 +220,27 @@ func (h *AdminHandler) UpdateNode(c *gin.Context) {
 	rawAllowedGroupIDs, hasAllowedGroupIDs := updates["allowed_group_ids"]
 	delete(updates, "allowed_group_ids")
 
+	// 所属节点组与节点组成员管理一样检查组内规则的端口冲突，并立即为 healthiest 规则重新选择节点
+	if rawNodeGroupID, ok := updates["node_group_id"]; ok {
+		delete(updates, "node_group_id")
+		groupID, valid := parseNodeGroupID(rawNodeGroupID)
+		if !valid {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "node_group_id 参数错误"})
+			return
+		}
+		if err := h.nodeGroupService.AssignNode(uint(id), groupID); err != nil {
+			writeNodeGroupError(c, err, "更新节点组失败", "UpdateNode", uint64(groupID), requestID, userID)
+			return
+		}
+		h.rebalanceGroupRules("UpdateNode", requestID, userID)
+	}
+
 	if len(updates) > 0 {
 		if err := h.nodeService.UpdateNode(uint(id), updates); err != nil {
+			if errors.Is(err, services.ErrInvalidPortRanges) {
+				c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+				return
+			}
 			logger.Error("UpdateNode: failed to update node", err, "node_id", id, "request_id", requestID, "user_id", userID)
 			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "更新失败"})
 			return
@@ -222,6 +287,23 @@ func (h *AdminHandler) UpdateNode(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"code": 0, "message": "更新成功"})
 }
 
+// parseNodeGroupID 解析更新请求中的 node_group_id，支持数字和数字字符串
+func parseNodeGroupID(raw interface{}) (uint, bool) {
+	switch v := raw.(type) {
+	case float64:
+		if v < 0 || v != float64(uint32(v)) {
+			return 0, false
+		}
+		return uint(v), true
+	case string:
+		id, err := strconv.ParseUint(v, 10, 32)
+		return uint(id), err == nil
+	case nil:
+		return 0, true
+	}
+	return 0, false
+}
+
 // DeleteNode 删除节点
 func (h *AdminHandler) DeleteNode(c *gin.Context) {
 	requestID := c.GetString("request_id")
@@ -243,6 +325,389 @@ func (h *AdminHandler) DeleteNode(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"code": 0, "message": "删除成功"})
 }
 
+// RotateNodeSecretRequest 节点密钥轮换请求
+type RotateNodeSecretRequest struct {
+	OverlapSeconds int `json:"overlap_seconds"` // 新旧密钥同时有效的时长，默认 1 小时
+}
+
+// RotateNodeSecret 轮换节点密钥，新密钥通过节点配置下发
+func (h *AdminHandler) RotateNodeSecret(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "admin")
+
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+
+	var req RotateNodeSecretRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		logger.Warn("RotateNodeSecret: invalid request", "error", err, "node_id", id, "request_id", requestID, "user_id", userID)
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "参数错误"})
+		return
+	}
+	if req.OverlapSeconds < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "overlap_seconds 不能为负数"})
+		return
+	}
+
+	rotation, err := h.nodeService.RotateNodeSecret(uint(id), time.Duration(req.OverlapSeconds)*time.Second)
+	if err != nil {
+		if errors.Is(err, services.ErrNodeNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"code": 404, "message": "节点不存在"})
+			return
+		}
+		logger.Error("RotateNodeSecret: failed to rotate secret", err, "node_id", id, "request_id", requestID, "user_id", userID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "轮换失败"})
+		return
+	}
+
+	log.Info("RotateNodeSecret success", "node_id", id, "expires_at", rotation.ExpiresAt)
+
+	c.JSON(http.StatusOK, gin.H{"code": 0, "message": "轮换成功", "data": rotation})
+}
+
+// RevokeNodeCredentials 立即吊销节点凭据，重新签发需调用轮换接口
+func (h *AdminHandler) RevokeNodeCredentials(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "admin")
+
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+
+	if err := h.nodeService.RevokeNodeCredentials(uint(id)); err != nil {
+		if errors.Is(err, services.ErrNodeNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"code": 404, "message": "节点不存在"})
+			return
+		}
+		logger.Error("RevokeNodeCredentials: failed to revoke credentials", err, "node_id", id, "request_id", requestID, "user_id", userID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "吊销失败"})
+		return
+	}
+
+	log.Info("RevokeNodeCredentials success", "node_id", id)
+
+	c.JSON(http.StatusOK, gin.H{"code": 0, "message": "吊销成功"})
+}
+
+// --- 节点注册令牌 ---
+
+// CreateNodeEnrollmentTokenRequest 签发节点注册令牌请求
+type CreateNodeEnrollmentTokenRequest struct {
+	Description string   `json:"description"`
+	MaxUses     int      `json:"max_uses"`   // 可注册次数，默认 1
+	ExpiresIn   int      `json:"expires_in"` // 有效期（秒），0 表示不过期
+	NodeGroupID uint     `json:"node_group_id"`
+	Region      string   `json:"region"`
+	Protocols   []string `json:"protocols"`
+}
+
+// GetNodeEnrollmentTokens 获取节点注册令牌列表
+func (h *AdminHandler) GetNodeEnrollmentTokens(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "admin")
+
+	tokens, err := h.nodeService.ListEnrollmentTokens()
+	if err != nil {
+		logger.Error("GetNodeEnrollmentTokens: failed to list tokens", err, "request_id", requestID, "user_id", userID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "获取失败"})
+		return
+	}
+
+	log.Info("GetNodeEnrollmentTokens success", "count", len(tokens))
+
+	c.JSON(http.StatusOK, gin.H{"code": 0, "data": tokens})
+}
+
+// CreateNodeEnrollmentToken 签发节点注册令牌，明文令牌只在响应中返回一次
+func (h *AdminHandler) CreateNodeEnrollmentToken(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "admin")
+
+	var req CreateNodeEnrollmentTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		logger.Warn("CreateNodeEnrollmentToken: invalid request", "error", err, "request_id", requestID, "user_id", userID)
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "参数错误"})
+		return
+	}
+	if req.MaxUses < 0 || req.MaxUses > services.MaxEnrollmentTokenUses {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": fmt.Sprintf("max_uses 范围为 1-%d", services.MaxEnrollmentTokenUses)})
+		return
+	}
+	if req.ExpiresIn < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "expires_in 不能为负数"})
+		return
+	}
+	for _, protocol := range req.Protocols {
+		if !services.IsSupportedNodeProtocol(protocol) {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "不支持的协议: " + protocol})
+			return
+		}
+	}
+
+	opts := services.EnrollmentTokenOptions{
+		Description: req.Description,
+		MaxUses:     req.MaxUses,
+		NodeGroupID: req.NodeGroupID,
+		Region:      req.Region,
+		Protocols:   req.Protocols,
+		CreatedBy:   userID,
+	}
+	if req.ExpiresIn > 0 {
+		expiresAt := time.Now().Add(time.Duration(req.ExpiresIn) * time.Second)
+		opts.ExpiresAt = &expiresAt
+	}
+
+	token, record, err := h.nodeService.CreateEnrollmentToken(opts)
+	if err != nil {
+		if errors.Is(err, services.ErrNodeGroupNotFound) {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+			return
+		}
+		logger.Error("CreateNodeEnrollmentToken: failed to create token", err, "request_id", requestID, "user_id", userID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "创建失败"})
+		return
+	}
+
+	log.Info("CreateNodeEnrollmentToken success", "token_id", record.ID, "max_uses", record.MaxUses)
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    0,
+		"message": "创建成功",
+		"data": gin.H{
+			"token":  token,
+			"record": record,
+		},
+	})
+}
+
+// RevokeNodeEnrollmentToken 吊销节点注册令牌
+func (h *AdminHandler) RevokeNodeEnrollmentToken(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "admin")
+
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+
+	if err := h.nodeService.RevokeEnrollmentToken(uint(id)); err != nil {
+		if errors.Is(err, services.ErrEnrollmentTokenNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"code": 404, "message": err.Error()})
+			return
+		}
+		logger.Error("RevokeNodeEnrollmentToken: failed to revoke token", err, "token_id", id, "request_id", requestID, "user_id", userID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "吊销失败"})
+		return
+	}
+
+	log.Info("RevokeNodeEnrollmentToken success", "token_id", id)
+
+	c.JSON(http.StatusOK, gin.H{"code": 0, "message": "吊销成功"})
+}
+
+// --- 节点组管理 ---
+
+// GetNodeGroups 获取节点组列表
+func (h *AdminHandler) GetNodeGroups(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "admin")
+
+	log.Debug("GetNodeGroups request")
+
+	groups, err := h.nodeGroupService.ListNodeGroups()
+	if err != nil {
+		logger.Error("GetNodeGroups: failed to list node groups", err, "request_id", requestID, "user_id", userID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "获取失败"})
+		return
+	}
+
+	log.Info("GetNodeGroups success", "group_count", len(groups))
+
+	c.JSON(http.StatusOK, gin.H{"code": 0, "data": groups})
+}
+
+// CreateNodeGroup 创建节点组
+func (h *AdminHandler) CreateNodeGroup(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "admin")
+
+	var req struct {
+		Name        string `json:"name" binding:"required"`
+		Type        string `json:"type" binding:"required"`
+		Description string `json:"description"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		logger.Warn("CreateNodeGroup: invalid request", "error", err, "request_id", requestID, "user_id", userID)
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "参数错误"})
+		return
+	}
+
+	log.Debug("CreateNodeGroup request", "name", req.Name, "type", req.Type)
+
+	group, err := h.nodeGroupService.CreateNodeGroup(req.Name, req.Type, req.Description)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidNodeGroupType) {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+			return
+		}
+		logger.Error("CreateNodeGroup: failed to create node group", err, "name", req.Name, "request_id", requestID, "user_id", userID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "创建失败"})
+		return
+	}
+
+	log.Info("CreateNodeGroup success", "group_id", group.ID, "name", req.Name)
+
+	c.JSON(http.StatusOK, gin.H{"code": 0, "message": "创建成功", "data": gin.H{"id": group.ID}})
+}
+
+// UpdateNodeGroup 更新节点组
+func (h *AdminHandler) UpdateNodeGroup(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "admin")
+
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+	var updates map[string]interface{}
+	if err := c.ShouldBindJSON(&updates); err != nil {
+		logger.Warn("UpdateNodeGroup: invalid request", "error", err, "group_id", id, "request_id", requestID, "user_id", userID)
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "参数错误"})
+		return
+	}
+
+	log.Debug("UpdateNodeGroup request", "group_id", id)
+
+	if err := h.nodeGroupService.UpdateNodeGroup(uint(id), updates); err != nil {
+		writeNodeGroupError(c, err, "更新失败", "UpdateNodeGroup", id, requestID, userID)
+		return
+	}
+
+	log.Info("UpdateNodeGroup success", "group_id", id)
+
+	c.JSON(http.StatusOK, gin.H{"code": 0, "message": "更新成功"})
+}
+
+// DeleteNodeGroup 删除节点组
+func (h *AdminHandler) DeleteNodeGroup(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "admin")
+
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+
+	log.Debug("DeleteNodeGroup request", "group_id", id)
+
+	if err := h.nodeGroupService.DeleteNodeGroup(uint(id)); err != nil {
+		writeNodeGroupError(c, err, "删除失败", "DeleteNodeGroup", id, requestID, userID)
+		return
+	}
+
+	log.Info("DeleteNodeGroup success", "group_id", id)
+
+	c.JSON(http.StatusOK, gin.H{"code": 0, "message": "删除成功"})
+}
+
+// GetNodeGroupMembers 获取节点组成员
+func (h *AdminHandler) GetNodeGroupMembers(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "admin")
+
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+
+	log.Debug("GetNodeGroupMembers request", "group_id", id)
+
+	if _, err := h.nodeGroupService.GetNodeGroupByID(uint(id)); err != nil {
+		writeNodeGroupError(c, err, "获取失败", "GetNodeGroupMembers", id, requestID, userID)
+		return
+	}
+	members, err := h.nodeGroupService.ListMembers(uint(id))
+	if err != nil {
+		logger.Error("GetNodeGroupMembers: failed to list members", err, "group_id", id, "request_id", requestID, "user_id", userID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "获取失败"})
+		return
+	}
+
+	log.Info("GetNodeGroupMembers success", "group_id", id, "member_count", len(members))
+
+	c.JSON(http.StatusOK, gin.H{"code": 0, "data": members})
+}
+
+// SetNodeGroupMembers 设置节点组成员
+func (h *AdminHandler) SetNodeGroupMembers(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "admin")
+
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+	var req struct {
+		NodeIDs []uint `json:"node_ids"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		logger.Warn("SetNodeGroupMembers: invalid request", "error", err, "group_id", id, "request_id", requestID, "user_id", userID)
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "参数错误"})
+		return
+	}
+
+	log.Debug("SetNodeGroupMembers request", "group_id", id, "node_count", len(req.NodeIDs))
+
+	if err := h.nodeGroupService.SetMembers(uint(id), req.NodeIDs); err != nil {
+		writeNodeGroupError(c, err, "更新失败", "SetNodeGroupMembers", id, requestID, userID)
+		return
+	}
+	h.rebalanceGroupRules("SetNodeGroupMembers", requestID, userID)
+
+	log.Info("SetNodeGroupMembers success", "group_id", id, "node_count", len(req.NodeIDs))
+
+	c.JSON(http.StatusOK, gin.H{"code": 0, "message": "更新成功"})
+}
+
+// RemoveNodeGroupMember 将节点移出节点组
+func (h *AdminHandler) RemoveNodeGroupMember(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "admin")
+
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+	nodeID, _ := strconv.ParseUint(c.Param("node_id"), 10, 32)
+
+	log.Debug("RemoveNodeGroupMember request", "group_id", id, "node_id", nodeID)
+
+	if err := h.nodeGroupService.RemoveMember(uint(id), uint(nodeID)); err != nil {
+		writeNodeGroupError(c, err, "移除失败", "RemoveNodeGroupMember", id, requestID, userID)
+		return
+	}
+	h.rebalanceGroupRules("RemoveNodeGroupMember", requestID, userID)
+
+	log.Info("RemoveNodeGroupMember success", "group_id", id, "node_id", nodeID)
+
+	c.JSON(http.StatusOK, gin.H{"code": 0, "message": "移除成功"})
+}
+
+// rebalanceGroupRules 节点组成员变化后立即为 healthiest 部署的规则重新选择节点，失败时由定时任务稍后重试
+func (h *AdminHandler) rebalanceGroupRules(action, requestID string, userID uint) {
+	if _, err := h.ruleService.RebalanceGroupRules(); err != nil {
+		logger.Warn(action+": rebalance group rules failed", "error", err, "request_id", requestID, "user_id", userID)
+	}
+}
+
+// writeNodeGroupError 将节点组服务错误映射为响应
+func writeNodeGroupError(c *gin.Context, err error, fallback, action string, groupID uint64, requestID string, userID uint) {
+	switch {
+	case errors.Is(err, services.ErrNodeGroupNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "message": err.Error()})
+	case errors.Is(err, services.ErrNodeNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "message": "节点不存在"})
+	case errors.Is(err, services.ErrNodeGroupInUse), errors.Is(err, services.ErrNodeGroupPortConflict):
+		c.JSON(http.StatusConflict, gin.H{"code": 409, "message": err.Error()})
+	case errors.Is(err, services.ErrInvalidNodeGroupType):
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+	default:
+		logger.Error(action+": node group operation failed", err, "group_id", groupID, "request_id", requestID, "user_id", userID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": fallback})
+	}
+}
+
 // --- 用户组管理 ---
 
 // GetUserGroups 获取用户组列表
@@ -312,6 +777,10 @@ func (h *AdminHandler) UpdateUserGroup(c *gin.Context) {
 	log.Debug("UpdateUserGroup request", "group_id", id)
 
 	if err := h.userGroupService.UpdateUserGroup(uint(id), updates); err != nil {
+		if errors.Is(err, services.ErrInvalidPortRanges) || errors.Is(err, services.ErrInvalidRuleQuota) {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+			return
+		}
 		logger.Error("UpdateUserGroup: failed to update user group", err, "group_id", id, "request_id", requestID, "user_id", userID)
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "更新失败"})
 		return
@@ -383,11 +852,18 @@ func (h *AdminHandler) UpdateUser(c *gin.Context) {
 
 	log.Debug("UpdateUser request", "target_user_id", id)
 
+	_, trafficChanged := updates["traffic_balance"]
 	if err := h.userService.UpdateUser(uint(id), updates); err != nil {
 		logger.Error("UpdateUser: failed to update user", err, "target_user_id", id, "request_id", requestID)
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "更新失败"})
 		return
 	}
+	// 管理员调整流量余额后同步规则启用状态
+	if trafficChanged && h.ruleService != nil {
+		if err := h.ruleService.SyncTrafficBalanceRules(uint(id)); err != nil {
+			logger.Warn("UpdateUser: sync rules with traffic balance failed", "error", err, "target_user_id", id, "request_id", requestID)
+		}
+	}
 
 	log.Info("UpdateUser success", "target_user_id", id)
 
@@ -803,6 +1279,11 @@ type CreatePackageRequest struct {
 	UserGroupID uint   `json:"user_group_id"`
 	Visible     bool   `json:"visible"`
 	Renewable   bool   `json:"renewable"`
+	// 设置任一限速项时，购买该套餐的用户按套餐而非用户组的限速设置创建规则，单位：kbps
+	DefaultSpeedLimitUp   int64 `json:"default_speed_limit_up" binding:"min=0"`
+	DefaultSpeedLimitDown int64 `json:"default_speed_limit_down" binding:"min=0"`
+	MaxSpeedLimitUp       int64 `json:"max_speed_limit_up" binding:"min=0"`
+	MaxSpeedLimitDown     int64 `json:"max_speed_limit_down" binding:"min=0"`
 }
 
 // CreatePackage 创建套餐
@@ -821,12 +1302,16 @@ func (h *AdminHandler) CreatePackage(c *gin.Context) {
 	log.Debug("CreatePackage request", "name", req.Name, "traffic", req.Traffic, "price", req.Price, "user_group_id", req.UserGroupID, "visible", req.Visible, "renewable", req.Renewable)
 
 	pkg := &models.Package{
-		Name:        req.Name,
-		Traffic:     req.Traffic,
-		Price:       req.Price,
-		UserGroupID: req.UserGroupID,
-		Visible:     req.Visible,
-		Renewable:   req.Renewable,
+		Name:                  req.Name,
+		Traffic:               req.Traffic,
+		Price:                 req.Price,
+		UserGroupID:           req.UserGroupID,
+		Visible:               req.Visible,
+		Renewable:             req.Renewable,
+		DefaultSpeedLimitUp:   req.DefaultSpeedLimitUp,
+		DefaultSpeedLimitDown: req.DefaultSpeedLimitDown,
+		MaxSpeedLimitUp:       req.MaxSpeedLimitUp,
+		MaxSpeedLimitDown:     req.MaxSpeedLimitDown,
 	}
 
 	if err := h.paymentService.CreatePackage(pkg); err != nil {
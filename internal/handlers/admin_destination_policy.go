@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"bakaray/internal/logger"
+	"bakaray/internal/middleware"
+	"bakaray/internal/models"
+	"bakaray/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- 目标地址策略 ---
+
+// UpdateDestinationPolicyRequest 更新目标地址策略请求，整体替换原策略
+type UpdateDestinationPolicyRequest struct {
+	BlockedCIDRs     []string `json:"blocked_cidrs"`
+	BlockedPorts     []string `json:"blocked_ports"`   // 单个端口或 a-b 范围
+	BlockedDomains   []string `json:"blocked_domains"` // 同时匹配子域名
+	ResolveHostnames bool     `json:"resolve_hostnames"`
+}
+
+// GetDestinationPolicy 获取目标地址策略
+func (h *AdminHandler) GetDestinationPolicy(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "admin")
+
+	policy, err := h.ruleService.GetDestinationPolicy()
+	if err != nil {
+		logger.Error("GetDestinationPolicy: failed to load policy", err, "request_id", requestID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "获取失败"})
+		return
+	}
+
+	log.Info("GetDestinationPolicy success")
+	c.JSON(http.StatusOK, gin.H{"code": 0, "data": policy})
+}
+
+// UpdateDestinationPolicy 更新目标地址策略，保存后由调度器在后台复查全部规则
+func (h *AdminHandler) UpdateDestinationPolicy(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "admin")
+
+	var req UpdateDestinationPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		logger.Warn("UpdateDestinationPolicy: invalid request", "error", err, "request_id", requestID, "user_id", userID)
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "参数错误"})
+		return
+	}
+
+	policy, err := h.ruleService.UpdateDestinationPolicy(models.DestinationPolicy{
+		BlockedCIDRs:     req.BlockedCIDRs,
+		BlockedPorts:     req.BlockedPorts,
+		BlockedDomains:   req.BlockedDomains,
+		ResolveHostnames: req.ResolveHostnames,
+	})
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidDestinationPolicy) {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+			return
+		}
+		logger.Error("UpdateDestinationPolicy: update failed", err, "request_id", requestID, "user_id", userID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "更新失败"})
+		return
+	}
+
+	log.Info("UpdateDestinationPolicy success", "recheck_revision", policy.RecheckRevision)
+	c.JSON(http.StatusOK, gin.H{
+		"code":    0,
+		"message": "更新成功，已有规则将在后台复查",
+		"data": gin.H{
+			"policy": policy,
+		},
+	})
+}
+
+// RecheckDestinations 请求按当前策略重新复查全部规则（例如域名解析结果变化后），由调度器在后台执行
+func (h *AdminHandler) RecheckDestinations(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "admin")
+
+	if err := h.ruleService.RequestDestinationRecheck(); err != nil {
+		logger.Error("RecheckDestinations: request recheck failed", err, "request_id", requestID, "user_id", userID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "复查失败"})
+		return
+	}
+
+	log.Info("RecheckDestinations success")
+	c.JSON(http.StatusOK, gin.H{"code": 0, "message": "已开始复查，结果见违规列表"})
+}
+
+// GetDestinationViolations 获取违反目标地址策略的规则目标
+func (h *AdminHandler) GetDestinationViolations(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "admin")
+
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+	log.Debug("GetDestinationViolations request", "page", page, "page_size", pageSize)
+
+	violations, total := h.ruleService.ListDestinationViolations(page, pageSize)
+
+	log.Info("GetDestinationViolations success", "count", len(violations), "total", total)
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 0,
+		"data": gin.H{
+			"list":  violations,
+			"total": total,
+			"page":  page,
+		},
+	})
+}
@@ -1,8 +1,13 @@
 package handlers
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
@@ -18,19 +23,21 @@ import (
 
 // NodeHandler 节点处理器
 type NodeHandler struct {
-	userService       *services.UserService
-	nodeService       *services.NodeService
-	ruleService       *services.RuleService
-	siteConfigService *services.SiteConfigService
+	userService         *services.UserService
+	nodeService         *services.NodeService
+	ruleService         *services.RuleService
+	siteConfigService   *services.SiteConfigService
+	probeHistoryService *services.ProbeHistoryService
 }
 
 // NewNodeHandler 创建节点处理器
-func NewNodeHandler(userService *services.UserService, nodeService *services.NodeService, ruleService *services.RuleService, siteConfigService *services.SiteConfigService) *NodeHandler {
+func NewNodeHandler(userService *services.UserService, nodeService *services.NodeService, ruleService *services.RuleService, siteConfigService *services.SiteConfigService, probeHistoryService *services.ProbeHistoryService) *NodeHandler {
 	return &NodeHandler{
-		userService:       userService,
-		nodeService:       nodeService,
-		ruleService:       ruleService,
-		siteConfigService: siteConfigService,
+		userService:         userService,
+		nodeService:         nodeService,
+		ruleService:         ruleService,
+		siteConfigService:   siteConfigService,
+		probeHistoryService: probeHistoryService,
 	}
 }
 
@@ -133,30 +140,136 @@ func (h *NodeHandler) GetNode(c *gin.Context) {
 	})
 }
 
+// defaultProbeHistoryRange 探针历史默认查询最近 1 小时
+const defaultProbeHistoryRange = time.Hour
+
+// GetNodeProbeHistory 获取节点探针历史。
+// from/to 为 Unix 秒，默认最近 1 小时；step 为秒数或时长（如 5m），省略时按范围自动选择。
+func (h *NodeHandler) GetNodeProbeHistory(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.Log.With("request_id", requestID, "component", "node")
+
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+	log.Debug("GetNodeProbeHistory request", "node_id", id)
+
+	node, err := h.nodeService.GetNodeByID(uint(id))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "message": "节点不存在"})
+		return
+	}
+
+	// 管理员可查看全部节点，普通用户仅限所在用户组可用的节点
+	if middleware.GetUserRole(c) != "admin" {
+		allowed, err := h.userCanAccessNode(userID, node.ID)
+		if err != nil {
+			logger.Error("GetNodeProbeHistory: failed to check node access", err, "node_id", id, "request_id", requestID)
+			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "读取节点授权失败"})
+			return
+		}
+		if !allowed {
+			c.JSON(http.StatusNotFound, gin.H{"code": 404, "message": "节点不存在"})
+			return
+		}
+	}
+
+	from, to, step, err := parseProbeHistoryQuery(c, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+		return
+	}
+
+	history, err := h.probeHistoryService.History(node.ID, from, to, step)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidProbeRange) || errors.Is(err, services.ErrProbeHistoryTooLarge) {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+			return
+		}
+		logger.Error("GetNodeProbeHistory: query failed", err, "node_id", id, "request_id", requestID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "获取探针历史失败"})
+		return
+	}
+
+	log.Info("GetNodeProbeHistory success", "node_id", id, "points", len(history.Points), "resolution", history.Resolution)
+
+	c.JSON(http.StatusOK, gin.H{"code": 0, "data": history})
+}
+
+// userCanAccessNode 判断用户所在用户组是否可使用节点
+func (h *NodeHandler) userCanAccessNode(userID, nodeID uint) (bool, error) {
+	user, err := h.userService.GetUserByID(userID)
+	if err != nil {
+		return false, nil
+	}
+	allowedGroups, err := h.nodeService.GetAllowedGroups(nodeID)
+	if err != nil {
+		return false, err
+	}
+	for _, groupID := range allowedGroups {
+		if groupID == user.UserGroupID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// parseProbeHistoryQuery 解析探针历史查询参数
+func parseProbeHistoryQuery(c *gin.Context, now time.Time) (time.Time, time.Time, time.Duration, error) {
+	to := now
+	if raw := c.Query("to"); raw != "" {
+		sec, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return time.Time{}, time.Time{}, 0, errors.New("to 必须为 Unix 时间戳（秒）")
+		}
+		to = time.Unix(sec, 0)
+	}
+	from := to.Add(-defaultProbeHistoryRange)
+	if raw := c.Query("from"); raw != "" {
+		sec, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return time.Time{}, time.Time{}, 0, errors.New("from 必须为 Unix 时间戳（秒）")
+		}
+		from = time.Unix(sec, 0)
+	}
+
+	var step time.Duration
+	if raw := c.Query("step"); raw != "" {
+		if sec, err := strconv.ParseInt(raw, 10, 64); err == nil {
+			step = time.Duration(sec) * time.Second
+		} else if d, err := time.ParseDuration(raw); err == nil {
+			step = d
+		} else {
+			return time.Time{}, time.Time{}, 0, errors.New("step 必须为秒数或时长（如 5m）")
+		}
+		if step <= 0 {
+			return time.Time{}, time.Time{}, 0, errors.New("step 必须大于 0")
+		}
+	}
+	return from, to, step, nil
+}
+
 // NodeHeartbeatRequest 节点心跳请求
 type NodeHeartbeatRequest struct {
-	NodeID       uint                    `json:"node_id" binding:"required"`
-	Secret       string                  `json:"secret" binding:"required"`
-	Probe        *models.ProbeData       `json:"probe"`
-	TrafficStats map[string]int64        `json:"traffic_stats"`
-	Diagnostics  []models.NodeDiagnostic `json:"diagnostics"`
+	NodeID       uint                          `json:"node_id"`
+	Secret       string                        `json:"secret"` // 仅旧版密钥认证模式使用
+	Probe        *models.ProbeData             `json:"probe"`
+	TrafficStats map[string]int64              `json:"traffic_stats"`
+	Diagnostics  []models.NodeDiagnostic       `json:"diagnostics"`
+	TargetHealth []services.TargetHealthReport `json:"target_health"` // 按规则健康检查设置得出的目标状态
+	Addresses    []string                      `json:"addresses"`     // 本机可绑定地址，未上报时保持原值
 }
 
+// NodeRegisterRequest 节点注册请求
 type NodeRegisterRequest struct {
-	Name   string `json:"name"`
-	Secret string `json:"secret" binding:"required"`
+	Name  string `json:"name"`
+	Token string `json:"token" binding:"required"` // 管理员签发的注册令牌
 }
 
-// NodeRegister 节点自动注册
+// NodeRegister 节点凭注册令牌注册，返回节点 ID 和节点独立密钥（仅返回一次）
 func (h *NodeHandler) NodeRegister(c *gin.Context) {
 	requestID := c.GetString("request_id")
 	log := logger.Log.With("request_id", requestID, "component", "node")
 
-	if h.siteConfigService == nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "站点配置服务未初始化"})
-		return
-	}
-
 	var req NodeRegisterRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		logger.Warn("NodeRegister: invalid request", "error", err, "request_id", requestID)
@@ -164,18 +277,6 @@ func (h *NodeHandler) NodeRegister(c *gin.Context) {
 		return
 	}
 
-	site, err := h.siteConfigService.GetOrCreate()
-	if err != nil {
-		logger.Error("NodeRegister: failed to load site config", err, "request_id", requestID)
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "读取站点配置失败"})
-		return
-	}
-	if req.Secret != site.NodeSecret {
-		logger.Warn("NodeRegister: invalid node secret", "request_id", requestID)
-		c.JSON(http.StatusUnauthorized, gin.H{"code": 401, "message": "无效的节点密钥"})
-		return
-	}
-
 	name := strings.TrimSpace(req.Name)
 	if name == "" {
 		replacer := strings.NewReplacer(".", "-", ":", "-")
@@ -187,10 +288,21 @@ func (h *NodeHandler) NodeRegister(c *gin.Context) {
 		host = "127.0.0.1"
 	}
 
-	node, err := h.nodeService.RegisterNode(name, host, 0, req.Secret)
+	node, err := h.nodeService.EnrollNode(req.Token, name, host, 0)
 	if err != nil {
-		logger.Error("NodeRegister: failed to register node", err, "name", name, "request_id", requestID)
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "注册节点失败"})
+		switch {
+		case errors.Is(err, services.ErrEnrollmentTokenInvalid),
+			errors.Is(err, services.ErrEnrollmentTokenExpired),
+			errors.Is(err, services.ErrEnrollmentTokenUsedUp),
+			errors.Is(err, services.ErrEnrollmentTokenRevoked):
+			logger.Warn("NodeRegister: enrollment token rejected", "error", err, "name", name, "request_id", requestID)
+			c.JSON(http.StatusUnauthorized, gin.H{"code": 401, "message": err.Error()})
+		case errors.Is(err, services.ErrNodeNameTaken):
+			c.JSON(http.StatusConflict, gin.H{"code": 409, "message": err.Error()})
+		default:
+			logger.Error("NodeRegister: failed to register node", err, "name", name, "request_id", requestID)
+			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "注册节点失败"})
+		}
 		return
 	}
 
@@ -203,6 +315,7 @@ func (h *NodeHandler) NodeRegister(c *gin.Context) {
 			"node_id": node.ID,
 			"name":    node.Name,
 			"host":    node.Host,
+			"secret":  node.Secret,
 		},
 	})
 }
@@ -219,16 +332,16 @@ func (h *NodeHandler) NodeHeartbeat(c *gin.Context) {
 		return
 	}
 
-	log.Debug("NodeHeartbeat request", "node_id", req.NodeID)
-
-	node, err := h.nodeService.GetNodeByID(req.NodeID)
-	if err != nil || node.Secret != req.Secret {
-		logger.Warn("NodeHeartbeat: invalid node secret", "node_id", req.NodeID, "request_id", requestID)
-		c.JSON(http.StatusUnauthorized, gin.H{"code": 401, "message": "无效的节点密钥"})
+	node, ok := authenticatedNode(c, req.NodeID)
+	if !ok {
+		logger.Warn("NodeHeartbeat: node id mismatch", "node_id", req.NodeID, "request_id", requestID)
 		return
 	}
+	req.NodeID = node.ID
+
+	log.Debug("NodeHeartbeat request", "node_id", req.NodeID)
 
-	h.nodeService.UpdateNodeStatus(req.NodeID, "online")
+	h.nodeService.UpdateNodeStatus(req.NodeID, services.NodeStatusOnline)
 
 	if req.Probe != nil {
 		h.nodeService.SaveProbeData(req.NodeID, req.Probe)
@@ -237,34 +350,34 @@ func (h *NodeHandler) NodeHeartbeat(c *gin.Context) {
 		h.nodeService.SaveDiagnostics(req.NodeID, req.Diagnostics)
 	}
 
+	if len(req.TargetHealth) > 0 {
+		if _, err := h.ruleService.RecordTargetHealth(node, req.TargetHealth, time.Now()); err != nil {
+			logger.Warn("NodeHeartbeat: failed to record target health", "error", err, "node_id", req.NodeID, "request_id", requestID)
+		}
+	}
+
+	if req.Addresses != nil {
+		if _, err := h.nodeService.UpdateListenAddresses(node, req.Addresses); err != nil {
+			logger.Warn("NodeHeartbeat: failed to save listen addresses", "error", err, "node_id", req.NodeID, "request_id", requestID)
+		}
+	}
+
 	if len(req.TrafficStats) > 0 {
 		deltas, err := h.nodeService.ComputeTrafficDeltas(req.NodeID, req.TrafficStats)
 		if err == nil {
-			now := time.Now()
-			disabledCount := 0
-			for ruleID, d := range deltas {
-				total := d.BytesIn + d.BytesOut
-				if total <= 0 {
-					continue
-				}
-				disabled, err := h.ruleService.UpdateTrafficUsedWithDisable(ruleID, total)
-				if err != nil {
-					logger.Warn("NodeHeartbeat: failed to update traffic", "rule_id", ruleID, "error", err, "request_id", requestID)
-					continue
-				}
-				if disabled {
-					disabledCount++
+			result, err := h.ruleService.RecordNodeTraffic(node, deltas, time.Now())
+			if err != nil {
+				logger.Warn("NodeHeartbeat: failed to record traffic", "error", err, "node_id", req.NodeID, "request_id", requestID)
+			}
+			if result != nil {
+				for _, ruleID := range result.LimitDisabled {
 					logger.Warn("NodeHeartbeat: rule disabled due to traffic limit", "rule_id", ruleID, "node_id", req.NodeID, "request_id", requestID)
 				}
-				_ = h.ruleService.CreateTrafficLog(&models.TrafficLog{
-					RuleID:    ruleID,
-					NodeID:    req.NodeID,
-					BytesIn:   d.BytesIn,
-					BytesOut:  d.BytesOut,
-					Timestamp: now,
-				})
+				for _, userID := range result.ExhaustedUsers {
+					logger.Warn("NodeHeartbeat: rules disabled due to exhausted traffic balance", "user_id", userID, "node_id", req.NodeID, "request_id", requestID)
+				}
+				logger.Debug("NodeHeartbeat: traffic updated", "node_id", req.NodeID, "rules_count", result.Rules, "billed", result.Billed, "disabled_count", len(result.LimitDisabled), "request_id", requestID)
 			}
-			logger.Debug("NodeHeartbeat: traffic updated", "node_id", req.NodeID, "rules_count", len(deltas), "disabled_count", disabledCount, "request_id", requestID)
 		} else {
 			logger.Warn("NodeHeartbeat: compute traffic deltas failed", "error", err, "node_id", req.NodeID, "request_id", requestID)
 		}
@@ -278,60 +391,191 @@ func (h *NodeHandler) NodeHeartbeat(c *gin.Context) {
 	})
 }
 
+// NodeTarget 下发给节点的转发目标
+type NodeTarget struct {
+	ID       uint   `json:"id"` // 上报健康状态时使用
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Weight   int    `json:"weight"`
+	Priority int    `json:"priority"` // failover 模式下数值越小越优先，其他模式忽略
+	Enabled  bool   `json:"enabled"`
+}
+
+// NodeRuleLimits 下发给节点、由节点在规则入口执行的限制，0 表示不限制
+type NodeRuleLimits struct {
+	SpeedLimitUp   int64 `json:"speed_limit_up"`   // 上行（客户端到目标）限速，单位：kbps
+	SpeedLimitDown int64 `json:"speed_limit_down"` // 下行（目标到客户端）限速，单位：kbps
+	MaxConnections int64 `json:"max_connections"`  // 最大并发连接数，超出时拒绝新连接
+	ConnRate       int64 `json:"conn_rate"`        // 每秒新建连接数
+}
+
+// NodeRuleACL 下发给节点的来源地址访问控制，在规则入口按来源 IP 匹配
+type NodeRuleACL struct {
+	Mode  string   `json:"mode"`  // allow：仅允许列表内地址；deny：拒绝列表内地址
+	CIDRs []string `json:"cidrs"` // 规范化后的 CIDR，单个地址为 /32 或 /128
+}
+
+// NodeProxyProtocol 下发给节点的 PROXY protocol 设置。
+// 隧道规则由出口节点连接目标：入口节点向出口发送 v2 头传递客户端地址，出口节点接收后按规则设置的版本发给目标。
+type NodeProxyProtocol struct {
+	Accept bool `json:"accept"` // 解析入站连接的 PROXY 头，以其中的地址作为客户端地址
+	Send   int  `json:"send"`   // 向下一跳发送的 PROXY 头版本，0 表示不发送
+}
+
+// NodeHealthCheck 下发给节点的目标健康检查设置。
+// 节点按 interval 对每个启用目标探测，连续 rise 次成功判定健康、连续 fall 次失败判定不健康，
+// 结果随心跳上报；auto_remove 为 true 时节点不再向不健康目标转发，恢复健康后自动加回，
+// 所有目标都不健康时仍按原目标转发。
+type NodeHealthCheck struct {
+	Type       string `json:"type"`     // tcp：建立连接；udp：发送探测包并等待响应
+	Interval   int    `json:"interval"` // 秒
+	Timeout    int    `json:"timeout"`  // 秒
+	Rise       int    `json:"rise"`
+	Fall       int    `json:"fall"`
+	AutoRemove bool   `json:"auto_remove"`
+}
+
+// tunnelProxyProtocolVersion 隧道入口向出口节点传递客户端地址使用的 PROXY protocol 版本
+const tunnelProxyProtocolVersion = 2
+
+// NodeRule 下发给节点的转发规则
+type NodeRule struct {
+	ID             uint              `json:"id"`
+	Name           string            `json:"name"`
+	Protocol       string            `json:"protocol"`
+	ListenPort     int               `json:"listen_port"`
+	Mode           string            `json:"mode"` // 目标选择策略：direct, rr, lb, least_conn, source_hash, failover，语义见 services.RuleModeDirect 等常量
+	Targets        []NodeTarget      `json:"targets"`
+	SpeedLimit     int64             `json:"speed_limit"` // 兼容旧版节点：上下行限速相同时为该值，否则为 0
+	Limits         NodeRuleLimits    `json:"limits"`
+	ACL            *NodeRuleACL      `json:"acl,omitempty"` // 未设置访问控制时省略
+	ProxyProtocol  NodeProxyProtocol `json:"proxy_protocol"`
+	HealthCheck    *NodeHealthCheck  `json:"health_check,omitempty"` // 未开启健康检查时省略
+	Enabled        bool              `json:"enabled"`
+	TunnelRole     string            `json:"tunnel_role,omitempty"`
+	TunnelProtocol string            `json:"tunnel_protocol,omitempty"`
+	TunnelRemote   string            `json:"tunnel_remote,omitempty"`
+	ReportTraffic  bool              `json:"report_traffic"`
+
+	// ListenPortEnd 端口范围规则的结束端口，listen_port+i 转发到各目标端口+i，流量按规则汇总上报；单端口规则省略
+	ListenPortEnd int `json:"listen_port_end,omitempty"`
+	// ListenIP 监听地址，省略时监听全部地址
+	ListenIP string `json:"listen_ip,omitempty"`
+}
+
 // NodeConfigRequest 获取配置请求
 type NodeConfigRequest struct {
-	NodeID uint   `json:"node_id" binding:"required"`
-	Secret string `json:"secret" binding:"required"`
+	NodeID uint   `json:"node_id"`
+	Secret string `json:"secret"` // 仅旧版密钥认证模式使用
+	Wait   int    `json:"wait"`   // 长轮询等待秒数，需配合 If-None-Match 使用
+}
+
+// nodeConfigSnapshot 某一版本的节点配置
+type nodeConfigSnapshot struct {
+	Rules          string
+	RulesCount     int
+	ReportInterval int
+	Revision       int64
+	ETag           string
+	SecretRotation *services.SecretRotation
 }
 
-// NodeConfig 获取节点配置
+// NodeConfig 获取节点配置。
+// 请求携带 If-None-Match 且与当前 ETag 一致时返回 304；同时指定 wait（秒）时进入长轮询，
+// 直到节点配置版本变化或等待超时。
 func (h *NodeHandler) NodeConfig(c *gin.Context) {
 	requestID := c.GetString("request_id")
 	log := logger.Log.With("request_id", requestID, "component", "node")
 
+	// 签名模式下 GET 请求可以不带请求体
 	var req NodeConfigRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
 		logger.Warn("NodeConfig: invalid request", "error", err, "request_id", requestID)
 		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "参数错误"})
 		return
 	}
 
-	log.Debug("NodeConfig request", "node_id", req.NodeID)
-
-	node, err := h.nodeService.GetNodeByID(req.NodeID)
-	if err != nil || node.Secret != req.Secret {
-		logger.Warn("NodeConfig: invalid node secret", "node_id", req.NodeID, "request_id", requestID)
-		c.JSON(http.StatusUnauthorized, gin.H{"code": 401, "message": "无效的节点密钥"})
+	node, ok := authenticatedNode(c, req.NodeID)
+	if !ok {
+		logger.Warn("NodeConfig: node id mismatch", "node_id", req.NodeID, "request_id", requestID)
 		return
 	}
+	req.NodeID = node.ID
 
-	rules, _ := h.nodeService.ListRulesByNode(req.NodeID, true)
-	site, err := h.siteConfigService.GetOrCreate()
+	log.Debug("NodeConfig request", "node_id", req.NodeID)
+
+	snapshot, err := h.buildNodeConfig(node)
 	if err != nil {
-		logger.Error("NodeConfig: load site config failed", err, "node_id", req.NodeID, "request_id", requestID)
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "读取站点配置失败"})
+		logger.Error("NodeConfig: build config failed", err, "node_id", req.NodeID, "request_id", requestID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "生成配置失败"})
 		return
 	}
 
-	type NodeTarget struct {
-		Host    string `json:"host"`
-		Port    int    `json:"port"`
-		Weight  int    `json:"weight"`
-		Enabled bool   `json:"enabled"`
+	ifNoneMatch := c.GetHeader("If-None-Match")
+	if etagMatches(ifNoneMatch, snapshot.ETag) {
+		wait := nodeConfigWait(c, req.Wait)
+		if wait <= 0 {
+			c.Header("ETag", snapshot.ETag)
+			c.Status(http.StatusNotModified)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), wait)
+		defer cancel()
+
+		for etagMatches(ifNoneMatch, snapshot.ETag) {
+			if _, err := h.nodeService.WaitForConfigRevision(ctx, node.ID, snapshot.Revision); err != nil {
+				if ctx.Err() != nil {
+					c.Header("ETag", snapshot.ETag)
+					c.Status(http.StatusNotModified)
+					return
+				}
+				logger.Error("NodeConfig: wait for revision failed", err, "node_id", req.NodeID, "request_id", requestID)
+				c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "读取配置版本失败"})
+				return
+			}
+
+			node, err = h.nodeService.GetNodeByID(req.NodeID)
+			if err != nil || node.SecretRevokedAt != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"code": 401, "message": "无效的节点密钥"})
+				return
+			}
+			snapshot, err = h.buildNodeConfig(node)
+			if err != nil {
+				logger.Error("NodeConfig: build config failed", err, "node_id", req.NodeID, "request_id", requestID)
+				c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "生成配置失败"})
+				return
+			}
+		}
 	}
-	type NodeRule struct {
-		ID             uint         `json:"id"`
-		Name           string       `json:"name"`
-		Protocol       string       `json:"protocol"`
-		ListenPort     int          `json:"listen_port"`
-		Mode           string       `json:"mode"`
-		Targets        []NodeTarget `json:"targets"`
-		SpeedLimit     int64        `json:"speed_limit"`
-		Enabled        bool         `json:"enabled"`
-		TunnelRole     string       `json:"tunnel_role,omitempty"`
-		TunnelProtocol string       `json:"tunnel_protocol,omitempty"`
-		TunnelRemote   string       `json:"tunnel_remote,omitempty"`
-		ReportTraffic  bool         `json:"report_traffic"`
+
+	log.Info("NodeConfig success", "node_id", req.NodeID, "rules_count", snapshot.RulesCount, "version", snapshot.Revision)
+
+	c.Header("ETag", snapshot.ETag)
+	c.JSON(http.StatusOK, gin.H{
+		"code": 0,
+		"data": gin.H{
+			"rules":           snapshot.Rules,
+			"report_interval": snapshot.ReportInterval,
+			"version":         snapshot.Revision,
+			"etag":            snapshot.ETag,
+			"secret_rotation": snapshot.SecretRotation,
+		},
+	})
+}
+
+// buildNodeConfig 生成节点当前配置。版本号在生成规则前读取，
+// 生成期间发生的变更会使下一次长轮询立即返回。
+func (h *NodeHandler) buildNodeConfig(node *models.Node) (*nodeConfigSnapshot, error) {
+	revision := node.ConfigRevision
+
+	rules, err := h.nodeService.ListRulesByNode(node.ID, true)
+	if err != nil {
+		return nil, err
+	}
+	site, err := h.siteConfigService.GetOrCreate()
+	if err != nil {
+		return nil, err
 	}
 
 	nodeRules := make([]NodeRule, 0, len(rules))
@@ -344,24 +588,51 @@ func (h *NodeHandler) NodeConfig(c *gin.Context) {
 		nodeTargets := make([]NodeTarget, 0, len(targets))
 		for _, t := range targets {
 			nodeTargets = append(nodeTargets, NodeTarget{
-				Host:    t.Host,
-				Port:    t.Port,
-				Weight:  t.Weight,
-				Enabled: t.Enabled,
+				ID:       t.ID,
+				Host:     t.Host,
+				Port:     t.Port,
+				Weight:   t.Weight,
+				Priority: t.Priority,
+				Enabled:  t.Enabled,
 			})
 		}
 
+		speedUp, speedDown := services.RuleSpeedLimits(&r)
 		nr := NodeRule{
-			ID:            r.ID,
-			Name:          r.Name,
-			Protocol:      ruleProtocol,
-			ListenPort:    r.ListenPort,
-			Mode:          r.Mode,
-			Targets:       nodeTargets,
-			SpeedLimit:    r.SpeedLimit,
+			ID:         r.ID,
+			Name:       r.Name,
+			Protocol:   ruleProtocol,
+			ListenPort: r.ListenPort,
+			Mode:       r.Mode,
+			Targets:    nodeTargets,
+			Limits: NodeRuleLimits{
+				SpeedLimitUp:   speedUp,
+				SpeedLimitDown: speedDown,
+				MaxConnections: r.MaxConnections,
+				ConnRate:       r.ConnRateLimit,
+			},
 			Enabled:       r.Enabled,
 			ReportTraffic: true,
 		}
+		if speedUp == speedDown {
+			nr.SpeedLimit = speedUp
+		}
+		nr.ListenPortEnd = r.ListenPortEnd
+		nr.ListenIP = r.ListenIP
+		if r.ACLMode != "" {
+			nr.ACL = &NodeRuleACL{Mode: r.ACLMode, CIDRs: []string(r.ACLEntries)}
+		}
+		nr.ProxyProtocol = NodeProxyProtocol{Accept: r.AcceptProxy, Send: r.ProxyProtocol}
+		if hc := r.HealthCheck; hc.Type != "" {
+			nr.HealthCheck = &NodeHealthCheck{
+				Type:       hc.Type,
+				Interval:   hc.Interval,
+				Timeout:    hc.Timeout,
+				Rise:       hc.Rise,
+				Fall:       hc.Fall,
+				AutoRemove: hc.AutoRemove,
+			}
+		}
 		if r.TunnelEnabled {
 			tunnelProtocol := services.NormalizeProtocol(r.TunnelProtocol)
 			if !services.NodeSupportsTunnelProtocol([]string(node.Protocols), tunnelProtocol) {
@@ -377,15 +648,16 @@ func (h *NodeHandler) NodeConfig(c *gin.Context) {
 			nr.TunnelRole = "entry"
 			nr.TunnelProtocol = tunnelProtocol
 			nr.TunnelRemote = fmt.Sprintf("%s:%d", exitNode.Host, r.TunnelPort)
+			if r.ProxyProtocol > 0 {
+				nr.ProxyProtocol.Send = tunnelProxyProtocolVersion
+			}
 		}
 		nodeRules = append(nodeRules, nr)
 	}
 
-	exitRules, err := h.ruleService.ListRulesByExitNode(req.NodeID, true)
+	exitRules, err := h.ruleService.ListRulesByExitNode(node.ID, true)
 	if err != nil {
-		logger.Error("NodeConfig: load exit rules failed", err, "node_id", req.NodeID, "request_id", requestID)
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "读取隧道规则失败"})
-		return
+		return nil, err
 	}
 	for _, r := range exitRules {
 		tunnelProtocol := services.NormalizeProtocol(r.TunnelProtocol)
@@ -404,33 +676,80 @@ func (h *NodeHandler) NodeConfig(c *gin.Context) {
 			Enabled:        r.Enabled,
 			TunnelRole:     "exit",
 			TunnelProtocol: tunnelProtocol,
+			ProxyProtocol:  NodeProxyProtocol{Accept: r.ProxyProtocol > 0, Send: r.ProxyProtocol},
 			ReportTraffic:  false,
 		})
 	}
 
 	rulesJSON, err := json.Marshal(nodeRules)
 	if err != nil {
-		logger.Error("NodeConfig: marshal rules failed", err, "node_id", req.NodeID, "request_id", requestID)
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "生成配置失败"})
-		return
+		return nil, err
 	}
 
-	log.Info("NodeConfig success", "node_id", req.NodeID, "rules_count", len(nodeRules))
+	// 待生效的密钥轮换也计入 ETag，保证节点能及时取到新密钥
+	rotation := services.PendingSecretRotation(node)
+	rotationKey := ""
+	if rotation != nil {
+		rotationKey = fmt.Sprintf("%s@%d", rotation.Secret, rotation.ExpiresAt.Unix())
+	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"code": 0,
-		"data": gin.H{
-			"rules":           string(rulesJSON),
-			"report_interval": site.NodeReportInterval,
-			"version":         1,
-		},
-	})
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%s", rulesJSON, site.NodeReportInterval, rotationKey)))
+	return &nodeConfigSnapshot{
+		Rules:          string(rulesJSON),
+		RulesCount:     len(nodeRules),
+		ReportInterval: site.NodeReportInterval,
+		Revision:       revision,
+		ETag:           `"` + hex.EncodeToString(sum[:12]) + `"`,
+		SecretRotation: rotation,
+	}, nil
+}
+
+// nodeConfigWait 解析长轮询等待时间，优先使用查询参数 wait
+func nodeConfigWait(c *gin.Context, bodyWait int) time.Duration {
+	seconds := bodyWait
+	if raw := c.Query("wait"); raw != "" {
+		if v, err := strconv.Atoi(raw); err == nil {
+			seconds = v
+		}
+	}
+	if seconds <= 0 {
+		return 0
+	}
+	wait := time.Duration(seconds) * time.Second
+	if wait > services.MaxConfigLongPollWait {
+		wait = services.MaxConfigLongPollWait
+	}
+	return wait
+}
+
+// etagMatches 判断 If-None-Match 是否命中当前 ETag
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticatedNode 获取节点认证中间件写入的节点，并校验请求体中的 node_id（如有）与之一致
+func authenticatedNode(c *gin.Context, bodyNodeID uint) (*models.Node, bool) {
+	node := middleware.GetNode(c)
+	if node == nil || (bodyNodeID != 0 && bodyNodeID != node.ID) {
+		c.JSON(http.StatusUnauthorized, gin.H{"code": 401, "message": "无效的节点密钥"})
+		return nil, false
+	}
+	return node, true
 }
 
 // NodeReportRequest 节点上报请求
 type NodeReportRequest struct {
-	NodeID uint              `json:"node_id" binding:"required"`
-	Secret string            `json:"secret" binding:"required"`
+	NodeID uint              `json:"node_id"`
+	Secret string            `json:"secret"` // 仅旧版密钥认证模式使用
 	Report *models.ProbeData `json:"report"`
 }
 
@@ -446,14 +765,14 @@ func (h *NodeHandler) NodeReport(c *gin.Context) {
 		return
 	}
 
-	log.Debug("NodeReport request", "node_id", req.NodeID)
-
-	node, err := h.nodeService.GetNodeByID(req.NodeID)
-	if err != nil || node.Secret != req.Secret {
-		logger.Warn("NodeReport: invalid node secret", "node_id", req.NodeID, "request_id", requestID)
-		c.JSON(http.StatusUnauthorized, gin.H{"code": 401, "message": "无效的节点密钥"})
+	node, ok := authenticatedNode(c, req.NodeID)
+	if !ok {
+		logger.Warn("NodeReport: node id mismatch", "node_id", req.NodeID, "request_id", requestID)
 		return
 	}
+	req.NodeID = node.ID
+
+	log.Debug("NodeReport request", "node_id", req.NodeID)
 
 	if req.Report != nil {
 		h.nodeService.SaveProbeData(req.NodeID, req.Report)
@@ -0,0 +1,316 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"bakaray/internal/middleware"
+	"bakaray/internal/models"
+	"bakaray/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func createNodeHandlerForTest(t *testing.T) (*NodeHandler, *gorm.DB) {
+	t.Helper()
+
+	dsn := fmt.Sprintf("file:%s-%d?mode=memory&cache=shared", strings.ReplaceAll(t.Name(), "/", "_"), time.Now().UnixNano())
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(
+		&models.User{},
+		&models.UserGroup{},
+		&models.Node{},
+		&models.NodeAllowedGroup{},
+		&models.NodeStatusEvent{},
+		&models.ForwardingRule{},
+		&models.Target{},
+		&models.TargetHealth{},
+		&models.DestinationPolicy{},
+		&models.DestinationViolation{},
+		&models.ListenPortReservation{},
+		&models.SiteConfig{},
+		&models.TrafficLog{},
+		&models.NodeProbeSample{},
+	))
+	require.NoError(t, db.Create(&models.SiteConfig{SiteName: "test", NodeSecret: "site-secret", NodeReportInterval: 10}).Error)
+
+	handler := NewNodeHandler(
+		services.NewUserService(db, nil),
+		services.NewNodeService(db, nil),
+		services.NewRuleService(db, nil),
+		services.NewSiteConfigService(db),
+		services.NewProbeHistoryService(db, services.DefaultProbeRetention),
+	)
+	return handler, db
+}
+
+func createConfigTestNode(t *testing.T, db *gorm.DB) *models.Node {
+	t.Helper()
+	node := &models.Node{
+		Name:      "config-node",
+		Host:      "10.0.0.1",
+		Secret:    "node-secret",
+		Status:    "online",
+		Protocols: services.NormalizeNodeProtocols(nil),
+	}
+	require.NoError(t, db.Create(node).Error)
+	return node
+}
+
+func nodeConfigRouter(handler *NodeHandler, db *gorm.DB) *gin.Engine {
+	nodeAuth := middleware.NewNodeAuthMiddleware(services.NewNodeService(db, nil), services.NewSiteConfigService(db))
+	router := gin.New()
+	router.POST("/config", nodeAuth.Authenticate(), handler.NodeConfig)
+	return router
+}
+
+func doNodeConfigRequest(router *gin.Engine, nodeID uint, secret, ifNoneMatch, query string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(gin.H{"node_id": nodeID, "secret": secret})
+	req := httptest.NewRequest(http.MethodPost, "/config"+query, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestNodeConfig_ETag(t *testing.T) {
+	handler, db := createNodeHandlerForTest(t)
+	node := createConfigTestNode(t, db)
+
+	router := nodeConfigRouter(handler, db)
+
+	first := doNodeConfigRequest(router, node.ID, "node-secret", "", "")
+	require.Equal(t, http.StatusOK, first.Code)
+	etag := first.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+
+	t.Run("ETag 未变化返回 304", func(t *testing.T) {
+		w := doNodeConfigRequest(router, node.ID, "node-secret", etag, "")
+		require.Equal(t, http.StatusNotModified, w.Code)
+		require.Equal(t, etag, w.Header().Get("ETag"))
+	})
+
+	t.Run("规则变化后返回新配置", func(t *testing.T) {
+		rule := &models.ForwardingRule{NodeID: node.ID, UserID: 1, Name: "r1", Protocol: "tcp", Enabled: true, Mode: "direct", ListenPort: 10080, SpeedLimitUp: 1024, SpeedLimitDown: 2048, MaxConnections: 64, ConnRateLimit: 10}
+		require.NoError(t, services.NewRuleService(db, nil).CreateRuleWithTargets(rule, []models.Target{{Host: "1.1.1.1", Port: 80, Weight: 1, Enabled: true}}))
+
+		w := doNodeConfigRequest(router, node.ID, "node-secret", etag, "")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NotEqual(t, etag, w.Header().Get("ETag"))
+
+		var resp struct {
+			Data struct {
+				Rules   string `json:"rules"`
+				Version int64  `json:"version"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Equal(t, int64(1), resp.Data.Version)
+
+		var rules []NodeRule
+		require.NoError(t, json.Unmarshal([]byte(resp.Data.Rules), &rules))
+		require.Len(t, rules, 1)
+		require.Equal(t, 10080, rules[0].ListenPort)
+		require.Equal(t, NodeRuleLimits{SpeedLimitUp: 1024, SpeedLimitDown: 2048, MaxConnections: 64, ConnRate: 10}, rules[0].Limits)
+		require.Zero(t, rules[0].SpeedLimit)
+	})
+
+	t.Run("错误密钥被拒绝", func(t *testing.T) {
+		w := doNodeConfigRequest(router, node.ID, "wrong", "", "")
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
+
+func TestNodeConfig_TunnelProxyProtocol(t *testing.T) {
+	handler, db := createNodeHandlerForTest(t)
+	entry := createConfigTestNode(t, db)
+	exit := &models.Node{Name: "exit-node", Host: "10.0.0.2", Secret: "exit-secret", Status: "online", Protocols: services.NormalizeNodeProtocols(nil)}
+	require.NoError(t, db.Create(exit).Error)
+
+	rule := &models.ForwardingRule{
+		NodeID: entry.ID, UserID: 1, Name: "pp", Protocol: "tcp", Enabled: true, Mode: "direct", ListenPort: 10081,
+		ProxyProtocol: 1, AcceptProxy: true,
+		TunnelEnabled: true, ExitNodeID: exit.ID, TunnelProtocol: "ws", TunnelPort: 20081,
+	}
+	require.NoError(t, services.NewRuleService(db, nil).CreateRuleWithTargets(rule, []models.Target{{Host: "1.1.1.1", Port: 80, Weight: 1, Enabled: true}}))
+
+	router := nodeConfigRouter(handler, db)
+	fetch := func(nodeID uint, secret string) NodeRule {
+		w := doNodeConfigRequest(router, nodeID, secret, "", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp struct {
+			Data struct {
+				Rules string `json:"rules"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		var rules []NodeRule
+		require.NoError(t, json.Unmarshal([]byte(resp.Data.Rules), &rules))
+		require.Len(t, rules, 1)
+		return rules[0]
+	}
+
+	// 入口接收上游 PROXY 头，并以 v2 把客户端地址传给出口；出口按规则版本发给目标
+	entryRule := fetch(entry.ID, "node-secret")
+	require.Equal(t, "entry", entryRule.TunnelRole)
+	require.Equal(t, NodeProxyProtocol{Accept: true, Send: 2}, entryRule.ProxyProtocol)
+
+	exitRule := fetch(exit.ID, "exit-secret")
+	require.Equal(t, "exit", exitRule.TunnelRole)
+	require.Equal(t, NodeProxyProtocol{Accept: true, Send: 1}, exitRule.ProxyProtocol)
+}
+
+func TestNodeConfig_LongPoll(t *testing.T) {
+	handler, db := createNodeHandlerForTest(t)
+	node := createConfigTestNode(t, db)
+	ruleService := services.NewRuleService(db, nil)
+
+	router := nodeConfigRouter(handler, db)
+
+	etag := doNodeConfigRequest(router, node.ID, "node-secret", "", "").Header().Get("ETag")
+
+	t.Run("超时仍未变化返回 304", func(t *testing.T) {
+		start := time.Now()
+		w := doNodeConfigRequest(router, node.ID, "node-secret", etag, "?wait=1")
+		require.Equal(t, http.StatusNotModified, w.Code)
+		require.GreaterOrEqual(t, time.Since(start), time.Second)
+	})
+
+	t.Run("配置变化时提前返回", func(t *testing.T) {
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			rule := &models.ForwardingRule{NodeID: node.ID, UserID: 1, Name: "r2", Protocol: "udp", Enabled: true, Mode: "direct", ListenPort: 10053}
+			_ = ruleService.CreateRuleWithTargets(rule, []models.Target{{Host: "8.8.8.8", Port: 53, Weight: 1, Enabled: true}})
+		}()
+
+		start := time.Now()
+		w := doNodeConfigRequest(router, node.ID, "node-secret", etag, "?wait=10")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NotEqual(t, etag, w.Header().Get("ETag"))
+		require.Less(t, time.Since(start), 5*time.Second)
+	})
+}
+
+func TestNodeConfig_SignedGetWithoutBody(t *testing.T) {
+	handler, db := createNodeHandlerForTest(t)
+	node := createConfigTestNode(t, db)
+	require.NoError(t, db.Model(&models.SiteConfig{}).Where("1 = 1").Update("node_legacy_auth", false).Error)
+
+	nodeAuth := middleware.NewNodeAuthMiddleware(services.NewNodeService(db, nil), services.NewSiteConfigService(db))
+	router := gin.New()
+	router.GET("/api/node/config", nodeAuth.Authenticate(), handler.NodeConfig)
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req := httptest.NewRequest(http.MethodGet, "/api/node/config?wait=0", nil)
+	req.Header.Set(middleware.NodeIDHeader, strconv.FormatUint(uint64(node.ID), 10))
+	req.Header.Set(middleware.NodeTimestampHeader, timestamp)
+	req.Header.Set(middleware.NodeNonceHeader, "get-config")
+	req.Header.Set(middleware.NodeSignatureHeader, services.SignNodeRequest("node-secret", http.MethodGet, "/api/node/config", "wait=0", timestamp, "get-config", nil))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NotEmpty(t, w.Header().Get("ETag"))
+}
+
+func TestNodeConfig_SecretRotation(t *testing.T) {
+	handler, db := createNodeHandlerForTest(t)
+	node := createConfigTestNode(t, db)
+	nodeService := services.NewNodeService(db, nil)
+	router := nodeConfigRouter(handler, db)
+
+	etag := doNodeConfigRequest(router, node.ID, "node-secret", "", "").Header().Get("ETag")
+
+	rotation, err := nodeService.RotateNodeSecret(node.ID, time.Hour)
+	require.NoError(t, err)
+
+	w := doNodeConfigRequest(router, node.ID, "node-secret", etag, "")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Data struct {
+			SecretRotation *services.SecretRotation `json:"secret_rotation"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.NotNil(t, resp.Data.SecretRotation)
+	require.Equal(t, rotation.Secret, resp.Data.SecretRotation.Secret)
+
+	// 节点切换到新密钥后不再下发轮换信息，旧密钥失效
+	w = doNodeConfigRequest(router, node.ID, rotation.Secret, "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Nil(t, resp.Data.SecretRotation)
+
+	w = doNodeConfigRequest(router, node.ID, "node-secret", "", "")
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	require.NoError(t, nodeService.RevokeNodeCredentials(node.ID))
+	w = doNodeConfigRequest(router, node.ID, rotation.Secret, "", "")
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestGetNodeProbeHistory(t *testing.T) {
+	handler, db := createNodeHandlerForTest(t)
+	node := createConfigTestNode(t, db)
+
+	group := &models.UserGroup{Name: "probe"}
+	require.NoError(t, db.Create(group).Error)
+	allowedUser := &models.User{Username: "allowed", PasswordHash: "x", Role: "user", UserGroupID: group.ID}
+	otherUser := &models.User{Username: "other", PasswordHash: "x", Role: "user"}
+	require.NoError(t, db.Create(allowedUser).Error)
+	require.NoError(t, db.Create(otherUser).Error)
+	require.NoError(t, db.Create(&models.NodeAllowedGroup{NodeID: node.ID, UserGroupID: group.ID}).Error)
+	require.NoError(t, services.NewNodeService(db, nil).SaveProbeData(node.ID, &models.ProbeData{CPU: models.CPUInfo{UsagePercent: 12}}))
+
+	request := func(userID uint, role, query string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.GET("/nodes/:id/probe/history", func(c *gin.Context) {
+			c.Set(middleware.UserIDKey, userID)
+			c.Set(middleware.UserRoleKey, role)
+			c.Next()
+		}, handler.GetNodeProbeHistory)
+		req := httptest.NewRequest(http.MethodGet, "/nodes/"+strconv.FormatUint(uint64(node.ID), 10)+"/probe/history"+query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("用户组可用节点返回历史", func(t *testing.T) {
+		w := request(allowedUser.ID, "user", "")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp struct {
+			Data services.ProbeHistory `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Equal(t, services.ProbeResolutionRaw, resp.Data.Resolution)
+		require.Len(t, resp.Data.Points, 1)
+		require.InDelta(t, 12, resp.Data.Points[0].CPUPercent, 0.001)
+	})
+
+	t.Run("无权限用户返回 404，管理员可查看", func(t *testing.T) {
+		require.Equal(t, http.StatusNotFound, request(otherUser.ID, "user", "").Code)
+		require.Equal(t, http.StatusOK, request(otherUser.ID, "admin", "").Code)
+	})
+
+	t.Run("参数错误返回 400", func(t *testing.T) {
+		require.Equal(t, http.StatusBadRequest, request(allowedUser.ID, "user", "?step=abc").Code)
+		require.Equal(t, http.StatusBadRequest, request(allowedUser.ID, "user", "?from=200&to=100").Code)
+		require.Equal(t, http.StatusBadRequest, request(allowedUser.ID, "user", "?step=1s&from=0&to=86400").Code)
+	})
+}
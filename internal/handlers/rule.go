@@ -1,10 +1,15 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"bakaray/internal/logger"
 	"bakaray/internal/middleware"
@@ -16,17 +21,25 @@ import (
 
 // RuleHandler 转发规则处理器
 type RuleHandler struct {
-	ruleService *services.RuleService
-	nodeService *services.NodeService
-	userService *services.UserService
+	ruleService         *services.RuleService
+	nodeService         *services.NodeService
+	userService         *services.UserService
+	nodeGroupService    *services.NodeGroupService
+	trafficStatsService *services.TrafficStatsService
+
+	// portMu 串行化规则端口的校验与保存，避免并发请求（尤其是自动分配端口）占用同一端口；
+	// 多个实例之间自动分配的端口由 ListenPortReservation 预留保证不重复
+	portMu sync.Mutex
 }
 
 // NewRuleHandler 创建规则处理器
-func NewRuleHandler(ruleService *services.RuleService, nodeService *services.NodeService, userService *services.UserService) *RuleHandler {
+func NewRuleHandler(ruleService *services.RuleService, nodeService *services.NodeService, userService *services.UserService, nodeGroupService *services.NodeGroupService, trafficStatsService *services.TrafficStatsService) *RuleHandler {
 	return &RuleHandler{
-		ruleService: ruleService,
-		nodeService: nodeService,
-		userService: userService,
+		ruleService:         ruleService,
+		nodeService:         nodeService,
+		userService:         userService,
+		nodeGroupService:    nodeGroupService,
+		trafficStatsService: trafficStatsService,
 	}
 }
 
@@ -64,47 +77,266 @@ func (h *RuleHandler) GetRules(c *gin.Context) {
 // CreateRuleRequest 创建规则请求
 type CreateRuleRequest struct {
 	Name           string          `json:"name" binding:"required"`
-	NodeID         uint            `json:"node_id" binding:"required"`
+	NodeID         uint            `json:"node_id"`
+	NodeGroupID    uint            `json:"node_group_id"` // 入口节点组，与 node_id 二选一
+	Placement      string          `json:"placement"`     // 节点组部署方式：all 或 healthiest（默认）
 	Protocol       string          `json:"protocol" binding:"required"`
-	ListenPort     int             `json:"listen_port" binding:"required"`
+	ListenPort     int             `json:"listen_port" binding:"required_without=AutoListenPort"`
 	Enabled        *bool           `json:"enabled"`
 	TrafficLimit   *int64          `json:"traffic_limit"`
-	SpeedLimit     *int64          `json:"speed_limit"`
+	SpeedLimit     *int64          `json:"speed_limit"`           // 兼容参数：上下行使用相同限速
+	SpeedLimitUp   *int64          `json:"speed_limit_up"`        // 上行限速（kbps），未指定时使用用户组或套餐的默认值
+	SpeedLimitDown *int64          `json:"speed_limit_down"`      // 下行限速（kbps）
+	MaxConnections *int64          `json:"max_connections"`       // 最大并发连接数，未指定时使用用户组上限
+	ConnRateLimit  *int64          `json:"conn_rate_limit"`       // 每秒新建连接数，未指定时使用用户组上限
+	ProxyProtocol  *int            `json:"proxy_protocol"`        // 向目标发送 PROXY protocol 的版本：0 不发送，1 或 2
+	AcceptProxy    *bool           `json:"accept_proxy_protocol"` // 监听端接收 PROXY protocol
 	Mode           string          `json:"mode"`
 	Targets        []TargetRequest `json:"targets" binding:"required,min=1"`
 	TunnelEnabled  bool            `json:"tunnel_enabled"`
 	ExitNodeID     uint            `json:"exit_node_id"`
+	ExitGroupID    uint            `json:"exit_group_id"` // 出口节点组，与 exit_node_id 二选一
 	TunnelProtocol string          `json:"tunnel_protocol"`
 	TunnelPort     int             `json:"tunnel_port"`
+
+	// HealthCheck 目标健康检查，type 为空表示关闭
+	HealthCheck *models.HealthCheck `json:"health_check"`
+
+	// ListenPortEnd 端口范围规则的结束端口，listen_port 至 listen_port_end 依次转发到目标端口起的相同范围；0 表示单端口
+	ListenPortEnd int `json:"listen_port_end"`
+
+	// AutoListenPort/AutoTunnelPort 在端口策略内自动分配空闲的监听端口/出口隧道端口，忽略 listen_port/tunnel_port
+	AutoListenPort bool `json:"auto_listen_port"`
+	AutoTunnelPort bool `json:"auto_tunnel_port"`
+
+	// ListenIP 监听地址，须为入口节点上报的可绑定地址；为空表示监听全部地址，节点组规则不支持
+	ListenIP string `json:"listen_ip"`
+
+	// Schedule 生效时间，不在生效时间内创建的规则先保持禁用，由调度器到时启用
+	Schedule *models.RuleSchedule `json:"schedule"`
 }
 
 // TargetRequest 目标请求
 type TargetRequest struct {
-	Host    string `json:"host" binding:"required"`
-	Port    int    `json:"port" binding:"required"`
-	Weight  int    `json:"weight"`
-	Enabled bool   `json:"enabled"`
+	Host     string `json:"host" binding:"required"`
+	Port     int    `json:"port" binding:"required"`
+	Weight   int    `json:"weight"`
+	Priority int    `json:"priority"` // failover 模式的优先级，数值越小越优先
+	Enabled  bool   `json:"enabled"`
 }
 
 type normalizedRuleSpec struct {
 	Protocol       string
 	ListenPort     int
+	ListenPortEnd  int // 端口范围规则的结束端口，单端口规则为 0
 	Enabled        bool
 	TrafficLimit   int64
-	SpeedLimit     int64
+	SpeedLimit     int64 // 兼容字段，上下行限速相同时等于该值
+	SpeedLimitUp   int64
+	SpeedLimitDown int64
+	MaxConnections int64
+	ConnRateLimit  int64
+	ProxyProtocol  int
+	AcceptProxy    bool
+	HealthCheck    models.HealthCheck
 	Mode           string
 	Targets        []TargetRequest
 	TunnelEnabled  bool
 	ExitNodeID     uint
 	TunnelProtocol string
 	TunnelPort     int
+	ListenIP       string
+	Schedule       models.RuleSchedule
+}
+
+// ruleSpecOptions 规则的扩展参数及用户适用的限制
+type ruleSpecOptions struct {
+	SpeedLimitUp   int64
+	SpeedLimitDown int64
+	MaxConnections int64
+	ConnRateLimit  int64
+	ProxyProtocol  int
+	AcceptProxy    bool
+	HealthCheck    models.HealthCheck
+	Limits         services.RuleLimits
+
+	// ListenPortEnd 端口范围规则的结束端口
+	ListenPortEnd int
+	// ListenIP 已规范化的监听地址，为空表示全部地址
+	ListenIP string
+	// Schedule 规则的生效时间
+	Schedule models.RuleSchedule
+
+	// ListenPolicy/TunnelPolicy 入口监听端口与出口隧道端口适用的端口策略，为空时不校验
+	ListenPolicy *services.ListenPortPolicy
+	TunnelPolicy *services.ListenPortPolicy
 }
 
 type existingRuleConflict struct {
 	ID      uint
 	Port    int
+	PortEnd int // 端口范围规则的结束端口，单端口为 0
 	Enabled bool
 	Layer4  string
+	IP      string // 监听地址，为空表示全部地址
+}
+
+// overlap 返回与 low-high 重叠的第一个端口
+func (c existingRuleConflict) overlap(low, high int) (int, bool) {
+	end := max(c.Port, c.PortEnd)
+	if c.Port > high || end < low {
+		return 0, false
+	}
+	return max(c.Port, low), true
+}
+
+// ruleDraft 创建/更新规则时合并后的完整规则参数
+type ruleDraft struct {
+	NodeID         uint
+	NodeGroupID    uint
+	Placement      string
+	Protocol       string
+	ListenPort     int
+	Enabled        bool
+	TrafficLimit   int64
+	SpeedLimitUp   int64
+	SpeedLimitDown int64
+	MaxConnections int64
+	ConnRateLimit  int64
+	ProxyProtocol  int
+	AcceptProxy    bool
+	HealthCheck    models.HealthCheck
+	Limits         services.RuleLimits
+	Mode           string
+	Targets        []TargetRequest
+	TunnelEnabled  bool
+	ExitNodeID     uint
+	ExitGroupID    uint
+	TunnelProtocol string
+	TunnelPort     int
+
+	// Pending 同一批次中已通过校验、尚未保存的规则占用的监听，按节点 ID 索引
+	Pending map[uint][]existingRuleConflict
+
+	// ListenPortEnd 端口范围规则的结束端口
+	ListenPortEnd int
+	// ListenIP 监听地址，为空表示全部地址
+	ListenIP string
+	// Schedule 规则的生效时间
+	Schedule models.RuleSchedule
+	// AutoListenPort/AutoTunnelPort 由系统在端口策略内分配空闲端口
+	AutoListenPort bool
+	AutoTunnelPort bool
+	// Current 更新时的原规则，原有端口不受之后收紧的端口策略限制
+	Current *models.ForwardingRule
+	// DryRun 试运行，自动分配的端口不写入预留
+	DryRun bool
+}
+
+// keepsListenPort 更新规则时入口节点与监听端口均未改变
+func (d *ruleDraft) keepsListenPort(entry *models.Node, port int) bool {
+	if d.Current == nil || d.Current.ListenPort != port || d.Current.ListenPortEnd != d.ListenPortEnd {
+		return false
+	}
+	return d.Current.NodeID == entry.ID || (d.Current.NodeGroupID != 0 && d.Current.NodeGroupID == d.NodeGroupID)
+}
+
+// keepsTunnelPort 更新规则时出口节点与隧道端口均未改变
+func (d *ruleDraft) keepsTunnelPort(exit *models.Node, port int) bool {
+	return d.Current != nil && d.Current.TunnelEnabled && d.Current.ExitNodeID == exit.ID && d.Current.TunnelPort == port
+}
+
+// specLimits 规则校验适用的限制，更新规则时未改变的限速、连接数与流量上限保留原值，不受之后收紧的上限限制
+func (d *ruleDraft) specLimits() services.RuleLimits {
+	limits := d.Limits
+	if d.Current == nil {
+		return limits
+	}
+	currentUp, currentDown := services.RuleSpeedLimits(d.Current)
+	if d.SpeedLimitUp == currentUp {
+		limits.MaxSpeedLimitUp = 0
+	}
+	if d.SpeedLimitDown == currentDown {
+		limits.MaxSpeedLimitDown = 0
+	}
+	if d.MaxConnections == d.Current.MaxConnections {
+		limits.MaxConnections = 0
+	}
+	if d.ConnRateLimit == d.Current.ConnRateLimit {
+		limits.MaxConnRate = 0
+	}
+	if d.TrafficLimit == d.Current.TrafficLimit {
+		limits.MaxTrafficLimit = 0
+	}
+	return limits
+}
+
+// reserveListenPort 分配并预留自动分配的端口，避免多个实例在规则保存前分配到同一端口；试运行时只分配不预留
+func (h *RuleHandler) reserveListenPort(dryRun bool, nodeIDs []uint, policies []services.ListenPortPolicy, used map[int]struct{}) (int, error) {
+	reserve := h.ruleService.ReserveListenPort
+	if dryRun {
+		reserve = h.ruleService.PreviewListenPort
+	}
+	port, err := reserve(nodeIDs, policies, used)
+	if err != nil && !errors.Is(err, services.ErrNoFreePort) {
+		logger.Error("resolveRulePlacement: reserve listen port failed", err, "node_ids", nodeIDs)
+		return 0, &ruleRequestError{Status: http.StatusInternalServerError, Message: "预留监听端口失败"}
+	}
+	return port, err
+}
+
+// checkReservedPorts 手动指定的监听端口与隧道端口不能使用其他请求已预留、尚未保存的端口，未改变的原有端口不检查
+func (h *RuleHandler) checkReservedPorts(d *ruleDraft, entry, exit *models.Node, spec *normalizedRuleSpec) error {
+	check := func(nodeID uint, port, portEnd int) (int, error) {
+		reserved, err := h.ruleService.ReservedListenPort(nodeID, port, portEnd)
+		if err != nil {
+			logger.Error("resolveRulePlacement: load listen port reservations failed", err, "node_id", nodeID)
+			return 0, &ruleRequestError{Status: http.StatusInternalServerError, Message: "读取端口预留失败"}
+		}
+		return reserved, nil
+	}
+	if !d.AutoListenPort && !d.keepsListenPort(entry, spec.ListenPort) {
+		reserved, err := check(entry.ID, spec.ListenPort, spec.ListenPortEnd)
+		if err != nil {
+			return err
+		}
+		if reserved != 0 {
+			return badRuleRequest(fmt.Sprintf("该节点端口 %d 已被其他规则预留，请稍后重试或更换端口", reserved))
+		}
+	}
+	if spec.TunnelEnabled && exit != nil && !d.AutoTunnelPort && !d.keepsTunnelPort(exit, spec.TunnelPort) {
+		reserved, err := check(exit.ID, spec.TunnelPort, spec.TunnelPort)
+		if err != nil {
+			return err
+		}
+		if reserved != 0 {
+			return badRuleRequest(fmt.Sprintf("出口节点端口 %d 已被其他规则预留，请稍后重试或更换端口", reserved))
+		}
+	}
+	return nil
+}
+
+// rulePlacement 规则校验通过后的部署位置
+type rulePlacement struct {
+	Spec        *normalizedRuleSpec
+	NodeID      uint // all 部署时为 0
+	NodeGroupID uint
+	Placement   string
+	ExitGroupID uint
+}
+
+// ruleRequestError 带 HTTP 状态码的规则校验错误
+type ruleRequestError struct {
+	Status  int
+	Message string
+}
+
+func (e *ruleRequestError) Error() string {
+	return e.Message
+}
+
+func badRuleRequest(message string) *ruleRequestError {
+	return &ruleRequestError{Status: http.StatusBadRequest, Message: message}
 }
 
 // CreateRule 创建规则
@@ -120,130 +352,144 @@ func (h *RuleHandler) CreateRule(c *gin.Context) {
 		return
 	}
 
-	log.Debug("CreateRule request", "name", req.Name, "protocol", req.Protocol, "node_id", req.NodeID)
+	log.Debug("CreateRule request", "name", req.Name, "protocol", req.Protocol, "node_id", req.NodeID, "node_group_id", req.NodeGroupID)
 
-	entryNode, err := h.nodeService.GetNodeByID(req.NodeID)
+	limits, err := h.ruleService.RuleLimitsForUser(userID)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "节点不存在"})
+		logger.Error("CreateRule: load rule limits failed", err, "user_id", userID, "request_id", requestID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "读取用户限制失败"})
 		return
 	}
 
-	allowed, err := h.userCanUseNode(userID, req.NodeID)
+	h.portMu.Lock()
+	defer h.portMu.Unlock()
+
+	placement, err := h.resolveRulePlacement(userID, createRuleDraft(&req, limits), 0)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "读取节点授权失败"})
+		writeRuleRequestError(c, err)
 		return
 	}
-	if !allowed {
-		c.JSON(http.StatusForbidden, gin.H{"code": 403, "message": "当前用户组无权使用该节点"})
+	usage, err := h.ruleService.RuleUsageForUser(userID)
+	if err != nil {
+		logger.Error("CreateRule: load rule usage failed", err, "user_id", userID, "request_id", requestID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "读取规则用量失败"})
 		return
 	}
+	if err := ruleQuotaError(limits, usage, 1, boolToInt64(placement.Spec.TunnelEnabled)); err != nil {
+		writeRuleRequestError(c, err)
+		return
+	}
+	rule := newRuleModel(userID, req.Name, placement)
 
-	var exitNode *models.Node
-	if req.TunnelEnabled {
-		if req.ExitNodeID == 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "启用隧道时必须选择出口节点"})
-			return
-		}
-
-		exitNode, err = h.nodeService.GetNodeByID(req.ExitNodeID)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "出口节点不存在"})
-			return
-		}
-
-		allowed, err = h.userCanUseNode(userID, req.ExitNodeID)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "读取出口节点授权失败"})
-			return
-		}
-		if !allowed {
-			c.JSON(http.StatusForbidden, gin.H{"code": 403, "message": "当前用户组无权使用出口节点"})
-			return
-		}
+	// 不在生效时间内的规则先保持禁用，由调度器到时启用；流量余额耗尽时规则先保持禁用，购买流量后自动启用
+	message := "创建成功"
+	if reason := services.RuleScheduleReason(rule, time.Now()); rule.Enabled && reason != "" {
+		rule.Enabled = false
+		rule.DisabledReason = reason
+		message = "创建成功，规则将在生效时间内自动启用"
+	} else if rule.Enabled && h.trafficBalanceExhausted(userID) {
+		rule.Enabled = false
+		rule.DisabledReason = services.RuleDisabledBalanceExhausted
+		message = "创建成功，流量余额不足，规则将在购买流量后自动启用"
 	}
 
-	entryConflicts, err := h.loadRuleConflicts(req.NodeID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "加载规则冲突信息失败"})
+	if err := h.ruleService.CreateRuleWithTargets(rule, buildTargetModels(placement.Spec.Targets)); err != nil {
+		logger.Error("CreateRule: create rule failed", err, "user_id", userID, "request_id", requestID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "创建规则失败"})
 		return
 	}
-	exitConflicts := []existingRuleConflict(nil)
-	if req.TunnelEnabled {
-		exitConflicts, err = h.loadRuleConflicts(req.ExitNodeID)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "加载出口节点冲突信息失败"})
-			return
-		}
-	}
 
-	enabledValue, trafficLimitValue, speedLimitValue := resolveRuleStateValues(req.Enabled, req.TrafficLimit, req.SpeedLimit, true, 0, 0)
-
-	spec, err := normalizeAndValidateRuleSpec(
-		entryNode,
-		exitNode,
-		req.Protocol,
-		req.ListenPort,
-		enabledValue,
-		trafficLimitValue,
-		speedLimitValue,
-		req.Mode,
-		req.Targets,
-		req.TunnelEnabled,
-		req.ExitNodeID,
-		req.TunnelProtocol,
-		req.TunnelPort,
-		entryConflicts,
-		exitConflicts,
-		0,
-	)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
-		return
+	log.Info("CreateRule success", "rule_id", rule.ID, "rule_name", rule.Name)
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    0,
+		"message": message,
+		"data": gin.H{
+			"id":              rule.ID,
+			"enabled":         rule.Enabled,
+			"disabled_reason": rule.DisabledReason,
+			"listen_port":     rule.ListenPort,
+			"tunnel_port":     rule.TunnelPort,
+		},
+	})
+}
+
+// createRuleDraft 按创建请求生成规则参数，未指定的限速、连接数使用用户组或套餐的默认值
+func createRuleDraft(req *CreateRuleRequest, limits *services.RuleLimits) ruleDraft {
+	enabledValue, trafficLimitValue, _ := resolveRuleStateValues(req.Enabled, req.TrafficLimit, nil, true, 0, 0)
+	speedLimitUp, speedLimitDown := resolveSpeedLimits(req.SpeedLimit, req.SpeedLimitUp, req.SpeedLimitDown, limits.DefaultSpeedLimitUp, limits.DefaultSpeedLimitDown)
+	var healthCheck models.HealthCheck
+	if req.HealthCheck != nil {
+		healthCheck = *req.HealthCheck
+	}
+	var schedule models.RuleSchedule
+	if req.Schedule != nil {
+		schedule = *req.Schedule
 	}
 
-	rule := &models.ForwardingRule{
+	return ruleDraft{
 		NodeID:         req.NodeID,
+		NodeGroupID:    req.NodeGroupID,
+		Placement:      req.Placement,
+		Protocol:       req.Protocol,
+		ListenPort:     req.ListenPort,
+		Enabled:        enabledValue,
+		TrafficLimit:   trafficLimitValue,
+		SpeedLimitUp:   speedLimitUp,
+		SpeedLimitDown: speedLimitDown,
+		MaxConnections: valueOrDefaultInt64(req.MaxConnections, limits.MaxConnections),
+		ConnRateLimit:  valueOrDefaultInt64(req.ConnRateLimit, limits.MaxConnRate),
+		ProxyProtocol:  valueOrDefaultInt(req.ProxyProtocol, 0),
+		AcceptProxy:    valueOrDefaultBool(req.AcceptProxy, false),
+		HealthCheck:    healthCheck,
+		Limits:         *limits,
+		Mode:           req.Mode,
+		Targets:        req.Targets,
+		TunnelEnabled:  req.TunnelEnabled,
+		ExitNodeID:     req.ExitNodeID,
+		ExitGroupID:    req.ExitGroupID,
+		TunnelProtocol: req.TunnelProtocol,
+		TunnelPort:     req.TunnelPort,
+		ListenPortEnd:  req.ListenPortEnd,
+		AutoListenPort: req.AutoListenPort,
+		AutoTunnelPort: req.AutoTunnelPort,
+		ListenIP:       req.ListenIP,
+		Schedule:       schedule,
+	}
+}
+
+// newRuleModel 根据校验通过的部署位置生成待保存的规则
+func newRuleModel(userID uint, name string, placement *rulePlacement) *models.ForwardingRule {
+	spec := placement.Spec
+	return &models.ForwardingRule{
+		NodeID:         placement.NodeID,
+		NodeGroupID:    placement.NodeGroupID,
+		Placement:      placement.Placement,
 		UserID:         userID,
-		Name:           req.Name,
+		Name:           name,
 		Protocol:       spec.Protocol,
 		ListenPort:     spec.ListenPort,
+		ListenPortEnd:  spec.ListenPortEnd,
 		Mode:           spec.Mode,
 		Enabled:        spec.Enabled,
 		TrafficUsed:    0,
 		TrafficLimit:   spec.TrafficLimit,
 		SpeedLimit:     spec.SpeedLimit,
+		SpeedLimitUp:   spec.SpeedLimitUp,
+		SpeedLimitDown: spec.SpeedLimitDown,
+		MaxConnections: spec.MaxConnections,
+		ConnRateLimit:  spec.ConnRateLimit,
+		ProxyProtocol:  spec.ProxyProtocol,
+		AcceptProxy:    spec.AcceptProxy,
+		HealthCheck:    spec.HealthCheck,
 		TunnelEnabled:  spec.TunnelEnabled,
 		ExitNodeID:     spec.ExitNodeID,
+		ExitGroupID:    placement.ExitGroupID,
 		TunnelProtocol: spec.TunnelProtocol,
 		TunnelPort:     spec.TunnelPort,
+		ListenIP:       spec.ListenIP,
+		Schedule:       spec.Schedule,
 	}
-
-	if err := h.ruleService.CreateRule(rule); err != nil {
-		logger.Error("CreateRule: create rule failed", err, "user_id", userID, "request_id", requestID)
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "创建规则失败"})
-		return
-	}
-
-	for _, t := range spec.Targets {
-		target := &models.Target{
-			RuleID:  rule.ID,
-			Host:    t.Host,
-			Port:    t.Port,
-			Weight:  t.Weight,
-			Enabled: t.Enabled,
-		}
-		h.ruleService.AddTarget(target)
-	}
-
-	log.Info("CreateRule success", "rule_id", rule.ID, "rule_name", rule.Name)
-
-	c.JSON(http.StatusOK, gin.H{
-		"code":    0,
-		"message": "创建成功",
-		"data": gin.H{
-			"id": rule.ID,
-		},
-	})
 }
 
 // GetRule 获取规则详情
@@ -321,16 +567,37 @@ type UpdateRuleRequest struct {
 	Name           string          `json:"name"`
 	Enabled        *bool           `json:"enabled"`
 	NodeID         *uint           `json:"node_id"`
+	NodeGroupID    *uint           `json:"node_group_id"`
+	Placement      string          `json:"placement"`
 	Protocol       string          `json:"protocol"`
 	ListenPort     *int            `json:"listen_port"`
 	TrafficLimit   *int64          `json:"traffic_limit"`
 	SpeedLimit     *int64          `json:"speed_limit"`
+	SpeedLimitUp   *int64          `json:"speed_limit_up"`
+	SpeedLimitDown *int64          `json:"speed_limit_down"`
+	MaxConnections *int64          `json:"max_connections"`
+	ConnRateLimit  *int64          `json:"conn_rate_limit"`
+	ProxyProtocol  *int            `json:"proxy_protocol"`
+	AcceptProxy    *bool           `json:"accept_proxy_protocol"`
 	Mode           string          `json:"mode"`
 	Targets        []TargetRequest `json:"targets"`
 	TunnelEnabled  *bool           `json:"tunnel_enabled"`
 	ExitNodeID     *uint           `json:"exit_node_id"`
+	ExitGroupID    *uint           `json:"exit_group_id"`
 	TunnelProtocol string          `json:"tunnel_protocol"`
 	TunnelPort     *int            `json:"tunnel_port"`
+
+	// HealthCheck 目标健康检查，未指定时保持原设置
+	HealthCheck *models.HealthCheck `json:"health_check"`
+
+	// ListenPortEnd 端口范围规则的结束端口，0 改为单端口规则，未指定时保持原设置
+	ListenPortEnd *int `json:"listen_port_end"`
+
+	// ListenIP 监听地址，空字符串改为监听全部地址，未指定时保持原设置；改为节点组规则时自动清除
+	ListenIP *string `json:"listen_ip"`
+
+	// Schedule 生效时间，未指定时保持原设置，指定时整体替换
+	Schedule *models.RuleSchedule `json:"schedule"`
 }
 
 // UpdateRule 更新规则
@@ -364,24 +631,17 @@ func (h *RuleHandler) UpdateRule(c *gin.Context) {
 
 	targets, _ := h.ruleService.ListTargets(rule.ID, false)
 
+	// 指定 node_id 而未指定 node_group_id 时改为单节点规则，出口同理
 	nodeID := rule.NodeID
+	nodeGroupID := rule.NodeGroupID
+	if req.NodeGroupID != nil {
+		nodeGroupID = *req.NodeGroupID
+	}
 	if req.NodeID != nil && *req.NodeID > 0 {
 		nodeID = *req.NodeID
-	}
-	entryNode, err := h.nodeService.GetNodeByID(nodeID)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "节点不存在"})
-		return
-	}
-
-	allowed, err := h.userCanUseNode(userID, nodeID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "读取节点授权失败"})
-		return
-	}
-	if !allowed {
-		c.JSON(http.StatusForbidden, gin.H{"code": 403, "message": "当前用户组无权使用该节点"})
-		return
+		if req.NodeGroupID == nil {
+			nodeGroupID = 0
+		}
 	}
 
 	tunnelEnabled := rule.TunnelEnabled
@@ -390,74 +650,93 @@ func (h *RuleHandler) UpdateRule(c *gin.Context) {
 	}
 
 	exitNodeID := rule.ExitNodeID
+	exitGroupID := rule.ExitGroupID
+	if req.ExitGroupID != nil {
+		exitGroupID = *req.ExitGroupID
+	}
 	if req.ExitNodeID != nil {
 		exitNodeID = *req.ExitNodeID
-	}
-
-	tunnelProtocol := coalesceString(req.TunnelProtocol, rule.TunnelProtocol)
-	tunnelPort := valueOrDefaultInt(req.TunnelPort, rule.TunnelPort)
-
-	var exitNode *models.Node
-	if tunnelEnabled {
-		if exitNodeID == 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "启用隧道时必须选择出口节点"})
-			return
-		}
-
-		exitNode, err = h.nodeService.GetNodeByID(exitNodeID)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "出口节点不存在"})
-			return
+		if req.ExitGroupID == nil && exitNodeID > 0 {
+			exitGroupID = 0
 		}
+	}
 
-		allowed, err = h.userCanUseNode(userID, exitNodeID)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "读取出口节点授权失败"})
-			return
-		}
-		if !allowed {
-			c.JSON(http.StatusForbidden, gin.H{"code": 403, "message": "当前用户组无权使用出口节点"})
-			return
-		}
+	limits, err := h.ruleService.RuleLimitsForUser(userID)
+	if err != nil {
+		logger.Error("UpdateRule: load rule limits failed", err, "user_id", userID, "request_id", requestID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "读取用户限制失败"})
+		return
 	}
 
-	entryConflicts, err := h.loadRuleConflicts(nodeID)
+	enabledValue, trafficLimitValue, _ := resolveRuleStateValues(req.Enabled, req.TrafficLimit, nil, rule.Enabled, rule.TrafficLimit, 0)
+	currentSpeedUp, currentSpeedDown := services.RuleSpeedLimits(rule)
+	speedLimitUp, speedLimitDown := resolveSpeedLimits(req.SpeedLimit, req.SpeedLimitUp, req.SpeedLimitDown, currentSpeedUp, currentSpeedDown)
+	maxConnections := valueOrDefaultInt64(req.MaxConnections, rule.MaxConnections)
+	connRateLimit := valueOrDefaultInt64(req.ConnRateLimit, rule.ConnRateLimit)
+	proxyProtocol := valueOrDefaultInt(req.ProxyProtocol, rule.ProxyProtocol)
+	acceptProxy := valueOrDefaultBool(req.AcceptProxy, rule.AcceptProxy)
+	healthCheck := rule.HealthCheck
+	if req.HealthCheck != nil {
+		healthCheck = *req.HealthCheck
+	}
+	listenIP := rule.ListenIP
+	if req.ListenIP != nil {
+		listenIP = *req.ListenIP
+	} else if nodeGroupID != 0 {
+		listenIP = ""
+	}
+	schedule := rule.Schedule
+	if req.Schedule != nil {
+		schedule = *req.Schedule
+	}
+
+	h.portMu.Lock()
+	defer h.portMu.Unlock()
+
+	placement, err := h.resolveRulePlacement(userID, ruleDraft{
+		NodeID:         nodeID,
+		NodeGroupID:    nodeGroupID,
+		Placement:      coalesceString(req.Placement, rule.Placement),
+		Protocol:       coalesceString(req.Protocol, services.NormalizeProtocol(rule.Protocol)),
+		ListenPort:     valueOrDefaultInt(req.ListenPort, rule.ListenPort),
+		Enabled:        enabledValue,
+		TrafficLimit:   trafficLimitValue,
+		SpeedLimitUp:   speedLimitUp,
+		SpeedLimitDown: speedLimitDown,
+		MaxConnections: maxConnections,
+		ConnRateLimit:  connRateLimit,
+		ProxyProtocol:  proxyProtocol,
+		AcceptProxy:    acceptProxy,
+		HealthCheck:    healthCheck,
+		Limits:         *limits,
+		Mode:           coalesceString(req.Mode, rule.Mode),
+		Targets:        coalesceTargets(req.Targets, targets),
+		TunnelEnabled:  tunnelEnabled,
+		ExitNodeID:     exitNodeID,
+		ExitGroupID:    exitGroupID,
+		TunnelProtocol: coalesceString(req.TunnelProtocol, rule.TunnelProtocol),
+		TunnelPort:     valueOrDefaultInt(req.TunnelPort, rule.TunnelPort),
+		ListenPortEnd:  valueOrDefaultInt(req.ListenPortEnd, rule.ListenPortEnd),
+		ListenIP:       listenIP,
+		Schedule:       schedule,
+		Current:        rule,
+	}, rule.ID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "加载规则冲突信息失败"})
+		writeRuleRequestError(c, err)
 		return
 	}
-	exitConflicts := []existingRuleConflict(nil)
-	if tunnelEnabled {
-		exitConflicts, err = h.loadRuleConflicts(exitNodeID)
+	spec := placement.Spec
+	if spec.TunnelEnabled && !rule.TunnelEnabled {
+		usage, err := h.ruleService.RuleUsageForUser(userID)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "加载出口节点冲突信息失败"})
+			logger.Error("UpdateRule: load rule usage failed", err, "user_id", userID, "request_id", requestID)
+			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "读取规则用量失败"})
+			return
+		}
+		if err := ruleQuotaError(limits, usage, 0, 1); err != nil {
+			writeRuleRequestError(c, err)
 			return
 		}
-	}
-
-	enabledValue, trafficLimitValue, speedLimitValue := resolveRuleStateValues(req.Enabled, req.TrafficLimit, req.SpeedLimit, rule.Enabled, rule.TrafficLimit, rule.SpeedLimit)
-
-	spec, err := normalizeAndValidateRuleSpec(
-		entryNode,
-		exitNode,
-		coalesceString(req.Protocol, services.NormalizeProtocol(rule.Protocol)),
-		valueOrDefaultInt(req.ListenPort, rule.ListenPort),
-		enabledValue,
-		trafficLimitValue,
-		speedLimitValue,
-		coalesceString(req.Mode, rule.Mode),
-		coalesceTargets(req.Targets, targets),
-		tunnelEnabled,
-		exitNodeID,
-		tunnelProtocol,
-		tunnelPort,
-		entryConflicts,
-		exitConflicts,
-		rule.ID,
-	)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
-		return
 	}
 
 	updates := map[string]interface{}{}
@@ -465,51 +744,435 @@ func (h *RuleHandler) UpdateRule(c *gin.Context) {
 		updates["name"] = req.Name
 	}
 	updates["enabled"] = spec.Enabled
+	message := "更新成功"
+	restore := req.Enabled == nil && !rule.Enabled && (rule.DisabledReason == services.RuleDisabledDestinationBlocked || rule.DisabledReason == services.RuleDisabledPortConflict || services.IsScheduleDisabledReason(rule.DisabledReason))
+	if restore {
+		// 目标与端口已通过校验，恢复因目标违规或端口冲突被禁用的规则；因生效时间被禁用的规则按新的设置重新判断
+		spec.Enabled = true
+		updates["enabled"] = true
+	}
+	if req.Enabled != nil || restore {
+		// 手动启停后不再由系统自动恢复；流量余额耗尽时启用的规则先保持禁用
+		updates["disabled_reason"] = ""
+		if spec.Enabled && h.trafficBalanceExhausted(userID) {
+			updates["enabled"] = false
+			updates["disabled_reason"] = services.RuleDisabledBalanceExhausted
+			message = "更新成功，流量余额不足，规则将在购买流量后自动启用"
+		}
+	}
+	// 不在生效时间内的规则保持禁用，由调度器到时启用
+	if updates["enabled"] == true {
+		if reason := services.RuleScheduleReason(&models.ForwardingRule{Schedule: spec.Schedule}, time.Now()); reason != "" {
+			updates["enabled"] = false
+			updates["disabled_reason"] = reason
+			message = "更新成功，规则将在生效时间内自动启用"
+		}
+	}
 	updates["traffic_limit"] = spec.TrafficLimit
 	updates["speed_limit"] = spec.SpeedLimit
+	updates["speed_limit_up"] = spec.SpeedLimitUp
+	updates["speed_limit_down"] = spec.SpeedLimitDown
+	updates["max_connections"] = spec.MaxConnections
+	updates["conn_rate_limit"] = spec.ConnRateLimit
+	updates["proxy_protocol"] = spec.ProxyProtocol
+	updates["accept_proxy"] = spec.AcceptProxy
+	updates["health_check_type"] = spec.HealthCheck.Type
+	updates["health_check_interval"] = spec.HealthCheck.Interval
+	updates["health_check_timeout"] = spec.HealthCheck.Timeout
+	updates["health_check_rise"] = spec.HealthCheck.Rise
+	updates["health_check_fall"] = spec.HealthCheck.Fall
+	updates["health_check_auto_remove"] = spec.HealthCheck.AutoRemove
 	updates["mode"] = spec.Mode
-	updates["node_id"] = nodeID
+	updates["node_id"] = placement.NodeID
+	updates["node_group_id"] = placement.NodeGroupID
+	updates["placement"] = placement.Placement
 	updates["protocol"] = spec.Protocol
 	updates["listen_port"] = spec.ListenPort
+	updates["listen_port_end"] = spec.ListenPortEnd
+	updates["listen_ip"] = spec.ListenIP
+	updates["schedule_starts_at"] = spec.Schedule.StartsAt
+	updates["schedule_expires_at"] = spec.Schedule.ExpiresAt
+	updates["schedule_windows"] = spec.Schedule.Windows
+	updates["schedule_timezone"] = spec.Schedule.Timezone
 	updates["tunnel_enabled"] = spec.TunnelEnabled
 	updates["exit_node_id"] = spec.ExitNodeID
+	updates["exit_group_id"] = placement.ExitGroupID
 	updates["tunnel_protocol"] = spec.TunnelProtocol
 	updates["tunnel_port"] = spec.TunnelPort
 
-	if err := h.ruleService.UpdateRule(uint(id), updates); err != nil {
+	// 未修改目标时保留原目标，避免重建目标丢失健康状态
+	var targetModels []models.Target
+	if req.Targets != nil {
+		targetModels = buildTargetModels(spec.Targets)
+	}
+	if err := h.ruleService.UpdateRuleWithTargets(uint(id), updates, targetModels); err != nil {
 		logger.Error("UpdateRule: update failed", err, "rule_id", id, "request_id", requestID)
 		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "更新失败"})
 		return
 	}
 
-	_ = h.ruleService.DeleteTargetsByRuleID(uint(id))
-	for _, t := range spec.Targets {
-		target := &models.Target{
-			RuleID:  uint(id),
-			Host:    t.Host,
-			Port:    t.Port,
-			Weight:  t.Weight,
-			Enabled: t.Enabled,
-		}
-		_ = h.ruleService.AddTarget(target)
-	}
-
 	log.Info("UpdateRule success", "rule_id", id, "rule_name", rule.Name)
 
 	c.JSON(http.StatusOK, gin.H{
 		"code":    0,
-		"message": "更新成功",
+		"message": message,
 	})
 }
 
-func normalizeAndValidateRuleSpec(entryNode *models.Node, exitNode *models.Node, protocol string, listenPort int, enabled bool, trafficLimit int64, speedLimit int64, mode string, targets []TargetRequest, tunnelEnabled bool, exitNodeID uint, tunnelProtocol string, tunnelPort int, entryRules []existingRuleConflict, exitRules []existingRuleConflict, currentRuleID uint) (*normalizedRuleSpec, error) {
+// trafficBalanceExhausted 判断用户流量余额是否已耗尽
+func (h *RuleHandler) trafficBalanceExhausted(userID uint) bool {
+	if h.userService == nil {
+		return false
+	}
+	user, err := h.userService.GetUserByID(userID)
+	return err == nil && user != nil && user.TrafficBalance <= 0
+}
+
+// resolveRulePlacement 校验规则并确定部署位置。
+// 单节点规则直接校验；入口节点组按 placement 部署到全部成员（all）或挑选最健康的成员（healthiest）；
+// 出口节点组挑选最健康且能通过校验的成员作为出口节点。
+func (h *RuleHandler) resolveRulePlacement(userID uint, d ruleDraft, currentRuleID uint) (*rulePlacement, error) {
+	placement := &rulePlacement{}
+
+	if d.AutoListenPort && d.ListenPortEnd != 0 {
+		return nil, badRuleRequest("端口范围规则不支持自动分配监听端口")
+	}
+	listenIP, err := services.NormalizeListenIP(d.ListenIP)
+	if err != nil {
+		return nil, badRuleRequest(err.Error())
+	}
+	if listenIP != "" && d.NodeGroupID != 0 {
+		return nil, badRuleRequest("节点组规则不支持指定监听地址")
+	}
+	portSpan := 0
+	if d.ListenPortEnd > d.ListenPort {
+		portSpan = d.ListenPortEnd - d.ListenPort
+	}
+	if err := h.ruleService.CheckTargetDestinationRange(buildTargetModels(sanitizeTargets(d.Targets)), portSpan); err != nil {
+		if errors.Is(err, services.ErrDestinationBlocked) {
+			return nil, badRuleRequest(err.Error())
+		}
+		return nil, &ruleRequestError{Status: http.StatusInternalServerError, Message: "读取目标地址策略失败"}
+	}
+
+	var entries []models.Node
+	if d.NodeGroupID != 0 {
+		mode := strings.ToLower(strings.TrimSpace(d.Placement))
+		if mode == "" {
+			mode = services.RulePlacementHealthiest
+		}
+		if mode != services.RulePlacementAll && mode != services.RulePlacementHealthiest {
+			return nil, badRuleRequest("部署方式仅支持 all 或 healthiest")
+		}
+
+		members, err := h.groupMembersForRule(userID, d.NodeGroupID, services.NodeGroupTypeEntry, mode == services.RulePlacementAll, d.NodeID)
+		if err != nil {
+			return nil, err
+		}
+		entries = members
+		placement.NodeGroupID = d.NodeGroupID
+		placement.Placement = mode
+	} else {
+		if d.NodeID == 0 {
+			return nil, badRuleRequest("必须选择节点或节点组")
+		}
+		entryNode, err := h.nodeService.GetNodeByID(d.NodeID)
+		if err != nil {
+			return nil, badRuleRequest("节点不存在")
+		}
+		allowed, err := h.userCanUseNode(userID, d.NodeID)
+		if err != nil {
+			return nil, &ruleRequestError{Status: http.StatusInternalServerError, Message: "读取节点授权失败"}
+		}
+		if !allowed {
+			return nil, &ruleRequestError{Status: http.StatusForbidden, Message: "当前用户组无权使用该节点"}
+		}
+		entries = []models.Node{*entryNode}
+	}
+
+	exits := []*models.Node{nil}
+	if d.TunnelEnabled {
+		if d.ExitGroupID != 0 {
+			members, err := h.groupMembersForRule(userID, d.ExitGroupID, services.NodeGroupTypeTarget, false, d.ExitNodeID)
+			if err != nil {
+				return nil, err
+			}
+			exits = make([]*models.Node, 0, len(members))
+			for i := range members {
+				exits = append(exits, &members[i])
+			}
+			placement.ExitGroupID = d.ExitGroupID
+		} else {
+			if d.ExitNodeID == 0 {
+				return nil, badRuleRequest("启用隧道时必须选择出口节点")
+			}
+			exitNode, err := h.nodeService.GetNodeByID(d.ExitNodeID)
+			if err != nil {
+				return nil, badRuleRequest("出口节点不存在")
+			}
+			allowed, err := h.userCanUseNode(userID, d.ExitNodeID)
+			if err != nil {
+				return nil, &ruleRequestError{Status: http.StatusInternalServerError, Message: "读取出口节点授权失败"}
+			}
+			if !allowed {
+				return nil, &ruleRequestError{Status: http.StatusForbidden, Message: "当前用户组无权使用出口节点"}
+			}
+			exits = []*models.Node{exitNode}
+		}
+	}
+
+	entryConflicts := make(map[uint][]existingRuleConflict, len(entries))
+	loadEntryConflicts := func(entry *models.Node) ([]existingRuleConflict, error) {
+		conflicts, ok := entryConflicts[entry.ID]
+		if !ok {
+			var err error
+			conflicts, err = h.loadRuleConflicts(entry.ID)
+			if err != nil {
+				return nil, &ruleRequestError{Status: http.StatusInternalServerError, Message: "加载规则冲突信息失败"}
+			}
+			entryConflicts[entry.ID] = conflicts
+		}
+		return append(conflicts[:len(conflicts):len(conflicts)], d.Pending[entry.ID]...), nil
+	}
+
+	// 部署到节点组全部成员时自动分配的端口必须在每个成员上都空闲
+	listenLayer4 := services.DirectProtocolNetwork(services.NormalizeProtocol(d.Protocol))
+	listenPort := d.ListenPort
+	if d.AutoListenPort && placement.Placement == services.RulePlacementAll {
+		policies := make([]services.ListenPortPolicy, 0, len(entries))
+		nodeIDs := make([]uint, 0, len(entries))
+		used := make(map[int]struct{})
+		for i := range entries {
+			conflicts, err := loadEntryConflicts(&entries[i])
+			if err != nil {
+				return nil, err
+			}
+			usedListenPorts(used, conflicts, listenLayer4, listenIP, currentRuleID)
+			policies = append(policies, services.NewListenPortPolicy(&entries[i], &d.Limits))
+			nodeIDs = append(nodeIDs, entries[i].ID)
+		}
+		port, err := h.reserveListenPort(d.DryRun, nodeIDs, policies, used)
+		if errors.Is(err, services.ErrNoFreePort) {
+			return nil, badRuleRequest("节点组内没有共同的空闲端口")
+		}
+		if err != nil {
+			return nil, err
+		}
+		listenPort = port
+	}
+
+	validate := func(entry *models.Node, exit *models.Node, exitConflicts []existingRuleConflict, tunnelPort int) (*normalizedRuleSpec, error) {
+		conflicts, err := loadEntryConflicts(entry)
+		if err != nil {
+			return nil, err
+		}
+		port := listenPort
+		if d.AutoListenPort && placement.Placement != services.RulePlacementAll {
+			used := usedListenPorts(make(map[int]struct{}), conflicts, listenLayer4, listenIP, currentRuleID)
+			port, err = h.reserveListenPort(d.DryRun, []uint{entry.ID}, []services.ListenPortPolicy{services.NewListenPortPolicy(entry, &d.Limits)}, used)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var listenPolicy, tunnelPolicy *services.ListenPortPolicy
+		if !d.keepsListenPort(entry, port) {
+			policy := services.NewListenPortPolicy(entry, &d.Limits)
+			listenPolicy = &policy
+		}
+		exitID := uint(0)
+		if exit != nil {
+			exitID = exit.ID
+			if !d.keepsTunnelPort(exit, tunnelPort) {
+				policy := services.NewListenPortPolicy(exit, &d.Limits)
+				tunnelPolicy = &policy
+			}
+		}
+		spec, err := normalizeAndValidateRuleSpec(
+			entry,
+			exit,
+			d.Protocol,
+			port,
+			d.Enabled,
+			d.TrafficLimit,
+			d.Mode,
+			d.Targets,
+			d.TunnelEnabled,
+			exitID,
+			d.TunnelProtocol,
+			tunnelPort,
+			conflicts,
+			exitConflicts,
+			currentRuleID,
+			ruleSpecOptions{
+				SpeedLimitUp:   d.SpeedLimitUp,
+				SpeedLimitDown: d.SpeedLimitDown,
+				MaxConnections: d.MaxConnections,
+				ConnRateLimit:  d.ConnRateLimit,
+				ProxyProtocol:  d.ProxyProtocol,
+				AcceptProxy:    d.AcceptProxy,
+				HealthCheck:    d.HealthCheck,
+				Limits:         d.specLimits(),
+				ListenPortEnd:  d.ListenPortEnd,
+				ListenIP:       listenIP,
+				Schedule:       d.Schedule,
+				ListenPolicy:   listenPolicy,
+				TunnelPolicy:   tunnelPolicy,
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+		if err := h.checkReservedPorts(&d, entry, exit, spec); err != nil {
+			return nil, err
+		}
+		return spec, nil
+	}
+
+	var lastErr error
+	for _, exit := range exits {
+		var exitConflicts []existingRuleConflict
+		if exit != nil {
+			var err error
+			exitConflicts, err = h.loadRuleConflicts(exit.ID)
+			if err != nil {
+				return nil, &ruleRequestError{Status: http.StatusInternalServerError, Message: "加载出口节点冲突信息失败"}
+			}
+			exitConflicts = append(exitConflicts, d.Pending[exit.ID]...)
+		}
+
+		tunnelPort := d.TunnelPort
+		if exit != nil && d.AutoTunnelPort {
+			if tunnelProtocol := services.NormalizeProtocol(d.TunnelProtocol); services.IsTunnelProtocol(tunnelProtocol) {
+				used := usedListenPorts(make(map[int]struct{}), exitConflicts, services.TunnelProtocolNetwork(tunnelProtocol), "", currentRuleID)
+				port, err := h.reserveListenPort(d.DryRun, []uint{exit.ID}, []services.ListenPortPolicy{services.NewListenPortPolicy(exit, &d.Limits)}, used)
+				if errors.Is(err, services.ErrNoFreePort) {
+					lastErr = fmt.Errorf("出口节点%w", err)
+					continue
+				}
+				if err != nil {
+					return nil, err
+				}
+				tunnelPort = port
+			}
+		}
+
+		if placement.Placement == services.RulePlacementAll {
+			var spec *normalizedRuleSpec
+			for i := range entries {
+				var err error
+				spec, err = validate(&entries[i], exit, exitConflicts, tunnelPort)
+				if err != nil {
+					var reqErr *ruleRequestError
+					if errors.As(err, &reqErr) {
+						return nil, err
+					}
+					lastErr = fmt.Errorf("节点 %s: %w", entries[i].Name, err)
+					spec = nil
+					break
+				}
+			}
+			if spec != nil {
+				placement.Spec = spec
+				return placement, nil
+			}
+			continue
+		}
+
+		for i := range entries {
+			spec, err := validate(&entries[i], exit, exitConflicts, tunnelPort)
+			if err == nil {
+				placement.Spec = spec
+				placement.NodeID = entries[i].ID
+				return placement, nil
+			}
+			var reqErr *ruleRequestError
+			if errors.As(err, &reqErr) {
+				return nil, err
+			}
+			lastErr = err
+		}
+	}
+
+	if lastErr == nil {
+		return nil, badRuleRequest("没有可用节点")
+	}
+	if placement.NodeGroupID != 0 || placement.ExitGroupID != 0 {
+		return nil, badRuleRequest("节点组内没有可部署的节点: " + lastErr.Error())
+	}
+	return nil, badRuleRequest(lastErr.Error())
+}
+
+// groupMembersForRule 读取用户可用的节点组成员并按健康度排序。
+// requireAll 为 true 时要求用户有权使用组内全部节点。
+func (h *RuleHandler) groupMembersForRule(userID, groupID uint, groupType string, requireAll bool, preferID uint) ([]models.Node, error) {
+	label := "入口"
+	if groupType == services.NodeGroupTypeTarget {
+		label = "出口"
+	}
+
+	group, err := h.nodeGroupService.GetNodeGroupByID(groupID)
+	if err != nil {
+		return nil, badRuleRequest(label + "节点组不存在")
+	}
+	if group.Type != groupType {
+		return nil, badRuleRequest(fmt.Sprintf("%s节点组类型必须为 %s", label, groupType))
+	}
+
+	members, err := h.nodeGroupService.ListMembers(groupID)
+	if err != nil {
+		return nil, &ruleRequestError{Status: http.StatusInternalServerError, Message: "读取节点组成员失败"}
+	}
+
+	usable := make([]models.Node, 0, len(members))
+	for _, member := range members {
+		allowed, err := h.userCanUseNode(userID, member.ID)
+		if err != nil {
+			return nil, &ruleRequestError{Status: http.StatusInternalServerError, Message: "读取节点授权失败"}
+		}
+		if allowed {
+			usable = append(usable, member)
+		} else if requireAll {
+			return nil, &ruleRequestError{Status: http.StatusForbidden, Message: "当前用户组无权使用" + label + "节点组内的全部节点"}
+		}
+	}
+	if len(usable) == 0 {
+		return nil, badRuleRequest(label + "节点组内没有可用节点")
+	}
+	if requireAll {
+		return usable, nil
+	}
+
+	ranked, err := h.nodeGroupService.RankPlacementCandidates(usable, preferID)
+	if err != nil {
+		return nil, &ruleRequestError{Status: http.StatusInternalServerError, Message: "读取节点组成员失败"}
+	}
+	return ranked, nil
+}
+
+// writeRuleRequestError 输出规则校验错误
+func writeRuleRequestError(c *gin.Context, err error) {
+	var reqErr *ruleRequestError
+	if errors.As(err, &reqErr) {
+		c.JSON(reqErr.Status, gin.H{"code": reqErr.Status, "message": reqErr.Message})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+}
+
+func normalizeAndValidateRuleSpec(entryNode *models.Node, exitNode *models.Node, protocol string, listenPort int, enabled bool, trafficLimit int64, mode string, targets []TargetRequest, tunnelEnabled bool, exitNodeID uint, tunnelProtocol string, tunnelPort int, entryRules []existingRuleConflict, exitRules []existingRuleConflict, currentRuleID uint, opts ruleSpecOptions) (*normalizedRuleSpec, error) {
 	spec := &normalizedRuleSpec{
 		Protocol:       services.NormalizeProtocol(protocol),
 		ListenPort:     listenPort,
 		Enabled:        enabled,
 		TrafficLimit:   maxInt64(0, trafficLimit),
-		SpeedLimit:     maxInt64(0, speedLimit),
-		Mode:           strings.ToLower(strings.TrimSpace(mode)),
+		SpeedLimitUp:   maxInt64(0, opts.SpeedLimitUp),
+		SpeedLimitDown: maxInt64(0, opts.SpeedLimitDown),
+		MaxConnections: maxInt64(0, opts.MaxConnections),
+		ConnRateLimit:  maxInt64(0, opts.ConnRateLimit),
+		ProxyProtocol:  opts.ProxyProtocol,
+		AcceptProxy:    opts.AcceptProxy,
+		Mode:           services.NormalizeRuleMode(mode),
 		Targets:        sanitizeTargets(targets),
 		TunnelEnabled:  tunnelEnabled,
 		ExitNodeID:     exitNodeID,
@@ -517,12 +1180,40 @@ func normalizeAndValidateRuleSpec(entryNode *models.Node, exitNode *models.Node,
 		TunnelPort:     tunnelPort,
 	}
 
-	if spec.Mode == "" {
-		spec.Mode = "direct"
-	}
 	if spec.ListenPort <= 0 || spec.ListenPort > 65535 {
 		return nil, fmt.Errorf("监听端口必须在 1-65535 之间")
 	}
+	if opts.ListenPortEnd != 0 && opts.ListenPortEnd != spec.ListenPort {
+		spec.ListenPortEnd = opts.ListenPortEnd
+		if spec.ListenPortEnd < spec.ListenPort || spec.ListenPortEnd > 65535 {
+			return nil, fmt.Errorf("结束端口必须在监听端口与 65535 之间")
+		}
+		if spec.ListenPortEnd-spec.ListenPort+1 > services.MaxRulePortRange {
+			return nil, fmt.Errorf("端口范围最多包含 %d 个端口", services.MaxRulePortRange)
+		}
+		if tunnelEnabled {
+			return nil, fmt.Errorf("端口范围规则暂不支持隧道")
+		}
+		for _, target := range spec.Targets {
+			if target.Port+spec.ListenPortEnd-spec.ListenPort > 65535 {
+				return nil, fmt.Errorf("目标 %s 的端口范围超出 65535", net.JoinHostPort(target.Host, strconv.Itoa(target.Port)))
+			}
+		}
+	}
+	if opts.ListenIP != "" {
+		if !services.NodeHasListenAddress(entryNode, opts.ListenIP) {
+			return nil, fmt.Errorf("节点未上报监听地址 %s", opts.ListenIP)
+		}
+		spec.ListenIP = opts.ListenIP
+	}
+	listenEnd := max(spec.ListenPort, spec.ListenPortEnd)
+	if opts.ListenPolicy != nil {
+		for port := spec.ListenPort; port <= listenEnd; port++ {
+			if err := opts.ListenPolicy.Check(port); err != nil {
+				return nil, fmt.Errorf("监听%w", err)
+			}
+		}
+	}
 
 	if !services.IsDirectProtocol(spec.Protocol) {
 		return nil, fmt.Errorf("直接转发协议仅支持 TCP 或 UDP")
@@ -530,42 +1221,100 @@ func normalizeAndValidateRuleSpec(entryNode *models.Node, exitNode *models.Node,
 	if !services.NodeSupportsDirectProtocol([]string(entryNode.Protocols), spec.Protocol) {
 		return nil, fmt.Errorf("节点未声明支持 %s", spec.Protocol)
 	}
+	if !services.QuotaAllows(opts.Limits.AllowedProtocols, spec.Protocol) {
+		return nil, fmt.Errorf("当前用户组不允许使用 %s 协议", spec.Protocol)
+	}
 
-	switch spec.Mode {
-	case "direct", "rr", "lb":
-	default:
-		return nil, fmt.Errorf("仅支持 direct、rr 或 lb")
+	if !services.IsRuleMode(spec.Mode) {
+		return nil, fmt.Errorf("转发模式仅支持 %s", strings.Join(services.RuleModes(), "、"))
+	}
+	if !services.QuotaAllows(opts.Limits.AllowedModes, spec.Mode) {
+		return nil, fmt.Errorf("当前用户组不允许使用 %s 转发模式", spec.Mode)
+	}
+	if opts.Limits.MaxTargetsPerRule > 0 && len(spec.Targets) > opts.Limits.MaxTargetsPerRule {
+		return nil, fmt.Errorf("每条规则最多 %d 个目标", opts.Limits.MaxTargetsPerRule)
 	}
 
 	enabledTargets := 0
+	priorities := make(map[int]struct{})
 	for _, target := range spec.Targets {
+		if target.Priority < 0 || target.Priority > services.MaxTargetPriority {
+			return nil, fmt.Errorf("目标优先级必须在 0-%d 之间", services.MaxTargetPriority)
+		}
 		if target.Enabled {
 			enabledTargets++
+			priorities[target.Priority] = struct{}{}
 		}
 	}
 	if enabledTargets == 0 {
 		return nil, fmt.Errorf("至少需要一个启用目标")
 	}
-	if spec.Mode == "direct" && enabledTargets != 1 {
+	if spec.Mode == services.RuleModeDirect && enabledTargets != 1 {
 		return nil, fmt.Errorf("direct 模式必须且只能有一个启用目标")
 	}
-	if spec.Mode != "direct" && enabledTargets < 2 {
+	if spec.Mode != services.RuleModeDirect && enabledTargets < 2 {
 		return nil, fmt.Errorf("%s 模式至少需要两个启用目标", spec.Mode)
 	}
+	if spec.Mode == services.RuleModeFailover && len(priorities) < 2 {
+		return nil, fmt.Errorf("failover 模式需要至少两个不同优先级的启用目标（主用与备用）")
+	}
+
+	if err := validateRuleLimit("上行限速", " kbps", spec.SpeedLimitUp, opts.Limits.MaxSpeedLimitUp, services.MaxSpeedLimit); err != nil {
+		return nil, err
+	}
+	if err := validateRuleLimit("下行限速", " kbps", spec.SpeedLimitDown, opts.Limits.MaxSpeedLimitDown, services.MaxSpeedLimit); err != nil {
+		return nil, err
+	}
+	if err := validateRuleLimit("最大连接数", "", spec.MaxConnections, opts.Limits.MaxConnections, services.MaxRuleConnections); err != nil {
+		return nil, err
+	}
+	if err := validateRuleLimit("每秒新建连接数", "", spec.ConnRateLimit, opts.Limits.MaxConnRate, services.MaxRuleConnRate); err != nil {
+		return nil, err
+	}
+	if err := validateRuleLimit("流量上限", " 字节", spec.TrafficLimit, opts.Limits.MaxTrafficLimit, math.MaxInt64); err != nil {
+		return nil, err
+	}
+	if spec.SpeedLimitUp == spec.SpeedLimitDown {
+		spec.SpeedLimit = spec.SpeedLimitUp
+	}
 
-	if spec.SpeedLimit > 0 {
-		return nil, fmt.Errorf("当前规则暂不支持限速")
+	// PROXY protocol v1 只能描述 TCP 连接；接收端仅支持 TCP 监听
+	switch spec.ProxyProtocol {
+	case 0, 2:
+	case 1:
+		if services.DirectProtocolNetwork(spec.Protocol) != "tcp" {
+			return nil, fmt.Errorf("PROXY protocol v1 仅支持 TCP 规则")
+		}
+	default:
+		return nil, fmt.Errorf("PROXY protocol 版本仅支持 1 或 2")
+	}
+	if spec.AcceptProxy && services.DirectProtocolNetwork(spec.Protocol) != "tcp" {
+		return nil, fmt.Errorf("仅 TCP 规则支持接收 PROXY protocol")
+	}
+
+	healthCheck, err := services.NormalizeHealthCheck(opts.HealthCheck, spec.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	spec.HealthCheck = healthCheck
+
+	schedule, err := services.NormalizeRuleSchedule(opts.Schedule)
+	if err != nil {
+		return nil, err
 	}
+	spec.Schedule = schedule
+
 	entryLayer4 := services.DirectProtocolNetwork(spec.Protocol)
 	for _, existing := range entryRules {
-		if existing.ID == currentRuleID || !existing.Enabled {
+		if (currentRuleID != 0 && existing.ID == currentRuleID) || !existing.Enabled {
 			continue
 		}
-		if existing.Port != spec.ListenPort {
+		port, overlaps := existing.overlap(spec.ListenPort, listenEnd)
+		if !overlaps || !services.ListenIPsOverlap(existing.IP, spec.ListenIP) {
 			continue
 		}
 		if existing.Layer4 == entryLayer4 {
-			return nil, fmt.Errorf("该节点端口 %d 的 %s 监听已存在", spec.ListenPort, strings.ToUpper(entryLayer4))
+			return nil, fmt.Errorf("该节点端口 %d 的 %s 监听已存在", port, strings.ToUpper(entryLayer4))
 		}
 	}
 
@@ -585,9 +1334,17 @@ func normalizeAndValidateRuleSpec(entryNode *models.Node, exitNode *models.Node,
 	if !services.IsTunnelProtocol(spec.TunnelProtocol) {
 		return nil, fmt.Errorf("不支持的隧道协议")
 	}
+	if !services.QuotaAllows(opts.Limits.AllowedProtocols, spec.TunnelProtocol) {
+		return nil, fmt.Errorf("当前用户组不允许使用 %s 隧道", spec.TunnelProtocol)
+	}
 	if spec.TunnelPort <= 0 || spec.TunnelPort > 65535 {
 		return nil, fmt.Errorf("隧道端口必须在 1-65535 之间")
 	}
+	if opts.TunnelPolicy != nil {
+		if err := opts.TunnelPolicy.Check(spec.TunnelPort); err != nil {
+			return nil, fmt.Errorf("出口节点隧道%w", err)
+		}
+	}
 	if !services.NodeSupportsTunnelProtocol([]string(entryNode.Protocols), spec.TunnelProtocol) {
 		return nil, fmt.Errorf("入口节点未声明支持 %s 隧道", spec.TunnelProtocol)
 	}
@@ -597,10 +1354,10 @@ func normalizeAndValidateRuleSpec(entryNode *models.Node, exitNode *models.Node,
 
 	exitLayer4 := services.TunnelProtocolNetwork(spec.TunnelProtocol)
 	for _, existing := range exitRules {
-		if existing.ID == currentRuleID || !existing.Enabled {
+		if (currentRuleID != 0 && existing.ID == currentRuleID) || !existing.Enabled {
 			continue
 		}
-		if existing.Port != spec.TunnelPort {
+		if _, overlaps := existing.overlap(spec.TunnelPort, spec.TunnelPort); !overlaps {
 			continue
 		}
 		if existing.Layer4 == exitLayer4 {
@@ -611,6 +1368,42 @@ func normalizeAndValidateRuleSpec(entryNode *models.Node, exitNode *models.Node,
 	return spec, nil
 }
 
+// validateRuleLimit 校验规则的限速、连接数等限制（0 表示不限制）。
+// 用户组或套餐设置了上限时，规则必须设置该限制且不能超过上限
+func validateRuleLimit(name, unit string, value, ceiling, maximum int64) error {
+	if value > maximum {
+		return fmt.Errorf("%s不能超过 %d%s", name, maximum, unit)
+	}
+	if ceiling > 0 && (value == 0 || value > ceiling) {
+		return fmt.Errorf("%s必须在 1-%d%s 之间", name, ceiling, unit)
+	}
+	return nil
+}
+
+// ruleQuotaError 检查在当前用量上再增加 rules 条规则、tunnelRules 条隧道规则后是否超出用户组的规则配额
+func ruleQuotaError(limits *services.RuleLimits, usage *services.RuleUsage, rules, tunnelRules int64) error {
+	if limits.MaxRules > 0 && rules > 0 && usage.Rules+rules > int64(limits.MaxRules) {
+		return &ruleRequestError{Status: http.StatusForbidden, Message: fmt.Sprintf("已达到规则数量上限（%d 条）", limits.MaxRules)}
+	}
+	if limits.MaxTunnelRules > 0 && tunnelRules > 0 && usage.TunnelRules+tunnelRules > int64(limits.MaxTunnelRules) {
+		return &ruleRequestError{Status: http.StatusForbidden, Message: fmt.Sprintf("已达到隧道规则数量上限（%d 条）", limits.MaxTunnelRules)}
+	}
+	return nil
+}
+
+// usedListenPorts 记录其他规则（包括已禁用的规则）在同一传输层、重叠监听地址上占用的端口，自动分配时避开
+func usedListenPorts(used map[int]struct{}, conflicts []existingRuleConflict, layer4, listenIP string, currentRuleID uint) map[int]struct{} {
+	for _, existing := range conflicts {
+		if existing.Layer4 != layer4 || !services.ListenIPsOverlap(existing.IP, listenIP) || (currentRuleID != 0 && existing.ID == currentRuleID) {
+			continue
+		}
+		for port := existing.Port; port <= max(existing.Port, existing.PortEnd); port++ {
+			used[port] = struct{}{}
+		}
+	}
+	return used
+}
+
 func (h *RuleHandler) loadRuleConflicts(nodeID uint) ([]existingRuleConflict, error) {
 	entryRules, err := h.ruleService.ListRulesByNode(nodeID, false)
 	if err != nil {
@@ -630,8 +1423,10 @@ func (h *RuleHandler) loadRuleConflicts(nodeID uint) ([]existingRuleConflict, er
 		out = append(out, existingRuleConflict{
 			ID:      rule.ID,
 			Port:    rule.ListenPort,
+			PortEnd: rule.ListenPortEnd,
 			Enabled: rule.Enabled,
 			Layer4:  services.DirectProtocolNetwork(ruleProtocol),
+			IP:      rule.ListenIP,
 		})
 	}
 	for _, rule := range exitRules {
@@ -680,10 +1475,11 @@ func sanitizeTargets(targets []TargetRequest) []TargetRequest {
 			weight = 1
 		}
 		out = append(out, TargetRequest{
-			Host:    host,
-			Port:    target.Port,
-			Weight:  weight,
-			Enabled: target.Enabled,
+			Host:     host,
+			Port:     target.Port,
+			Weight:   weight,
+			Priority: target.Priority,
+			Enabled:  target.Enabled,
 		})
 	}
 	return out
@@ -700,6 +1496,14 @@ func resolveRuleStateValues(enabled *bool, trafficLimit *int64, speedLimit *int6
 	return valueOrDefaultBool(enabled, fallbackEnabled), valueOrDefaultInt64(trafficLimit, fallbackTrafficLimit), valueOrDefaultInt64(speedLimit, fallbackSpeedLimit)
 }
 
+// resolveSpeedLimits 合并上下行限速参数：分别指定时优先，只指定 speed_limit 时上下行相同，都未指定时使用 fallback
+func resolveSpeedLimits(speedLimit, speedLimitUp, speedLimitDown *int64, fallbackUp, fallbackDown int64) (int64, int64) {
+	if speedLimitUp == nil && speedLimitDown == nil && speedLimit != nil {
+		return *speedLimit, *speedLimit
+	}
+	return valueOrDefaultInt64(speedLimitUp, fallbackUp), valueOrDefaultInt64(speedLimitDown, fallbackDown)
+}
+
 func valueOrDefaultBool(value *bool, fallback bool) bool {
 	if value == nil {
 		return fallback
@@ -721,6 +1525,20 @@ func valueOrDefaultInt64(value *int64, fallback int64) int64 {
 	return *value
 }
 
+func buildTargetModels(targets []TargetRequest) []models.Target {
+	out := make([]models.Target, 0, len(targets))
+	for _, t := range targets {
+		out = append(out, models.Target{
+			Host:     t.Host,
+			Port:     t.Port,
+			Weight:   t.Weight,
+			Priority: t.Priority,
+			Enabled:  t.Enabled,
+		})
+	}
+	return out
+}
+
 func coalesceTargets(incoming []TargetRequest, existing []models.Target) []TargetRequest {
 	if incoming != nil {
 		return incoming
@@ -728,10 +1546,11 @@ func coalesceTargets(incoming []TargetRequest, existing []models.Target) []Targe
 	out := make([]TargetRequest, 0, len(existing))
 	for _, target := range existing {
 		out = append(out, TargetRequest{
-			Host:    target.Host,
-			Port:    target.Port,
-			Weight:  target.Weight,
-			Enabled: target.Enabled,
+			Host:     target.Host,
+			Port:     target.Port,
+			Weight:   target.Weight,
+			Priority: target.Priority,
+			Enabled:  target.Enabled,
 		})
 	}
 	return out
@@ -744,6 +1563,13 @@ func maxInt64(minimum, value int64) int64 {
 	return value
 }
 
+func boolToInt64(value bool) int64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
 // CountRules 统计规则数量（管理员用）
 func (h *RuleHandler) CountRules(c *gin.Context) {
 	total := h.ruleService.CountAllRules()
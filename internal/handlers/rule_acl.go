@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"bakaray/internal/logger"
+	"bakaray/internal/middleware"
+	"bakaray/internal/models"
+	"bakaray/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RuleACLRequest 更新规则访问控制请求
+type RuleACLRequest struct {
+	Mode    string   `json:"mode"`    // allow, deny；为空表示关闭访问控制
+	Entries []string `json:"entries"` // IPv4/IPv6 地址或 CIDR
+}
+
+// ownedRule 读取当前用户的规则，不存在或无权访问时输出错误并返回 nil
+func (h *RuleHandler) ownedRule(c *gin.Context, userID uint) *models.ForwardingRule {
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+	rule, err := h.ruleService.GetRuleByID(uint(id))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "message": "规则不存在"})
+		return nil
+	}
+	if rule.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "message": "无权操作此规则"})
+		return nil
+	}
+	return rule
+}
+
+func ruleACLView(mode string, entries []string) gin.H {
+	if entries == nil {
+		entries = []string{}
+	}
+	return gin.H{
+		"mode":        mode,
+		"entries":     entries,
+		"max_entries": services.MaxRuleACLEntries,
+	}
+}
+
+// GetRuleACL 获取规则的来源地址访问控制
+func (h *RuleHandler) GetRuleACL(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "rule")
+
+	rule := h.ownedRule(c, userID)
+	if rule == nil {
+		return
+	}
+
+	log.Debug("GetRuleACL request", "rule_id", rule.ID)
+
+	c.JSON(http.StatusOK, gin.H{"code": 0, "data": ruleACLView(rule.ACLMode, rule.ACLEntries)})
+}
+
+// UpdateRuleACL 更新规则的来源地址访问控制
+func (h *RuleHandler) UpdateRuleACL(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "rule")
+
+	var req RuleACLRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		logger.Warn("UpdateRuleACL: invalid request", "error", err, "request_id", requestID, "user_id", userID)
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "参数错误"})
+		return
+	}
+
+	rule := h.ownedRule(c, userID)
+	if rule == nil {
+		return
+	}
+
+	mode, entries, err := services.NormalizeRuleACL(req.Mode, req.Entries)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+		return
+	}
+
+	if err := h.ruleService.UpdateRuleACL(rule.ID, mode, entries); err != nil {
+		logger.Error("UpdateRuleACL: update failed", err, "rule_id", rule.ID, "request_id", requestID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "更新失败"})
+		return
+	}
+
+	log.Info("UpdateRuleACL success", "rule_id", rule.ID, "mode", mode, "entries", len(entries))
+
+	c.JSON(http.StatusOK, gin.H{"code": 0, "message": "更新成功", "data": ruleACLView(mode, entries)})
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"bakaray/internal/logger"
+	"bakaray/internal/middleware"
+	"bakaray/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ImportNodeConfigRequest 从 gost/realm 配置导入规则的请求
+type ImportNodeConfigRequest struct {
+	Format     string `json:"format" binding:"required"`  // gost 或 realm
+	Content    string `json:"content" binding:"required"` // 配置文件内容
+	UserID     uint   `json:"user_id" binding:"required"` // 规则所属用户
+	NodeID     uint   `json:"node_id" binding:"required"` // 规则的入口节点
+	ExitNodeID uint   `json:"exit_node_id"`               // 由转发链转换出的隧道规则使用的出口节点
+	DryRun     bool   `json:"dry_run"`
+}
+
+// ImportNodeConfig 管理员将节点上原有的 gost v3 / realm 配置转换为指定用户在指定节点上的规则。
+// 无法转换的内容在 data.unsupported 中列出，不影响其余规则的导入。
+func (h *RuleHandler) ImportNodeConfig(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	adminID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, adminID, "rule")
+
+	var req ImportNodeConfigRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		logger.Warn("ImportNodeConfig: invalid request", "error", err, "request_id", requestID, "user_id", adminID)
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "参数错误"})
+		return
+	}
+	if len(req.Content) > maxRuleImportBytes {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": fmt.Sprintf("配置内容不能超过 %d MB", maxRuleImportBytes>>20)})
+		return
+	}
+	if _, err := h.userService.GetUserByID(req.UserID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "用户不存在"})
+		return
+	}
+
+	result, err := services.ParseNodeConfig(req.Format, []byte(req.Content))
+	if err != nil {
+		logger.Warn("ImportNodeConfig: parse failed", "error", err, "format", req.Format, "request_id", requestID, "user_id", adminID)
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+		return
+	}
+	if len(result.Rules) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "配置中没有可导入的规则", "data": gin.H{"unsupported": result.Unsupported}})
+		return
+	}
+	if len(result.Rules) > MaxRuleImportRows {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": fmt.Sprintf("单次最多导入 %d 条规则", MaxRuleImportRows)})
+		return
+	}
+
+	rows := make([]ruleImportRow, len(result.Rules))
+	for i, imported := range result.Rules {
+		rows[i] = importedRuleRow(&imported, req.NodeID, req.ExitNodeID)
+	}
+
+	log.Debug("ImportNodeConfig request", "format", req.Format, "owner_id", req.UserID, "node_id", req.NodeID, "rules", len(rows), "unsupported", len(result.Unsupported), "dry_run", req.DryRun)
+	h.applyRuleImport(c, "ImportNodeConfig", req.UserID, rows, req.DryRun, gin.H{"unsupported": result.Unsupported})
+}
+
+// importedRuleRow 将配置中转换出的规则落到指定的入口/出口节点上
+func importedRuleRow(imported *services.ImportedRule, nodeID, exitNodeID uint) ruleImportRow {
+	row := ruleImportRow{Req: CreateRuleRequest{
+		Name:          imported.Name,
+		NodeID:        nodeID,
+		Protocol:      imported.Protocol,
+		ListenPort:    imported.ListenPort,
+		ListenPortEnd: imported.ListenPortEnd,
+		Mode:          imported.Mode,
+		Targets:       make([]TargetRequest, len(imported.Targets)),
+	}}
+	for i, target := range imported.Targets {
+		row.Req.Targets[i] = TargetRequest{
+			Host:     target.Host,
+			Port:     target.Port,
+			Weight:   target.Weight,
+			Priority: target.Priority,
+			Enabled:  target.Enabled,
+		}
+	}
+	if imported.TunnelProtocol != "" {
+		if exitNodeID == 0 {
+			row.Err = errors.New(imported.Source + " 经转发链转发，需要指定 exit_node_id")
+		}
+		row.Req.TunnelEnabled = true
+		row.Req.ExitNodeID = exitNodeID
+		row.Req.TunnelProtocol = imported.TunnelProtocol
+		row.Req.TunnelPort = imported.TunnelPort
+	}
+	return row
+}
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"bakaray/internal/logger"
+	"bakaray/internal/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetRuleTargetHealth 获取规则各目标的健康状态
+func (h *RuleHandler) GetRuleTargetHealth(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "rule")
+
+	rule := h.ownedRule(c, userID)
+	if rule == nil {
+		return
+	}
+
+	log.Debug("GetRuleTargetHealth request", "rule_id", rule.ID)
+
+	targets, err := h.ruleService.RuleTargetHealth(rule, time.Now())
+	if err != nil {
+		logger.Error("GetRuleTargetHealth: query failed", err, "rule_id", rule.ID, "request_id", requestID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "获取健康状态失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 0,
+		"data": gin.H{
+			"health_check": rule.HealthCheck,
+			"targets":      targets,
+		},
+	})
+}
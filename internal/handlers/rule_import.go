@@ -0,0 +1,701 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bakaray/internal/logger"
+	"bakaray/internal/middleware"
+	"bakaray/internal/models"
+	"bakaray/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// 批量导入限制
+const (
+	MaxRuleImportRows  = 1000
+	maxRuleImportBytes = 4 << 20
+)
+
+// 导入导出格式
+const (
+	ruleFormatJSON = "json"
+	ruleFormatCSV  = "csv"
+)
+
+// RuleImportRowResult 导入单行的校验或保存结果
+type RuleImportRowResult struct {
+	Row    int    `json:"row"` // 从 1 开始，CSV 不含表头行
+	Name   string `json:"name"`
+	ID     uint   `json:"id,omitempty"` // 实际导入后的规则 ID
+	NodeID uint   `json:"node_id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ruleImportRow 解析后的一行，解析失败时 Err 不为空
+type ruleImportRow struct {
+	Req CreateRuleRequest
+	Err error
+}
+
+// ExportRules 导出当前用户的全部规则，format 为 json（默认）或 csv，导出内容可直接用于导入
+func (h *RuleHandler) ExportRules(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "rule")
+
+	format := strings.ToLower(c.DefaultQuery("format", ruleFormatJSON))
+	if format != ruleFormatJSON && format != ruleFormatCSV {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "format 仅支持 json 或 csv"})
+		return
+	}
+
+	rules, err := h.ruleService.ListAllRulesByUser(userID)
+	if err != nil {
+		logger.Error("ExportRules: list rules failed", err, "user_id", userID, "request_id", requestID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "导出失败"})
+		return
+	}
+
+	items := make([]CreateRuleRequest, 0, len(rules))
+	for i := range rules {
+		targets, err := h.ruleService.ListTargets(rules[i].ID, false)
+		if err != nil {
+			logger.Error("ExportRules: list targets failed", err, "rule_id", rules[i].ID, "request_id", requestID)
+			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "导出失败"})
+			return
+		}
+		items = append(items, exportRuleRequest(&rules[i], targets))
+	}
+
+	filename := fmt.Sprintf("rules-%s.%s", time.Now().Format("20060102150405"), format)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+
+	log.Info("ExportRules success", "format", format, "rules_count", len(items))
+
+	if format == ruleFormatCSV {
+		var buf bytes.Buffer
+		if err := writeRuleCSV(&buf, items); err != nil {
+			logger.Error("ExportRules: write csv failed", err, "request_id", requestID)
+			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "导出失败"})
+			return
+		}
+		c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+		return
+	}
+	c.JSON(http.StatusOK, items)
+}
+
+// ImportRules 批量导入规则。请求体为导出的 JSON 数组或 CSV，format 未指定时按 Content-Type 判断。
+// 每一行都按创建规则的流程校验（含端口冲突，同批次内的规则也互相检查）；
+// dry_run=true 时只返回逐行校验结果；否则任一行无效时不导入任何规则，全部有效时在同一事务中创建。
+func (h *RuleHandler) ImportRules(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "rule")
+
+	format := strings.ToLower(c.Query("format"))
+	if format == "" {
+		format = ruleFormatJSON
+		if strings.Contains(c.ContentType(), "csv") {
+			format = ruleFormatCSV
+		}
+	}
+	dryRun, _ := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxRuleImportBytes))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": fmt.Sprintf("读取请求失败，导入内容不能超过 %d MB", maxRuleImportBytes>>20)})
+		return
+	}
+
+	var rows []ruleImportRow
+	switch format {
+	case ruleFormatJSON:
+		rows, err = parseRuleJSON(body)
+	case ruleFormatCSV:
+		rows, err = parseRuleCSV(bytes.NewReader(body))
+	default:
+		err = errors.New("format 仅支持 json 或 csv")
+	}
+	if err == nil && len(rows) == 0 {
+		err = errors.New("没有可导入的规则")
+	}
+	if err == nil && len(rows) > MaxRuleImportRows {
+		err = fmt.Errorf("单次最多导入 %d 条规则", MaxRuleImportRows)
+	}
+	if err != nil {
+		logger.Warn("ImportRules: invalid request", "error", err, "format", format, "request_id", requestID, "user_id", userID)
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+		return
+	}
+
+	log.Debug("ImportRules request", "format", format, "rows", len(rows), "dry_run", dryRun)
+	h.applyRuleImport(c, "ImportRules", userID, rows, dryRun, nil)
+}
+
+// applyRuleImport 以 userID 的身份逐行校验规则，全部有效且非 dry run 时在一个事务中创建；
+// 任一行无效时不导入任何规则。extra 会合并到响应的 data 中。
+func (h *RuleHandler) applyRuleImport(c *gin.Context, action string, userID uint, rows []ruleImportRow, dryRun bool, extra gin.H) {
+	requestID := c.GetString("request_id")
+	log := logger.WithContext(requestID, middleware.GetUserID(c), "rule")
+
+	limits, err := h.ruleService.RuleLimitsForUser(userID)
+	if err != nil {
+		logger.Error(action+": load rule limits failed", err, "user_id", userID, "request_id", requestID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "读取用户限制失败"})
+		return
+	}
+	exhausted := h.trafficBalanceExhausted(userID)
+
+	h.portMu.Lock()
+	defer h.portMu.Unlock()
+
+	// 同批次通过校验的规则累加到用量中，超出用户组配额的行校验失败
+	usage, err := h.ruleService.RuleUsageForUser(userID)
+	if err != nil {
+		logger.Error(action+": load rule usage failed", err, "user_id", userID, "request_id", requestID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "读取规则用量失败"})
+		return
+	}
+
+	results := make([]RuleImportRowResult, len(rows))
+	rules := make([]*models.ForwardingRule, 0, len(rows))
+	targets := make([][]models.Target, 0, len(rows))
+	ruleRows := make([]int, 0, len(rows))
+	pending := make(map[uint][]existingRuleConflict)
+	failed := 0
+	for i, row := range rows {
+		results[i] = RuleImportRowResult{Row: i + 1, Name: row.Req.Name}
+		err := row.Err
+		if err == nil {
+			err = binding.Validator.ValidateStruct(&row.Req)
+		}
+		var placement *rulePlacement
+		if err == nil {
+			draft := createRuleDraft(&row.Req, limits)
+			draft.Pending = pending
+			draft.DryRun = dryRun
+			placement, err = h.resolveRulePlacement(userID, draft, 0)
+		}
+		if err == nil {
+			err = ruleQuotaError(limits, usage, 1, boolToInt64(placement.Spec.TunnelEnabled))
+		}
+		if err == nil {
+			err = h.reservePendingListeners(pending, placement)
+		}
+		if err != nil {
+			results[i].Error = err.Error()
+			failed++
+			continue
+		}
+		usage.Rules++
+		usage.TunnelRules += boolToInt64(placement.Spec.TunnelEnabled)
+
+		rule := newRuleModel(userID, row.Req.Name, placement)
+		if reason := services.RuleScheduleReason(rule, time.Now()); rule.Enabled && reason != "" {
+			rule.Enabled = false
+			rule.DisabledReason = reason
+		} else if rule.Enabled && exhausted {
+			rule.Enabled = false
+			rule.DisabledReason = services.RuleDisabledBalanceExhausted
+		}
+		results[i].NodeID = rule.NodeID
+		rules = append(rules, rule)
+		targets = append(targets, buildTargetModels(placement.Spec.Targets))
+		ruleRows = append(ruleRows, i)
+	}
+
+	data := gin.H{
+		"dry_run": dryRun,
+		"total":   len(rows),
+		"valid":   len(rows) - failed,
+		"failed":  failed,
+		"rows":    results,
+	}
+	for key, value := range extra {
+		data[key] = value
+	}
+	if failed > 0 && !dryRun {
+		log.Info(action+" rejected", "rows", len(rows), "failed", failed)
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": fmt.Sprintf("%d 条规则校验失败，未导入任何规则", failed), "data": data})
+		return
+	}
+	if dryRun {
+		log.Info(action+" dry run", "rows", len(rows), "failed", failed)
+		c.JSON(http.StatusOK, gin.H{"code": 0, "message": "校验完成", "data": data})
+		return
+	}
+
+	if err := h.ruleService.CreateRulesWithTargets(rules, targets); err != nil {
+		logger.Error(action+": create rules failed", err, "user_id", userID, "request_id", requestID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "导入失败，未导入任何规则"})
+		return
+	}
+	for i, rule := range rules {
+		results[ruleRows[i]].ID = rule.ID
+	}
+
+	log.Info(action+" success", "rules_count", len(rules))
+
+	message := "导入成功"
+	if exhausted {
+		message = "导入成功，流量余额不足，规则将在购买流量后自动启用"
+	}
+	c.JSON(http.StatusOK, gin.H{"code": 0, "message": message, "data": data})
+}
+
+// reservePendingListeners 记录已通过校验的规则将占用的监听，供同批次后续规则检查端口冲突
+func (h *RuleHandler) reservePendingListeners(pending map[uint][]existingRuleConflict, placement *rulePlacement) error {
+	spec := placement.Spec
+	if !spec.Enabled {
+		return nil
+	}
+
+	entryIDs := []uint{placement.NodeID}
+	if placement.Placement == services.RulePlacementAll {
+		members, err := h.nodeGroupService.ListMembers(placement.NodeGroupID)
+		if err != nil {
+			return errors.New("读取节点组成员失败")
+		}
+		entryIDs = entryIDs[:0]
+		for _, member := range members {
+			entryIDs = append(entryIDs, member.ID)
+		}
+	}
+	for _, nodeID := range entryIDs {
+		pending[nodeID] = append(pending[nodeID], existingRuleConflict{
+			Port:    spec.ListenPort,
+			PortEnd: spec.ListenPortEnd,
+			Enabled: true,
+			Layer4:  services.DirectProtocolNetwork(spec.Protocol),
+			IP:      spec.ListenIP,
+		})
+	}
+	if spec.TunnelEnabled {
+		pending[spec.ExitNodeID] = append(pending[spec.ExitNodeID], existingRuleConflict{
+			Port:    spec.TunnelPort,
+			Enabled: true,
+			Layer4:  services.TunnelProtocolNetwork(spec.TunnelProtocol),
+		})
+	}
+	return nil
+}
+
+// exportRuleRequest 将已有规则转换为创建请求，导入时得到相同的规则
+func exportRuleRequest(rule *models.ForwardingRule, targets []models.Target) CreateRuleRequest {
+	speedUp, speedDown := services.RuleSpeedLimits(rule)
+	req := CreateRuleRequest{
+		Name:           rule.Name,
+		NodeID:         rule.NodeID,
+		NodeGroupID:    rule.NodeGroupID,
+		Placement:      rule.Placement,
+		Protocol:       services.NormalizeProtocol(rule.Protocol),
+		ListenPort:     rule.ListenPort,
+		Enabled:        &rule.Enabled,
+		TrafficLimit:   &rule.TrafficLimit,
+		SpeedLimitUp:   &speedUp,
+		SpeedLimitDown: &speedDown,
+		MaxConnections: &rule.MaxConnections,
+		ConnRateLimit:  &rule.ConnRateLimit,
+		ProxyProtocol:  &rule.ProxyProtocol,
+		AcceptProxy:    &rule.AcceptProxy,
+		Mode:           rule.Mode,
+		Targets:        make([]TargetRequest, 0, len(targets)),
+		TunnelEnabled:  rule.TunnelEnabled,
+		ExitNodeID:     rule.ExitNodeID,
+		ExitGroupID:    rule.ExitGroupID,
+		TunnelProtocol: rule.TunnelProtocol,
+		TunnelPort:     rule.TunnelPort,
+	}
+	req.ListenPortEnd = rule.ListenPortEnd
+	req.ListenIP = rule.ListenIP
+	if rule.HealthCheck.Type != "" {
+		hc := rule.HealthCheck
+		req.HealthCheck = &hc
+	}
+	if schedule := rule.Schedule; schedule.StartsAt != nil || schedule.ExpiresAt != nil || len(schedule.Windows) > 0 {
+		req.Schedule = &schedule
+	}
+	for _, t := range targets {
+		req.Targets = append(req.Targets, TargetRequest{
+			Host:     t.Host,
+			Port:     t.Port,
+			Weight:   t.Weight,
+			Priority: t.Priority,
+			Enabled:  t.Enabled,
+		})
+	}
+	return req
+}
+
+// parseRuleJSON 解析 JSON 数组，单个元素格式错误只影响该行
+func parseRuleJSON(body []byte) ([]ruleImportRow, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(body, &items); err != nil {
+		return nil, errors.New("JSON 格式错误，需要规则数组")
+	}
+	rows := make([]ruleImportRow, len(items))
+	for i, item := range items {
+		if err := json.Unmarshal(item, &rows[i].Req); err != nil {
+			rows[i].Err = fmt.Errorf("JSON 格式错误: %v", err)
+		}
+	}
+	return rows, nil
+}
+
+// ruleCSVColumn CSV 的一列及其与创建请求字段的对应关系
+type ruleCSVColumn struct {
+	Name string
+	Get  func(req *CreateRuleRequest) string
+	Set  func(req *CreateRuleRequest, value string) error
+}
+
+// ruleCSVColumns CSV 列定义，导出时按此顺序输出；导入时按表头匹配，可省略可选列。
+// targets 列中多个目标以 ";" 分隔，单个目标为 host:port，可追加 ",w=权重"、",p=优先级"、",off"（禁用）
+var ruleCSVColumns = []ruleCSVColumn{
+	{"name", func(r *CreateRuleRequest) string { return r.Name }, func(r *CreateRuleRequest, v string) error { r.Name = v; return nil }},
+	{"node_id", func(r *CreateRuleRequest) string { return formatCSVUint(r.NodeID) }, func(r *CreateRuleRequest, v string) error { return parseCSVUint(v, &r.NodeID) }},
+	{"node_group_id", func(r *CreateRuleRequest) string { return formatCSVUint(r.NodeGroupID) }, func(r *CreateRuleRequest, v string) error { return parseCSVUint(v, &r.NodeGroupID) }},
+	{"placement", func(r *CreateRuleRequest) string { return r.Placement }, func(r *CreateRuleRequest, v string) error { r.Placement = v; return nil }},
+	{"protocol", func(r *CreateRuleRequest) string { return r.Protocol }, func(r *CreateRuleRequest, v string) error { r.Protocol = v; return nil }},
+	{"listen_port", func(r *CreateRuleRequest) string { return strconv.Itoa(r.ListenPort) }, func(r *CreateRuleRequest, v string) error { return parseCSVPort(v, &r.ListenPort, &r.AutoListenPort) }},
+	{"listen_port_end", func(r *CreateRuleRequest) string { return formatCSVInt(r.ListenPortEnd) }, func(r *CreateRuleRequest, v string) error { return parseCSVInt(v, &r.ListenPortEnd) }},
+	{"listen_ip", func(r *CreateRuleRequest) string { return r.ListenIP }, func(r *CreateRuleRequest, v string) error { r.ListenIP = v; return nil }},
+	{"enabled", func(r *CreateRuleRequest) string { return formatCSVBoolPtr(r.Enabled) }, func(r *CreateRuleRequest, v string) error { return parseCSVBoolPtr(v, &r.Enabled) }},
+	{"traffic_limit", func(r *CreateRuleRequest) string { return formatCSVInt64Ptr(r.TrafficLimit) }, func(r *CreateRuleRequest, v string) error { return parseCSVInt64Ptr(v, &r.TrafficLimit) }},
+	{"speed_limit_up", func(r *CreateRuleRequest) string { return formatCSVInt64Ptr(r.SpeedLimitUp) }, func(r *CreateRuleRequest, v string) error { return parseCSVInt64Ptr(v, &r.SpeedLimitUp) }},
+	{"speed_limit_down", func(r *CreateRuleRequest) string { return formatCSVInt64Ptr(r.SpeedLimitDown) }, func(r *CreateRuleRequest, v string) error { return parseCSVInt64Ptr(v, &r.SpeedLimitDown) }},
+	{"max_connections", func(r *CreateRuleRequest) string { return formatCSVInt64Ptr(r.MaxConnections) }, func(r *CreateRuleRequest, v string) error { return parseCSVInt64Ptr(v, &r.MaxConnections) }},
+	{"conn_rate_limit", func(r *CreateRuleRequest) string { return formatCSVInt64Ptr(r.ConnRateLimit) }, func(r *CreateRuleRequest, v string) error { return parseCSVInt64Ptr(v, &r.ConnRateLimit) }},
+	{"proxy_protocol", func(r *CreateRuleRequest) string { return formatCSVIntPtr(r.ProxyProtocol) }, func(r *CreateRuleRequest, v string) error { return parseCSVIntPtr(v, &r.ProxyProtocol) }},
+	{"accept_proxy_protocol", func(r *CreateRuleRequest) string { return formatCSVBoolPtr(r.AcceptProxy) }, func(r *CreateRuleRequest, v string) error { return parseCSVBoolPtr(v, &r.AcceptProxy) }},
+	{"mode", func(r *CreateRuleRequest) string { return r.Mode }, func(r *CreateRuleRequest, v string) error { r.Mode = v; return nil }},
+	{"targets", func(r *CreateRuleRequest) string { return formatCSVTargets(r.Targets) }, func(r *CreateRuleRequest, v string) (err error) { r.Targets, err = parseCSVTargets(v); return err }},
+	{"tunnel_enabled", func(r *CreateRuleRequest) string { return strconv.FormatBool(r.TunnelEnabled) }, func(r *CreateRuleRequest, v string) error { return parseCSVBool(v, &r.TunnelEnabled) }},
+	{"exit_node_id", func(r *CreateRuleRequest) string { return formatCSVUint(r.ExitNodeID) }, func(r *CreateRuleRequest, v string) error { return parseCSVUint(v, &r.ExitNodeID) }},
+	{"exit_group_id", func(r *CreateRuleRequest) string { return formatCSVUint(r.ExitGroupID) }, func(r *CreateRuleRequest, v string) error { return parseCSVUint(v, &r.ExitGroupID) }},
+	{"tunnel_protocol", func(r *CreateRuleRequest) string { return r.TunnelProtocol }, func(r *CreateRuleRequest, v string) error { r.TunnelProtocol = v; return nil }},
+	{"tunnel_port", func(r *CreateRuleRequest) string { return formatCSVInt(r.TunnelPort) }, func(r *CreateRuleRequest, v string) error { return parseCSVPort(v, &r.TunnelPort, &r.AutoTunnelPort) }},
+	{"health_check_type", func(r *CreateRuleRequest) string { return csvHealthCheck(r).Type }, func(r *CreateRuleRequest, v string) error { ensureHealthCheck(r).Type = v; return nil }},
+	{"health_check_interval", func(r *CreateRuleRequest) string { return formatCSVInt(csvHealthCheck(r).Interval) }, func(r *CreateRuleRequest, v string) error { return parseCSVInt(v, &ensureHealthCheck(r).Interval) }},
+	{"health_check_timeout", func(r *CreateRuleRequest) string { return formatCSVInt(csvHealthCheck(r).Timeout) }, func(r *CreateRuleRequest, v string) error { return parseCSVInt(v, &ensureHealthCheck(r).Timeout) }},
+	{"health_check_rise", func(r *CreateRuleRequest) string { return formatCSVInt(csvHealthCheck(r).Rise) }, func(r *CreateRuleRequest, v string) error { return parseCSVInt(v, &ensureHealthCheck(r).Rise) }},
+	{"health_check_fall", func(r *CreateRuleRequest) string { return formatCSVInt(csvHealthCheck(r).Fall) }, func(r *CreateRuleRequest, v string) error { return parseCSVInt(v, &ensureHealthCheck(r).Fall) }},
+	{"health_check_auto_remove", func(r *CreateRuleRequest) string { return formatCSVBool(csvHealthCheck(r).AutoRemove) }, func(r *CreateRuleRequest, v string) error { return parseCSVBool(v, &ensureHealthCheck(r).AutoRemove) }},
+	{"schedule_starts_at", func(r *CreateRuleRequest) string { return formatCSVTime(csvSchedule(r).StartsAt) }, func(r *CreateRuleRequest, v string) error { return parseCSVTime(v, &ensureSchedule(r).StartsAt) }},
+	{"schedule_expires_at", func(r *CreateRuleRequest) string { return formatCSVTime(csvSchedule(r).ExpiresAt) }, func(r *CreateRuleRequest, v string) error { return parseCSVTime(v, &ensureSchedule(r).ExpiresAt) }},
+	{"schedule_windows", func(r *CreateRuleRequest) string { return strings.Join(csvSchedule(r).Windows, ";") }, func(r *CreateRuleRequest, v string) error { return parseCSVList(v, &ensureSchedule(r).Windows) }},
+	{"schedule_timezone", func(r *CreateRuleRequest) string { return csvSchedule(r).Timezone }, func(r *CreateRuleRequest, v string) error { ensureSchedule(r).Timezone = v; return nil }},
+}
+
+// writeRuleCSV 按 ruleCSVColumns 输出带表头的 CSV
+func writeRuleCSV(w io.Writer, items []CreateRuleRequest) error {
+	cw := csv.NewWriter(w)
+	header := make([]string, len(ruleCSVColumns))
+	for i, col := range ruleCSVColumns {
+		header[i] = col.Name
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for i := range items {
+		record := make([]string, len(ruleCSVColumns))
+		for j, col := range ruleCSVColumns {
+			record[j] = col.Get(&items[i])
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// parseRuleCSV 解析带表头的 CSV，空单元格视为未指定；单行的取值错误只影响该行
+func parseRuleCSV(r io.Reader) ([]ruleImportRow, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("CSV 格式错误: %v", err)
+	}
+
+	byName := make(map[string]ruleCSVColumn, len(ruleCSVColumns))
+	for _, col := range ruleCSVColumns {
+		byName[col.Name] = col
+	}
+	columns := make([]ruleCSVColumn, len(header))
+	seen := make(map[string]bool, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		col, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("未知的 CSV 列: %s", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("CSV 列重复: %s", name)
+		}
+		seen[name] = true
+		columns[i] = col
+	}
+	for _, required := range []string{"name", "protocol", "listen_port", "targets"} {
+		if !seen[required] {
+			return nil, fmt.Errorf("CSV 缺少必需的列: %s", required)
+		}
+	}
+
+	var rows []ruleImportRow
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("CSV 格式错误: %v", err)
+		}
+		var row ruleImportRow
+		for i, value := range record {
+			value = strings.TrimSpace(value)
+			if value == "" {
+				continue
+			}
+			if err := columns[i].Set(&row.Req, value); err != nil {
+				row.Err = fmt.Errorf("%s: %v", columns[i].Name, err)
+				break
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// formatCSVTargets 按 targets 列的格式输出目标，权重为 1、优先级为 0 时省略
+func formatCSVTargets(targets []TargetRequest) string {
+	parts := make([]string, 0, len(targets))
+	for _, t := range targets {
+		part := net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+		if t.Weight > 1 {
+			part += ",w=" + strconv.Itoa(t.Weight)
+		}
+		if t.Priority != 0 {
+			part += ",p=" + strconv.Itoa(t.Priority)
+		}
+		if !t.Enabled {
+			part += ",off"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ";")
+}
+
+// parseCSVTargets 解析 targets 列，IPv6 地址需写成 [addr]:port
+func parseCSVTargets(value string) ([]TargetRequest, error) {
+	var targets []TargetRequest
+	for _, part := range strings.Split(value, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		fields := strings.Split(part, ",")
+		host, portText, err := net.SplitHostPort(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return nil, fmt.Errorf("目标 %s 格式错误，应为 host:port", fields[0])
+		}
+		port, err := strconv.Atoi(portText)
+		if err != nil {
+			return nil, fmt.Errorf("目标 %s 端口无效", fields[0])
+		}
+		target := TargetRequest{Host: host, Port: port, Weight: 1, Enabled: true}
+		for _, option := range fields[1:] {
+			option = strings.TrimSpace(option)
+			key, val, _ := strings.Cut(option, "=")
+			switch key {
+			case "w":
+				target.Weight, err = strconv.Atoi(val)
+			case "p":
+				target.Priority, err = strconv.Atoi(val)
+			case "off":
+				target.Enabled = false
+			default:
+				err = errors.New("unknown option")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("目标 %s 的选项 %s 无效", fields[0], option)
+			}
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+func csvHealthCheck(req *CreateRuleRequest) models.HealthCheck {
+	if req.HealthCheck == nil {
+		return models.HealthCheck{}
+	}
+	return *req.HealthCheck
+}
+
+func ensureHealthCheck(req *CreateRuleRequest) *models.HealthCheck {
+	if req.HealthCheck == nil {
+		req.HealthCheck = &models.HealthCheck{}
+	}
+	return req.HealthCheck
+}
+
+func csvSchedule(req *CreateRuleRequest) models.RuleSchedule {
+	if req.Schedule == nil {
+		return models.RuleSchedule{}
+	}
+	return *req.Schedule
+}
+
+func ensureSchedule(req *CreateRuleRequest) *models.RuleSchedule {
+	if req.Schedule == nil {
+		req.Schedule = &models.RuleSchedule{}
+	}
+	return req.Schedule
+}
+
+func formatCSVTime(value *time.Time) string {
+	if value == nil {
+		return ""
+	}
+	return value.UTC().Format(time.RFC3339)
+}
+
+// parseCSVList 解析以 ";" 分隔的列表
+func parseCSVList(value string, target *models.StringSlice) error {
+	*target = strings.Split(value, ";")
+	return nil
+}
+
+// parseCSVTime 解析 RFC 3339 时间，如 2026-10-01T20:00:00+08:00
+func parseCSVTime(value string, target **time.Time) error {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return errors.New("时间格式应为 RFC 3339，如 2026-10-01T20:00:00+08:00")
+	}
+	*target = &parsed
+	return nil
+}
+
+func formatCSVUint(value uint) string {
+	if value == 0 {
+		return ""
+	}
+	return strconv.FormatUint(uint64(value), 10)
+}
+
+func formatCSVInt(value int) string {
+	if value == 0 {
+		return ""
+	}
+	return strconv.Itoa(value)
+}
+
+func formatCSVBool(value bool) string {
+	if !value {
+		return ""
+	}
+	return "true"
+}
+
+func formatCSVIntPtr(value *int) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.Itoa(*value)
+}
+
+func formatCSVInt64Ptr(value *int64) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatInt(*value, 10)
+}
+
+func formatCSVBoolPtr(value *bool) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatBool(*value)
+}
+
+func parseCSVUint(value string, out *uint) error {
+	n, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return errors.New("需要非负整数")
+	}
+	*out = uint(n)
+	return nil
+}
+
+func parseCSVInt(value string, out *int) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return errors.New("需要整数")
+	}
+	*out = n
+	return nil
+}
+
+// parseCSVPort 解析端口列，auto 表示自动分配
+func parseCSVPort(value string, out *int, auto *bool) error {
+	if strings.EqualFold(strings.TrimSpace(value), "auto") {
+		*auto = true
+		return nil
+	}
+	return parseCSVInt(value, out)
+}
+
+func parseCSVBool(value string, out *bool) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return errors.New("需要 true 或 false")
+	}
+	*out = b
+	return nil
+}
+
+func parseCSVIntPtr(value string, out **int) error {
+	var n int
+	if err := parseCSVInt(value, &n); err != nil {
+		return err
+	}
+	*out = &n
+	return nil
+}
+
+func parseCSVInt64Ptr(value string, out **int64) error {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return errors.New("需要整数")
+	}
+	*out = &n
+	return nil
+}
+
+func parseCSVBoolPtr(value string, out **bool) error {
+	var b bool
+	if err := parseCSVBool(value, &b); err != nil {
+		return err
+	}
+	*out = &b
+	return nil
+}
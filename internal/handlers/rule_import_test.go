@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"bakaray/internal/middleware"
+	"bakaray/internal/models"
+	"bakaray/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestRuleCSVTargets(t *testing.T) {
+	targets := []TargetRequest{
+		{Host: "10.0.0.1", Port: 80, Weight: 1, Enabled: true},
+		{Host: "2001:db8::1", Port: 443, Weight: 3, Priority: 1, Enabled: false},
+	}
+	value := formatCSVTargets(targets)
+	require.Equal(t, "10.0.0.1:80;[2001:db8::1]:443,w=3,p=1,off", value)
+
+	parsed, err := parseCSVTargets(value)
+	require.NoError(t, err)
+	require.Equal(t, targets, parsed)
+
+	for _, invalid := range []string{"10.0.0.1", "10.0.0.1:http", "10.0.0.1:80,w=x", "10.0.0.1:80,backup"} {
+		_, err := parseCSVTargets(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestImportExportRules(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	dsn := fmt.Sprintf("file:%s-%d?mode=memory&cache=shared", strings.ReplaceAll(t.Name(), "/", "_"), time.Now().UnixNano())
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(
+		&models.User{},
+		&models.UserGroup{},
+		&models.Package{},
+		&models.Order{},
+		&models.Node{},
+		&models.NodeAllowedGroup{},
+		&models.ForwardingRule{},
+		&models.Target{},
+		&models.DestinationPolicy{},
+		&models.ListenPortReservation{},
+	))
+
+	group := &models.UserGroup{Name: "default"}
+	require.NoError(t, db.Create(group).Error)
+	user := &models.User{Username: "importer", PasswordHash: "x", Role: "user", UserGroupID: group.ID, TrafficBalance: 1 << 30}
+	require.NoError(t, db.Create(user).Error)
+	node := &models.Node{Name: "import-node", Host: "10.0.0.1", Secret: "s", Protocols: services.NormalizeNodeProtocols(nil)}
+	require.NoError(t, db.Create(node).Error)
+	require.NoError(t, db.Create(&models.NodeAllowedGroup{NodeID: node.ID, UserGroupID: group.ID}).Error)
+
+	ruleService := services.NewRuleService(db, nil)
+	handler := NewRuleHandler(ruleService, services.NewNodeService(db, nil), services.NewUserService(db, nil), services.NewNodeGroupService(db), nil)
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set(middleware.UserIDKey, user.ID)
+		c.Next()
+	})
+	router.GET("/rules/export", handler.ExportRules)
+	router.POST("/rules/import", handler.ImportRules)
+	router.POST("/admin/rules/import-config", handler.ImportNodeConfig)
+
+	doImport := func(query, contentType, body string) (*httptest.ResponseRecorder, []RuleImportRowResult) {
+		req := httptest.NewRequest(http.MethodPost, "/rules/import"+query, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var resp struct {
+			Data struct {
+				Rows []RuleImportRowResult `json:"rows"`
+			} `json:"data"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		return w, resp.Data.Rows
+	}
+	countRules := func() int64 {
+		var count int64
+		require.NoError(t, db.Model(&models.ForwardingRule{}).Count(&count).Error)
+		return count
+	}
+
+	csvBody := fmt.Sprintf("name,node_id,protocol,listen_port,mode,targets\n"+
+		"web,%[1]d,tcp,8080,rr,10.0.0.10:80;10.0.0.11:80\n"+
+		"dup,%[1]d,tcp,8080,direct,10.0.0.12:80\n"+
+		"dns,%[1]d,udp,8080,direct,10.0.0.53:53\n"+
+		"bad,%[1]d,tcp,abc,direct,10.0.0.13:80\n", node.ID)
+
+	t.Run("dry run 返回逐行结果且不写入", func(t *testing.T) {
+		w, rows := doImport("?dry_run=true", "text/csv", csvBody)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Len(t, rows, 4)
+		require.Empty(t, rows[0].Error)
+		require.Contains(t, rows[1].Error, "8080")
+		require.Empty(t, rows[2].Error, "UDP 与 TCP 监听同一端口不冲突")
+		require.Contains(t, rows[3].Error, "listen_port")
+		require.Zero(t, countRules())
+	})
+
+	t.Run("dry run 自动分配端口时不写入预留", func(t *testing.T) {
+		body := fmt.Sprintf("name,node_id,protocol,listen_port,mode,targets\nauto,%d,tcp,auto,direct,10.0.0.14:80\n", node.ID)
+		w, rows := doImport("?dry_run=true", "text/csv", body)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Len(t, rows, 1)
+		require.Empty(t, rows[0].Error)
+		var count int64
+		require.NoError(t, db.Model(&models.ListenPortReservation{}).Count(&count).Error)
+		require.Zero(t, count)
+	})
+
+	t.Run("存在无效行时不导入任何规则", func(t *testing.T) {
+		w, _ := doImport("", "text/csv", csvBody)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		require.Zero(t, countRules())
+	})
+
+	t.Run("全部有效时导入并可导出", func(t *testing.T) {
+		body, _ := json.Marshal([]gin.H{
+			{"name": "a", "node_id": node.ID, "protocol": "tcp", "listen_port": 9001, "mode": "direct", "targets": []gin.H{{"host": "10.0.0.20", "port": 80, "enabled": true}}},
+			{"name": "b", "node_id": node.ID, "protocol": "tcp", "listen_port": 9002, "mode": "failover", "health_check": gin.H{"type": "tcp"}, "targets": []gin.H{
+				{"host": "10.0.0.21", "port": 80, "enabled": true},
+				{"host": "10.0.0.22", "port": 80, "priority": 1, "enabled": true},
+				{"host": "10.0.0.23", "port": 80, "enabled": false},
+			}},
+		})
+		w, rows := doImport("", "application/json", string(body))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Len(t, rows, 2)
+		require.NotZero(t, rows[0].ID)
+		require.NotZero(t, rows[1].ID)
+		require.EqualValues(t, 2, countRules())
+
+		req := httptest.NewRequest(http.MethodGet, "/rules/export?format=csv", nil)
+		exported := httptest.NewRecorder()
+		router.ServeHTTP(exported, req)
+		require.Equal(t, http.StatusOK, exported.Code)
+		require.Contains(t, exported.Header().Get("Content-Disposition"), "attachment")
+
+		parsed, err := parseRuleCSV(bytes.NewReader(exported.Body.Bytes()))
+		require.NoError(t, err)
+		require.Len(t, parsed, 2)
+		require.NoError(t, parsed[1].Err)
+		require.Equal(t, "b", parsed[1].Req.Name)
+		require.Equal(t, services.RuleModeFailover, parsed[1].Req.Mode)
+		require.Equal(t, services.HealthCheckTCP, parsed[1].Req.HealthCheck.Type)
+		require.Len(t, parsed[1].Req.Targets, 3)
+		require.False(t, parsed[1].Req.Targets[2].Enabled)
+
+		// 导出内容再次导入时与已有规则端口冲突
+		w, rows = doImport("?dry_run=true", "text/csv", exported.Body.String())
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Contains(t, rows[0].Error, "9001")
+	})
+
+	t.Run("从 realm 配置导入到指定节点和用户", func(t *testing.T) {
+		content := "[[endpoints]]\nlisten = \"0.0.0.0:9101\"\nremote = \"10.0.0.30:80\"\n\n" +
+			"[[endpoints]]\nlisten = \"0.0.0.0:9102\"\nremote = \"10.0.0.31:80\"\nremote_transport = \"ws;host=a;path=/\"\n"
+		body, _ := json.Marshal(gin.H{"format": "realm", "content": content, "user_id": user.ID, "node_id": node.ID})
+		req := httptest.NewRequest(http.MethodPost, "/admin/rules/import-config", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var resp struct {
+			Data struct {
+				Rows        []RuleImportRowResult        `json:"rows"`
+				Unsupported []services.ConfigImportIssue `json:"unsupported"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Len(t, resp.Data.Rows, 1)
+		require.Len(t, resp.Data.Unsupported, 1)
+
+		rule, err := ruleService.GetRuleByID(resp.Data.Rows[0].ID)
+		require.NoError(t, err)
+		require.Equal(t, user.ID, rule.UserID)
+		require.Equal(t, node.ID, rule.NodeID)
+		require.Equal(t, 9101, rule.ListenPort)
+	})
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"bakaray/internal/middleware"
+	"bakaray/internal/models"
+	"bakaray/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestUpdateRuleKeepsExistingLimits(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	dsn := fmt.Sprintf("file:%s-%d?mode=memory&cache=shared", strings.ReplaceAll(t.Name(), "/", "_"), time.Now().UnixNano())
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(
+		&models.User{},
+		&models.UserGroup{},
+		&models.Package{},
+		&models.Order{},
+		&models.Node{},
+		&models.NodeAllowedGroup{},
+		&models.ForwardingRule{},
+		&models.Target{},
+		&models.TargetHealth{},
+		&models.DestinationPolicy{},
+		&models.DestinationViolation{},
+		&models.ListenPortReservation{},
+	))
+
+	group := &models.UserGroup{Name: "limits"}
+	require.NoError(t, db.Create(group).Error)
+	user := &models.User{Username: "limits", PasswordHash: "x", Role: "user", UserGroupID: group.ID, TrafficBalance: 1 << 30}
+	require.NoError(t, db.Create(user).Error)
+	node := &models.Node{Name: "limits-node", Host: "10.0.0.1", Secret: "s", Protocols: services.NormalizeNodeProtocols(nil)}
+	require.NoError(t, db.Create(node).Error)
+	require.NoError(t, db.Create(&models.NodeAllowedGroup{NodeID: node.ID, UserGroupID: group.ID}).Error)
+
+	handler := NewRuleHandler(services.NewRuleService(db, nil), services.NewNodeService(db, nil), services.NewUserService(db, nil), services.NewNodeGroupService(db), nil)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set(middleware.UserIDKey, user.ID)
+		c.Next()
+	})
+	router.POST("/rules", handler.CreateRule)
+	router.PUT("/rules/:id", handler.UpdateRule)
+
+	send := func(method, path string, payload gin.H) int {
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// 创建不限速、不限连接数与流量的规则后用户组才收紧上限
+	require.Equal(t, http.StatusOK, send(http.MethodPost, "/rules", gin.H{
+		"name":        "unlimited",
+		"node_id":     node.ID,
+		"protocol":    "tcp",
+		"listen_port": 8080,
+		"mode":        "direct",
+		"targets":     []gin.H{{"host": "10.0.0.10", "port": 80, "enabled": true}},
+	}))
+	var rule models.ForwardingRule
+	require.NoError(t, db.Where("listen_port = ?", 8080).First(&rule).Error)
+	path := fmt.Sprintf("/rules/%d", rule.ID)
+	require.NoError(t, db.Model(group).Updates(map[string]interface{}{
+		"max_speed_limit_up":     1024,
+		"max_speed_limit_down":   1024,
+		"max_rule_connections":   100,
+		"max_rule_conn_rate":     10,
+		"max_rule_traffic_limit": 1 << 30,
+	}).Error)
+
+	t.Run("未改变的限制不受新上限限制", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, send(http.MethodPut, path, gin.H{"name": "renamed"}))
+		require.Equal(t, http.StatusOK, send(http.MethodPut, path, gin.H{"speed_limit_up": 0, "speed_limit_down": 0}))
+		require.Equal(t, http.StatusOK, send(http.MethodPut, path, gin.H{"max_connections": 0, "conn_rate_limit": 0}))
+		require.Equal(t, http.StatusOK, send(http.MethodPut, path, gin.H{"traffic_limit": 0}))
+	})
+
+	t.Run("修改限速时按上限校验", func(t *testing.T) {
+		require.Equal(t, http.StatusBadRequest, send(http.MethodPut, path, gin.H{"speed_limit_up": 2048}))
+		require.Equal(t, http.StatusOK, send(http.MethodPut, path, gin.H{"speed_limit_up": 512}))
+		// 已改为有限速后不能再改回不限速
+		require.Equal(t, http.StatusBadRequest, send(http.MethodPut, path, gin.H{"speed_limit_up": 0}))
+		require.Equal(t, http.StatusOK, send(http.MethodPut, path, gin.H{"name": "renamed-again"}))
+	})
+
+	t.Run("修改连接数时按上限校验", func(t *testing.T) {
+		require.Equal(t, http.StatusBadRequest, send(http.MethodPut, path, gin.H{"max_connections": 200}))
+		require.Equal(t, http.StatusBadRequest, send(http.MethodPut, path, gin.H{"conn_rate_limit": 20}))
+		require.Equal(t, http.StatusOK, send(http.MethodPut, path, gin.H{"max_connections": 50, "conn_rate_limit": 5}))
+		require.Equal(t, http.StatusBadRequest, send(http.MethodPut, path, gin.H{"max_connections": 0}))
+		require.Equal(t, http.StatusOK, send(http.MethodPut, path, gin.H{"name": "renamed-third"}))
+	})
+
+	t.Run("修改流量上限时按配额校验", func(t *testing.T) {
+		require.Equal(t, http.StatusBadRequest, send(http.MethodPut, path, gin.H{"traffic_limit": 2 << 30}))
+		require.Equal(t, http.StatusOK, send(http.MethodPut, path, gin.H{"traffic_limit": 1 << 20}))
+		require.Equal(t, http.StatusBadRequest, send(http.MethodPut, path, gin.H{"traffic_limit": 0}))
+		require.Equal(t, http.StatusOK, send(http.MethodPut, path, gin.H{"name": "renamed-fourth"}))
+	})
+}
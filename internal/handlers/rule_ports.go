@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"bakaray/internal/logger"
+	"bakaray/internal/middleware"
+	"bakaray/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetFreePorts 查询节点上当前用户可用的空闲端口。
+// protocol 为 tcp/udp 时查询监听端口，为隧道协议时查询作为出口节点的隧道端口。
+// listen_ip 指定监听地址时，只监听节点其他地址的规则不占用端口；隧道端口总是监听全部地址。
+func (h *RuleHandler) GetFreePorts(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "rule")
+
+	nodeID, _ := strconv.ParseUint(c.Query("node_id"), 10, 32)
+	protocol := services.NormalizeProtocol(c.DefaultQuery("protocol", "tcp"))
+	count, _ := strconv.Atoi(c.DefaultQuery("count", "10"))
+	if count <= 0 || count > services.MaxFreePortCount {
+		count = services.MaxFreePortCount
+	}
+
+	listenIP, err := services.NormalizeListenIP(c.Query("listen_ip"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+		return
+	}
+
+	var layer4 string
+	switch {
+	case services.IsDirectProtocol(protocol):
+		layer4 = services.DirectProtocolNetwork(protocol)
+	case services.IsTunnelProtocol(protocol):
+		layer4 = services.TunnelProtocolNetwork(protocol)
+		listenIP = ""
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "不支持的协议"})
+		return
+	}
+
+	log.Debug("GetFreePorts request", "node_id", nodeID, "protocol", protocol, "listen_ip", listenIP, "count", count)
+
+	node, err := h.nodeService.GetNodeByID(uint(nodeID))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "message": "节点不存在"})
+		return
+	}
+	if listenIP != "" && !services.NodeHasListenAddress(node, listenIP) {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "节点未上报监听地址 " + listenIP})
+		return
+	}
+	allowed, err := h.userCanUseNode(userID, node.ID)
+	if err != nil {
+		logger.Error("GetFreePorts: load node permission failed", err, "node_id", node.ID, "request_id", requestID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "读取节点授权失败"})
+		return
+	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "message": "当前用户组无权使用该节点"})
+		return
+	}
+
+	limits, err := h.ruleService.RuleLimitsForUser(userID)
+	if err != nil {
+		logger.Error("GetFreePorts: load rule limits failed", err, "user_id", userID, "request_id", requestID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "读取用户限制失败"})
+		return
+	}
+	conflicts, err := h.loadRuleConflicts(node.ID)
+	if err != nil {
+		logger.Error("GetFreePorts: load rule conflicts failed", err, "node_id", node.ID, "request_id", requestID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "加载规则冲突信息失败"})
+		return
+	}
+
+	used := usedListenPorts(make(map[int]struct{}), conflicts, layer4, listenIP, 0)
+	if err := h.ruleService.AddReservedListenPorts([]uint{node.ID}, used); err != nil {
+		logger.Error("GetFreePorts: load listen port reservations failed", err, "node_id", node.ID, "request_id", requestID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "读取端口预留失败"})
+		return
+	}
+
+	policy := services.NewListenPortPolicy(node, limits)
+	ports := services.FreeListenPorts([]services.ListenPortPolicy{policy}, used, count)
+
+	log.Info("GetFreePorts success", "node_id", node.ID, "protocol", protocol, "count", len(ports))
+
+	c.JSON(http.StatusOK, gin.H{
+		"code": 0,
+		"data": gin.H{
+			"node_id":            node.ID,
+			"protocol":           protocol,
+			"ports":              ports,
+			"listen_port_ranges": node.ListenPortRanges,
+			"reserved_ports":     node.ReservedPorts,
+			"listen_addresses":   node.ListenAddresses,
+		},
+	})
+}
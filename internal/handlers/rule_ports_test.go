@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"bakaray/internal/middleware"
+	"bakaray/internal/models"
+	"bakaray/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestAutoListenPort(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	dsn := fmt.Sprintf("file:%s-%d?mode=memory&cache=shared", strings.ReplaceAll(t.Name(), "/", "_"), time.Now().UnixNano())
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(
+		&models.User{},
+		&models.UserGroup{},
+		&models.Package{},
+		&models.Order{},
+		&models.Node{},
+		&models.NodeAllowedGroup{},
+		&models.ForwardingRule{},
+		&models.Target{},
+		&models.DestinationPolicy{},
+		&models.ListenPortReservation{},
+	))
+
+	group := &models.UserGroup{Name: "default"}
+	require.NoError(t, db.Create(group).Error)
+	user := &models.User{Username: "ports", PasswordHash: "x", Role: "user", UserGroupID: group.ID, TrafficBalance: 1 << 30}
+	require.NoError(t, db.Create(user).Error)
+	node := &models.Node{
+		Name:             "ports-node",
+		Host:             "10.0.0.1",
+		Secret:           "s",
+		Protocols:        services.NormalizeNodeProtocols(nil),
+		ListenPortRanges: models.StringSlice{"30000-30002"},
+		ReservedPorts:    models.StringSlice{"30000"},
+	}
+	require.NoError(t, db.Create(node).Error)
+	require.NoError(t, db.Create(&models.NodeAllowedGroup{NodeID: node.ID, UserGroupID: group.ID}).Error)
+
+	handler := NewRuleHandler(services.NewRuleService(db, nil), services.NewNodeService(db, nil), services.NewUserService(db, nil), services.NewNodeGroupService(db), nil)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set(middleware.UserIDKey, user.ID)
+		c.Next()
+	})
+	router.POST("/rules", handler.CreateRule)
+	router.GET("/rules/free-ports", handler.GetFreePorts)
+
+	type createResponse struct {
+		Message string `json:"message"`
+		Data    struct {
+			ListenPort int `json:"listen_port"`
+		} `json:"data"`
+	}
+	create := func(extra gin.H) (int, createResponse) {
+		payload := gin.H{
+			"name":     "auto",
+			"node_id":  node.ID,
+			"protocol": "tcp",
+			"mode":     "direct",
+			"targets":  []gin.H{{"host": "10.0.0.10", "port": 80, "enabled": true}},
+		}
+		for key, value := range extra {
+			payload[key] = value
+		}
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(http.MethodPost, "/rules", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var resp createResponse
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+	freePorts := func() []int {
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/rules/free-ports?node_id=%d&protocol=tcp", node.ID), nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp struct {
+			Data struct {
+				Ports []int `json:"ports"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp.Data.Ports
+	}
+
+	code, resp := create(gin.H{})
+	require.Equal(t, http.StatusBadRequest, code, "未指定端口且未启用自动分配")
+
+	code, resp = create(gin.H{"listen_port": 8080})
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Contains(t, resp.Message, "30000-30002")
+
+	code, resp = create(gin.H{"listen_port": 30000})
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Contains(t, resp.Message, "保留")
+
+	// 其他请求已预留、尚未保存的端口不在空闲端口中，也不能手动指定
+	reservation := &models.ListenPortReservation{NodeID: node.ID, Port: 30001, ExpiresAt: time.Now().Add(time.Minute)}
+	require.NoError(t, db.Create(reservation).Error)
+	require.Equal(t, []int{30002}, freePorts())
+	code, resp = create(gin.H{"listen_port": 30001})
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Contains(t, resp.Message, "预留")
+	require.NoError(t, db.Model(reservation).Update("expires_at", time.Now().Add(-time.Second)).Error)
+
+	require.Equal(t, []int{30001, 30002}, freePorts())
+
+	code, resp = create(gin.H{"auto_listen_port": true})
+	require.Equal(t, http.StatusOK, code, resp.Message)
+	require.Equal(t, 30001, resp.Data.ListenPort)
+
+	code, resp = create(gin.H{"auto_listen_port": true})
+	require.Equal(t, http.StatusOK, code, resp.Message)
+	require.Equal(t, 30002, resp.Data.ListenPort)
+
+	require.Empty(t, freePorts())
+	code, resp = create(gin.H{"auto_listen_port": true})
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Contains(t, resp.Message, "空闲端口")
+}
+
+func TestRuleListenIP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	dsn := fmt.Sprintf("file:%s-%d?mode=memory&cache=shared", strings.ReplaceAll(t.Name(), "/", "_"), time.Now().UnixNano())
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(
+		&models.User{},
+		&models.UserGroup{},
+		&models.Package{},
+		&models.Order{},
+		&models.Node{},
+		&models.NodeAllowedGroup{},
+		&models.ForwardingRule{},
+		&models.Target{},
+		&models.DestinationPolicy{},
+		&models.ListenPortReservation{},
+	))
+
+	group := &models.UserGroup{Name: "default"}
+	require.NoError(t, db.Create(group).Error)
+	user := &models.User{Username: "bind", PasswordHash: "x", Role: "user", UserGroupID: group.ID, TrafficBalance: 1 << 30}
+	require.NoError(t, db.Create(user).Error)
+	node := &models.Node{
+		Name:            "bind-node",
+		Host:            "10.0.0.1",
+		Secret:          "s",
+		Protocols:       services.NormalizeNodeProtocols(nil),
+		ListenAddresses: models.StringSlice{"10.0.0.1", "10.0.0.2"},
+	}
+	require.NoError(t, db.Create(node).Error)
+	require.NoError(t, db.Create(&models.NodeAllowedGroup{NodeID: node.ID, UserGroupID: group.ID}).Error)
+
+	handler := NewRuleHandler(services.NewRuleService(db, nil), services.NewNodeService(db, nil), services.NewUserService(db, nil), services.NewNodeGroupService(db), nil)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set(middleware.UserIDKey, user.ID)
+		c.Next()
+	})
+	router.POST("/rules", handler.CreateRule)
+
+	create := func(listenIP string, port int) (int, string) {
+		body, _ := json.Marshal(gin.H{
+			"name":        "bind",
+			"node_id":     node.ID,
+			"protocol":    "tcp",
+			"listen_port": port,
+			"listen_ip":   listenIP,
+			"mode":        "direct",
+			"targets":     []gin.H{{"host": "10.0.0.10", "port": 80, "enabled": true}},
+		})
+		req := httptest.NewRequest(http.MethodPost, "/rules", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var resp struct {
+			Message string `json:"message"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp.Message
+	}
+
+	code, message := create("10.0.0.9", 8080)
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Contains(t, message, "未上报")
+
+	code, message = create("10.0.0.1", 8080)
+	require.Equal(t, http.StatusOK, code, message)
+	code, message = create("10.0.0.2", 8080)
+	require.Equal(t, http.StatusOK, code, "不同地址可以监听同一端口: "+message)
+
+	code, message = create("10.0.0.1", 8080)
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Contains(t, message, "已存在")
+	code, _ = create("", 8080)
+	require.Equal(t, http.StatusBadRequest, code, "全部地址与指定地址冲突")
+
+	code, message = create("0.0.0.0", 9090)
+	require.Equal(t, http.StatusOK, code, message)
+	code, _ = create("10.0.0.2", 9090)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	var rules []models.ForwardingRule
+	require.NoError(t, db.Order("id").Find(&rules).Error)
+	require.Len(t, rules, 3)
+	require.Equal(t, "10.0.0.1", rules[0].ListenIP)
+	require.Equal(t, "", rules[2].ListenIP)
+}
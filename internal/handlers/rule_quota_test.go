@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"bakaray/internal/middleware"
+	"bakaray/internal/models"
+	"bakaray/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestRuleQuota(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	dsn := fmt.Sprintf("file:%s-%d?mode=memory&cache=shared", strings.ReplaceAll(t.Name(), "/", "_"), time.Now().UnixNano())
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(
+		&models.User{},
+		&models.UserGroup{},
+		&models.Package{},
+		&models.Order{},
+		&models.Node{},
+		&models.NodeAllowedGroup{},
+		&models.ForwardingRule{},
+		&models.Target{},
+		&models.TargetHealth{},
+		&models.DestinationPolicy{},
+		&models.DestinationViolation{},
+		&models.ListenPortReservation{},
+	))
+
+	group := &models.UserGroup{
+		Name:                "limited",
+		MaxRules:            2,
+		MaxTargetsPerRule:   2,
+		MaxRuleTrafficLimit: 1 << 30,
+		AllowedProtocols:    models.StringSlice{"tcp"},
+		AllowedModes:        models.StringSlice{"direct", "rr"},
+	}
+	require.NoError(t, db.Create(group).Error)
+	user := &models.User{Username: "quota", PasswordHash: "x", Role: "user", UserGroupID: group.ID, TrafficBalance: 1 << 30}
+	require.NoError(t, db.Create(user).Error)
+	node := &models.Node{Name: "quota-node", Host: "10.0.0.1", Secret: "s", Protocols: services.NormalizeNodeProtocols(nil)}
+	require.NoError(t, db.Create(node).Error)
+	require.NoError(t, db.Create(&models.NodeAllowedGroup{NodeID: node.ID, UserGroupID: group.ID}).Error)
+
+	ruleService := services.NewRuleService(db, nil)
+	handler := NewRuleHandler(ruleService, services.NewNodeService(db, nil), services.NewUserService(db, nil), services.NewNodeGroupService(db), nil)
+	userHandler := NewUserHandler(services.NewUserService(db, nil), ruleService, services.NewUserGroupService(db))
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set(middleware.UserIDKey, user.ID)
+		c.Next()
+	})
+	router.POST("/rules", handler.CreateRule)
+	router.PUT("/rules/:id", handler.UpdateRule)
+	router.POST("/rules/import", handler.ImportRules)
+	router.GET("/profile", userHandler.GetProfile)
+
+	send := func(method, path string, payload gin.H) int {
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	newRule := func(port int, overrides gin.H) gin.H {
+		payload := gin.H{
+			"name":          "quota",
+			"node_id":       node.ID,
+			"protocol":      "tcp",
+			"listen_port":   port,
+			"mode":          "direct",
+			"traffic_limit": 1 << 20,
+			"targets":       []gin.H{{"host": "10.0.0.10", "port": 80, "enabled": true}},
+		}
+		for key, value := range overrides {
+			payload[key] = value
+		}
+		return payload
+	}
+	targets := func(n int) []gin.H {
+		out := make([]gin.H, 0, n)
+		for i := 0; i < n; i++ {
+			out = append(out, gin.H{"host": fmt.Sprintf("10.0.0.%d", 10+i), "port": 80, "enabled": true})
+		}
+		return out
+	}
+
+	require.Equal(t, http.StatusBadRequest, send(http.MethodPost, "/rules", newRule(8080, gin.H{"protocol": "udp"})))
+	require.Equal(t, http.StatusBadRequest, send(http.MethodPost, "/rules", newRule(8080, gin.H{"mode": "lb", "targets": targets(2)})))
+	require.Equal(t, http.StatusBadRequest, send(http.MethodPost, "/rules", newRule(8080, gin.H{"mode": "rr", "targets": targets(3)})))
+	// 设置了流量上限配额时规则必须设置不超过配额的流量上限
+	require.Equal(t, http.StatusBadRequest, send(http.MethodPost, "/rules", newRule(8080, gin.H{"traffic_limit": 0})))
+	require.Equal(t, http.StatusBadRequest, send(http.MethodPost, "/rules", newRule(8080, gin.H{"traffic_limit": 2 << 30})))
+
+	require.Equal(t, http.StatusOK, send(http.MethodPost, "/rules", newRule(8080, gin.H{"mode": "rr", "targets": targets(2)})))
+	require.Equal(t, http.StatusOK, send(http.MethodPost, "/rules", newRule(8081, nil)))
+	require.Equal(t, http.StatusForbidden, send(http.MethodPost, "/rules", newRule(8082, nil)))
+
+	var rule models.ForwardingRule
+	require.NoError(t, db.Where("listen_port = ?", 8081).First(&rule).Error)
+	path := fmt.Sprintf("/rules/%d", rule.ID)
+	require.Equal(t, http.StatusBadRequest, send(http.MethodPut, path, gin.H{"traffic_limit": 2 << 30}))
+	require.Equal(t, http.StatusOK, send(http.MethodPut, path, gin.H{"name": "renamed"}))
+
+	req := httptest.NewRequest(http.MethodGet, "/profile", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Data struct {
+			RuleQuota struct {
+				MaxRules         int      `json:"max_rules"`
+				Rules            int64    `json:"rules"`
+				AllowedProtocols []string `json:"allowed_protocols"`
+			} `json:"rule_quota"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Equal(t, 2, resp.Data.RuleQuota.MaxRules)
+	require.Equal(t, int64(2), resp.Data.RuleQuota.Rules)
+	require.Equal(t, []string{"tcp"}, resp.Data.RuleQuota.AllowedProtocols)
+
+	// 导入时只有新建的规则占用配额，与已有规则重复的行按端口冲突报错
+	importRows := func(rules ...gin.H) []RuleImportRowResult {
+		body, _ := json.Marshal(rules)
+		req := httptest.NewRequest(http.MethodPost, "/rules/import?dry_run=true", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp struct {
+			Data struct {
+				Rows []RuleImportRowResult `json:"rows"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp.Data.Rows
+	}
+	rows := importRows(newRule(8081, nil), newRule(8083, nil))
+	require.Contains(t, rows[0].Error, "8081")
+	require.Contains(t, rows[1].Error, "规则数量上限")
+	require.NoError(t, db.Model(group).Update("max_rules", 3).Error)
+	rows = importRows(newRule(8081, nil), newRule(8083, nil), newRule(8084, nil))
+	require.Contains(t, rows[0].Error, "8081")
+	require.Empty(t, rows[1].Error)
+	require.Contains(t, rows[2].Error, "规则数量上限")
+
+	// 已有隧道规则达到配额后不能再启用隧道
+	limits := &services.RuleLimits{MaxTunnelRules: 1}
+	require.NoError(t, ruleQuotaError(limits, &services.RuleUsage{Rules: 5}, 1, 1))
+	require.Error(t, ruleQuotaError(limits, &services.RuleUsage{Rules: 5, TunnelRules: 1}, 0, 1))
+}
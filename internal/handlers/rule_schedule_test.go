@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"bakaray/internal/middleware"
+	"bakaray/internal/models"
+	"bakaray/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestRuleSchedule(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	dsn := fmt.Sprintf("file:%s-%d?mode=memory&cache=shared", strings.ReplaceAll(t.Name(), "/", "_"), time.Now().UnixNano())
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(
+		&models.User{},
+		&models.UserGroup{},
+		&models.Package{},
+		&models.Order{},
+		&models.Node{},
+		&models.NodeAllowedGroup{},
+		&models.ForwardingRule{},
+		&models.Target{},
+		&models.TargetHealth{},
+		&models.DestinationPolicy{},
+		&models.DestinationViolation{},
+		&models.ListenPortReservation{},
+	))
+
+	group := &models.UserGroup{Name: "default"}
+	require.NoError(t, db.Create(group).Error)
+	user := &models.User{Username: "schedule", PasswordHash: "x", Role: "user", UserGroupID: group.ID, TrafficBalance: 1 << 30}
+	require.NoError(t, db.Create(user).Error)
+	node := &models.Node{Name: "schedule-node", Host: "10.0.0.1", Secret: "s", Protocols: services.NormalizeNodeProtocols(nil)}
+	require.NoError(t, db.Create(node).Error)
+	require.NoError(t, db.Create(&models.NodeAllowedGroup{NodeID: node.ID, UserGroupID: group.ID}).Error)
+
+	handler := NewRuleHandler(services.NewRuleService(db, nil), services.NewNodeService(db, nil), services.NewUserService(db, nil), services.NewNodeGroupService(db), nil)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set(middleware.UserIDKey, user.ID)
+		c.Next()
+	})
+	router.POST("/rules", handler.CreateRule)
+	router.PUT("/rules/:id", handler.UpdateRule)
+
+	send := func(method, path string, payload gin.H) int {
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	load := func() models.ForwardingRule {
+		var rule models.ForwardingRule
+		require.NoError(t, db.First(&rule).Error)
+		return rule
+	}
+
+	// 创建时已到期的规则保持禁用
+	code := send(http.MethodPost, "/rules", gin.H{
+		"name":        "event",
+		"node_id":     node.ID,
+		"protocol":    "tcp",
+		"listen_port": 8080,
+		"mode":        "direct",
+		"targets":     []gin.H{{"host": "10.0.0.10", "port": 80, "enabled": true}},
+		"schedule":    gin.H{"expires_at": time.Now().Add(-time.Hour)},
+	})
+	require.Equal(t, http.StatusOK, code)
+	rule := load()
+	require.False(t, rule.Enabled)
+	require.Equal(t, services.RuleDisabledExpired, rule.DisabledReason)
+
+	path := fmt.Sprintf("/rules/%d", rule.ID)
+	require.Equal(t, http.StatusBadRequest, send(http.MethodPut, path, gin.H{"schedule": gin.H{"windows": []string{"weekdays 09:00-18:00"}}}))
+
+	// 修改生效时间后按新的设置重新判断
+	require.Equal(t, http.StatusOK, send(http.MethodPut, path, gin.H{"schedule": gin.H{"windows": []string{"daily 00:00-24:00"}}}))
+	rule = load()
+	require.True(t, rule.Enabled)
+	require.Empty(t, rule.DisabledReason)
+	require.Nil(t, rule.Schedule.ExpiresAt)
+
+	require.Equal(t, http.StatusOK, send(http.MethodPut, path, gin.H{"schedule": gin.H{"starts_at": time.Now().Add(time.Hour)}}))
+	rule = load()
+	require.False(t, rule.Enabled)
+	require.Equal(t, services.RuleDisabledNotStarted, rule.DisabledReason)
+	require.Empty(t, rule.Schedule.Windows)
+
+	// 未修改生效时间的更新保持原设置
+	require.Equal(t, http.StatusOK, send(http.MethodPut, path, gin.H{"name": "renamed"}))
+	rule = load()
+	require.NotNil(t, rule.Schedule.StartsAt)
+	require.Equal(t, services.RuleDisabledNotStarted, rule.DisabledReason)
+}
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"bakaray/internal/models"
+	"bakaray/internal/services"
 )
 
 func TestResolveRuleStateValues(t *testing.T) {
@@ -31,15 +32,14 @@ func TestNormalizeAndValidateRuleSpec(t *testing.T) {
 	entryNode := &models.Node{ID: 1, Protocols: models.StringSlice{"tcp", "udp", "quic"}}
 	exitNode := &models.Node{ID: 2, Protocols: models.StringSlice{"ws", "grpc", "quic"}}
 
-	t.Run("rejects speed limit", func(t *testing.T) {
-		_, err := normalizeAndValidateRuleSpec(
+	t.Run("accepts separate up and down speed limits", func(t *testing.T) {
+		spec, err := normalizeAndValidateRuleSpec(
 			entryNode,
 			nil,
 			"tcp",
 			8081,
 			true,
 			0,
-			64,
 			"direct",
 			[]TargetRequest{{Host: "127.0.0.1", Port: 80, Weight: 1, Enabled: true}},
 			false,
@@ -49,9 +49,221 @@ func TestNormalizeAndValidateRuleSpec(t *testing.T) {
 			nil,
 			nil,
 			0,
+			ruleSpecOptions{SpeedLimitUp: 1024, SpeedLimitDown: 4096},
 		)
-		if err == nil || !strings.Contains(err.Error(), "暂不支持限速") {
-			t.Fatalf("expected speed limit validation error, got %v", err)
+		if err != nil {
+			t.Fatalf("expected speed limits to be accepted, got %v", err)
+		}
+		if spec.SpeedLimitUp != 1024 || spec.SpeedLimitDown != 4096 || spec.SpeedLimit != 0 {
+			t.Fatalf("unexpected speed limits: up=%d down=%d legacy=%d", spec.SpeedLimitUp, spec.SpeedLimitDown, spec.SpeedLimit)
+		}
+	})
+
+	t.Run("enforces group speed limit maximum", func(t *testing.T) {
+		limits := services.RuleLimits{MaxSpeedLimitUp: 2048, MaxSpeedLimitDown: 8192}
+		for _, tc := range []struct {
+			up, down int64
+			message  string
+		}{
+			{up: 4096, down: 1024, message: "上行限速必须在 1-2048 kbps 之间"},
+			{up: 1024, down: 0, message: "下行限速必须在 1-8192 kbps 之间"},
+		} {
+			_, err := normalizeAndValidateRuleSpec(
+				entryNode,
+				nil,
+				"tcp",
+				8081,
+				true,
+				0,
+				"direct",
+				[]TargetRequest{{Host: "127.0.0.1", Port: 80, Weight: 1, Enabled: true}},
+				false,
+				0,
+				"",
+				0,
+				nil,
+				nil,
+				0,
+				ruleSpecOptions{SpeedLimitUp: tc.up, SpeedLimitDown: tc.down, Limits: limits},
+			)
+			if err == nil || err.Error() != tc.message {
+				t.Fatalf("expected %q, got %v", tc.message, err)
+			}
+		}
+	})
+
+	t.Run("enforces group connection ceilings", func(t *testing.T) {
+		limits := services.RuleLimits{MaxConnections: 100, MaxConnRate: 20}
+		for _, tc := range []struct {
+			connections, rate int64
+			message           string
+		}{
+			{connections: 0, rate: 10, message: "最大连接数必须在 1-100 之间"},
+			{connections: 50, rate: 30, message: "每秒新建连接数必须在 1-20 之间"},
+			{connections: 50, rate: 10},
+		} {
+			spec, err := normalizeAndValidateRuleSpec(
+				entryNode,
+				nil,
+				"tcp",
+				8081,
+				true,
+				0,
+				"direct",
+				[]TargetRequest{{Host: "127.0.0.1", Port: 80, Weight: 1, Enabled: true}},
+				false,
+				0,
+				"",
+				0,
+				nil,
+				nil,
+				0,
+				ruleSpecOptions{MaxConnections: tc.connections, ConnRateLimit: tc.rate, Limits: limits},
+			)
+			if tc.message == "" {
+				if err != nil || spec.MaxConnections != tc.connections || spec.ConnRateLimit != tc.rate {
+					t.Fatalf("expected connection limits to be accepted, got spec=%+v err=%v", spec, err)
+				}
+				continue
+			}
+			if err == nil || err.Error() != tc.message {
+				t.Fatalf("expected %q, got %v", tc.message, err)
+			}
+		}
+	})
+
+	t.Run("validates proxy protocol options", func(t *testing.T) {
+		for _, tc := range []struct {
+			protocol string
+			opts     ruleSpecOptions
+			message  string
+		}{
+			{protocol: "tcp", opts: ruleSpecOptions{ProxyProtocol: 1, AcceptProxy: true}},
+			{protocol: "udp", opts: ruleSpecOptions{ProxyProtocol: 2}},
+			{protocol: "udp", opts: ruleSpecOptions{ProxyProtocol: 1}, message: "PROXY protocol v1 仅支持 TCP 规则"},
+			{protocol: "tcp", opts: ruleSpecOptions{ProxyProtocol: 3}, message: "PROXY protocol 版本仅支持 1 或 2"},
+			{protocol: "udp", opts: ruleSpecOptions{AcceptProxy: true}, message: "仅 TCP 规则支持接收 PROXY protocol"},
+		} {
+			_, err := normalizeAndValidateRuleSpec(
+				entryNode,
+				nil,
+				tc.protocol,
+				8081,
+				true,
+				0,
+				"direct",
+				[]TargetRequest{{Host: "127.0.0.1", Port: 80, Weight: 1, Enabled: true}},
+				false,
+				0,
+				"",
+				0,
+				nil,
+				nil,
+				0,
+				tc.opts,
+			)
+			if tc.message == "" {
+				if err != nil {
+					t.Fatalf("expected %+v on %s to be accepted, got %v", tc.opts, tc.protocol, err)
+				}
+				continue
+			}
+			if err == nil || err.Error() != tc.message {
+				t.Fatalf("expected %q, got %v", tc.message, err)
+			}
+		}
+	})
+
+	t.Run("normalizes health check settings", func(t *testing.T) {
+		targets := []TargetRequest{
+			{Host: "127.0.0.1", Port: 80, Weight: 1, Enabled: true},
+			{Host: "127.0.0.2", Port: 80, Weight: 1, Enabled: true},
+		}
+		validate := func(protocol string, hc models.HealthCheck) (*normalizedRuleSpec, error) {
+			return normalizeAndValidateRuleSpec(entryNode, nil, protocol, 8082, true, 0, "rr", targets, false, 0, "", 0, nil, nil, 0, ruleSpecOptions{HealthCheck: hc})
+		}
+
+		spec, err := validate("udp", models.HealthCheck{Type: "udp", Interval: 5, AutoRemove: true})
+		if err != nil {
+			t.Fatalf("expected udp health check to be accepted, got %v", err)
+		}
+		if spec.HealthCheck.Timeout != services.DefaultHealthCheckTimeout || spec.HealthCheck.Fall != services.DefaultHealthCheckFall || !spec.HealthCheck.AutoRemove {
+			t.Fatalf("expected defaults to be filled, got %+v", spec.HealthCheck)
+		}
+
+		if _, err := validate("tcp", models.HealthCheck{Type: "udp"}); err == nil || !strings.Contains(err.Error(), "udp 检查仅适用于 UDP 规则") {
+			t.Fatalf("expected udp check on tcp rule to be rejected, got %v", err)
+		}
+		if _, err := validate("tcp", models.HealthCheck{Type: "tcp", Interval: 3, Timeout: 3}); err == nil || !strings.Contains(err.Error(), "超时") {
+			t.Fatalf("expected timeout >= interval to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("normalizes schedule settings", func(t *testing.T) {
+		targets := []TargetRequest{{Host: "127.0.0.1", Port: 80, Weight: 1, Enabled: true}}
+		validate := func(schedule models.RuleSchedule) (*normalizedRuleSpec, error) {
+			return normalizeAndValidateRuleSpec(entryNode, nil, "tcp", 8083, true, 0, "direct", targets, false, 0, "", 0, nil, nil, 0, ruleSpecOptions{Schedule: schedule})
+		}
+
+		spec, err := validate(models.RuleSchedule{Windows: models.StringSlice{"Sat,Sun 20:00-02:00"}, Timezone: "Asia/Shanghai"})
+		if err != nil {
+			t.Fatalf("expected schedule to be accepted, got %v", err)
+		}
+		if len(spec.Schedule.Windows) != 1 || spec.Schedule.Windows[0] != "sat-sun 20:00-02:00" {
+			t.Fatalf("expected windows to be normalized, got %v", spec.Schedule.Windows)
+		}
+
+		if _, err := validate(models.RuleSchedule{Windows: models.StringSlice{"weekend 20:00-02:00"}}); err == nil || !strings.Contains(err.Error(), "生效时段") {
+			t.Fatalf("expected invalid window to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("validates load balancing modes", func(t *testing.T) {
+		primary := TargetRequest{Host: "10.0.0.1", Port: 80, Weight: 1, Enabled: true}
+		backup := TargetRequest{Host: "10.0.0.2", Port: 80, Weight: 1, Priority: 10, Enabled: true}
+		for _, tc := range []struct {
+			mode    string
+			targets []TargetRequest
+			message string
+		}{
+			{mode: "least-conn", targets: []TargetRequest{primary, backup}},
+			{mode: "source_hash", targets: []TargetRequest{primary, backup}},
+			{mode: "failover", targets: []TargetRequest{primary, backup}},
+			{mode: "failover", targets: []TargetRequest{primary, {Host: "10.0.0.3", Port: 80, Enabled: true}}, message: "failover 模式需要至少两个不同优先级的启用目标（主用与备用）"},
+			{mode: "source_hash", targets: []TargetRequest{primary}, message: "source_hash 模式至少需要两个启用目标"},
+			{mode: "rr", targets: []TargetRequest{primary, {Host: "10.0.0.3", Port: 80, Priority: -1, Enabled: true}}, message: "目标优先级必须在 0-100 之间"},
+			{mode: "random", targets: []TargetRequest{primary, backup}, message: "转发模式仅支持 direct、rr、lb、least_conn、source_hash、failover"},
+		} {
+			spec, err := normalizeAndValidateRuleSpec(
+				entryNode,
+				nil,
+				"tcp",
+				8081,
+				true,
+				0,
+				tc.mode,
+				tc.targets,
+				false,
+				0,
+				"",
+				0,
+				nil,
+				nil,
+				0,
+				ruleSpecOptions{},
+			)
+			if tc.message == "" {
+				if err != nil {
+					t.Fatalf("expected mode %s to be accepted, got %v", tc.mode, err)
+				}
+				if tc.mode == "failover" && spec.Targets[1].Priority != 10 {
+					t.Fatalf("expected target priority to be kept, got %+v", spec.Targets)
+				}
+				continue
+			}
+			if err == nil || err.Error() != tc.message {
+				t.Fatalf("mode %s: expected %q, got %v", tc.mode, tc.message, err)
+			}
 		}
 	})
 
@@ -63,7 +275,6 @@ func TestNormalizeAndValidateRuleSpec(t *testing.T) {
 			8082,
 			true,
 			0,
-			0,
 			"rr",
 			[]TargetRequest{{Host: "127.0.0.1", Port: 80, Weight: 1, Enabled: true}},
 			false,
@@ -73,6 +284,7 @@ func TestNormalizeAndValidateRuleSpec(t *testing.T) {
 			nil,
 			nil,
 			0,
+			ruleSpecOptions{},
 		)
 		if err == nil || !strings.Contains(err.Error(), "至少需要两个启用目标") {
 			t.Fatalf("expected rr target count validation error, got %v", err)
@@ -87,7 +299,6 @@ func TestNormalizeAndValidateRuleSpec(t *testing.T) {
 			8083,
 			true,
 			0,
-			0,
 			"direct",
 			[]TargetRequest{{Host: "127.0.0.1", Port: 80, Weight: 1, Enabled: true}},
 			false,
@@ -99,6 +310,7 @@ func TestNormalizeAndValidateRuleSpec(t *testing.T) {
 			},
 			nil,
 			0,
+			ruleSpecOptions{},
 		)
 		if err == nil || !strings.Contains(err.Error(), "监听已存在") {
 			t.Fatalf("expected listen port conflict error, got %v", err)
@@ -113,7 +325,6 @@ func TestNormalizeAndValidateRuleSpec(t *testing.T) {
 			8084,
 			true,
 			0,
-			0,
 			"direct",
 			[]TargetRequest{{Host: "127.0.0.1", Port: 80, Weight: 1, Enabled: true}},
 			false,
@@ -123,6 +334,7 @@ func TestNormalizeAndValidateRuleSpec(t *testing.T) {
 			nil,
 			nil,
 			0,
+			ruleSpecOptions{},
 		)
 		if err == nil || !strings.Contains(err.Error(), "仅支持 TCP 或 UDP") {
 			t.Fatalf("expected unsupported protocol validation error, got %v", err)
@@ -137,7 +349,6 @@ func TestNormalizeAndValidateRuleSpec(t *testing.T) {
 			8085,
 			true,
 			0,
-			0,
 			"direct",
 			[]TargetRequest{{Host: "127.0.0.1", Port: 53, Weight: 1, Enabled: true}},
 			true,
@@ -147,6 +358,7 @@ func TestNormalizeAndValidateRuleSpec(t *testing.T) {
 			nil,
 			nil,
 			0,
+			ruleSpecOptions{},
 		)
 		if err != nil {
 			t.Fatalf("expected tunnel rule to pass validation, got %v", err)
@@ -164,7 +376,6 @@ func TestNormalizeAndValidateRuleSpec(t *testing.T) {
 			8086,
 			true,
 			0,
-			0,
 			"direct",
 			[]TargetRequest{{Host: "127.0.0.1", Port: 80, Weight: 1, Enabled: true}},
 			true,
@@ -174,6 +385,7 @@ func TestNormalizeAndValidateRuleSpec(t *testing.T) {
 			nil,
 			nil,
 			0,
+			ruleSpecOptions{},
 		)
 		if err == nil || !strings.Contains(err.Error(), "入口节点未声明支持 ws 隧道") {
 			t.Fatalf("expected entry tunnel capability validation error, got %v", err)
@@ -188,7 +400,6 @@ func TestNormalizeAndValidateRuleSpec(t *testing.T) {
 			8086,
 			true,
 			0,
-			0,
 			"direct",
 			[]TargetRequest{{Host: "127.0.0.1", Port: 80, Weight: 1, Enabled: true}},
 			true,
@@ -200,9 +411,75 @@ func TestNormalizeAndValidateRuleSpec(t *testing.T) {
 				{ID: 3, Port: 9444, Enabled: true, Layer4: "udp"},
 			},
 			0,
+			ruleSpecOptions{},
 		)
 		if err == nil || !strings.Contains(err.Error(), "出口节点端口 9444") {
 			t.Fatalf("expected exit conflict error, got %v", err)
 		}
 	})
+
+	t.Run("validates port range rules", func(t *testing.T) {
+		validate := func(listenPort, listenPortEnd int, targetPort int, tunnel bool, conflicts []existingRuleConflict) (*normalizedRuleSpec, error) {
+			exit, exitID, tunnelProtocol := (*models.Node)(nil), uint(0), ""
+			if tunnel {
+				exit, exitID, tunnelProtocol = exitNode, exitNode.ID, "quic"
+			}
+			return normalizeAndValidateRuleSpec(
+				entryNode,
+				exit,
+				"tcp",
+				listenPort,
+				true,
+				0,
+				"direct",
+				[]TargetRequest{{Host: "127.0.0.1", Port: targetPort, Weight: 1, Enabled: true}},
+				tunnel,
+				exitID,
+				tunnelProtocol,
+				9445,
+				conflicts,
+				nil,
+				0,
+				ruleSpecOptions{ListenPortEnd: listenPortEnd},
+			)
+		}
+
+		spec, err := validate(20000, 20100, 30000, false, []existingRuleConflict{
+			{ID: 4, Port: 20050, Enabled: true, Layer4: "udp"},
+			{ID: 5, Port: 19000, PortEnd: 19999, Enabled: true, Layer4: "tcp"},
+		})
+		if err != nil {
+			t.Fatalf("expected port range rule to be accepted, got %v", err)
+		}
+		if spec.ListenPort != 20000 || spec.ListenPortEnd != 20100 {
+			t.Fatalf("unexpected port range: %d-%d", spec.ListenPort, spec.ListenPortEnd)
+		}
+
+		spec, err = validate(20000, 20000, 30000, false, nil)
+		if err != nil || spec.ListenPortEnd != 0 {
+			t.Fatalf("expected single-port range to be normalized, got end=%v err=%v", spec, err)
+		}
+
+		cases := []struct {
+			name          string
+			listenPortEnd int
+			targetPort    int
+			tunnel        bool
+			conflicts     []existingRuleConflict
+			message       string
+		}{
+			{name: "end before start", listenPortEnd: 19999, targetPort: 30000, message: "结束端口"},
+			{name: "too many ports", listenPortEnd: 20000 + services.MaxRulePortRange, targetPort: 30000, message: "最多包含"},
+			{name: "target overflow", listenPortEnd: 20100, targetPort: 65500, message: "超出 65535"},
+			{name: "tunnel", listenPortEnd: 20100, targetPort: 30000, tunnel: true, message: "不支持隧道"},
+			{name: "single port inside range", listenPortEnd: 20100, targetPort: 30000, conflicts: []existingRuleConflict{{ID: 6, Port: 20050, Enabled: true, Layer4: "tcp"}}, message: "端口 20050"},
+			{name: "overlapping range", listenPortEnd: 20100, targetPort: 30000, conflicts: []existingRuleConflict{{ID: 7, Port: 20100, PortEnd: 20200, Enabled: true, Layer4: "tcp"}}, message: "端口 20100"},
+		}
+		for _, tc := range cases {
+			_, err := validate(20000, tc.listenPortEnd, tc.targetPort, tc.tunnel, tc.conflicts)
+			if err == nil || !strings.Contains(err.Error(), tc.message) {
+				t.Fatalf("%s: expected error containing %q, got %v", tc.name, tc.message, err)
+			}
+		}
+	})
 }
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bakaray/internal/logger"
+	"bakaray/internal/middleware"
+	"bakaray/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultTrafficSeriesRange = 24 * time.Hour
+	// hourlyTrafficSeriesMaxRange 未指定 interval 时，超过该范围按天返回
+	hourlyTrafficSeriesMaxRange = 7 * 24 * time.Hour
+)
+
+// parseTrafficSeriesQuery 解析流量时间序列查询参数：from/to 为 Unix 时间戳（秒，默认最近 24 小时），
+// interval 为 hour 或 day，group_by 为逗号分隔的 rule、node，rule_id/node_id 用于过滤
+func parseTrafficSeriesQuery(c *gin.Context, now time.Time) (services.TrafficSeriesQuery, error) {
+	q := services.TrafficSeriesQuery{To: now}
+	if raw := c.Query("to"); raw != "" {
+		sec, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return q, errors.New("to 必须为 Unix 时间戳（秒）")
+		}
+		q.To = time.Unix(sec, 0)
+	}
+	q.From = q.To.Add(-defaultTrafficSeriesRange)
+	if raw := c.Query("from"); raw != "" {
+		sec, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return q, errors.New("from 必须为 Unix 时间戳（秒）")
+		}
+		q.From = time.Unix(sec, 0)
+	}
+
+	switch strings.ToLower(strings.TrimSpace(c.Query("interval"))) {
+	case "":
+		q.Interval = services.TrafficResolutionHour
+		if q.To.Sub(q.From) > hourlyTrafficSeriesMaxRange {
+			q.Interval = services.TrafficResolutionDay
+		}
+	case "hour", "1h":
+		q.Interval = services.TrafficResolutionHour
+	case "day", "1d":
+		q.Interval = services.TrafficResolutionDay
+	default:
+		return q, services.ErrInvalidTrafficInterval
+	}
+
+	for _, field := range strings.Split(c.Query("group_by"), ",") {
+		switch strings.ToLower(strings.TrimSpace(field)) {
+		case "":
+		case "rule":
+			q.GroupByRule = true
+		case "node":
+			q.GroupByNode = true
+		default:
+			return q, errors.New("group_by 仅支持 rule、node")
+		}
+	}
+
+	var err error
+	if q.Filter.RuleID, err = parseOptionalID(c, "rule_id"); err != nil {
+		return q, err
+	}
+	if q.Filter.NodeID, err = parseOptionalID(c, "node_id"); err != nil {
+		return q, err
+	}
+	return q, nil
+}
+
+func parseOptionalID(c *gin.Context, name string) (uint, error) {
+	raw := c.Query(name)
+	if raw == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(raw, 10, 32)
+	if err != nil {
+		return 0, errors.New(name + " 无效")
+	}
+	return uint(id), nil
+}
+
+// writeTrafficSeries 查询并返回流量时间序列
+func (h *RuleHandler) writeTrafficSeries(c *gin.Context, handler string, q services.TrafficSeriesQuery) {
+	requestID := c.GetString("request_id")
+
+	if h.trafficStatsService == nil {
+		logger.Error(handler+": traffic stats service not initialized", errors.New("traffic stats service not initialized"), "request_id", requestID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "服务未初始化"})
+		return
+	}
+
+	series, err := h.trafficStatsService.Series(q)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidTrafficRange) || errors.Is(err, services.ErrInvalidTrafficInterval) || errors.Is(err, services.ErrTrafficSeriesTooLarge) {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+			return
+		}
+		logger.Error(handler+": query failed", err, "request_id", requestID)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "获取流量统计失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"code": 0, "data": series})
+}
+
+// GetRuleTraffic 获取单条规则的流量时间序列，可按节点分组
+func (h *RuleHandler) GetRuleTraffic(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "rule")
+
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 32)
+	log.Debug("GetRuleTraffic request", "rule_id", id)
+
+	rule, err := h.ruleService.GetRuleByID(uint(id))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"code": 404, "message": "规则不存在"})
+		return
+	}
+	if rule.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"code": 403, "message": "无权访问此规则"})
+		return
+	}
+
+	q, err := parseTrafficSeriesQuery(c, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+		return
+	}
+	q.Filter.RuleID = rule.ID
+	q.GroupByRule = false
+
+	h.writeTrafficSeries(c, "GetRuleTraffic", q)
+}
+
+// GetTrafficSeries 获取当前用户的流量时间序列，可按规则、节点分组
+func (h *RuleHandler) GetTrafficSeries(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "rule")
+
+	q, err := parseTrafficSeriesQuery(c, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+		return
+	}
+	q.Filter.UserID = userID
+
+	log.Debug("GetTrafficSeries request", "interval", q.Interval, "rule_id", q.Filter.RuleID, "node_id", q.Filter.NodeID)
+
+	h.writeTrafficSeries(c, "GetTrafficSeries", q)
+}
+
+// GetAdminTrafficSeries 管理员获取全站流量时间序列，可按 user_id 过滤
+func (h *RuleHandler) GetAdminTrafficSeries(c *gin.Context) {
+	requestID := c.GetString("request_id")
+	userID := middleware.GetUserID(c)
+	log := logger.WithContext(requestID, userID, "admin")
+
+	q, err := parseTrafficSeriesQuery(c, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+		return
+	}
+	if q.Filter.UserID, err = parseOptionalID(c, "user_id"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": err.Error()})
+		return
+	}
+
+	log.Debug("GetAdminTrafficSeries request", "interval", q.Interval, "user_id", q.Filter.UserID, "rule_id", q.Filter.RuleID, "node_id", q.Filter.NodeID)
+
+	h.writeTrafficSeries(c, "GetAdminTrafficSeries", q)
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"bakaray/internal/middleware"
+	"bakaray/internal/models"
+	"bakaray/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestGetRuleTraffic(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	dsn := fmt.Sprintf("file:%s-%d?mode=memory&cache=shared", strings.ReplaceAll(t.Name(), "/", "_"), time.Now().UnixNano())
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.User{}, &models.ForwardingRule{}, &models.TrafficLog{}, &models.TrafficRollup{}))
+
+	handler := NewRuleHandler(services.NewRuleService(db, nil), nil, nil, nil, services.NewTrafficStatsService(db, services.DefaultTrafficRetention))
+
+	owner := &models.User{Username: "owner", PasswordHash: "x", Role: "user"}
+	other := &models.User{Username: "other", PasswordHash: "x", Role: "user"}
+	require.NoError(t, db.Create(owner).Error)
+	require.NoError(t, db.Create(other).Error)
+	rule := &models.ForwardingRule{NodeID: 1, UserID: owner.ID, Name: "r", Protocol: "tcp", ListenPort: 9000}
+	require.NoError(t, db.Create(rule).Error)
+	require.NoError(t, db.Create(&models.TrafficLog{RuleID: rule.ID, NodeID: 1, UserID: owner.ID, BytesIn: 64, BytesOut: 16, Timestamp: time.Now().UTC().Add(-time.Minute)}).Error)
+
+	request := func(userID uint, query string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.GET("/rules/:id/traffic", func(c *gin.Context) {
+			c.Set(middleware.UserIDKey, userID)
+			c.Next()
+		}, handler.GetRuleTraffic)
+		req := httptest.NewRequest(http.MethodGet, "/rules/"+strconv.FormatUint(uint64(rule.ID), 10)+"/traffic"+query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("规则所有者按节点分组获取流量", func(t *testing.T) {
+		w := request(owner.ID, "?group_by=node")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp struct {
+			Data services.TrafficSeries `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Equal(t, int64(services.TrafficResolutionHour), resp.Data.Interval)
+		require.Len(t, resp.Data.Series, 1)
+		require.Equal(t, uint(1), resp.Data.Series[0].NodeID)
+		require.Equal(t, int64(64), resp.Data.Totals.BytesIn)
+		require.Equal(t, int64(16), resp.Data.Totals.BytesOut)
+	})
+
+	t.Run("其他用户无权访问", func(t *testing.T) {
+		require.Equal(t, http.StatusForbidden, request(other.ID, "").Code)
+	})
+
+	t.Run("参数错误返回 400", func(t *testing.T) {
+		require.Equal(t, http.StatusBadRequest, request(owner.ID, "?interval=minute").Code)
+		require.Equal(t, http.StatusBadRequest, request(owner.ID, "?group_by=user").Code)
+		require.Equal(t, http.StatusBadRequest, request(owner.ID, "?from=200&to=100").Code)
+	})
+}
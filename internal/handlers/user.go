@@ -51,6 +51,30 @@ func (h *UserHandler) GetProfile(c *gin.Context) {
 		}
 	}
 
+	// 用户组规则配额与当前用量，配额为 0 或为空表示不限制
+	var ruleQuota gin.H
+	if h.ruleService != nil {
+		limits, err := h.ruleService.RuleLimitsForUser(userID)
+		var usage *services.RuleUsage
+		if err == nil {
+			usage, err = h.ruleService.RuleUsageForUser(userID)
+		}
+		if err != nil {
+			logger.Warn("GetProfile: load rule quota failed", "error", err, "user_id", userID, "request_id", requestID)
+		} else {
+			ruleQuota = gin.H{
+				"max_rules":            limits.MaxRules,
+				"rules":                usage.Rules,
+				"max_tunnel_rules":     limits.MaxTunnelRules,
+				"tunnel_rules":         usage.TunnelRules,
+				"max_targets_per_rule": limits.MaxTargetsPerRule,
+				"max_traffic_limit":    limits.MaxTrafficLimit,
+				"allowed_protocols":    limits.AllowedProtocols,
+				"allowed_modes":        limits.AllowedModes,
+			}
+		}
+	}
+
 	log.Info("GetProfile success", "username", user.Username)
 
 	c.JSON(http.StatusOK, gin.H{
@@ -64,6 +88,7 @@ func (h *UserHandler) GetProfile(c *gin.Context) {
 			"user_group_name": userGroupName,
 			"role":            user.Role,
 			"created_at":      user.CreatedAt,
+			"rule_quota":      ruleQuota,
 		},
 	})
 }
@@ -142,12 +167,10 @@ func (h *UserHandler) GetTrafficStats(c *gin.Context) {
 	}
 
 	user, _ := h.userService.GetUserByID(userID)
+	// 流量余额在心跳计费时按节点倍率实时扣除，即为剩余流量
 	remaining := int64(0)
-	if user != nil {
-		remaining = user.TrafficBalance - usedTotal
-		if remaining < 0 {
-			remaining = 0
-		}
+	if user != nil && user.TrafficBalance > 0 {
+		remaining = user.TrafficBalance
 	}
 
 	log.Info("GetTrafficStats success", "days", days, "bytes_in", bytesIn, "bytes_out", bytesOut, "total_used", usedTotal, "remaining", remaining)
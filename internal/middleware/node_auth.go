@@ -0,0 +1,175 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"bakaray/internal/logger"
+	"bakaray/internal/models"
+	"bakaray/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	NodeIDHeader        = "X-Node-Id"
+	NodeTimestampHeader = "X-Node-Timestamp"
+	NodeNonceHeader     = "X-Node-Nonce"
+	NodeSignatureHeader = "X-Node-Signature"
+
+	NodeIDKey = "node_id"
+	NodeKey   = "node"
+
+	// maxNodeRequestBody 节点请求体大小上限
+	maxNodeRequestBody = 8 << 20
+)
+
+// NodeAuthMiddleware 节点通信认证中间件。
+// 节点在请求头中携带节点 ID、时间戳、nonce 和 HMAC 签名；
+// 站点开启 node_legacy_auth 时仍接受请求体中的明文 secret。
+type NodeAuthMiddleware struct {
+	nodeService       *services.NodeService
+	siteConfigService *services.SiteConfigService
+}
+
+// NewNodeAuthMiddleware 创建节点认证中间件
+func NewNodeAuthMiddleware(nodeService *services.NodeService, siteConfigService *services.SiteConfigService) *NodeAuthMiddleware {
+	return &NodeAuthMiddleware{
+		nodeService:       nodeService,
+		siteConfigService: siteConfigService,
+	}
+}
+
+// legacyNodeCredential 旧版请求体中的节点凭据
+type legacyNodeCredential struct {
+	NodeID uint   `json:"node_id"`
+	Secret string `json:"secret"`
+}
+
+// Authenticate 节点认证
+func (m *NodeAuthMiddleware) Authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetString("request_id")
+
+		body, err := readNodeRequestBody(c)
+		if err != nil {
+			logger.Warn("NodeAuth: read body failed", "error", err, "request_id", requestID)
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "message": "参数错误"})
+			c.Abort()
+			return
+		}
+
+		var node *models.Node
+		if signature := c.GetHeader(NodeSignatureHeader); signature != "" {
+			nodeID, err := strconv.ParseUint(c.GetHeader(NodeIDHeader), 10, 32)
+			if err != nil || nodeID == 0 {
+				c.JSON(http.StatusUnauthorized, gin.H{"code": 401, "message": "缺少节点 ID"})
+				c.Abort()
+				return
+			}
+			node, err = m.nodeService.AuthenticateNodeSignature(
+				uint(nodeID),
+				c.Request.Method,
+				c.Request.URL.Path,
+				c.Request.URL.RawQuery,
+				c.GetHeader(NodeTimestampHeader),
+				c.GetHeader(NodeNonceHeader),
+				signature,
+				body,
+			)
+			if err != nil {
+				logger.Warn("NodeAuth: signature rejected", "node_id", nodeID, "error", err, "request_id", requestID)
+				c.JSON(http.StatusUnauthorized, gin.H{"code": 401, "message": nodeAuthErrorMessage(err)})
+				c.Abort()
+				return
+			}
+		} else {
+			site, err := m.siteConfigService.GetOrCreate()
+			if err != nil {
+				logger.Error("NodeAuth: failed to load site config", err, "request_id", requestID)
+				c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "message": "读取站点配置失败"})
+				c.Abort()
+				return
+			}
+			if !site.NodeLegacyAuth {
+				c.JSON(http.StatusUnauthorized, gin.H{"code": 401, "message": "节点请求需要签名"})
+				c.Abort()
+				return
+			}
+
+			var cred legacyNodeCredential
+			if len(body) > 0 {
+				_ = json.Unmarshal(body, &cred)
+			}
+			node, err = m.nodeService.AuthenticateNodeSecret(cred.NodeID, cred.Secret)
+			if err != nil {
+				logger.Warn("NodeAuth: invalid node secret", "node_id", cred.NodeID, "error", err, "request_id", requestID)
+				c.JSON(http.StatusUnauthorized, gin.H{"code": 401, "message": nodeAuthErrorMessage(err)})
+				c.Abort()
+				return
+			}
+		}
+
+		c.Set(NodeIDKey, node.ID)
+		c.Set(NodeKey, node)
+
+		c.Next()
+	}
+}
+
+// readNodeRequestBody 读取请求体并回填，供后续处理器再次绑定
+func readNodeRequestBody(c *gin.Context) ([]byte, error) {
+	if c.Request.Body == nil {
+		return nil, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxNodeRequestBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxNodeRequestBody {
+		return nil, errors.New("request body too large")
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+func nodeAuthErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, services.ErrNodeRequestExpired):
+		return "请求时间戳无效或已过期"
+	case errors.Is(err, services.ErrNodeNonceReused):
+		return "重复的请求"
+	case errors.Is(err, services.ErrInvalidNodeNonce):
+		return "无效的请求 nonce"
+	case errors.Is(err, services.ErrNodeCredentialsRevoked):
+		return "节点凭据已吊销"
+	case errors.Is(err, services.ErrInvalidNodeCredential):
+		return "无效的节点密钥"
+	default:
+		return "无效的节点签名"
+	}
+}
+
+// GetNodeID 从上下文获取已认证的节点 ID
+func GetNodeID(c *gin.Context) uint {
+	if id, exists := c.Get(NodeIDKey); exists {
+		if nid, ok := id.(uint); ok {
+			return nid
+		}
+	}
+	return 0
+}
+
+// GetNode 从上下文获取已认证的节点
+func GetNode(c *gin.Context) *models.Node {
+	if v, exists := c.Get(NodeKey); exists {
+		if node, ok := v.(*models.Node); ok {
+			return node
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"bakaray/internal/logger"
+	"bakaray/internal/models"
+	"bakaray/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func init() {
+	_ = logger.Init("error")
+}
+
+func setupNodeAuthTest(t *testing.T, legacy bool) (*gin.Engine, *gorm.DB, *models.Node) {
+	t.Helper()
+
+	dsn := fmt.Sprintf("file:%s-%d?mode=memory&cache=shared", strings.ReplaceAll(t.Name(), "/", "_"), time.Now().UnixNano())
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.Node{}, &models.SiteConfig{}))
+
+	site := &models.SiteConfig{SiteName: "test", NodeReportInterval: 10}
+	require.NoError(t, db.Create(site).Error)
+	require.NoError(t, db.Model(site).Update("node_legacy_auth", legacy).Error)
+
+	node := &models.Node{Name: "auth-node", Host: "127.0.0.1", Secret: "node-secret", Status: "online"}
+	require.NoError(t, db.Create(node).Error)
+
+	m := NewNodeAuthMiddleware(services.NewNodeService(db, nil), services.NewSiteConfigService(db))
+	r := gin.New()
+	r.POST("/api/node/heartbeat", m.Authenticate(), func(c *gin.Context) {
+		var body map[string]any
+		_ = c.ShouldBindJSON(&body)
+		c.JSON(http.StatusOK, gin.H{"node_id": GetNodeID(c), "body": body})
+	})
+	return r, db, node
+}
+
+func signedNodeRequest(nodeID uint, secret string, ts time.Time, nonce, body string) *http.Request {
+	path := "/api/node/heartbeat"
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(NodeIDHeader, strconv.FormatUint(uint64(nodeID), 10))
+	req.Header.Set(NodeTimestampHeader, timestamp)
+	req.Header.Set(NodeNonceHeader, nonce)
+	req.Header.Set(NodeSignatureHeader, services.SignNodeRequest(secret, http.MethodPost, path, "", timestamp, nonce, []byte(body)))
+	return req
+}
+
+func TestNodeAuth_Signature(t *testing.T) {
+	r, _, node := setupNodeAuthTest(t, false)
+	body := `{"probe":null}`
+
+	t.Run("签名正确且请求体可再次读取", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, signedNodeRequest(node.ID, "node-secret", time.Now(), "nonce-ok", body))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Contains(t, w.Body.String(), fmt.Sprintf(`"node_id":%d`, node.ID))
+		require.Contains(t, w.Body.String(), `"probe":null`)
+	})
+
+	t.Run("nonce 重放被拒绝", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, signedNodeRequest(node.ID, "node-secret", time.Now(), "nonce-ok", body))
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("时间戳超出窗口被拒绝", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, signedNodeRequest(node.ID, "node-secret", time.Now().Add(-services.NodeSignatureMaxSkew-time.Minute), "nonce-old", body))
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("错误密钥被拒绝", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, signedNodeRequest(node.ID, "wrong-secret", time.Now(), "nonce-bad", body))
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("篡改请求体被拒绝", func(t *testing.T) {
+		req := signedNodeRequest(node.ID, "node-secret", time.Now(), "nonce-tamper", body)
+		req.Body = httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(`{"probe":{}}`)).Body
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("篡改查询参数被拒绝", func(t *testing.T) {
+		// 签名时查询参数为 wait=1，实际发送的查询参数不同时签名不匹配
+		signed := func(nonce, query string) *http.Request {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			req := httptest.NewRequest(http.MethodPost, "/api/node/heartbeat?"+query, bytes.NewBufferString(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(NodeIDHeader, strconv.FormatUint(uint64(node.ID), 10))
+			req.Header.Set(NodeTimestampHeader, timestamp)
+			req.Header.Set(NodeNonceHeader, nonce)
+			req.Header.Set(NodeSignatureHeader, services.SignNodeRequest("node-secret", http.MethodPost, "/api/node/heartbeat", "wait=1", timestamp, nonce, []byte(body)))
+			return req
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, signed("nonce-query-ok", "wait=1"))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, signed("nonce-query-tamper", "wait=60"))
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("关闭旧版模式时拒绝明文密钥", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/node/heartbeat", bytes.NewBufferString(fmt.Sprintf(`{"node_id":%d,"secret":"node-secret"}`, node.ID)))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
+
+func TestNodeAuth_LegacySecret(t *testing.T) {
+	r, _, node := setupNodeAuthTest(t, true)
+
+	tests := []struct {
+		name   string
+		secret string
+		status int
+	}{
+		{"密钥正确", "node-secret", http.StatusOK},
+		{"密钥错误", "node-secre", http.StatusUnauthorized},
+		{"缺少密钥", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/node/heartbeat", bytes.NewBufferString(fmt.Sprintf(`{"node_id":%d,"secret":%q}`, node.ID, tt.secret)))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			require.Equal(t, tt.status, w.Code)
+		})
+	}
+}
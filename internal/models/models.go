@@ -27,29 +27,87 @@ func (u *User) AfterFind(_ *gorm.DB) error {
 
 // UserGroup 用户组表
 type UserGroup struct {
-	ID          uint      `json:"id" gorm:"primaryKey"`
-	Name        string    `json:"name" gorm:"size:64;not null"`
-	Description string    `json:"description" gorm:"size:255"`
-	CreatedAt   time.Time `json:"created_at"`
+	ID                    uint      `json:"id" gorm:"primaryKey"`
+	Name                  string    `json:"name" gorm:"size:64;not null"`
+	Description           string    `json:"description" gorm:"size:255"`
+	DefaultSpeedLimitUp   int64     `json:"default_speed_limit_up" gorm:"default:0"`   // 新建规则默认上行限速，单位：kbps，0 表示不限速
+	DefaultSpeedLimitDown int64     `json:"default_speed_limit_down" gorm:"default:0"` // 新建规则默认下行限速，单位：kbps
+	MaxSpeedLimitUp       int64     `json:"max_speed_limit_up" gorm:"default:0"`       // 规则上行限速上限，单位：kbps，0 表示不限制
+	MaxSpeedLimitDown     int64     `json:"max_speed_limit_down" gorm:"default:0"`     // 规则下行限速上限，单位：kbps
+	MaxRuleConnections    int64     `json:"max_rule_connections" gorm:"default:0"`     // 单条规则最大并发连接数上限，0 表示不限制
+	MaxRuleConnRate       int64     `json:"max_rule_conn_rate" gorm:"default:0"`       // 单条规则每秒新建连接数上限，0 表示不限制
+	CreatedAt             time.Time `json:"created_at"`
+
+	// 监听端口策略：与节点的端口策略叠加，组内用户只能使用同时满足两者的端口
+	ListenPortRanges StringSlice `json:"listen_port_ranges" gorm:"type:text"`
+	ReservedPorts    StringSlice `json:"reserved_ports" gorm:"type:text"`
+
+	// 规则配额：0 或为空表示不限制
+	MaxRules            int         `json:"max_rules" gorm:"default:0"`              // 组内每个用户最多的规则数
+	MaxTargetsPerRule   int         `json:"max_targets_per_rule" gorm:"default:0"`   // 单条规则最多的目标数
+	MaxTunnelRules      int         `json:"max_tunnel_rules" gorm:"default:0"`       // 每个用户最多启用隧道的规则数
+	MaxRuleTrafficLimit int64       `json:"max_rule_traffic_limit" gorm:"default:0"` // 单条规则流量上限的最大值，单位：字节；设置后规则必须设置流量上限
+	AllowedProtocols    StringSlice `json:"allowed_protocols" gorm:"type:text"`      // 允许使用的监听协议与隧道协议
+	AllowedModes        StringSlice `json:"allowed_modes" gorm:"type:text"`          // 允许使用的转发模式
 }
 
 // Node 节点表
 type Node struct {
+	ID              uint        `json:"id" gorm:"primaryKey"`
+	Name            string      `json:"name" gorm:"size:128;not null"`
+	Host            string      `json:"host" gorm:"size:255;not null"`
+	Port            int         `json:"port" gorm:"not null"`
+	Secret          string      `json:"-" gorm:"size:128;not null"`
+	NextSecret      string      `json:"-" gorm:"size:128"`                       // 轮换中的新密钥，重叠期内与 Secret 同时有效
+	SecretRotateAt  *time.Time  `json:"secret_rotate_at"`                        // 重叠期截止时间，到期后 NextSecret 取代 Secret
+	SecretRevokedAt *time.Time  `json:"secret_revoked_at"`                       // 凭据吊销时间，吊销后拒绝所有请求直到重新签发
+	Status          string      `json:"status" gorm:"size:20;default:'offline'"` // online, offline
+	NodeGroupID     uint        `json:"node_group_id"`
+	Protocols       StringSlice `json:"protocols" gorm:"type:text"` // JSON数组：["tcp","udp","ws","grpc",...]
+	Multiplier      float64     `json:"multiplier" gorm:"default:1"`
+	Region          string      `json:"region" gorm:"size:64"`
+	LastSeen        *time.Time  `json:"last_seen"`
+	ConfigRevision  int64       `json:"config_revision" gorm:"default:0"` // 配置版本号，影响该节点的规则/目标/协议/隧道出口变化时递增
+	CreatedAt       time.Time   `json:"created_at"`
+	UpdatedAt       time.Time   `json:"updated_at"`
+
+	// 监听端口策略：规则在该节点上的监听端口与隧道端口必须落在 ListenPortRanges 内（为空表示不限制）且不在 ReservedPorts 中
+	ListenPortRanges StringSlice `json:"listen_port_ranges" gorm:"type:text"` // JSON数组：["10000-20000","30000"]
+	ReservedPorts    StringSlice `json:"reserved_ports" gorm:"type:text"`
+
+	// 节点心跳上报的本机可绑定地址，规则可选择其中之一作为监听地址
+	ListenAddresses StringSlice `json:"listen_addresses" gorm:"type:text"`
+}
+
+// NodeEnrollmentToken 节点注册令牌（管理员签发，节点凭令牌注册并获得独立密钥）
+type NodeEnrollmentToken struct {
 	ID          uint        `json:"id" gorm:"primaryKey"`
-	Name        string      `json:"name" gorm:"size:128;not null"`
-	Host        string      `json:"host" gorm:"size:255;not null"`
-	Port        int         `json:"port" gorm:"not null"`
-	Secret      string      `json:"-" gorm:"size:128;not null"`
-	Status      string      `json:"status" gorm:"size:20;default:'offline'"` // online, offline
+	TokenHash   string      `json:"-" gorm:"size:64;uniqueIndex;not null"` // 令牌 SHA-256，明文只在签发时返回一次
+	TokenPrefix string      `json:"token_prefix" gorm:"size:16"`
+	Description string      `json:"description" gorm:"size:255"`
+	MaxUses     int         `json:"max_uses" gorm:"not null;default:1"`
+	UsedCount   int         `json:"used_count" gorm:"not null;default:0"`
+	ExpiresAt   *time.Time  `json:"expires_at"`
 	NodeGroupID uint        `json:"node_group_id"`
-	Protocols   StringSlice `json:"protocols" gorm:"type:text"` // JSON数组：["tcp","udp","ws","grpc",...]
-	Multiplier  float64     `json:"multiplier" gorm:"default:1"`
 	Region      string      `json:"region" gorm:"size:64"`
-	LastSeen    *time.Time  `json:"last_seen"`
+	Protocols   StringSlice `json:"protocols" gorm:"type:text"` // 为空时使用全部支持的协议
+	RevokedAt   *time.Time  `json:"revoked_at"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+	CreatedBy   uint        `json:"created_by"`
 	CreatedAt   time.Time   `json:"created_at"`
 	UpdatedAt   time.Time   `json:"updated_at"`
 }
 
+// NodeStatusEvent 节点上下线记录
+type NodeStatusEvent struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	NodeID     uint      `json:"node_id" gorm:"index;not null"`
+	FromStatus string    `json:"from_status" gorm:"size:20"`
+	ToStatus   string    `json:"to_status" gorm:"size:20;not null"`
+	Reason     string    `json:"reason" gorm:"size:32"` // heartbeat, timeout, admin
+	CreatedAt  time.Time `json:"created_at" gorm:"index"`
+}
+
 // NodeAllowedGroups 节点-用户组关联表
 type NodeAllowedGroup struct {
 	ID          uint      `json:"id" gorm:"primaryKey"`
@@ -69,23 +127,59 @@ type NodeGroup struct {
 
 // ForwardingRule 转发规则表
 type ForwardingRule struct {
-	ID             uint      `json:"id" gorm:"primaryKey"`
-	NodeID         uint      `json:"node_id" gorm:"index;not null"`
-	UserID         uint      `json:"user_id" gorm:"index;not null"`
-	Name           string    `json:"name" gorm:"size:128;not null"`
-	Protocol       string    `json:"protocol" gorm:"size:20;not null"` // tcp, udp
-	Enabled        bool      `json:"enabled" gorm:"default:true"`
-	TrafficUsed    int64     `json:"traffic_used" gorm:"default:0"`        // 单位：字节
-	TrafficLimit   int64     `json:"traffic_limit" gorm:"default:0"`       // 单位：字节
-	SpeedLimit     int64     `json:"speed_limit" gorm:"default:0"`         // 单位：kbps
-	Mode           string    `json:"mode" gorm:"size:20;default:'direct'"` // direct, rr, lb
-	ListenPort     int       `json:"listen_port" gorm:"not null"`
-	TunnelEnabled  bool      `json:"tunnel_enabled" gorm:"default:false"`
-	ExitNodeID     uint      `json:"exit_node_id" gorm:"index"`
-	TunnelProtocol string    `json:"tunnel_protocol" gorm:"size:20"`
-	TunnelPort     int       `json:"tunnel_port"`
-	CreatedAt      time.Time `json:"created_at"`
-	UpdatedAt      time.Time `json:"updated_at"`
+	ID             uint        `json:"id" gorm:"primaryKey"`
+	NodeID         uint        `json:"node_id" gorm:"index;not null"` // 单节点规则或 healthiest 部署时的当前节点；all 部署时为 0
+	NodeGroupID    uint        `json:"node_group_id" gorm:"index"`    // 入口节点组，0 表示单节点规则
+	Placement      string      `json:"placement" gorm:"size:16"`      // 节点组部署方式：all, healthiest
+	UserID         uint        `json:"user_id" gorm:"index;not null"`
+	Name           string      `json:"name" gorm:"size:128;not null"`
+	Protocol       string      `json:"protocol" gorm:"size:20;not null"` // tcp, udp
+	Enabled        bool        `json:"enabled" gorm:"default:true"`
+	DisabledReason string      `json:"disabled_reason" gorm:"size:32"`       // 系统自动禁用的原因：traffic_limit, balance_exhausted, destination_blocked, schedule_pending, expired, outside_window；手动启停时清空
+	TrafficUsed    int64       `json:"traffic_used" gorm:"default:0"`        // 单位：字节
+	TrafficLimit   int64       `json:"traffic_limit" gorm:"default:0"`       // 单位：字节
+	SpeedLimit     int64       `json:"speed_limit" gorm:"default:0"`         // 单位：kbps；兼容字段，上下行限速相同时等于该值，否则为 0
+	SpeedLimitUp   int64       `json:"speed_limit_up" gorm:"default:0"`      // 上行（客户端到目标）限速，单位：kbps，0 表示不限速
+	SpeedLimitDown int64       `json:"speed_limit_down" gorm:"default:0"`    // 下行（目标到客户端）限速，单位：kbps
+	MaxConnections int64       `json:"max_connections" gorm:"default:0"`     // 最大并发连接数，0 表示不限制
+	ConnRateLimit  int64       `json:"conn_rate_limit" gorm:"default:0"`     // 每秒新建连接数，0 表示不限制
+	ACLMode        string      `json:"acl_mode" gorm:"size:8"`               // 来源地址访问控制：allow（仅允许列表内）, deny（拒绝列表内），为空表示不限制
+	ACLEntries     StringSlice `json:"acl_entries" gorm:"type:text"`         // JSON数组：["10.0.0.0/8","2001:db8::/32",...]
+	ProxyProtocol  int         `json:"proxy_protocol" gorm:"default:0"`      // 向目标发送 PROXY protocol 的版本：0 不发送，1 或 2
+	AcceptProxy    bool        `json:"accept_proxy_protocol"`                // 监听端接收上游负载均衡发来的 PROXY protocol
+	Mode           string      `json:"mode" gorm:"size:20;default:'direct'"` // direct, rr, lb, least_conn, source_hash, failover
+	ListenPort     int         `json:"listen_port" gorm:"not null"`
+	ListenPortEnd  int         `json:"listen_port_end" gorm:"default:0"` // 端口范围规则的结束端口，0 表示单端口；目标端口从 Target.Port 起按相同偏移对应
+	ListenIP       string      `json:"listen_ip" gorm:"size:45"`         // 监听地址，须为入口节点上报的地址；为空表示监听全部地址
+	TunnelEnabled  bool        `json:"tunnel_enabled" gorm:"default:false"`
+	ExitNodeID     uint        `json:"exit_node_id" gorm:"index"`
+	ExitGroupID    uint        `json:"exit_group_id" gorm:"index"` // 出口节点组，选择其中最健康的节点作为 ExitNodeID
+	TunnelProtocol string      `json:"tunnel_protocol" gorm:"size:20"`
+	TunnelPort     int         `json:"tunnel_port"`
+	HealthCheck    HealthCheck `json:"health_check" gorm:"embedded;embeddedPrefix:health_check_"`
+	CreatedAt      time.Time   `json:"created_at"`
+	UpdatedAt      time.Time   `json:"updated_at"`
+
+	// Schedule 生效时间，不在生效时间内的规则由调度器禁用，进入生效时间后自动恢复
+	Schedule RuleSchedule `json:"schedule" gorm:"embedded;embeddedPrefix:schedule_"`
+}
+
+// HealthCheck 规则目标的主动健康检查设置，由部署规则的节点执行
+type HealthCheck struct {
+	Type       string `json:"type" gorm:"size:8"` // tcp（建立连接）, udp（发送探测包并等待响应）；为空表示不检查
+	Interval   int    `json:"interval"`           // 检查间隔，单位：秒
+	Timeout    int    `json:"timeout"`            // 单次检查超时，单位：秒
+	Rise       int    `json:"rise"`               // 连续成功达到该次数后判定为健康
+	Fall       int    `json:"fall"`               // 连续失败达到该次数后判定为不健康
+	AutoRemove bool   `json:"auto_remove"`        // 不健康的目标自动移出轮询，恢复健康后重新加入
+}
+
+// RuleSchedule 规则的生效时间：StartsAt 至 ExpiresAt 之间，且设置了每周生效时段时处于其中之一
+type RuleSchedule struct {
+	StartsAt  *time.Time  `json:"starts_at"`                // 生效时间，为空表示立即生效
+	ExpiresAt *time.Time  `json:"expires_at"`               // 到期时间，为空表示不过期
+	Windows   StringSlice `json:"windows" gorm:"type:text"` // JSON数组：["mon-fri 09:00-18:00","sat,sun 20:00-02:00"]，为空表示全天生效
+	Timezone  string      `json:"timezone" gorm:"size:64"`  // 生效时段使用的 IANA 时区，如 Asia/Shanghai；为空表示 UTC
 }
 
 // Target 转发目标表
@@ -95,21 +189,65 @@ type Target struct {
 	Host      string    `json:"host" gorm:"size:255;not null"`
 	Port      int       `json:"port" gorm:"not null"`
 	Weight    int       `json:"weight" gorm:"default:1"`
+	Priority  int       `json:"priority" gorm:"default:0"` // failover 模式的优先级，数值越小越优先
 	Enabled   bool      `json:"enabled" gorm:"default:true"`
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// TargetHealth 节点上报的目标健康状态，每个目标在每个执行检查的节点上一条
+type TargetHealth struct {
+	ID        uint      `json:"-" gorm:"primaryKey"`
+	TargetID  uint      `json:"target_id" gorm:"uniqueIndex:idx_target_health;not null"`
+	NodeID    uint      `json:"node_id" gorm:"uniqueIndex:idx_target_health;not null"`
+	RuleID    uint      `json:"rule_id" gorm:"index;not null"`
+	Healthy   bool      `json:"healthy"`
+	LatencyMs int64     `json:"latency_ms"`
+	Error     string    `json:"error" gorm:"size:255"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// DestinationPolicy 管理员设置的目标地址策略（全局唯一），创建/更新规则时校验目标，变更后复查已有规则
+type DestinationPolicy struct {
+	ID               uint        `json:"id" gorm:"primaryKey"`
+	BlockedCIDRs     StringSlice `json:"blocked_cidrs" gorm:"column:blocked_cidrs;type:text"` // JSON数组：["127.0.0.0/8","169.254.0.0/16",...]
+	BlockedPorts     StringSlice `json:"blocked_ports" gorm:"type:text"`                      // JSON数组：["25","6660-6669",...]
+	BlockedDomains   StringSlice `json:"blocked_domains" gorm:"type:text"`                    // JSON数组，同时匹配其子域名
+	ResolveHostnames bool        `json:"resolve_hostnames"`                                   // 校验时解析域名目标，按解析出的地址检查网段
+	UpdatedAt        time.Time   `json:"updated_at"`
+
+	// 已有规则由调度器在后台复查：保存策略或请求复查时递增 RecheckRevision，复查完成后 CheckedRevision 追上
+	RecheckRevision int64 `json:"recheck_revision"`
+	CheckedRevision int64 `json:"checked_revision"`
+}
+
+// DestinationViolation 最近一次策略复查发现的违规目标
+type DestinationViolation struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	RuleID    uint      `json:"rule_id" gorm:"index;not null"`
+	RuleName  string    `json:"rule_name" gorm:"size:128"`
+	UserID    uint      `json:"user_id" gorm:"index"`
+	TargetID  uint      `json:"target_id"`
+	Host      string    `json:"host" gorm:"size:255"`
+	Port      int       `json:"port"`
+	Reason    string    `json:"reason" gorm:"size:255"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
 // Package 套餐表
 type Package struct {
-	ID          uint      `json:"id" gorm:"primaryKey"`
-	Name        string    `json:"name" gorm:"size:128;not null"`
-	Traffic     int64     `json:"traffic" gorm:"not null"` // 单位：字节
-	Price       int64     `json:"price" gorm:"not null"`   // 单位：分
-	UserGroupID uint      `json:"user_group_id"`
-	Visible     bool      `json:"visible" gorm:"default:true"`    // 是否显示
-	Renewable   bool      `json:"renewable" gorm:"default:false"` // 是否可续费（重复购买）
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	ID                    uint      `json:"id" gorm:"primaryKey"`
+	Name                  string    `json:"name" gorm:"size:128;not null"`
+	Traffic               int64     `json:"traffic" gorm:"not null"` // 单位：字节
+	Price                 int64     `json:"price" gorm:"not null"`   // 单位：分
+	UserGroupID           uint      `json:"user_group_id"`
+	Visible               bool      `json:"visible" gorm:"default:true"`               // 是否显示
+	Renewable             bool      `json:"renewable" gorm:"default:false"`            // 是否可续费（重复购买）
+	DefaultSpeedLimitUp   int64     `json:"default_speed_limit_up" gorm:"default:0"`   // 设置任一限速项时，购买后覆盖用户组的限速设置，单位：kbps
+	DefaultSpeedLimitDown int64     `json:"default_speed_limit_down" gorm:"default:0"` // 单位：kbps
+	MaxSpeedLimitUp       int64     `json:"max_speed_limit_up" gorm:"default:0"`       // 单位：kbps，0 表示不限制
+	MaxSpeedLimitDown     int64     `json:"max_speed_limit_down" gorm:"default:0"`     // 单位：kbps
+	CreatedAt             time.Time `json:"created_at"`
+	UpdatedAt             time.Time `json:"updated_at"`
 }
 
 // Order 订单表
@@ -156,23 +294,58 @@ type SiteConfig struct {
 	ID                 uint      `json:"id" gorm:"primaryKey"`
 	SiteName           string    `json:"site_name" gorm:"size:128;not null"`
 	SiteDomain         string    `json:"site_domain" gorm:"size:255"`
-	NodeSecret         string    `json:"node_secret" gorm:"size:128"`
+	NodeSecret         string    `json:"-" gorm:"size:128"` // Deprecated: 节点改用注册令牌签发的独立密钥，仅保留列兼容旧数据库
 	NodeReportInterval int       `json:"node_report_interval" gorm:"default:10"`
+	NodeLegacyAuth     bool      `json:"node_legacy_auth" gorm:"default:true"` // 是否允许节点使用请求体明文密钥认证（迁移期兼容）
+	BillExitMultiplier bool      `json:"bill_exit_multiplier"`                 // 隧道规则计费时是否叠加出口节点倍率
 	CreatedAt          time.Time `json:"created_at"`
 	UpdatedAt          time.Time `json:"updated_at"`
 }
 
+// SchedulerLease 定时任务租约表（多副本部署时保证同一任务同一时刻只有一个实例执行）
+type SchedulerLease struct {
+	Name      string    `json:"name" gorm:"primaryKey;size:64"`
+	Holder    string    `json:"holder" gorm:"size:128;not null"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"index"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ListenPortReservation 自动分配端口的短期预留表（多副本部署时保证同一节点的同一端口只分配给一条规则）
+type ListenPortReservation struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	NodeID    uint      `json:"node_id" gorm:"not null;uniqueIndex:idx_listen_port_reservation,priority:1"`
+	Port      int       `json:"port" gorm:"not null;uniqueIndex:idx_listen_port_reservation,priority:2"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"index"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
 // TrafficLog 流量日志表
 type TrafficLog struct {
 	ID        uint      `json:"id" gorm:"primaryKey"`
 	RuleID    uint      `json:"rule_id" gorm:"index;not null"`
 	NodeID    uint      `json:"node_id" gorm:"index;not null"`
+	UserID    uint      `json:"user_id" gorm:"index"` // 规则所属用户，规则删除后仍可统计
 	BytesIn   int64     `json:"bytes_in" gorm:"default:0"`
 	BytesOut  int64     `json:"bytes_out" gorm:"default:0"`
+	Billed    int64     `json:"billed" gorm:"default:0"` // 按节点倍率计费后从用户流量余额扣除的字节数
+	RolledUp  bool      `json:"-" gorm:"index"`          // 是否已计入小时/天聚合
 	Timestamp time.Time `json:"timestamp" gorm:"index"`
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// TrafficRollup 流量日志按小时/天的聚合。Resolution 为聚合粒度（秒），按 UTC 对齐
+type TrafficRollup struct {
+	ID         uint      `json:"-" gorm:"primaryKey"`
+	RuleID     uint      `json:"rule_id" gorm:"not null;uniqueIndex:idx_traffic_rollup,priority:1"`
+	NodeID     uint      `json:"node_id" gorm:"not null;uniqueIndex:idx_traffic_rollup,priority:2"`
+	Resolution int       `json:"resolution" gorm:"not null;uniqueIndex:idx_traffic_rollup,priority:3"`
+	BucketAt   time.Time `json:"bucket_at" gorm:"not null;uniqueIndex:idx_traffic_rollup,priority:4;index"`
+	UserID     uint      `json:"user_id" gorm:"index"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+	Billed     int64     `json:"billed"`
+}
+
 // ProbeData 探针数据结构（不存数据库，仅 Redis 缓存）
 type ProbeData struct {
 	Timestamp int64         `json:"timestamp"`
@@ -181,14 +354,41 @@ type ProbeData struct {
 	Network   []NetworkInfo `json:"network"`
 }
 
+// NodeProbeSample 节点探针历史采样。Resolution 为聚合粒度（秒），0 表示原始采样
+type NodeProbeSample struct {
+	ID         uint      `json:"-" gorm:"primaryKey"`
+	NodeID     uint      `json:"node_id" gorm:"not null;uniqueIndex:idx_node_probe_sample,priority:1"`
+	Resolution int       `json:"resolution" gorm:"not null;uniqueIndex:idx_node_probe_sample,priority:2"`
+	SampledAt  time.Time `json:"sampled_at" gorm:"not null;uniqueIndex:idx_node_probe_sample,priority:3;index"`
+	Samples    int       `json:"samples"` // 聚合的原始采样数
+	CPUPercent float64   `json:"cpu_percent"`
+	CPUMax     float64   `json:"cpu_max"`
+	MemPercent float64   `json:"mem_percent"`
+	MemUsed    uint64    `json:"mem_used"`
+	MemTotal   uint64    `json:"mem_total"`
+	RxSpeed    uint64    `json:"rx_speed"` // 各网卡合计，字节/秒
+	TxSpeed    uint64    `json:"tx_speed"`
+	RxSpeedMax uint64    `json:"rx_speed_max"`
+	TxSpeedMax uint64    `json:"tx_speed_max"`
+}
+
+// StateEntry 运行时状态（未配置 Redis 时由数据库状态存储使用）
+type StateEntry struct {
+	Key       string     `gorm:"column:state_key;primaryKey;size:191"`
+	Value     []byte     `gorm:"column:value"`
+	ExpiresAt *time.Time `gorm:"index"`
+	UpdatedAt time.Time
+}
+
 // NodeDiagnostic 节点规则诊断信息（不存数据库，仅 Redis 缓存）
 type NodeDiagnostic struct {
-	RuleID     uint   `json:"rule_id"`
-	RuleName   string `json:"rule_name"`
-	ListenPort int    `json:"listen_port"`
-	Status     string `json:"status"`
-	Message    string `json:"message"`
-	UpdatedAt  int64  `json:"updated_at"`
+	RuleID            uint   `json:"rule_id"`
+	RuleName          string `json:"rule_name"`
+	ListenPort        int    `json:"listen_port"`
+	Status            string `json:"status"`
+	Message           string `json:"message"`
+	ActiveConnections int64  `json:"active_connections"` // 规则当前活动连接数，旧版节点不上报时为 0
+	UpdatedAt         int64  `json:"updated_at"`
 }
 
 // CPUInfo CPU 信息
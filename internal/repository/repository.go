@@ -82,12 +82,22 @@ func AutoMigrate(db *gorm.DB) error {
 		&models.NodeGroup{},
 		&models.ForwardingRule{},
 		&models.Target{},
+		&models.TargetHealth{},
+		&models.DestinationPolicy{},
+		&models.DestinationViolation{},
 		&models.Package{},
 		&models.Order{},
 		&models.PaymentConfig{},
 		&models.PaymentProvider{},
 		&models.SiteConfig{},
 		&models.TrafficLog{},
+		&models.TrafficRollup{},
+		&models.NodeStatusEvent{},
+		&models.NodeProbeSample{},
+		&models.StateEntry{},
+		&models.NodeEnrollmentToken{},
+		&models.SchedulerLease{},
+		&models.ListenPortReservation{},
 	); err != nil {
 		return err
 	}
@@ -116,6 +126,55 @@ func addMissingColumns(db *gorm.DB) error {
 		{"forwarding_rules", "exit_node_id", "BIGINT", "0"},
 		{"forwarding_rules", "tunnel_protocol", "VARCHAR(20)", "''"},
 		{"forwarding_rules", "tunnel_port", "INTEGER", "0"},
+		{"nodes", "config_revision", "BIGINT", "0"},
+		{"forwarding_rules", "node_group_id", "BIGINT", "0"},
+		{"forwarding_rules", "placement", "VARCHAR(16)", "''"},
+		{"forwarding_rules", "exit_group_id", "BIGINT", "0"},
+		{"nodes", "next_secret", "VARCHAR(128)", "''"},
+		{"nodes", "secret_rotate_at", "DATETIME", "NULL"},
+		{"nodes", "secret_revoked_at", "DATETIME", "NULL"},
+		{"site_configs", "node_legacy_auth", "BOOLEAN", "1"},
+		{"forwarding_rules", "disabled_reason", "VARCHAR(32)", "''"},
+		{"traffic_logs", "billed", "BIGINT", "0"},
+		{"site_configs", "bill_exit_multiplier", "BOOLEAN", "0"},
+		{"traffic_logs", "user_id", "BIGINT", "0"},
+		{"traffic_logs", "rolled_up", "BOOLEAN", "0"},
+		{"forwarding_rules", "speed_limit_up", "BIGINT", "0"},
+		{"forwarding_rules", "speed_limit_down", "BIGINT", "0"},
+		{"user_groups", "default_speed_limit_up", "BIGINT", "0"},
+		{"user_groups", "default_speed_limit_down", "BIGINT", "0"},
+		{"user_groups", "max_speed_limit_up", "BIGINT", "0"},
+		{"user_groups", "max_speed_limit_down", "BIGINT", "0"},
+		{"packages", "default_speed_limit_up", "BIGINT", "0"},
+		{"packages", "default_speed_limit_down", "BIGINT", "0"},
+		{"packages", "max_speed_limit_up", "BIGINT", "0"},
+		{"packages", "max_speed_limit_down", "BIGINT", "0"},
+		{"forwarding_rules", "max_connections", "BIGINT", "0"},
+		{"forwarding_rules", "conn_rate_limit", "BIGINT", "0"},
+		{"user_groups", "max_rule_connections", "BIGINT", "0"},
+		{"user_groups", "max_rule_conn_rate", "BIGINT", "0"},
+		{"forwarding_rules", "acl_mode", "VARCHAR(8)", "''"},
+		{"forwarding_rules", "proxy_protocol", "INTEGER", "0"},
+		{"forwarding_rules", "accept_proxy", "BOOLEAN", "0"},
+		{"targets", "priority", "INTEGER", "0"},
+		{"forwarding_rules", "health_check_type", "VARCHAR(8)", "''"},
+		{"forwarding_rules", "health_check_interval", "INTEGER", "0"},
+		{"forwarding_rules", "health_check_timeout", "INTEGER", "0"},
+		{"forwarding_rules", "health_check_rise", "INTEGER", "0"},
+		{"forwarding_rules", "health_check_fall", "INTEGER", "0"},
+		{"forwarding_rules", "health_check_auto_remove", "BOOLEAN", "0"},
+		{"forwarding_rules", "listen_port_end", "INTEGER", "0"},
+		{"forwarding_rules", "listen_ip", "VARCHAR(45)", "''"},
+		{"forwarding_rules", "schedule_starts_at", "DATETIME", "NULL"},
+		{"forwarding_rules", "schedule_expires_at", "DATETIME", "NULL"},
+		{"forwarding_rules", "schedule_windows", "TEXT", "NULL"},
+		{"forwarding_rules", "schedule_timezone", "VARCHAR(64)", "''"},
+		{"user_groups", "max_rules", "INTEGER", "0"},
+		{"user_groups", "max_targets_per_rule", "INTEGER", "0"},
+		{"user_groups", "max_tunnel_rules", "INTEGER", "0"},
+		{"user_groups", "max_rule_traffic_limit", "BIGINT", "0"},
+		{"destination_policies", "recheck_revision", "BIGINT", "0"},
+		{"destination_policies", "checked_revision", "BIGINT", "0"},
 	}
 
 	// 检测数据库类型
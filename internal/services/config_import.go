@@ -0,0 +1,443 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"bakaray/internal/models"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// 可导入的节点配置格式
+const (
+	ConfigFormatGost  = "gost"  // gost v3 YAML（或 JSON）配置
+	ConfigFormatRealm = "realm" // realm TOML 配置
+)
+
+var ErrInvalidNodeConfig = errors.New("无法解析节点配置")
+
+// ImportedRule 从节点配置中转换出的规则
+type ImportedRule struct {
+	Source         string // 配置中的位置，如 services[0]、endpoints[2]
+	Name           string
+	Protocol       string // tcp, udp
+	ListenPort     int
+	ListenPortEnd  int // gost 端口范围转发的结束端口，单端口为 0
+	Mode           string
+	Targets        []models.Target
+	TunnelProtocol string // 非空时规则经单跳转发链到达出口节点，由导入方指定出口节点
+	TunnelPort     int
+}
+
+// ConfigImportIssue 配置中无法转换的内容
+type ConfigImportIssue struct {
+	Source  string `json:"source"`
+	Message string `json:"message"`
+}
+
+// ConfigImportResult 节点配置的转换结果
+type ConfigImportResult struct {
+	Rules       []ImportedRule
+	Unsupported []ConfigImportIssue
+}
+
+func (r *ConfigImportResult) unsupported(source, format string, args ...any) {
+	r.Unsupported = append(r.Unsupported, ConfigImportIssue{Source: source, Message: fmt.Sprintf(format, args...)})
+}
+
+// ParseNodeConfig 按格式解析节点配置
+func ParseNodeConfig(format string, data []byte) (*ConfigImportResult, error) {
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case ConfigFormatGost:
+		return ParseGostConfig(data)
+	case ConfigFormatRealm:
+		return ParseRealmConfig(data)
+	default:
+		return nil, fmt.Errorf("%w: 格式仅支持 gost 或 realm", ErrInvalidNodeConfig)
+	}
+}
+
+type gostConfig struct {
+	Services []gostService `yaml:"services"`
+	Chains   []gostChain   `yaml:"chains"`
+}
+
+type gostService struct {
+	Name      string         `yaml:"name"`
+	Addr      string         `yaml:"addr"`
+	Handler   gostHandler    `yaml:"handler"`
+	Listener  gostComponent  `yaml:"listener"`
+	Forwarder *gostForwarder `yaml:"forwarder"`
+}
+
+type gostHandler struct {
+	Type  string `yaml:"type"`
+	Chain string `yaml:"chain"`
+}
+
+type gostComponent struct {
+	Type string `yaml:"type"`
+}
+
+type gostForwarder struct {
+	Nodes    []gostNode `yaml:"nodes"`
+	Selector *struct {
+		Strategy string `yaml:"strategy"`
+	} `yaml:"selector"`
+}
+
+type gostNode struct {
+	Name      string        `yaml:"name"`
+	Addr      string        `yaml:"addr"`
+	Connector gostComponent `yaml:"connector"`
+	Dialer    gostComponent `yaml:"dialer"`
+}
+
+type gostChain struct {
+	Name string `yaml:"name"`
+	Hops []struct {
+		Name  string     `yaml:"name"`
+		Nodes []gostNode `yaml:"nodes"`
+	} `yaml:"hops"`
+}
+
+// gostSelectorModes gost 负载均衡策略对应的转发模式，fifo 按节点顺序作为主备
+var gostSelectorModes = map[string]string{
+	"round": RuleModeRoundRobin,
+	"rand":  RuleModeLoadBalance,
+	"fifo":  RuleModeFailover,
+	"hash":  RuleModeSourceHash,
+}
+
+// ParseGostConfig 解析 gost v3 配置中的 tcp/udp 端口转发服务。
+// handler 引用的转发链只有一跳且该跳只有一个节点时转换为隧道规则，节点的 dialer 类型作为隧道协议；
+// 其他服务（代理、反向转发、多跳链等）列入 Unsupported。
+func ParseGostConfig(data []byte) (*ConfigImportResult, error) {
+	var cfg gostConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidNodeConfig, err)
+	}
+
+	chains := make(map[string]gostChain, len(cfg.Chains))
+	for _, chain := range cfg.Chains {
+		chains[chain.Name] = chain
+	}
+
+	result := &ConfigImportResult{}
+	for i, svc := range cfg.Services {
+		source := fmt.Sprintf("services[%d]", i)
+		if svc.Name != "" {
+			source += " " + svc.Name
+		}
+
+		handlerType := strings.ToLower(svc.Handler.Type)
+		listenerType := strings.ToLower(svc.Listener.Type)
+		if listenerType == "" {
+			listenerType = "tcp"
+		}
+		if handlerType != "tcp" && handlerType != "udp" {
+			if handlerType == "relay" && IsTunnelProtocol(listenerType) {
+				result.unsupported(source, "%s 监听的 relay 服务是隧道出口，由面板为隧道规则自动生成，已跳过", listenerType)
+			} else {
+				result.unsupported(source, "不支持 %s 类型的服务，仅导入 tcp/udp 端口转发", coalesceType(handlerType))
+			}
+			continue
+		}
+		if listenerType != handlerType {
+			result.unsupported(source, "%s 转发服务使用 %s 监听，暂不支持", handlerType, listenerType)
+			continue
+		}
+
+		port, portEnd, err := parseListenPort(svc.Addr)
+		if err != nil {
+			result.unsupported(source, "%v", err)
+			continue
+		}
+		if svc.Forwarder == nil || len(svc.Forwarder.Nodes) == 0 {
+			result.unsupported(source, "没有 forwarder 目标")
+			continue
+		}
+
+		rule := ImportedRule{Source: source, Name: svc.Name, Protocol: handlerType, ListenPort: port}
+		if portEnd != port {
+			rule.ListenPortEnd = portEnd
+		}
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("gost-%s-%d", handlerType, port)
+		}
+		targets, err := importTargets(svc.Forwarder.Nodes, portEnd-port)
+		if err != nil {
+			result.unsupported(source, "%v", err)
+			continue
+		}
+		rule.Targets = targets
+
+		strategy := ""
+		if svc.Forwarder.Selector != nil {
+			strategy = strings.ToLower(svc.Forwarder.Selector.Strategy)
+		}
+		rule.Mode = RuleModeDirect
+		if len(targets) > 1 {
+			mode, ok := gostSelectorModes[strategy]
+			if strategy == "" {
+				mode, ok = RuleModeRoundRobin, true
+			}
+			if !ok {
+				result.unsupported(source, "不支持的负载均衡策略 %s", strategy)
+				continue
+			}
+			rule.Mode = mode
+			if mode == RuleModeFailover {
+				for j := range rule.Targets {
+					rule.Targets[j].Priority = j
+				}
+			}
+		}
+
+		if svc.Handler.Chain != "" {
+			chain, ok := chains[svc.Handler.Chain]
+			if !ok {
+				result.unsupported(source, "引用的转发链 %s 不存在", svc.Handler.Chain)
+				continue
+			}
+			if len(chain.Hops) != 1 || len(chain.Hops[0].Nodes) != 1 {
+				result.unsupported(source, "转发链 %s 不是单跳单节点，无法转换为隧道", chain.Name)
+				continue
+			}
+			hop := chain.Hops[0].Nodes[0]
+			protocol := NormalizeProtocol(hop.Dialer.Type)
+			if protocol == "" {
+				protocol = "tcp"
+			}
+			if !IsTunnelProtocol(protocol) {
+				result.unsupported(source, "转发链 %s 的 %s 拨号器没有对应的隧道协议", chain.Name, protocol)
+				continue
+			}
+			if connector := strings.ToLower(hop.Connector.Type); connector != "" && connector != "relay" && connector != "forward" {
+				result.unsupported(source, "转发链 %s 使用 %s 连接器，仅支持 relay", chain.Name, connector)
+				continue
+			}
+			_, tunnelPort, err := splitHostPort(hop.Addr)
+			if err != nil {
+				result.unsupported(source, "转发链 %s 的节点地址无效: %v", chain.Name, err)
+				continue
+			}
+			rule.TunnelProtocol = protocol
+			rule.TunnelPort = tunnelPort
+		}
+
+		result.Rules = append(result.Rules, rule)
+	}
+	return result, nil
+}
+
+type realmConfig struct {
+	Network   realmNetwork    `toml:"network"`
+	Endpoints []realmEndpoint `toml:"endpoints"`
+}
+
+type realmNetwork struct {
+	NoTCP  *bool `toml:"no_tcp"`
+	UseUDP *bool `toml:"use_udp"`
+}
+
+type realmEndpoint struct {
+	Listen          string       `toml:"listen"`
+	Remote          string       `toml:"remote"`
+	ExtraRemotes    []string     `toml:"extra_remotes"`
+	Balance         string       `toml:"balance"`
+	Through         string       `toml:"through"`
+	Network         realmNetwork `toml:"network"`
+	ListenTransport string       `toml:"listen_transport"`
+	RemoteTransport string       `toml:"remote_transport"`
+}
+
+// ParseRealmConfig 解析 realm 配置的 endpoints。同时开启 TCP 与 UDP 的端点拆成两条规则；
+// balance 的 roundrobin/iphash 转换为 rr/source_hash 并带上权重，未设置 balance 的多目标按顺序作为主备。
+// 使用 listen_transport/remote_transport 的端点的最终目标在另一端配置中，无法转换，列入 Unsupported。
+func ParseRealmConfig(data []byte) (*ConfigImportResult, error) {
+	var cfg realmConfig
+	if err := toml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidNodeConfig, err)
+	}
+
+	result := &ConfigImportResult{}
+	for i, ep := range cfg.Endpoints {
+		source := fmt.Sprintf("endpoints[%d]", i)
+		if ep.ListenTransport != "" || ep.RemoteTransport != "" {
+			result.unsupported(source, "使用了 listen_transport/remote_transport 的 realm 隧道端点，最终目标在另一端配置中，已跳过")
+			continue
+		}
+
+		port, portEnd, err := parseListenPort(ep.Listen)
+		if err == nil && portEnd != port {
+			err = fmt.Errorf("realm 不支持监听端口范围 %s", ep.Listen)
+		}
+		if err != nil {
+			result.unsupported(source, "%v", err)
+			continue
+		}
+
+		remotes := append([]string{ep.Remote}, ep.ExtraRemotes...)
+		targets := make([]models.Target, 0, len(remotes))
+		for _, remote := range remotes {
+			host, targetPort, err := splitHostPort(remote)
+			if err != nil {
+				targets = nil
+				result.unsupported(source, "目标 %s 无效: %v", remote, err)
+				break
+			}
+			targets = append(targets, models.Target{Host: host, Port: targetPort, Weight: 1, Enabled: true})
+		}
+		if targets == nil {
+			continue
+		}
+
+		mode := RuleModeDirect
+		if len(targets) > 1 {
+			strategy, weights, err := parseRealmBalance(ep.Balance, len(targets))
+			if err != nil {
+				result.unsupported(source, "%v", err)
+				continue
+			}
+			mode = strategy
+			for j := range targets {
+				if weights != nil {
+					targets[j].Weight = weights[j]
+				}
+				if mode == RuleModeFailover {
+					targets[j].Priority = j
+				}
+			}
+		}
+		if ep.Through != "" {
+			result.unsupported(source, "through=%s 已忽略，节点使用默认出口地址", ep.Through)
+		}
+
+		noTCP := realmFlag(ep.Network.NoTCP, cfg.Network.NoTCP, false)
+		useUDP := realmFlag(ep.Network.UseUDP, cfg.Network.UseUDP, false)
+		var protocols []string
+		if !noTCP {
+			protocols = append(protocols, "tcp")
+		}
+		if useUDP {
+			protocols = append(protocols, "udp")
+		}
+		if len(protocols) == 0 {
+			result.unsupported(source, "同时关闭了 TCP 与 UDP")
+			continue
+		}
+		for _, protocol := range protocols {
+			ruleTargets := make([]models.Target, len(targets))
+			copy(ruleTargets, targets)
+			result.Rules = append(result.Rules, ImportedRule{
+				Source:     source,
+				Name:       fmt.Sprintf("realm-%s-%d", protocol, port),
+				Protocol:   protocol,
+				ListenPort: port,
+				Mode:       mode,
+				Targets:    ruleTargets,
+			})
+		}
+	}
+	return result, nil
+}
+
+// parseRealmBalance 解析 "roundrobin: 4, 2, 1" 形式的 balance 设置，权重可省略
+func parseRealmBalance(balance string, targets int) (string, []int, error) {
+	strategy, weightText, _ := strings.Cut(balance, ":")
+	var mode string
+	switch strings.ToLower(strings.TrimSpace(strategy)) {
+	case "":
+		return RuleModeFailover, nil, nil
+	case "roundrobin":
+		mode = RuleModeRoundRobin
+	case "iphash":
+		mode = RuleModeSourceHash
+	default:
+		return "", nil, fmt.Errorf("不支持的 balance 策略 %s", strategy)
+	}
+	if strings.TrimSpace(weightText) == "" {
+		return mode, nil, nil
+	}
+	parts := strings.Split(weightText, ",")
+	if len(parts) != targets {
+		return "", nil, fmt.Errorf("balance 权重数量 %d 与目标数量 %d 不一致", len(parts), targets)
+	}
+	weights := make([]int, len(parts))
+	for i, part := range parts {
+		weight, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || weight <= 0 {
+			return "", nil, fmt.Errorf("balance 权重 %s 无效", strings.TrimSpace(part))
+		}
+		weights[i] = weight
+	}
+	return mode, weights, nil
+}
+
+func realmFlag(endpoint, global *bool, fallback bool) bool {
+	if endpoint != nil {
+		return *endpoint
+	}
+	if global != nil {
+		return *global
+	}
+	return fallback
+}
+
+// importTargets 转换 forwarder 节点；监听端口范围的 span 不为 0 时，目标必须是大小相同的端口范围
+func importTargets(nodes []gostNode, span int) ([]models.Target, error) {
+	targets := make([]models.Target, 0, len(nodes))
+	for _, node := range nodes {
+		host, portText, err := net.SplitHostPort(strings.TrimSpace(node.Addr))
+		if err != nil || host == "" {
+			return nil, fmt.Errorf("目标 %s 无效", node.Addr)
+		}
+		low, high, err := parsePortRange(portText)
+		if err != nil {
+			return nil, fmt.Errorf("目标 %s 无效: %v", node.Addr, err)
+		}
+		if high-low != span {
+			return nil, fmt.Errorf("目标 %s 的端口范围与监听端口范围大小不一致", node.Addr)
+		}
+		targets = append(targets, models.Target{Host: host, Port: low, Weight: 1, Enabled: true})
+	}
+	return targets, nil
+}
+
+// parseListenPort 解析 ":8080"、"0.0.0.0:8080"、"[::]:8080"、":10000-10010" 形式的监听地址
+func parseListenPort(addr string) (int, int, error) {
+	_, portText, err := net.SplitHostPort(strings.TrimSpace(addr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("监听地址 %s 无效", addr)
+	}
+	low, high, err := parsePortRange(portText)
+	if err != nil {
+		return 0, 0, fmt.Errorf("监听端口 %s 无效", portText)
+	}
+	return low, high, nil
+}
+
+func splitHostPort(addr string) (string, int, error) {
+	host, portText, err := net.SplitHostPort(strings.TrimSpace(addr))
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil || port < 1 || port > 65535 || host == "" {
+		return "", 0, fmt.Errorf("地址 %s 无效", addr)
+	}
+	return host, port, nil
+}
+
+func coalesceType(value string) string {
+	if value == "" {
+		return "未指定"
+	}
+	return value
+}
@@ -0,0 +1,170 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseGostConfig(t *testing.T) {
+	config := `
+services:
+  - name: web
+    addr: ":8080"
+    handler:
+      type: tcp
+    listener:
+      type: tcp
+    forwarder:
+      selector:
+        strategy: fifo
+      nodes:
+        - name: a
+          addr: 10.0.0.1:80
+        - name: b
+          addr: 10.0.0.2:80
+  - name: dns
+    addr: "[::]:5353"
+    handler:
+      type: udp
+    listener:
+      type: udp
+    forwarder:
+      nodes:
+        - addr: 10.0.0.53:53
+  - name: via-tunnel
+    addr: ":9000"
+    handler:
+      type: tcp
+      chain: to-exit
+    listener:
+      type: tcp
+    forwarder:
+      nodes:
+        - addr: 192.168.1.10:22
+  - name: exit
+    addr: ":8443"
+    handler:
+      type: relay
+    listener:
+      type: wss
+  - name: socks
+    addr: ":1080"
+    handler:
+      type: socks5
+  - name: range
+    addr: ":10000-10010"
+    handler:
+      type: tcp
+    forwarder:
+      nodes:
+        - addr: 10.0.0.1:20000-20010
+  - name: range-mismatch
+    addr: ":11000-11010"
+    handler:
+      type: tcp
+    forwarder:
+      nodes:
+        - addr: 10.0.0.1:11000
+chains:
+  - name: to-exit
+    hops:
+      - name: hop-0
+        nodes:
+          - name: exit
+            addr: exit.example.com:8443
+            connector:
+              type: relay
+            dialer:
+              type: wss
+`
+	result, err := ParseGostConfig([]byte(config))
+	require.NoError(t, err)
+	require.Len(t, result.Rules, 4)
+	require.Len(t, result.Unsupported, 3)
+
+	web := result.Rules[0]
+	require.Equal(t, "web", web.Name)
+	require.Equal(t, "tcp", web.Protocol)
+	require.Equal(t, 8080, web.ListenPort)
+	require.Equal(t, RuleModeFailover, web.Mode)
+	require.Len(t, web.Targets, 2)
+	require.Equal(t, "10.0.0.2", web.Targets[1].Host)
+	require.Equal(t, 1, web.Targets[1].Priority)
+
+	dns := result.Rules[1]
+	require.Equal(t, "udp", dns.Protocol)
+	require.Equal(t, 5353, dns.ListenPort)
+	require.Equal(t, RuleModeDirect, dns.Mode)
+
+	tunnel := result.Rules[2]
+	require.Equal(t, "wss", tunnel.TunnelProtocol)
+	require.Equal(t, 8443, tunnel.TunnelPort)
+	require.Equal(t, "192.168.1.10", tunnel.Targets[0].Host)
+
+	portRange := result.Rules[3]
+	require.Equal(t, 10000, portRange.ListenPort)
+	require.Equal(t, 10010, portRange.ListenPortEnd)
+	require.Equal(t, 20000, portRange.Targets[0].Port)
+
+	require.Contains(t, result.Unsupported[0].Source, "exit")
+	require.Contains(t, result.Unsupported[1].Message, "socks5")
+	require.Contains(t, result.Unsupported[2].Message, "端口范围")
+
+	_, err = ParseGostConfig([]byte("services: ["))
+	require.ErrorIs(t, err, ErrInvalidNodeConfig)
+}
+
+func TestParseRealmConfig(t *testing.T) {
+	config := `
+[network]
+use_udp = true
+
+[[endpoints]]
+listen = "0.0.0.0:5000"
+remote = "10.0.0.1:443"
+extra_remotes = ["10.0.0.2:443", "10.0.0.3:443"]
+balance = "roundrobin: 4, 2, 1"
+
+[[endpoints]]
+listen = "[::]:6000"
+remote = "backup.example.com:80"
+extra_remotes = ["10.0.0.9:80"]
+network = { use_udp = false }
+through = "192.168.0.2"
+
+[[endpoints]]
+listen = "0.0.0.0:7000"
+remote = "10.0.0.4:7000"
+remote_transport = "ws;host=example.com;path=/chat"
+`
+	result, err := ParseRealmConfig([]byte(config))
+	require.NoError(t, err)
+	require.Len(t, result.Rules, 3)
+
+	require.Equal(t, "tcp", result.Rules[0].Protocol)
+	require.Equal(t, "udp", result.Rules[1].Protocol)
+	for _, rule := range result.Rules[:2] {
+		require.Equal(t, 5000, rule.ListenPort)
+		require.Equal(t, RuleModeRoundRobin, rule.Mode)
+		require.Len(t, rule.Targets, 3)
+		require.Equal(t, 4, rule.Targets[0].Weight)
+		require.Equal(t, 1, rule.Targets[2].Weight)
+	}
+
+	failover := result.Rules[2]
+	require.Equal(t, "tcp", failover.Protocol)
+	require.Equal(t, 6000, failover.ListenPort)
+	require.Equal(t, RuleModeFailover, failover.Mode)
+	require.Equal(t, "backup.example.com", failover.Targets[0].Host)
+	require.Equal(t, 1, failover.Targets[1].Priority)
+
+	require.Len(t, result.Unsupported, 2)
+	require.Contains(t, result.Unsupported[0].Message, "through")
+	require.Equal(t, "endpoints[2]", result.Unsupported[1].Source)
+
+	_, _, err = parseRealmBalance("roundrobin: 1, 2", 3)
+	require.Error(t, err)
+	_, err = ParseNodeConfig("nginx", nil)
+	require.ErrorIs(t, err, ErrInvalidNodeConfig)
+}
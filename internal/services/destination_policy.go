@@ -0,0 +1,506 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bakaray/internal/logger"
+	"bakaray/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// RuleDisabledDestinationBlocked 规则目标违反目标地址策略，修改目标或策略放宽后自动恢复
+const RuleDisabledDestinationBlocked = "destination_blocked"
+
+// MaxDestinationPolicyEntries 目标地址策略每个列表最多的条目数
+const MaxDestinationPolicyEntries = 1024
+
+// destinationLookupTimeout 校验时解析单个域名的超时
+const destinationLookupTimeout = 3 * time.Second
+
+// destinationLookupWorkers 复查时同时解析的域名数
+const destinationLookupWorkers = 8
+
+// DestinationRecheckSweepInterval 检查是否有待执行的目标地址策略复查的周期
+const DestinationRecheckSweepInterval = 10 * time.Second
+
+var (
+	ErrInvalidDestinationPolicy = errors.New("无效的目标地址策略")
+	ErrDestinationBlocked       = errors.New("目标地址被禁止")
+)
+
+// NormalizeDestinationPolicy 校验并规范化目标地址策略：网段按掩码对齐，端口为单个端口或 a-b 范围，
+// 域名转为小写并去掉开头的 "*."，各列表去重
+func NormalizeDestinationPolicy(policy *models.DestinationPolicy) error {
+	cidrs, err := normalizePolicyList(policy.BlockedCIDRs, func(entry string) (string, error) {
+		prefix, err := parseACLPrefix(entry)
+		if err != nil {
+			return "", fmt.Errorf("%s 不是有效的 IP 地址或 CIDR", entry)
+		}
+		return prefix.String(), nil
+	})
+	if err != nil {
+		return err
+	}
+	ports, err := normalizePolicyList(policy.BlockedPorts, func(entry string) (string, error) {
+		low, high, err := parsePortRange(entry)
+		if err != nil {
+			return "", err
+		}
+		if low == high {
+			return strconv.Itoa(low), nil
+		}
+		return fmt.Sprintf("%d-%d", low, high), nil
+	})
+	if err != nil {
+		return err
+	}
+	domains, err := normalizePolicyList(policy.BlockedDomains, func(entry string) (string, error) {
+		domain := strings.TrimSuffix(strings.TrimPrefix(strings.ToLower(entry), "*."), ".")
+		if domain == "" || strings.ContainsAny(domain, " /:*") {
+			return "", fmt.Errorf("%s 不是有效的域名", entry)
+		}
+		return domain, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	policy.BlockedCIDRs = cidrs
+	policy.BlockedPorts = ports
+	policy.BlockedDomains = domains
+	return nil
+}
+
+func normalizePolicyList(entries []string, normalize func(string) (string, error)) (models.StringSlice, error) {
+	out := make(models.StringSlice, 0, len(entries))
+	seen := make(map[string]struct{}, len(entries))
+	for _, raw := range entries {
+		entry := strings.TrimSpace(raw)
+		if entry == "" {
+			continue
+		}
+		value, err := normalize(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidDestinationPolicy, err.Error())
+		}
+		if _, ok := seen[value]; ok {
+			continue
+		}
+		seen[value] = struct{}{}
+		out = append(out, value)
+	}
+	if len(out) > MaxDestinationPolicyEntries {
+		return nil, fmt.Errorf("%w: 每个列表最多 %d 条", ErrInvalidDestinationPolicy, MaxDestinationPolicyEntries)
+	}
+	return out, nil
+}
+
+// parsePortRange 解析 "25" 或 "6660-6669" 形式的端口范围
+func parsePortRange(entry string) (int, int, error) {
+	lowText, highText, isRange := strings.Cut(entry, "-")
+	low, err := strconv.Atoi(strings.TrimSpace(lowText))
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s 不是有效的端口", entry)
+	}
+	high := low
+	if isRange {
+		if high, err = strconv.Atoi(strings.TrimSpace(highText)); err != nil {
+			return 0, 0, fmt.Errorf("%s 不是有效的端口范围", entry)
+		}
+	}
+	if low < 1 || high > 65535 || low > high {
+		return 0, 0, fmt.Errorf("端口范围 %s 必须在 1-65535 之间且起始不大于结束", entry)
+	}
+	return low, high, nil
+}
+
+// destinationPolicy 解析后的目标地址策略
+type destinationPolicy struct {
+	prefixes []netip.Prefix
+	ports    [][2]int
+	domains  []string
+	resolve  bool
+}
+
+func compileDestinationPolicy(policy *models.DestinationPolicy) *destinationPolicy {
+	compiled := &destinationPolicy{domains: []string(policy.BlockedDomains), resolve: policy.ResolveHostnames}
+	for _, entry := range policy.BlockedCIDRs {
+		if prefix, err := parseACLPrefix(entry); err == nil {
+			compiled.prefixes = append(compiled.prefixes, prefix)
+		}
+	}
+	for _, entry := range policy.BlockedPorts {
+		if low, high, err := parsePortRange(entry); err == nil {
+			compiled.ports = append(compiled.ports, [2]int{low, high})
+		}
+	}
+	return compiled
+}
+
+func (p *destinationPolicy) empty() bool {
+	return len(p.prefixes) == 0 && len(p.ports) == 0 && len(p.domains) == 0
+}
+
+func (p *destinationPolicy) blockedAddr(addr netip.Addr) (netip.Prefix, bool) {
+	addr = addr.Unmap()
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(addr) {
+			return prefix, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// check 检查单个目标，返回违规原因，未违规时返回空字符串。
+// span 为端口范围规则的端口数减一，目标端口 port 至 port+span 均需检查；
+// lookup 为 nil 时不解析域名；strict 为 true 时域名解析失败也视为违规
+func (p *destinationPolicy) check(host string, port, span int, lookup func(string) ([]netip.Addr, error), strict bool) string {
+	for _, r := range p.ports {
+		if port <= r[1] && port+span >= r[0] {
+			return fmt.Sprintf("端口 %d 被禁止", max(port, r[0]))
+		}
+	}
+
+	host = normalizeDestinationHost(host)
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if prefix, blocked := p.blockedAddr(addr); blocked {
+			return fmt.Sprintf("地址 %s 属于被禁止的网段 %s", host, prefix)
+		}
+		return ""
+	}
+
+	domain := strings.ToLower(host)
+	for _, blocked := range p.domains {
+		if domain == blocked || strings.HasSuffix(domain, "."+blocked) {
+			return fmt.Sprintf("域名 %s 在黑名单中", host)
+		}
+	}
+
+	if !p.resolve || lookup == nil || len(p.prefixes) == 0 {
+		return ""
+	}
+	addrs, err := lookup(domain)
+	if err != nil {
+		if strict {
+			return fmt.Sprintf("域名 %s 解析失败", host)
+		}
+		return ""
+	}
+	for _, addr := range addrs {
+		if prefix, blocked := p.blockedAddr(addr); blocked {
+			return fmt.Sprintf("域名 %s 解析到被禁止的网段 %s", host, prefix)
+		}
+	}
+	return ""
+}
+
+// normalizeDestinationHost 去掉目标地址两侧的空白、IPv6 方括号与域名末尾的点
+func normalizeDestinationHost(host string) string {
+	return strings.TrimSuffix(strings.Trim(strings.TrimSpace(host), "[]"), ".")
+}
+
+// prefetchLookups 并发解析策略需要检查的目标域名（最多 destinationLookupWorkers 个同时进行），
+// 返回只读取解析结果的 lookup，复查在开启事务前完成全部 DNS 查询
+func (s *RuleService) prefetchLookups(ctx context.Context, policy *destinationPolicy, targets []models.Target) (func(string) ([]netip.Addr, error), error) {
+	type result struct {
+		addrs []netip.Addr
+		err   error
+	}
+	results := make(map[string]result)
+	lookup := func(host string) ([]netip.Addr, error) {
+		r, ok := results[host]
+		if !ok {
+			return nil, fmt.Errorf("域名 %s 未解析", host)
+		}
+		return r.addrs, r.err
+	}
+	if !policy.resolve || len(policy.prefixes) == 0 {
+		return lookup, nil
+	}
+
+	var hosts []string
+	seen := make(map[string]struct{})
+	for _, t := range targets {
+		host := normalizeDestinationHost(t.Host)
+		if _, err := netip.ParseAddr(host); err == nil {
+			continue
+		}
+		host = strings.ToLower(host)
+		if _, ok := seen[host]; !ok {
+			seen[host] = struct{}{}
+			hosts = append(hosts, host)
+		}
+	}
+
+	queue := make(chan string)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for range min(destinationLookupWorkers, len(hosts)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for host := range queue {
+				lookupCtx, cancel := context.WithTimeout(ctx, destinationLookupTimeout)
+				addrs, err := s.resolveHost(lookupCtx, host)
+				cancel()
+				mu.Lock()
+				results[host] = result{addrs: addrs, err: err}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, host := range hosts {
+		queue <- host
+	}
+	close(queue)
+	wg.Wait()
+	// 解析因退出而中断时不复查，避免把解析失败的违规目标当作合规
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return lookup, nil
+}
+
+// lookupHost 解析域名，结果按域名缓存，供一次校验或复查内复用
+func (s *RuleService) lookupHost() func(string) ([]netip.Addr, error) {
+	type result struct {
+		addrs []netip.Addr
+		err   error
+	}
+	cache := make(map[string]result)
+	return func(host string) ([]netip.Addr, error) {
+		if r, ok := cache[host]; ok {
+			return r.addrs, r.err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), destinationLookupTimeout)
+		defer cancel()
+		addrs, err := s.resolveHost(ctx, host)
+		cache[host] = result{addrs: addrs, err: err}
+		return addrs, err
+	}
+}
+
+// GetDestinationPolicy 获取目标地址策略，不存在时创建空策略
+func (s *RuleService) GetDestinationPolicy() (*models.DestinationPolicy, error) {
+	var policy models.DestinationPolicy
+	if err := s.db.Order("id asc").First(&policy).Error; err == nil {
+		return &policy, nil
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if err := s.db.Create(&policy).Error; err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// CheckTargetDestinations 按目标地址策略校验规则目标，违规时返回 ErrDestinationBlocked。
+// 开启域名解析时，解析失败的域名目标同样被拒绝
+func (s *RuleService) CheckTargetDestinations(targets []models.Target) error {
+	return s.CheckTargetDestinationRange(targets, 0)
+}
+
+// CheckTargetDestinationRange 校验端口范围规则的目标，每个目标的端口 Port 至 Port+span 均需符合策略
+func (s *RuleService) CheckTargetDestinationRange(targets []models.Target, span int) error {
+	policy, err := s.GetDestinationPolicy()
+	if err != nil {
+		return err
+	}
+	compiled := compileDestinationPolicy(policy)
+	if compiled.empty() {
+		return nil
+	}
+	lookup := s.lookupHost()
+	for _, t := range targets {
+		if reason := compiled.check(t.Host, t.Port, span, lookup, true); reason != "" {
+			return fmt.Errorf("%w: %s", ErrDestinationBlocked, reason)
+		}
+	}
+	return nil
+}
+
+// DestinationRecheckResult 目标地址策略复查结果
+type DestinationRecheckResult struct {
+	Checked    int    `json:"checked"`    // 检查的目标数
+	Violations int    `json:"violations"` // 违规的目标数
+	Disabled   []uint `json:"disabled"`   // 本次因违规被禁用的规则
+	Restored   []uint `json:"restored"`   // 不再违规、本次恢复启用的规则
+}
+
+// UpdateDestinationPolicy 保存目标地址策略，已有规则由调度器在后台复查
+func (s *RuleService) UpdateDestinationPolicy(policy models.DestinationPolicy) (*models.DestinationPolicy, error) {
+	if err := NormalizeDestinationPolicy(&policy); err != nil {
+		return nil, err
+	}
+	current, err := s.GetDestinationPolicy()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(current).Updates(map[string]interface{}{
+		"blocked_cidrs":     policy.BlockedCIDRs,
+		"blocked_ports":     policy.BlockedPorts,
+		"blocked_domains":   policy.BlockedDomains,
+		"resolve_hostnames": policy.ResolveHostnames,
+		"recheck_revision":  gorm.Expr("recheck_revision + 1"),
+	}).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.First(current, current.ID).Error; err != nil {
+		return nil, err
+	}
+	return current, nil
+}
+
+// RequestDestinationRecheck 请求按当前策略复查全部规则，由调度器在后台执行
+func (s *RuleService) RequestDestinationRecheck() error {
+	current, err := s.GetDestinationPolicy()
+	if err != nil {
+		return err
+	}
+	return s.db.Model(current).Update("recheck_revision", gorm.Expr("recheck_revision + 1")).Error
+}
+
+// RunDestinationRecheck 供调度器调用的目标地址策略复查任务，仅在策略变更或请求复查后执行
+func (s *RuleService) RunDestinationRecheck(ctx context.Context) error {
+	policy, err := s.GetDestinationPolicy()
+	if err != nil {
+		return err
+	}
+	if policy.CheckedRevision >= policy.RecheckRevision {
+		return nil
+	}
+	result, err := s.RecheckDestinations(ctx)
+	if err != nil {
+		return err
+	}
+	// 复查期间再次请求时 RecheckRevision 已递增，下一周期继续复查
+	if err := s.db.Model(&models.DestinationPolicy{}).
+		Where("id = ? AND checked_revision < ?", policy.ID, policy.RecheckRevision).
+		Update("checked_revision", policy.RecheckRevision).Error; err != nil {
+		return err
+	}
+	logger.Info("Destination recheck finished", "checked", result.Checked, "violations", result.Violations, "disabled", len(result.Disabled), "restored", len(result.Restored))
+	return nil
+}
+
+// RecheckDestinations 按当前策略复查全部规则目标并重建违规列表：
+// 启用中的违规规则被禁用并标记原因；因违规被禁用、现已合规的规则恢复启用（流量余额耗尽时改为等待购买流量，
+// 不在生效时间内时改为等待调度器启用）。
+// 域名在开启事务前并发解析；复查时域名解析失败不视为违规，避免 DNS 临时故障导致规则被批量禁用
+func (s *RuleService) RecheckDestinations(ctx context.Context) (*DestinationRecheckResult, error) {
+	policy, err := s.GetDestinationPolicy()
+	if err != nil {
+		return nil, err
+	}
+	compiled := compileDestinationPolicy(policy)
+
+	var rules []models.ForwardingRule
+	if err := s.db.Order("id asc").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	var targets []models.Target
+	if err := s.db.Order("id asc").Find(&targets).Error; err != nil {
+		return nil, err
+	}
+	targetsByRule := make(map[uint][]models.Target, len(rules))
+	for _, t := range targets {
+		targetsByRule[t.RuleID] = append(targetsByRule[t.RuleID], t)
+	}
+	lookup, err := s.prefetchLookups(ctx, compiled, targets)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &DestinationRecheckResult{Disabled: []uint{}, Restored: []uint{}}
+	var violations []models.DestinationViolation
+	var nodeIDs []uint
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		for i := range rules {
+			rule := &rules[i]
+			blocked := false
+			for _, t := range targetsByRule[rule.ID] {
+				result.Checked++
+				if compiled.empty() {
+					continue
+				}
+				reason := compiled.check(t.Host, t.Port, RuleListenPortEnd(rule)-rule.ListenPort, lookup, false)
+				if reason == "" {
+					continue
+				}
+				blocked = true
+				violations = append(violations, models.DestinationViolation{
+					RuleID:   rule.ID,
+					RuleName: rule.Name,
+					UserID:   rule.UserID,
+					TargetID: t.ID,
+					Host:     t.Host,
+					Port:     t.Port,
+					Reason:   reason,
+				})
+			}
+
+			updates := map[string]interface{}{}
+			switch {
+			case blocked && rule.Enabled:
+				updates["enabled"] = false
+				updates["disabled_reason"] = RuleDisabledDestinationBlocked
+				result.Disabled = append(result.Disabled, rule.ID)
+			case !blocked && !rule.Enabled && rule.DisabledReason == RuleDisabledDestinationBlocked:
+				// 不在生效时间内、流量余额耗尽或端口已被占用时改为对应原因
+				held := RuleScheduleReason(rule, time.Now())
+				if held == "" {
+					var err error
+					if held, err = ruleReenableReason(tx, rule); err != nil {
+						return err
+					}
+				}
+				if held != "" {
+					updates["disabled_reason"] = held
+				} else {
+					updates["enabled"] = true
+					updates["disabled_reason"] = ""
+					result.Restored = append(result.Restored, rule.ID)
+				}
+			default:
+				continue
+			}
+			if err := tx.Model(&models.ForwardingRule{}).Where("id = ?", rule.ID).Updates(updates).Error; err != nil {
+				return err
+			}
+			nodeIDs = append(nodeIDs, ruleNodeIDs(tx, rule)...)
+		}
+
+		if err := tx.Where("1 = 1").Delete(&models.DestinationViolation{}).Error; err != nil {
+			return err
+		}
+		if len(violations) > 0 {
+			return tx.CreateInBatches(violations, 100).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Violations = len(violations)
+	return result, bumpConfigRevision(s.db, nodeIDs...)
+}
+
+// ListDestinationViolations 获取最近一次复查发现的违规目标
+func (s *RuleService) ListDestinationViolations(page, pageSize int) ([]models.DestinationViolation, int64) {
+	var violations []models.DestinationViolation
+	var total int64
+
+	s.db.Model(&models.DestinationViolation{}).Count(&total)
+	offset := (page - 1) * pageSize
+	s.db.Order("rule_id asc, id asc").Offset(offset).Limit(pageSize).Find(&violations)
+
+	return violations, total
+}
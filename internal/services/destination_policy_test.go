@@ -0,0 +1,230 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"bakaray/internal/models"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeDestinationPolicy(t *testing.T) {
+	t.Run("规范化并去重", func(t *testing.T) {
+		policy := models.DestinationPolicy{
+			BlockedCIDRs:   models.StringSlice{"10.1.2.3/8", " 127.0.0.1 ", "10.0.0.0/8", ""},
+			BlockedPorts:   models.StringSlice{"25", "6660 - 6669", "25-25"},
+			BlockedDomains: models.StringSlice{"*.Example.com", "example.com.", "metadata.internal"},
+		}
+		require.NoError(t, NormalizeDestinationPolicy(&policy))
+		require.Equal(t, models.StringSlice{"10.0.0.0/8", "127.0.0.1/32"}, policy.BlockedCIDRs)
+		require.Equal(t, models.StringSlice{"25", "6660-6669"}, policy.BlockedPorts)
+		require.Equal(t, models.StringSlice{"example.com", "metadata.internal"}, policy.BlockedDomains)
+	})
+
+	t.Run("拒绝无效条目", func(t *testing.T) {
+		for _, policy := range []models.DestinationPolicy{
+			{BlockedCIDRs: models.StringSlice{"10.0.0.0/33"}},
+			{BlockedPorts: models.StringSlice{"0"}},
+			{BlockedPorts: models.StringSlice{"100-50"}},
+			{BlockedPorts: models.StringSlice{"smtp"}},
+			{BlockedDomains: models.StringSlice{"http://example.com"}},
+		} {
+			require.ErrorIs(t, NormalizeDestinationPolicy(&policy), ErrInvalidDestinationPolicy, "%+v", policy)
+		}
+	})
+}
+
+func TestCheckTargetDestinations(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	service := NewRuleService(db, nil)
+	service.resolveHost = func(_ context.Context, host string) ([]netip.Addr, error) {
+		switch host {
+		case "internal.example.net":
+			return []netip.Addr{netip.MustParseAddr("::ffff:169.254.169.254")}, nil
+		case "public.example.net":
+			return []netip.Addr{netip.MustParseAddr("203.0.113.10")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	require.NoError(t, service.CheckTargetDestinations([]models.Target{{Host: "127.0.0.1", Port: 25}}))
+
+	_, err := service.UpdateDestinationPolicy(models.DestinationPolicy{
+		BlockedCIDRs:   models.StringSlice{"127.0.0.0/8", "169.254.0.0/16", "::1/128"},
+		BlockedPorts:   models.StringSlice{"25"},
+		BlockedDomains: models.StringSlice{"blocked.example"},
+	})
+	require.NoError(t, err)
+
+	for _, target := range []models.Target{
+		{Host: "127.0.0.2", Port: 80},
+		{Host: "[::1]", Port: 80},
+		{Host: "1.1.1.1", Port: 25},
+		{Host: "mail.blocked.example", Port: 80},
+	} {
+		err := service.CheckTargetDestinations([]models.Target{target})
+		require.ErrorIs(t, err, ErrDestinationBlocked, "%s:%d", target.Host, target.Port)
+	}
+	require.NoError(t, service.CheckTargetDestinations([]models.Target{{Host: "1.1.1.1", Port: 80}, {Host: "internal.example.net", Port: 80}}))
+
+	_, err = service.UpdateDestinationPolicy(models.DestinationPolicy{
+		BlockedCIDRs:     models.StringSlice{"169.254.0.0/16"},
+		ResolveHostnames: true,
+	})
+	require.NoError(t, err)
+
+	err = service.CheckTargetDestinations([]models.Target{{Host: "internal.example.net", Port: 80}})
+	require.ErrorIs(t, err, ErrDestinationBlocked)
+	require.Contains(t, err.Error(), "169.254.0.0/16")
+	err = service.CheckTargetDestinations([]models.Target{{Host: "missing.example.net", Port: 80}})
+	require.ErrorIs(t, err, ErrDestinationBlocked)
+	require.Contains(t, err.Error(), "解析失败")
+	require.NoError(t, service.CheckTargetDestinations([]models.Target{{Host: "public.example.net", Port: 80}}))
+}
+
+func TestRecheckDestinations(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	service := NewRuleService(db, nil)
+	user := createTestUser(t, db, "policy-user")
+	require.NoError(t, db.Model(user).Update("traffic_balance", 1000).Error)
+	node := createTestNode(t, db, "policy-node")
+
+	blocked := createBillingRule(t, db, user.ID, node.ID, 9501)
+	require.NoError(t, service.UpdateRuleWithTargets(blocked.ID, nil, []models.Target{{Host: "10.0.0.5", Port: 22, Weight: 1, Enabled: true}}))
+	allowed := createBillingRule(t, db, user.ID, node.ID, 9502)
+	require.NoError(t, service.UpdateRuleWithTargets(allowed.ID, nil, []models.Target{{Host: "203.0.113.5", Port: 443, Weight: 1, Enabled: true}}))
+	manual := createBillingRule(t, db, user.ID, node.ID, 9503)
+	require.NoError(t, service.UpdateRuleWithTargets(manual.ID, map[string]interface{}{"enabled": false}, []models.Target{{Host: "10.0.0.6", Port: 22, Weight: 1, Enabled: true}}))
+
+	recheck := func(policy models.DestinationPolicy) *DestinationRecheckResult {
+		_, err := service.UpdateDestinationPolicy(policy)
+		require.NoError(t, err)
+		result, err := service.RecheckDestinations(context.Background())
+		require.NoError(t, err)
+		return result
+	}
+
+	var before models.Node
+	require.NoError(t, db.First(&before, node.ID).Error)
+
+	result := recheck(models.DestinationPolicy{BlockedCIDRs: models.StringSlice{"10.0.0.0/8"}})
+	require.Equal(t, 3, result.Checked)
+	require.Equal(t, 2, result.Violations)
+	require.Equal(t, []uint{blocked.ID}, result.Disabled)
+	require.Empty(t, result.Restored)
+
+	saved, err := service.GetRuleByID(blocked.ID)
+	require.NoError(t, err)
+	require.False(t, saved.Enabled)
+	require.Equal(t, RuleDisabledDestinationBlocked, saved.DisabledReason)
+
+	// 手动禁用的规则只记录违规，不改变原因
+	saved, err = service.GetRuleByID(manual.ID)
+	require.NoError(t, err)
+	require.Empty(t, saved.DisabledReason)
+
+	violations, total := service.ListDestinationViolations(1, 20)
+	require.EqualValues(t, 2, total)
+	require.Equal(t, blocked.ID, violations[0].RuleID)
+	require.Equal(t, "10.0.0.5", violations[0].Host)
+	require.Contains(t, violations[0].Reason, "10.0.0.0/8")
+
+	var after models.Node
+	require.NoError(t, db.First(&after, node.ID).Error)
+	require.Greater(t, after.ConfigRevision, before.ConfigRevision)
+
+	// 策略放宽后恢复因违规被禁用的规则，违规列表随之清空
+	result = recheck(models.DestinationPolicy{})
+	require.Equal(t, []uint{blocked.ID}, result.Restored)
+	require.Zero(t, result.Violations)
+
+	saved, err = service.GetRuleByID(blocked.ID)
+	require.NoError(t, err)
+	require.True(t, saved.Enabled)
+	require.Empty(t, saved.DisabledReason)
+
+	_, total = service.ListDestinationViolations(1, 20)
+	require.Zero(t, total)
+
+	// 禁用期间端口被其他规则占用时保持禁用，由调度器在端口空闲后恢复
+	result = recheck(models.DestinationPolicy{BlockedCIDRs: models.StringSlice{"10.0.0.0/8"}})
+	require.Equal(t, []uint{blocked.ID}, result.Disabled)
+	createBillingRule(t, db, user.ID, node.ID, 9501)
+	result = recheck(models.DestinationPolicy{})
+	require.Empty(t, result.Restored)
+	saved, err = service.GetRuleByID(blocked.ID)
+	require.NoError(t, err)
+	require.False(t, saved.Enabled)
+	require.Equal(t, RuleDisabledPortConflict, saved.DisabledReason)
+}
+
+func TestRunDestinationRecheck(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	service := NewRuleService(db, nil)
+	var mu sync.Mutex
+	lookups := map[string]int{}
+	service.resolveHost = func(_ context.Context, host string) ([]netip.Addr, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		lookups[host]++
+		if host == "internal.example.net" {
+			return []netip.Addr{netip.MustParseAddr("10.0.0.9")}, nil
+		}
+		return []netip.Addr{netip.MustParseAddr("203.0.113.9")}, nil
+	}
+	user := createTestUser(t, db, "recheck-user")
+	require.NoError(t, db.Model(user).Update("traffic_balance", 1000).Error)
+	node := createTestNode(t, db, "recheck-node")
+
+	blocked := createBillingRule(t, db, user.ID, node.ID, 9511)
+	require.NoError(t, service.UpdateRuleWithTargets(blocked.ID, nil, []models.Target{
+		{Host: "internal.example.net", Port: 80, Weight: 1, Enabled: true},
+		{Host: "Internal.Example.net.", Port: 81, Weight: 1, Enabled: true},
+	}))
+	allowed := createBillingRule(t, db, user.ID, node.ID, 9512)
+	require.NoError(t, service.UpdateRuleWithTargets(allowed.ID, nil, []models.Target{{Host: "public.example.net", Port: 80, Weight: 1, Enabled: true}}))
+
+	// 没有待执行的复查时不做任何事
+	require.NoError(t, service.RunDestinationRecheck(context.Background()))
+	require.Empty(t, lookups)
+
+	policy, err := service.UpdateDestinationPolicy(models.DestinationPolicy{BlockedCIDRs: models.StringSlice{"10.0.0.0/8"}, ResolveHostnames: true})
+	require.NoError(t, err)
+	require.Greater(t, policy.RecheckRevision, policy.CheckedRevision)
+
+	require.NoError(t, service.RunDestinationRecheck(context.Background()))
+	// 每个域名只解析一次
+	require.Equal(t, map[string]int{"internal.example.net": 1, "public.example.net": 1}, lookups)
+	saved, err := service.GetRuleByID(blocked.ID)
+	require.NoError(t, err)
+	require.Equal(t, RuleDisabledDestinationBlocked, saved.DisabledReason)
+	policy, err = service.GetDestinationPolicy()
+	require.NoError(t, err)
+	require.Equal(t, policy.RecheckRevision, policy.CheckedRevision)
+
+	require.NoError(t, service.RunDestinationRecheck(context.Background()))
+	require.Equal(t, 1, lookups["internal.example.net"])
+
+	require.NoError(t, service.RequestDestinationRecheck())
+	require.NoError(t, service.RunDestinationRecheck(context.Background()))
+	require.Equal(t, 2, lookups["internal.example.net"])
+
+	// 退出时中断的复查不改变规则状态
+	require.NoError(t, service.RequestDestinationRecheck())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, service.RunDestinationRecheck(ctx), context.Canceled)
+	policy, err = service.GetDestinationPolicy()
+	require.NoError(t, err)
+	require.Greater(t, policy.RecheckRevision, policy.CheckedRevision)
+}
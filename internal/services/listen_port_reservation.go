@@ -0,0 +1,109 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"bakaray/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// listenPortReservationTTL 自动分配端口的预留有效期，覆盖从分配到规则保存的时间，规则保存后由规则本身占用端口
+const listenPortReservationTTL = time.Minute
+
+// maxListenPortReserveAttempts 预留时与其他实例冲突后重新分配端口的最多次数
+const maxListenPortReserveAttempts = 16
+
+var errListenPortReserved = errors.New("端口已被其他请求预留")
+
+// ReserveListenPort 在 nodeIDs 的每个节点上分配并预留同一个符合全部策略且未被占用的端口。
+// 预留记录按节点与端口唯一，多个实例同时分配到同一端口时只有一个能预留成功，其余实例换下一个端口重试；
+// 仍在有效期内的预留视为已占用，预留不区分协议和监听地址。used 会加入已尝试过的端口。
+func (s *RuleService) ReserveListenPort(nodeIDs []uint, policies []ListenPortPolicy, used map[int]struct{}) (int, error) {
+	now := time.Now()
+	if err := s.db.Where("expires_at <= ?", now).Delete(&models.ListenPortReservation{}).Error; err != nil {
+		return 0, err
+	}
+	if err := s.AddReservedListenPorts(nodeIDs, used); err != nil {
+		return 0, err
+	}
+
+	for attempt := 0; attempt < maxListenPortReserveAttempts; attempt++ {
+		port, err := AllocateListenPort(policies, used)
+		if err != nil {
+			return 0, err
+		}
+		ok, err := s.reserveListenPort(nodeIDs, port, now.Add(listenPortReservationTTL))
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return port, nil
+		}
+		used[port] = struct{}{}
+	}
+	return 0, ErrNoFreePort
+}
+
+// PreviewListenPort 与 ReserveListenPort 相同地分配端口但不写入预留，用于试运行
+func (s *RuleService) PreviewListenPort(nodeIDs []uint, policies []ListenPortPolicy, used map[int]struct{}) (int, error) {
+	if err := s.AddReservedListenPorts(nodeIDs, used); err != nil {
+		return 0, err
+	}
+	return AllocateListenPort(policies, used)
+}
+
+// AddReservedListenPorts 将 nodeIDs 上仍在有效期内的预留端口加入 used
+func (s *RuleService) AddReservedListenPorts(nodeIDs []uint, used map[int]struct{}) error {
+	var reserved []int
+	if err := s.db.Model(&models.ListenPortReservation{}).
+		Where("node_id IN ? AND expires_at > ?", nodeIDs, time.Now()).
+		Pluck("port", &reserved).Error; err != nil {
+		return err
+	}
+	for _, port := range reserved {
+		used[port] = struct{}{}
+	}
+	return nil
+}
+
+// ReservedListenPort 返回节点上 port 至 portEnd 之间仍在有效期内的预留端口，没有时返回 0。
+// 手动指定的端口同样不能使用其他请求刚分配、尚未保存的端口
+func (s *RuleService) ReservedListenPort(nodeID uint, port, portEnd int) (int, error) {
+	var reserved []int
+	if err := s.db.Model(&models.ListenPortReservation{}).
+		Where("node_id = ? AND port BETWEEN ? AND ? AND expires_at > ?", nodeID, port, max(port, portEnd), time.Now()).
+		Order("port asc").Limit(1).Pluck("port", &reserved).Error; err != nil {
+		return 0, err
+	}
+	if len(reserved) == 0 {
+		return 0, nil
+	}
+	return reserved[0], nil
+}
+
+// reserveListenPort 在一个事务中为全部节点预留端口，任一节点上已被预留时全部回滚并返回 false
+func (s *RuleService) reserveListenPort(nodeIDs []uint, port int, expiresAt time.Time) (bool, error) {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		for _, nodeID := range nodeIDs {
+			result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.ListenPortReservation{
+				NodeID:    nodeID,
+				Port:      port,
+				ExpiresAt: expiresAt,
+			})
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return errListenPortReserved
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errListenPortReserved) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,96 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"bakaray/internal/models"
+
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestReserveListenPort(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	nodeA := createTestNode(t, db, "reserve-a")
+	nodeB := createTestNode(t, db, "reserve-b")
+	policies := []ListenPortPolicy{NewListenPortPolicy(&models.Node{ListenPortRanges: models.StringSlice{"31000-31002"}}, nil)}
+
+	t.Run("不同实例分配到不同端口", func(t *testing.T) {
+		first, err := NewRuleService(db, nil).ReserveListenPort([]uint{nodeA.ID}, policies, map[int]struct{}{})
+		require.NoError(t, err)
+		second, err := NewRuleService(db, nil).ReserveListenPort([]uint{nodeA.ID}, policies, map[int]struct{}{})
+		require.NoError(t, err)
+		require.Equal(t, 31000, first)
+		require.Equal(t, 31001, second)
+	})
+
+	t.Run("任一节点上已被预留时整体回滚", func(t *testing.T) {
+		ok, err := NewRuleService(db, nil).reserveListenPort([]uint{nodeB.ID, nodeA.ID}, 31000, time.Now().Add(time.Minute))
+		require.NoError(t, err)
+		require.False(t, ok)
+		var count int64
+		require.NoError(t, db.Model(&models.ListenPortReservation{}).Where("node_id = ?", nodeB.ID).Count(&count).Error)
+		require.Zero(t, count)
+	})
+
+	t.Run("预留时与其他实例冲突则换端口重试", func(t *testing.T) {
+		// 模拟另一个实例在本实例读取预留之后、写入之前抢先预留了同一端口
+		competing := false
+		require.NoError(t, db.Callback().Query().After("gorm:query").Register("test:competing_reservation", func(tx *gorm.DB) {
+			if tx.Statement.Table != "listen_port_reservations" || competing {
+				return
+			}
+			competing = true
+			require.NoError(t, db.Create(&models.ListenPortReservation{NodeID: nodeB.ID, Port: 31000, ExpiresAt: time.Now().Add(time.Minute)}).Error)
+		}))
+		defer db.Callback().Query().Remove("test:competing_reservation")
+
+		port, err := NewRuleService(db, nil).ReserveListenPort([]uint{nodeB.ID}, policies, map[int]struct{}{})
+		require.NoError(t, err)
+		require.True(t, competing)
+		require.Equal(t, 31001, port)
+
+		var ports []int
+		require.NoError(t, db.Model(&models.ListenPortReservation{}).Where("node_id = ?", nodeB.ID).Order("port").Pluck("port", &ports).Error)
+		require.Equal(t, []int{31000, 31001}, ports)
+	})
+
+	t.Run("过期的预留可以重新分配", func(t *testing.T) {
+		require.NoError(t, db.Model(&models.ListenPortReservation{}).Where("node_id = ?", nodeA.ID).Update("expires_at", time.Now().Add(-time.Second)).Error)
+		port, err := NewRuleService(db, nil).ReserveListenPort([]uint{nodeA.ID}, policies, map[int]struct{}{})
+		require.NoError(t, err)
+		require.Equal(t, 31000, port)
+	})
+
+	t.Run("试运行只分配不预留", func(t *testing.T) {
+		nodeC := createTestNode(t, db, "reserve-c")
+		service := NewRuleService(db, nil)
+		for i := 0; i < 2; i++ {
+			port, err := service.PreviewListenPort([]uint{nodeC.ID}, policies, map[int]struct{}{})
+			require.NoError(t, err)
+			require.Equal(t, 31000, port)
+		}
+		reserved, err := service.ReservedListenPort(nodeC.ID, 31000, 31002)
+		require.NoError(t, err)
+		require.Zero(t, reserved)
+
+		_, err = service.ReserveListenPort([]uint{nodeC.ID}, policies, map[int]struct{}{})
+		require.NoError(t, err)
+		reserved, err = service.ReservedListenPort(nodeC.ID, 30990, 31005)
+		require.NoError(t, err)
+		require.Equal(t, 31000, reserved)
+		port, err := service.PreviewListenPort([]uint{nodeC.ID}, policies, map[int]struct{}{})
+		require.NoError(t, err)
+		require.Equal(t, 31001, port)
+	})
+
+	t.Run("全部端口已预留时没有空闲端口", func(t *testing.T) {
+		_, err := NewRuleService(db, nil).ReserveListenPort([]uint{nodeB.ID}, policies, map[int]struct{}{})
+		require.NoError(t, err)
+		_, err = NewRuleService(db, nil).ReserveListenPort([]uint{nodeB.ID}, policies, map[int]struct{}{})
+		require.ErrorIs(t, err, ErrNoFreePort)
+	})
+}
@@ -0,0 +1,263 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"bakaray/internal/models"
+)
+
+// MaxPortRangeEntries 端口范围/保留端口列表最多的条目数
+const MaxPortRangeEntries = 256
+
+// 未限制端口范围时自动分配端口的起点，避开常用服务端口
+const defaultAutoPortLow = 10000
+
+// MaxFreePortCount 查询空闲端口时单次最多返回的数量
+const MaxFreePortCount = 100
+
+// MaxRulePortRange 端口范围规则最多包含的端口数
+const MaxRulePortRange = 1000
+
+var (
+	ErrInvalidPortRanges = errors.New("无效的端口范围")
+	ErrNoFreePort        = errors.New("没有可分配的空闲端口")
+)
+
+// NormalizePortRanges 校验并规范化端口列表，条目为单个端口或 a-b 范围，去重后保持原有顺序
+func NormalizePortRanges(entries []string) (models.StringSlice, error) {
+	out := make(models.StringSlice, 0, len(entries))
+	seen := make(map[string]struct{}, len(entries))
+	for _, raw := range entries {
+		entry := strings.TrimSpace(raw)
+		if entry == "" {
+			continue
+		}
+		low, high, err := parsePortRange(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidPortRanges, err.Error())
+		}
+		value := strconv.Itoa(low)
+		if low != high {
+			value = fmt.Sprintf("%d-%d", low, high)
+		}
+		if _, ok := seen[value]; ok {
+			continue
+		}
+		seen[value] = struct{}{}
+		out = append(out, value)
+	}
+	if len(out) > MaxPortRangeEntries {
+		return nil, fmt.Errorf("%w: 最多 %d 条", ErrInvalidPortRanges, MaxPortRangeEntries)
+	}
+	return out, nil
+}
+
+// normalizePortRangeUpdates 规范化节点/用户组更新中的端口策略字段
+func normalizePortRangeUpdates(updates map[string]interface{}) error {
+	for _, key := range []string{"listen_port_ranges", "reserved_ports"} {
+		raw, ok := updates[key]
+		if !ok {
+			continue
+		}
+		entries, ok := stringListUpdate(raw)
+		if !ok {
+			return fmt.Errorf("%w: %s 格式错误", ErrInvalidPortRanges, key)
+		}
+		normalized, err := NormalizePortRanges(entries)
+		if err != nil {
+			return err
+		}
+		updates[key] = normalized
+	}
+	return nil
+}
+
+// stringListUpdate 解析更新中的列表字段，兼容 JSON 数组、JSON 字符串和逗号分隔的字符串；格式不支持时返回 false
+func stringListUpdate(raw interface{}) ([]string, bool) {
+	var entries []string
+	switch v := raw.(type) {
+	case nil:
+	case []string:
+		entries = v
+	case models.StringSlice:
+		entries = v
+	case []interface{}:
+		for _, item := range v {
+			switch typed := item.(type) {
+			case string:
+				entries = append(entries, typed)
+			case float64:
+				entries = append(entries, strconv.FormatFloat(typed, 'f', -1, 64))
+			default:
+				return nil, false
+			}
+		}
+	case string:
+		if err := json.Unmarshal([]byte(v), &entries); err != nil {
+			entries = strings.Split(v, ",")
+		}
+	default:
+		return nil, false
+	}
+	return entries, true
+}
+
+// RuleListenPortEnd 返回规则监听的最后一个端口，单端口规则为 ListenPort
+func RuleListenPortEnd(rule *models.ForwardingRule) int {
+	if rule.ListenPortEnd > rule.ListenPort {
+		return rule.ListenPortEnd
+	}
+	return rule.ListenPort
+}
+
+type portSpan struct {
+	low, high int
+}
+
+func parsePortSpans(entries []string) []portSpan {
+	spans := make([]portSpan, 0, len(entries))
+	for _, entry := range entries {
+		low, high, err := parsePortRange(strings.TrimSpace(entry))
+		if err != nil {
+			continue
+		}
+		spans = append(spans, portSpan{low: low, high: high})
+	}
+	return spans
+}
+
+func spansContain(spans []portSpan, port int) bool {
+	for _, span := range spans {
+		if port >= span.low && port <= span.high {
+			return true
+		}
+	}
+	return false
+}
+
+// ListenPortPolicy 节点与用户组端口策略的叠加结果
+type ListenPortPolicy struct {
+	allowed  [][]portSpan // 每一层（节点、用户组）的允许范围，端口需同时落在每一层内
+	reserved []portSpan
+}
+
+// NewListenPortPolicy 生成用户在节点上适用的端口策略，limits 为空时只使用节点策略
+func NewListenPortPolicy(node *models.Node, limits *RuleLimits) ListenPortPolicy {
+	var policy ListenPortPolicy
+	layers := [][]string{node.ListenPortRanges}
+	reserved := [][]string{node.ReservedPorts}
+	if limits != nil {
+		layers = append(layers, limits.ListenPortRanges)
+		reserved = append(reserved, limits.ReservedPorts)
+	}
+	for _, layer := range layers {
+		if spans := parsePortSpans(layer); len(spans) > 0 {
+			policy.allowed = append(policy.allowed, spans)
+		}
+	}
+	for _, entries := range reserved {
+		policy.reserved = append(policy.reserved, parsePortSpans(entries)...)
+	}
+	return policy
+}
+
+// Check 校验端口是否符合策略
+func (p ListenPortPolicy) Check(port int) error {
+	if spansContain(p.reserved, port) {
+		return fmt.Errorf("端口 %d 为保留端口", port)
+	}
+	for _, layer := range p.allowed {
+		if !spansContain(layer, port) {
+			return fmt.Errorf("端口 %d 不在允许的端口范围 %s 内", port, formatPortSpans(layer))
+		}
+	}
+	return nil
+}
+
+func (p ListenPortPolicy) allows(port int) bool {
+	if spansContain(p.reserved, port) {
+		return false
+	}
+	for _, layer := range p.allowed {
+		if !spansContain(layer, port) {
+			return false
+		}
+	}
+	return true
+}
+
+// portCandidates 按从小到大的顺序返回候选端口区间：取第一个限制了范围的策略的第一层，
+// 全部策略都未限制范围时从 defaultAutoPortLow 开始
+func portCandidates(policies []ListenPortPolicy) []portSpan {
+	for _, policy := range policies {
+		if len(policy.allowed) > 0 {
+			spans := append([]portSpan(nil), policy.allowed[0]...)
+			sort.Slice(spans, func(i, j int) bool { return spans[i].low < spans[j].low })
+			return spans
+		}
+	}
+	return []portSpan{{low: defaultAutoPortLow, high: 65535}}
+}
+
+// FreeListenPorts 返回同时符合全部策略且未被占用的端口，最多 limit 个
+func FreeListenPorts(policies []ListenPortPolicy, used map[int]struct{}, limit int) []int {
+	if limit <= 0 {
+		return nil
+	}
+	ports := make([]int, 0, limit)
+	seen := make(map[int]struct{})
+	for _, span := range portCandidates(policies) {
+		for port := span.low; port <= span.high; port++ {
+			if _, ok := used[port]; ok {
+				continue
+			}
+			if _, ok := seen[port]; ok {
+				continue
+			}
+			seen[port] = struct{}{}
+			if !policiesAllow(policies, port) {
+				continue
+			}
+			ports = append(ports, port)
+			if len(ports) == limit {
+				return ports
+			}
+		}
+	}
+	return ports
+}
+
+// AllocateListenPort 分配一个同时符合全部策略且未被占用的端口
+func AllocateListenPort(policies []ListenPortPolicy, used map[int]struct{}) (int, error) {
+	ports := FreeListenPorts(policies, used, 1)
+	if len(ports) == 0 {
+		return 0, ErrNoFreePort
+	}
+	return ports[0], nil
+}
+
+func policiesAllow(policies []ListenPortPolicy, port int) bool {
+	for _, policy := range policies {
+		if !policy.allows(port) {
+			return false
+		}
+	}
+	return true
+}
+
+func formatPortSpans(spans []portSpan) string {
+	parts := make([]string, len(spans))
+	for i, span := range spans {
+		if span.low == span.high {
+			parts[i] = strconv.Itoa(span.low)
+		} else {
+			parts[i] = fmt.Sprintf("%d-%d", span.low, span.high)
+		}
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,62 @@
+package services
+
+import (
+	"testing"
+
+	"bakaray/internal/models"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizePortRanges(t *testing.T) {
+	ranges, err := NormalizePortRanges([]string{" 20000 - 20100 ", "30000", "30000-30000", ""})
+	require.NoError(t, err)
+	require.Equal(t, models.StringSlice{"20000-20100", "30000"}, ranges)
+
+	for _, invalid := range []string{"0", "70000", "200-100", "ssh"} {
+		_, err := NormalizePortRanges([]string{invalid})
+		require.ErrorIs(t, err, ErrInvalidPortRanges, invalid)
+	}
+
+	updates := map[string]interface{}{"listen_port_ranges": []interface{}{"10000-10010", float64(443)}, "reserved_ports": "10005, 10006"}
+	require.NoError(t, normalizePortRangeUpdates(updates))
+	require.Equal(t, models.StringSlice{"10000-10010", "443"}, updates["listen_port_ranges"])
+	require.Equal(t, models.StringSlice{"10005", "10006"}, updates["reserved_ports"])
+}
+
+func TestListenPortPolicy(t *testing.T) {
+	node := &models.Node{
+		ListenPortRanges: models.StringSlice{"10000-10010", "20000-20010"},
+		ReservedPorts:    models.StringSlice{"10000", "20005"},
+	}
+	limits := &RuleLimits{ListenPortRanges: []string{"10005-20005"}}
+	policy := NewListenPortPolicy(node, limits)
+
+	require.NoError(t, policy.Check(10005))
+	require.NoError(t, policy.Check(20001))
+	require.ErrorContains(t, policy.Check(10000), "保留")
+	require.ErrorContains(t, policy.Check(20005), "保留")
+	require.ErrorContains(t, policy.Check(15000), "10000-10010,20000-20010")
+	require.ErrorContains(t, policy.Check(10001), "10005-20005")
+
+	used := map[int]struct{}{10005: {}, 10006: {}}
+	require.Equal(t, []int{10007, 10008, 10009, 10010, 20000, 20001, 20002, 20003, 20004}, FreeListenPorts([]ListenPortPolicy{policy}, used, 20))
+
+	port, err := AllocateListenPort([]ListenPortPolicy{policy}, used)
+	require.NoError(t, err)
+	require.Equal(t, 10007, port)
+
+	// 多个节点共同分配时取各自策略的交集
+	other := NewListenPortPolicy(&models.Node{ListenPortRanges: models.StringSlice{"20003-30000"}}, nil)
+	port, err = AllocateListenPort([]ListenPortPolicy{policy, other}, used)
+	require.NoError(t, err)
+	require.Equal(t, 20003, port)
+
+	_, err = AllocateListenPort([]ListenPortPolicy{NewListenPortPolicy(&models.Node{ListenPortRanges: models.StringSlice{"10005"}}, nil)}, used)
+	require.ErrorIs(t, err, ErrNoFreePort)
+
+	// 未限制范围时从默认起点分配
+	port, err = AllocateListenPort([]ListenPortPolicy{NewListenPortPolicy(&models.Node{}, nil)}, nil)
+	require.NoError(t, err)
+	require.Equal(t, defaultAutoPortLow, port)
+}
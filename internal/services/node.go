@@ -11,7 +11,6 @@ import (
 
 	"bakaray/internal/models"
 
-	"github.com/redis/go-redis/v9"
 	"gorm.io/gorm"
 )
 
@@ -20,7 +19,7 @@ var ErrNodeNotFound = errors.New("节点不存在")
 // NodeService 节点服务
 type NodeService struct {
 	db    *gorm.DB
-	redis *redis.Client
+	state StateStore
 }
 
 type TrafficDelta struct {
@@ -28,11 +27,14 @@ type TrafficDelta struct {
 	BytesOut int64
 }
 
-// NewNodeService 创建节点服务
-func NewNodeService(db *gorm.DB, redis *redis.Client) *NodeService {
+// NewNodeService 创建节点服务，state 为 nil 时使用进程内状态存储
+func NewNodeService(db *gorm.DB, state StateStore) *NodeService {
+	if state == nil {
+		state = NewMemoryStateStore()
+	}
 	return &NodeService{
 		db:    db,
-		redis: redis,
+		state: state,
 	}
 }
 
@@ -56,31 +58,6 @@ func (s *NodeService) CreateNode(name, host string, port int, secret string, gro
 	return node, nil
 }
 
-// RegisterNode 自动注册节点。相同名称的节点重复注册时复用原 ID，并刷新地址、端口和密钥。
-func (s *NodeService) RegisterNode(name, host string, port int, secret string) (*models.Node, error) {
-	var node models.Node
-	if err := s.db.Where("name = ?", name).First(&node).Error; err == nil {
-		updates := map[string]interface{}{
-			"host":      host,
-			"port":      port,
-			"secret":    secret,
-			"protocols": NormalizeNodeProtocols(nil),
-		}
-		if err := s.db.Model(&models.Node{}).Where("id = ?", node.ID).Updates(updates).Error; err != nil {
-			return nil, err
-		}
-		node.Host = host
-		node.Port = port
-		node.Secret = secret
-		node.Protocols = NormalizeNodeProtocols(nil)
-		return &node, nil
-	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
-		return nil, err
-	}
-
-	return s.CreateNode(name, host, port, secret, 0, nil, 1, "")
-}
-
 // GetNodeByID 根据ID获取节点
 func (s *NodeService) GetNodeByID(id uint) (*models.Node, error) {
 	var node models.Node
@@ -94,20 +71,35 @@ func (s *NodeService) GetNodeByID(id uint) (*models.Node, error) {
 	return &node, nil
 }
 
-// UpdateNodeStatus 更新节点状态
+// UpdateNodeStatus 更新节点状态，状态发生变化时记录上下线事件
 func (s *NodeService) UpdateNodeStatus(id uint, status string) error {
 	now := time.Now()
-	result := s.db.Model(&models.Node{}).Where("id = ?", id).Updates(map[string]interface{}{
-		"status":    status,
-		"last_seen": &now,
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var node models.Node
+		if err := tx.Select("id", "status").First(&node, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNodeNotFound
+			}
+			return err
+		}
+
+		if err := tx.Model(&models.Node{}).Where("id = ?", id).Updates(map[string]interface{}{
+			"status":    status,
+			"last_seen": &now,
+		}).Error; err != nil {
+			return err
+		}
+
+		if node.Status == status {
+			return nil
+		}
+		return tx.Create(&models.NodeStatusEvent{
+			NodeID:     id,
+			FromStatus: node.Status,
+			ToStatus:   status,
+			Reason:     NodeStatusReasonHeartbeat,
+		}).Error
 	})
-	if result.Error != nil {
-		return result.Error
-	}
-	if result.RowsAffected == 0 {
-		return ErrNodeNotFound
-	}
-	return nil
 }
 
 // ListNodes 获取节点列表（所有节点，管理员用）
@@ -175,32 +167,30 @@ func (s *NodeService) CountNodes() int64 {
 	return total
 }
 
-// SaveProbeData 保存探针数据到 Redis
+// SaveProbeData 保存探针数据：最新一份写入状态存储，同时写入探针历史
 func (s *NodeService) SaveProbeData(nodeID uint, probe *models.ProbeData) error {
-	if s.redis == nil {
-		return nil
+	if err := recordProbeSample(s.db, nodeID, probe, time.Now()); err != nil {
+		return err
 	}
 	data, err := json.Marshal(probe)
 	if err != nil {
 		return err
 	}
 
-	ctx := context.Background()
 	key := fmt.Sprintf("node_probe:%d", nodeID)
-	return s.redis.Set(ctx, key, data, 5*time.Minute).Err()
+	return s.state.Set(context.Background(), key, data, nodeStateTTL)
 }
 
-// GetProbeData 获取探针数据从 Redis
+// GetProbeData 从状态存储获取最新探针数据
 func (s *NodeService) GetProbeData(nodeID uint) (*models.ProbeData, error) {
-	if s.redis == nil {
-		return nil, nil
-	}
-	ctx := context.Background()
 	key := fmt.Sprintf("node_probe:%d", nodeID)
-	data, err := s.redis.Get(ctx, key).Bytes()
+	data, ok, err := s.state.Get(context.Background(), key)
 	if err != nil {
 		return nil, err
 	}
+	if !ok {
+		return nil, ErrStateNotFound
+	}
 
 	var probe models.ProbeData
 	if err := json.Unmarshal(data, &probe); err != nil {
@@ -209,32 +199,27 @@ func (s *NodeService) GetProbeData(nodeID uint) (*models.ProbeData, error) {
 	return &probe, nil
 }
 
-// SaveDiagnostics 保存节点诊断到 Redis
+// SaveDiagnostics 保存节点诊断到状态存储
 func (s *NodeService) SaveDiagnostics(nodeID uint, diagnostics []models.NodeDiagnostic) error {
-	if s.redis == nil {
-		return nil
-	}
 	data, err := json.Marshal(diagnostics)
 	if err != nil {
 		return err
 	}
 
-	ctx := context.Background()
 	key := fmt.Sprintf("node_diagnostics:%d", nodeID)
-	return s.redis.Set(ctx, key, data, 5*time.Minute).Err()
+	return s.state.Set(context.Background(), key, data, nodeStateTTL)
 }
 
-// GetDiagnostics 从 Redis 获取节点诊断
+// GetDiagnostics 从状态存储获取节点诊断
 func (s *NodeService) GetDiagnostics(nodeID uint) ([]models.NodeDiagnostic, error) {
-	if s.redis == nil {
-		return nil, nil
-	}
-	ctx := context.Background()
 	key := fmt.Sprintf("node_diagnostics:%d", nodeID)
-	data, err := s.redis.Get(ctx, key).Bytes()
+	data, ok, err := s.state.Get(context.Background(), key)
 	if err != nil {
 		return nil, err
 	}
+	if !ok {
+		return nil, ErrStateNotFound
+	}
 
 	var diagnostics []models.NodeDiagnostic
 	if err := json.Unmarshal(data, &diagnostics); err != nil {
@@ -246,9 +231,6 @@ func (s *NodeService) GetDiagnostics(nodeID uint) ([]models.NodeDiagnostic, erro
 // ComputeTrafficDeltas computes per-rule traffic deltas based on cumulative counters reported by the node.
 // Expected keys: rule_{id}_in / rule_{id}_out.
 func (s *NodeService) ComputeTrafficDeltas(nodeID uint, stats map[string]int64) (map[uint]TrafficDelta, error) {
-	if s.redis == nil {
-		return map[uint]TrafficDelta{}, nil
-	}
 	type counts struct {
 		in  int64
 		out int64
@@ -256,10 +238,16 @@ func (s *NodeService) ComputeTrafficDeltas(nodeID uint, stats map[string]int64)
 
 	current := make(map[uint]*counts)
 	for k, v := range stats {
+		// rule_<id>_<in|out>；端口范围规则可按端口分别上报 rule_<id>_<port>_<in|out>，累加到规则
 		parts := strings.Split(k, "_")
-		if len(parts) != 3 || parts[0] != "rule" {
+		if (len(parts) != 3 && len(parts) != 4) || parts[0] != "rule" {
 			continue
 		}
+		if len(parts) == 4 {
+			if _, err := strconv.Atoi(parts[2]); err != nil {
+				continue
+			}
+		}
 
 		ruleID64, err := strconv.ParseUint(parts[1], 10, 64)
 		if err != nil {
@@ -273,11 +261,11 @@ func (s *NodeService) ComputeTrafficDeltas(nodeID uint, stats map[string]int64)
 			current[ruleID] = c
 		}
 
-		switch parts[2] {
+		switch parts[len(parts)-1] {
 		case "in":
-			c.in = v
+			c.in += v
 		case "out":
-			c.out = v
+			c.out += v
 		}
 	}
 
@@ -287,32 +275,19 @@ func (s *NodeService) ComputeTrafficDeltas(nodeID uint, stats map[string]int64)
 
 	ctx := context.Background()
 	hashKey := fmt.Sprintf("node_traffic_last:%d", nodeID)
-	pipe := s.redis.Pipeline()
-
-	type lastCmds struct {
-		in  *redis.StringCmd
-		out *redis.StringCmd
-	}
-	last := make(map[uint]lastCmds, len(current))
-	for ruleID := range current {
-		last[ruleID] = lastCmds{
-			in:  pipe.HGet(ctx, hashKey, fmt.Sprintf("%d_in", ruleID)),
-			out: pipe.HGet(ctx, hashKey, fmt.Sprintf("%d_out", ruleID)),
-		}
-	}
-
-	pipe.Expire(ctx, hashKey, 7*24*time.Hour)
-
-	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+	last, err := s.state.HGetAll(ctx, hashKey)
+	if err != nil {
 		return nil, err
 	}
 
 	deltas := make(map[uint]TrafficDelta, len(current))
-	updatePipe := s.redis.Pipeline()
+	fields := make(map[string]string, len(current)*2)
 
 	for ruleID, c := range current {
-		lastIn, _ := strconv.ParseInt(last[ruleID].in.Val(), 10, 64)
-		lastOut, _ := strconv.ParseInt(last[ruleID].out.Val(), 10, 64)
+		inField := fmt.Sprintf("%d_in", ruleID)
+		outField := fmt.Sprintf("%d_out", ruleID)
+		lastIn, _ := strconv.ParseInt(last[inField], 10, 64)
+		lastOut, _ := strconv.ParseInt(last[outField], 10, 64)
 
 		dIn := c.in - lastIn
 		dOut := c.out - lastOut
@@ -327,13 +302,14 @@ func (s *NodeService) ComputeTrafficDeltas(nodeID uint, stats map[string]int64)
 			deltas[ruleID] = TrafficDelta{BytesIn: dIn, BytesOut: dOut}
 		}
 
-		updatePipe.HSet(ctx, hashKey,
-			fmt.Sprintf("%d_in", ruleID), c.in,
-			fmt.Sprintf("%d_out", ruleID), c.out,
-		)
+		fields[inField] = strconv.FormatInt(c.in, 10)
+		fields[outField] = strconv.FormatInt(c.out, 10)
+	}
+
+	// 基线写入失败时不计费，下次上报按旧基线重新计算，避免重复计费
+	if err := s.state.HSet(ctx, hashKey, fields, trafficBaselineTTL); err != nil {
+		return nil, err
 	}
-	updatePipe.Expire(ctx, hashKey, 7*24*time.Hour)
-	_, _ = updatePipe.Exec(ctx)
 
 	return deltas, nil
 }
@@ -375,7 +351,7 @@ func (s *NodeService) SetAllowedGroups(nodeID uint, groupIDs []uint) error {
 // ListRulesByNode 获取节点的规则列表
 func (s *NodeService) ListRulesByNode(nodeID uint, enabledOnly bool) ([]models.ForwardingRule, error) {
 	var rules []models.ForwardingRule
-	query := s.db.Where("node_id = ?", nodeID)
+	query := rulesOnNode(s.db, nodeID)
 	if enabledOnly {
 		query = query.Where("enabled = ?", true)
 	}
@@ -394,11 +370,25 @@ func (s *NodeService) DeleteNode(id uint) error {
 	if result.RowsAffected == 0 {
 		return ErrNodeNotFound
 	}
-	return nil
+	if err := s.db.Where("node_id = ?", id).Delete(&models.NodeProbeSample{}).Error; err != nil {
+		return err
+	}
+	// 以该节点为出口的隧道规则将不再下发
+	entryIDs, err := tunnelEntryNodeIDs(s.db, id)
+	if err != nil {
+		return err
+	}
+	return bumpConfigRevision(s.db, entryIDs...)
 }
 
-// UpdateNode 更新节点
+// UpdateNode 更新节点。所属节点组需通过 NodeGroupService 修改，以检查组内规则的端口冲突。
 func (s *NodeService) UpdateNode(id uint, updates map[string]interface{}) error {
+	stripNodeCredentialFields(updates)
+	delete(updates, "node_group_id")
+	if len(updates) == 0 {
+		_, err := s.GetNodeByID(id)
+		return err
+	}
 	if raw, ok := updates["protocols"]; ok {
 		switch v := raw.(type) {
 		case []string:
@@ -426,8 +416,12 @@ func (s *NodeService) UpdateNode(id uint, updates map[string]interface{}) error
 		}
 	}
 
+	if err := normalizePortRangeUpdates(updates); err != nil {
+		return err
+	}
+
 	// Normalize numeric fields that may arrive as strings.
-	for _, key := range []string{"port", "node_group_id"} {
+	for _, key := range []string{"port"} {
 		if raw, ok := updates[key]; ok {
 			if sVal, ok := raw.(string); ok {
 				if num, err := strconv.ParseUint(sVal, 10, 64); err == nil {
@@ -444,5 +438,5 @@ func (s *NodeService) UpdateNode(id uint, updates map[string]interface{}) error
 	if result.RowsAffected == 0 {
 		return ErrNodeNotFound
 	}
-	return nil
+	return s.BumpConfigRevision(id)
 }
@@ -0,0 +1,76 @@
+package services
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"bakaray/internal/models"
+)
+
+// MaxNodeListenAddresses 节点最多上报的可绑定地址数
+const MaxNodeListenAddresses = 64
+
+// NormalizeListenIP 规范化规则的监听地址。空字符串、0.0.0.0 与 :: 均表示监听全部地址，返回空字符串
+func NormalizeListenIP(value string) (string, error) {
+	value = strings.Trim(strings.TrimSpace(value), "[]")
+	if value == "" {
+		return "", nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil || addr.Zone() != "" {
+		return "", fmt.Errorf("监听地址 %s 不是有效的 IP 地址", value)
+	}
+	addr = addr.Unmap()
+	if addr.IsUnspecified() {
+		return "", nil
+	}
+	return addr.String(), nil
+}
+
+// NodeHasListenAddress 判断地址是否在节点上报的可绑定地址中
+func NodeHasListenAddress(node *models.Node, ip string) bool {
+	return slices.Contains([]string(node.ListenAddresses), ip)
+}
+
+// ListenIPsOverlap 判断两个监听地址是否会占用同一端口：任一方监听全部地址或两者相同时冲突
+func ListenIPsOverlap(a, b string) bool {
+	return a == "" || b == "" || a == b
+}
+
+// normalizeNodeAddresses 规范化节点上报的地址：去掉无效、未指定和带 zone 的链路本地地址，去重并排序
+func normalizeNodeAddresses(addresses []string) models.StringSlice {
+	out := make(models.StringSlice, 0, len(addresses))
+	for _, raw := range addresses {
+		addr, err := netip.ParseAddr(strings.Trim(strings.TrimSpace(raw), "[]"))
+		if err != nil || addr.Zone() != "" {
+			continue
+		}
+		addr = addr.Unmap()
+		if addr.IsUnspecified() {
+			continue
+		}
+		if value := addr.String(); !slices.Contains(out, value) {
+			out = append(out, value)
+		}
+	}
+	slices.Sort(out)
+	if len(out) > MaxNodeListenAddresses {
+		out = out[:MaxNodeListenAddresses]
+	}
+	return out
+}
+
+// UpdateListenAddresses 保存节点心跳上报的可绑定地址，地址未变化时不写数据库。返回是否有变化
+func (s *NodeService) UpdateListenAddresses(node *models.Node, addresses []string) (bool, error) {
+	normalized := normalizeNodeAddresses(addresses)
+	if slices.Equal([]string(normalized), []string(node.ListenAddresses)) {
+		return false, nil
+	}
+	if err := s.db.Model(&models.Node{}).Where("id = ?", node.ID).Update("listen_addresses", normalized).Error; err != nil {
+		return false, err
+	}
+	node.ListenAddresses = normalized
+	return true, nil
+}
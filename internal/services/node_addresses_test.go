@@ -0,0 +1,53 @@
+package services
+
+import (
+	"testing"
+
+	"bakaray/internal/models"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeListenIP(t *testing.T) {
+	for input, want := range map[string]string{
+		"":                "",
+		"0.0.0.0":         "",
+		"[::]":            "",
+		" 192.0.2.10 ":    "192.0.2.10",
+		"::ffff:10.0.0.1": "10.0.0.1",
+		"2001:DB8::1":     "2001:db8::1",
+	} {
+		got, err := NormalizeListenIP(input)
+		require.NoError(t, err, input)
+		require.Equal(t, want, got, input)
+	}
+	for _, invalid := range []string{"example.com", "10.0.0.1:80", "fe80::1%eth0"} {
+		_, err := NormalizeListenIP(invalid)
+		require.Error(t, err, invalid)
+	}
+
+	require.True(t, ListenIPsOverlap("", "10.0.0.1"))
+	require.True(t, ListenIPsOverlap("10.0.0.1", "10.0.0.1"))
+	require.False(t, ListenIPsOverlap("10.0.0.1", "10.0.0.2"))
+}
+
+func TestUpdateListenAddresses(t *testing.T) {
+	db := setupTestDB(t)
+	service := NewNodeService(db, nil)
+
+	node := &models.Node{Name: "addr", Host: "10.0.0.1", Secret: "s"}
+	require.NoError(t, db.Create(node).Error)
+
+	changed, err := service.UpdateListenAddresses(node, []string{"10.0.0.2", "0.0.0.0", "bogus", "fe80::1%eth0", "2001:db8::1", "10.0.0.1", "10.0.0.2"})
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.Equal(t, models.StringSlice{"10.0.0.1", "10.0.0.2", "2001:db8::1"}, node.ListenAddresses)
+
+	stored, err := service.GetNodeByID(node.ID)
+	require.NoError(t, err)
+	require.Equal(t, node.ListenAddresses, stored.ListenAddresses)
+
+	changed, err = service.UpdateListenAddresses(stored, []string{"2001:db8::1", "10.0.0.1", "10.0.0.2"})
+	require.NoError(t, err)
+	require.False(t, changed)
+}
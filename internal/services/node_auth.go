@@ -0,0 +1,136 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"bakaray/internal/models"
+)
+
+const (
+	// NodeSignatureMaxSkew 节点请求时间戳允许的最大偏差
+	NodeSignatureMaxSkew = 5 * time.Minute
+	// nodeNonceTTL nonce 记录保留时长，覆盖时间窗口两侧
+	nodeNonceTTL = 2 * NodeSignatureMaxSkew
+	// maxNodeNonceLength nonce 最大长度
+	maxNodeNonceLength = 64
+)
+
+var (
+	ErrInvalidNodeCredential = errors.New("无效的节点密钥")
+	ErrNodeRequestExpired    = errors.New("请求时间戳超出允许范围")
+	ErrNodeNonceReused       = errors.New("请求 nonce 已使用")
+	ErrInvalidNodeNonce      = errors.New("无效的请求 nonce")
+)
+
+// NodeSignaturePayload 生成节点请求签名原文：
+// METHOD\nPATH\nQUERY\nTIMESTAMP\nNONCE\nhex(sha256(BODY))
+// QUERY 为请求中原样的查询字符串（不含 ?），没有查询参数时为空
+func NodeSignaturePayload(method, path, query, timestamp, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	return strings.Join([]string{
+		strings.ToUpper(method),
+		path,
+		query,
+		timestamp,
+		nonce,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+}
+
+// SignNodeRequest 使用节点密钥计算请求签名（hex 编码的 HMAC-SHA256）
+func SignNodeRequest(secret, method, path, query, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(NodeSignaturePayload(method, path, query, timestamp, nonce, body)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyNodeSignature 常量时间校验请求签名
+func VerifyNodeSignature(secret, signature, method, path, query, timestamp, nonce string, body []byte) bool {
+	expected := SignNodeRequest(secret, method, path, query, timestamp, nonce, body)
+	return hmac.Equal([]byte(expected), []byte(strings.ToLower(signature)))
+}
+
+// SecretEquals 常量时间比较密钥
+func SecretEquals(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// CheckNodeTimestamp 校验请求时间戳是否在允许的偏差内
+func CheckNodeTimestamp(ts, now time.Time) error {
+	skew := now.Sub(ts)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > NodeSignatureMaxSkew {
+		return ErrNodeRequestExpired
+	}
+	return nil
+}
+
+// AuthenticateNodeSecret 使用明文密钥认证节点（旧版请求体密钥模式）
+func (s *NodeService) AuthenticateNodeSecret(nodeID uint, secret string) (*models.Node, error) {
+	if secret == "" {
+		return nil, ErrInvalidNodeCredential
+	}
+	node, err := s.GetNodeByID(nodeID)
+	if err != nil {
+		return nil, ErrInvalidNodeCredential
+	}
+	if err := s.resolveNodeCredential(node, func(candidate string) bool {
+		return SecretEquals(candidate, secret)
+	}); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// AuthenticateNodeSignature 校验签名请求：时间戳窗口、签名及 nonce 去重
+// timestamp 为 Unix 秒。
+func (s *NodeService) AuthenticateNodeSignature(nodeID uint, method, path, query, timestamp, nonce, signature string, body []byte) (*models.Node, error) {
+	if nonce == "" || len(nonce) > maxNodeNonceLength {
+		return nil, ErrInvalidNodeNonce
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, ErrNodeRequestExpired
+	}
+	if err := CheckNodeTimestamp(time.Unix(unix, 0), time.Now()); err != nil {
+		return nil, err
+	}
+
+	node, err := s.GetNodeByID(nodeID)
+	if err != nil {
+		return nil, ErrInvalidNodeCredential
+	}
+	if err := s.resolveNodeCredential(node, func(candidate string) bool {
+		return VerifyNodeSignature(candidate, signature, method, path, query, timestamp, nonce, body)
+	}); err != nil {
+		return nil, err
+	}
+
+	// 签名通过后再记录 nonce，避免伪造请求占用合法 nonce
+	fresh, err := s.useNodeNonce(nodeID, nonce)
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		return nil, ErrNodeNonceReused
+	}
+	return node, nil
+}
+
+// useNodeNonce 记录 nonce，已存在时返回 false。
+// 使用 Redis 或数据库状态存储时跨实例共享。
+func (s *NodeService) useNodeNonce(nodeID uint, nonce string) (bool, error) {
+	key := fmt.Sprintf("node_nonce:%d:%s", nodeID, nonce)
+	return s.state.SetNX(context.Background(), key, []byte("1"), nodeNonceTTL)
+}
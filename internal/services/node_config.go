@@ -0,0 +1,207 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"bakaray/internal/models"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// MaxConfigLongPollWait 配置长轮询最长等待时间
+	MaxConfigLongPollWait = 60 * time.Second
+	// configRevisionRecheckInterval 长轮询期间回查数据库的周期，覆盖其他面板副本产生的变更
+	configRevisionRecheckInterval = time.Second
+)
+
+// configRevisionHub 进程内配置版本变更通知
+type configRevisionHub struct {
+	mu      sync.Mutex
+	waiters map[uint]map[chan struct{}]struct{}
+}
+
+var configHub = &configRevisionHub{waiters: make(map[uint]map[chan struct{}]struct{})}
+
+func (h *configRevisionHub) subscribe(nodeID uint) (chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	h.mu.Lock()
+	if h.waiters[nodeID] == nil {
+		h.waiters[nodeID] = make(map[chan struct{}]struct{})
+	}
+	h.waiters[nodeID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.waiters[nodeID], ch)
+		if len(h.waiters[nodeID]) == 0 {
+			delete(h.waiters, nodeID)
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (h *configRevisionHub) notify(nodeIDs ...uint) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, nodeID := range nodeIDs {
+		for ch := range h.waiters[nodeID] {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (h *configRevisionHub) notifyAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, waiters := range h.waiters {
+		for ch := range waiters {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// bumpConfigRevision 递增节点配置版本号并唤醒等待中的长轮询
+func bumpConfigRevision(db *gorm.DB, nodeIDs ...uint) error {
+	ids := uniqueNodeIDs(nodeIDs)
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := db.Model(&models.Node{}).Where("id IN ?", ids).
+		UpdateColumn("config_revision", gorm.Expr("config_revision + 1")).Error; err != nil {
+		return err
+	}
+	configHub.notify(ids...)
+	return nil
+}
+
+// bumpAllConfigRevisions 递增所有节点配置版本号（站点级配置变化时使用）
+func bumpAllConfigRevisions(db *gorm.DB) error {
+	if err := db.Model(&models.Node{}).Where("1 = 1").
+		UpdateColumn("config_revision", gorm.Expr("config_revision + 1")).Error; err != nil {
+		return err
+	}
+	configHub.notifyAll()
+	return nil
+}
+
+// tunnelEntryNodeIDs 返回以 exitNodeID 为出口的隧道规则所在的入口节点
+func tunnelEntryNodeIDs(db *gorm.DB, exitNodeID uint) ([]uint, error) {
+	var rules []models.ForwardingRule
+	if err := db.Select("id", "node_id", "node_group_id", "placement").
+		Where("tunnel_enabled = ? AND exit_node_id = ?", true, exitNodeID).
+		Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	var ids []uint
+	for i := range rules {
+		ruleIDs, err := ruleEntryNodeIDs(db, &rules[i])
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, ruleIDs...)
+	}
+	return uniqueNodeIDs(ids), nil
+}
+
+// ruleEntryNodeIDs 返回规则的入口节点；all 部署的规则为入口节点组的全部成员
+func ruleEntryNodeIDs(db *gorm.DB, rule *models.ForwardingRule) ([]uint, error) {
+	if rule.Placement != RulePlacementAll || rule.NodeGroupID == 0 {
+		return []uint{rule.NodeID}, nil
+	}
+	var ids []uint
+	err := db.Model(&models.Node{}).Where("node_group_id = ?", rule.NodeGroupID).Pluck("id", &ids).Error
+	return ids, err
+}
+
+// ruleNodeIDs 返回规则影响的节点（入口节点，以及启用隧道时的出口节点）
+func ruleNodeIDs(db *gorm.DB, rule *models.ForwardingRule) []uint {
+	if rule == nil {
+		return nil
+	}
+	ids, _ := ruleEntryNodeIDs(db, rule)
+	if rule.TunnelEnabled && rule.ExitNodeID > 0 {
+		ids = append(ids, rule.ExitNodeID)
+	}
+	return ids
+}
+
+// rulesOnNode 查询部署在节点上的入口规则：直接指定该节点的规则，以及该节点所在组的 all 部署规则
+func rulesOnNode(db *gorm.DB, nodeID uint) *gorm.DB {
+	groupIDs := db.Model(&models.Node{}).Select("node_group_id").Where("id = ? AND node_group_id <> 0", nodeID)
+	return db.Where("node_id = ? OR (placement = ? AND node_group_id IN (?))", nodeID, RulePlacementAll, groupIDs)
+}
+
+func uniqueNodeIDs(nodeIDs []uint) []uint {
+	seen := make(map[uint]struct{}, len(nodeIDs))
+	out := make([]uint, 0, len(nodeIDs))
+	for _, id := range nodeIDs {
+		if id == 0 {
+			continue
+		}
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		out = append(out, id)
+	}
+	return out
+}
+
+// GetConfigRevision 获取节点当前配置版本号
+func (s *NodeService) GetConfigRevision(nodeID uint) (int64, error) {
+	var node models.Node
+	if err := s.db.Select("id", "config_revision").First(&node, nodeID).Error; err != nil {
+		return 0, err
+	}
+	return node.ConfigRevision, nil
+}
+
+// BumpConfigRevision 递增节点配置版本号，同时刷新以这些节点为出口的隧道入口节点
+func (s *NodeService) BumpConfigRevision(nodeIDs ...uint) error {
+	affected := append([]uint(nil), nodeIDs...)
+	for _, nodeID := range nodeIDs {
+		entryIDs, err := tunnelEntryNodeIDs(s.db, nodeID)
+		if err != nil {
+			return err
+		}
+		affected = append(affected, entryIDs...)
+	}
+	return bumpConfigRevision(s.db, affected...)
+}
+
+// WaitForConfigRevision 阻塞直到节点配置版本号不等于 known，或 ctx 结束
+func (s *NodeService) WaitForConfigRevision(ctx context.Context, nodeID uint, known int64) (int64, error) {
+	notify, unsubscribe := configHub.subscribe(nodeID)
+	defer unsubscribe()
+
+	ticker := time.NewTicker(configRevisionRecheckInterval)
+	defer ticker.Stop()
+
+	for {
+		current, err := s.GetConfigRevision(nodeID)
+		if err != nil {
+			return 0, err
+		}
+		if current != known {
+			return current, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return current, ctx.Err()
+		case <-notify:
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"bakaray/internal/models"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigRevisionBumps(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	nodeService := NewNodeService(db, nil)
+	ruleService := NewRuleService(db, nil)
+	entry := createTestNode(t, db, "RevisionEntry")
+	exit := createTestNode(t, db, "RevisionExit")
+
+	revision := func(nodeID uint) int64 {
+		rev, err := nodeService.GetConfigRevision(nodeID)
+		require.NoError(t, err)
+		return rev
+	}
+
+	rule := &models.ForwardingRule{
+		NodeID:         entry.ID,
+		Name:           "tunnel",
+		Protocol:       "tcp",
+		Enabled:        true,
+		Mode:           "direct",
+		ListenPort:     10000,
+		TunnelEnabled:  true,
+		ExitNodeID:     exit.ID,
+		TunnelProtocol: "ws",
+		TunnelPort:     20000,
+	}
+	require.NoError(t, ruleService.CreateRuleWithTargets(rule, []models.Target{{Host: "1.1.1.1", Port: 80, Weight: 1, Enabled: true}}))
+	require.Equal(t, int64(1), revision(entry.ID))
+	require.Equal(t, int64(1), revision(exit.ID))
+
+	t.Run("更新规则目标递增入口与出口版本", func(t *testing.T) {
+		require.NoError(t, ruleService.UpdateRuleWithTargets(rule.ID, map[string]interface{}{"listen_port": 10001}, []models.Target{{Host: "2.2.2.2", Port: 80, Weight: 1, Enabled: true}}))
+		require.Equal(t, int64(2), revision(entry.ID))
+		require.Equal(t, int64(2), revision(exit.ID))
+
+		targets, err := ruleService.ListTargets(rule.ID, false)
+		require.NoError(t, err)
+		require.Len(t, targets, 1)
+		require.Equal(t, "2.2.2.2", targets[0].Host)
+	})
+
+	t.Run("出口节点变更刷新入口节点", func(t *testing.T) {
+		require.NoError(t, nodeService.UpdateNode(exit.ID, map[string]interface{}{"host": "exit.example.com"}))
+		require.Equal(t, int64(3), revision(entry.ID))
+		require.Equal(t, int64(3), revision(exit.ID))
+	})
+
+	t.Run("删除规则递增版本", func(t *testing.T) {
+		require.NoError(t, ruleService.DeleteRule(rule.ID))
+		require.Equal(t, int64(4), revision(entry.ID))
+		require.Equal(t, int64(4), revision(exit.ID))
+	})
+}
+
+func TestWaitForConfigRevision(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	nodeService := NewNodeService(db, nil)
+	node := createTestNode(t, db, "WaitNode")
+
+	t.Run("版本已变化时立即返回", func(t *testing.T) {
+		require.NoError(t, nodeService.BumpConfigRevision(node.ID))
+		rev, err := nodeService.WaitForConfigRevision(context.Background(), node.ID, 0)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), rev)
+	})
+
+	t.Run("变更后唤醒等待者", func(t *testing.T) {
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			_ = nodeService.BumpConfigRevision(node.ID)
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		start := time.Now()
+		rev, err := nodeService.WaitForConfigRevision(ctx, node.ID, 1)
+		require.NoError(t, err)
+		require.Equal(t, int64(2), rev)
+		require.Less(t, time.Since(start), configRevisionRecheckInterval)
+	})
+
+	t.Run("超时返回上下文错误", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := nodeService.WaitForConfigRevision(ctx, node.ID, 2)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
@@ -0,0 +1,208 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"bakaray/internal/models"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// enrollmentTokenPrefix 注册令牌前缀，便于识别和日志脱敏
+	enrollmentTokenPrefix = "brt_"
+	// MaxEnrollmentTokenUses 单个令牌允许的最大注册次数
+	MaxEnrollmentTokenUses = 1000
+)
+
+var (
+	ErrEnrollmentTokenInvalid  = errors.New("无效的注册令牌")
+	ErrEnrollmentTokenExpired  = errors.New("注册令牌已过期")
+	ErrEnrollmentTokenUsedUp   = errors.New("注册令牌使用次数已用完")
+	ErrEnrollmentTokenRevoked  = errors.New("注册令牌已吊销")
+	ErrEnrollmentTokenNotFound = errors.New("注册令牌不存在")
+	ErrNodeNameTaken           = errors.New("节点名称已存在")
+)
+
+// EnrollmentTokenOptions 签发注册令牌参数
+type EnrollmentTokenOptions struct {
+	Description string
+	MaxUses     int
+	ExpiresAt   *time.Time
+	NodeGroupID uint
+	Region      string
+	Protocols   []string
+	CreatedBy   uint
+}
+
+// CreateEnrollmentToken 签发注册令牌，返回的明文令牌只在此处出现一次
+func (s *NodeService) CreateEnrollmentToken(opts EnrollmentTokenOptions) (string, *models.NodeEnrollmentToken, error) {
+	if opts.NodeGroupID != 0 {
+		var count int64
+		if err := s.db.Model(&models.NodeGroup{}).Where("id = ?", opts.NodeGroupID).Count(&count).Error; err != nil {
+			return "", nil, err
+		}
+		if count == 0 {
+			return "", nil, ErrNodeGroupNotFound
+		}
+	}
+	if opts.MaxUses <= 0 {
+		opts.MaxUses = 1
+	}
+	if opts.MaxUses > MaxEnrollmentTokenUses {
+		opts.MaxUses = MaxEnrollmentTokenUses
+	}
+
+	raw, err := randomHex(24)
+	if err != nil {
+		return "", nil, err
+	}
+	token := enrollmentTokenPrefix + raw
+
+	var protocols models.StringSlice
+	if len(opts.Protocols) > 0 {
+		protocols = NormalizeNodeProtocols(opts.Protocols)
+	}
+
+	record := &models.NodeEnrollmentToken{
+		TokenHash:   hashEnrollmentToken(token),
+		TokenPrefix: token[:len(enrollmentTokenPrefix)+6],
+		Description: strings.TrimSpace(opts.Description),
+		MaxUses:     opts.MaxUses,
+		ExpiresAt:   opts.ExpiresAt,
+		NodeGroupID: opts.NodeGroupID,
+		Region:      strings.TrimSpace(opts.Region),
+		Protocols:   protocols,
+		CreatedBy:   opts.CreatedBy,
+	}
+	if err := s.db.Create(record).Error; err != nil {
+		return "", nil, err
+	}
+	return token, record, nil
+}
+
+// ListEnrollmentTokens 获取注册令牌列表
+func (s *NodeService) ListEnrollmentTokens() ([]models.NodeEnrollmentToken, error) {
+	var tokens []models.NodeEnrollmentToken
+	if err := s.db.Order("id desc").Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// RevokeEnrollmentToken 吊销注册令牌，已注册的节点不受影响
+func (s *NodeService) RevokeEnrollmentToken(id uint) error {
+	now := time.Now()
+	result := s.db.Model(&models.NodeEnrollmentToken{}).
+		Where("id = ? AND revoked_at IS NULL", id).
+		Update("revoked_at", &now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		var count int64
+		if err := s.db.Model(&models.NodeEnrollmentToken{}).Where("id = ?", id).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrEnrollmentTokenNotFound
+		}
+	}
+	return nil
+}
+
+// EnrollNode 凭注册令牌创建节点并生成节点独立密钥。
+// 节点名称已存在时拒绝注册，不会覆盖已有节点。
+func (s *NodeService) EnrollNode(token, name, host string, port int) (*models.Node, error) {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return nil, ErrEnrollmentTokenInvalid
+	}
+	secret, err := GenerateNodeSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	var node *models.Node
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		var record models.NodeEnrollmentToken
+		if err := tx.Where("token_hash = ?", hashEnrollmentToken(token)).First(&record).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrEnrollmentTokenInvalid
+			}
+			return err
+		}
+
+		now := time.Now()
+		switch {
+		case record.RevokedAt != nil:
+			return ErrEnrollmentTokenRevoked
+		case record.ExpiresAt != nil && !now.Before(*record.ExpiresAt):
+			return ErrEnrollmentTokenExpired
+		case record.UsedCount >= record.MaxUses:
+			return ErrEnrollmentTokenUsedUp
+		}
+
+		var count int64
+		if err := tx.Model(&models.Node{}).Where("name = ?", name).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrNodeNameTaken
+		}
+
+		// 条件递增，并发注册时不会超出次数限制
+		result := tx.Model(&models.NodeEnrollmentToken{}).
+			Where("id = ? AND used_count < max_uses", record.ID).
+			Updates(map[string]interface{}{
+				"used_count":   gorm.Expr("used_count + 1"),
+				"last_used_at": &now,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrEnrollmentTokenUsedUp
+		}
+
+		node = &models.Node{
+			Name:        name,
+			Host:        host,
+			Port:        port,
+			Secret:      secret,
+			Status:      NodeStatusOffline,
+			NodeGroupID: record.NodeGroupID,
+			Protocols:   NormalizeNodeProtocols([]string(record.Protocols)),
+			Multiplier:  1,
+			Region:      record.Region,
+		}
+		return tx.Create(node).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// GenerateNodeSecret 生成节点独立密钥
+func GenerateNodeSecret() (string, error) {
+	return randomHex(32)
+}
+
+func hashEnrollmentToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,101 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"bakaray/internal/models"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnrollNode(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	service := NewNodeService(db, nil)
+
+	group := &models.NodeGroup{Name: "enroll-group"}
+	require.NoError(t, db.Create(group).Error)
+
+	t.Run("令牌注册生成独立密钥并继承预设", func(t *testing.T) {
+		token, record, err := service.CreateEnrollmentToken(EnrollmentTokenOptions{
+			MaxUses:     2,
+			NodeGroupID: group.ID,
+			Region:      "HK",
+			Protocols:   []string{"TCP", "ws", "unknown"},
+		})
+		require.NoError(t, err)
+		require.NotEqual(t, token, record.TokenHash)
+
+		first, err := service.EnrollNode(token, "enroll-a", "10.0.0.1", 0)
+		require.NoError(t, err)
+		second, err := service.EnrollNode(token, "enroll-b", "10.0.0.2", 0)
+		require.NoError(t, err)
+
+		require.Len(t, first.Secret, 64)
+		require.NotEqual(t, first.Secret, second.Secret)
+		require.Equal(t, group.ID, first.NodeGroupID)
+		require.Equal(t, "HK", first.Region)
+		require.Equal(t, models.StringSlice{"tcp", "ws"}, first.Protocols)
+
+		_, err = service.EnrollNode(token, "enroll-c", "10.0.0.3", 0)
+		require.ErrorIs(t, err, ErrEnrollmentTokenUsedUp)
+
+		var stored models.NodeEnrollmentToken
+		require.NoError(t, db.First(&stored, record.ID).Error)
+		require.Equal(t, 2, stored.UsedCount)
+		require.NotNil(t, stored.LastUsedAt)
+	})
+
+	t.Run("未指定协议时使用默认协议", func(t *testing.T) {
+		token, _, err := service.CreateEnrollmentToken(EnrollmentTokenOptions{})
+		require.NoError(t, err)
+
+		node, err := service.EnrollNode(token, "enroll-default", "10.0.0.4", 0)
+		require.NoError(t, err)
+		require.Equal(t, models.StringSlice(SupportedNodeProtocols()), node.Protocols)
+	})
+
+	t.Run("同名节点不会被覆盖", func(t *testing.T) {
+		existing := createTestNode(t, db, "taken-name")
+		token, record, err := service.CreateEnrollmentToken(EnrollmentTokenOptions{})
+		require.NoError(t, err)
+
+		_, err = service.EnrollNode(token, "taken-name", "10.0.0.5", 0)
+		require.ErrorIs(t, err, ErrNodeNameTaken)
+
+		node, err := service.GetNodeByID(existing.ID)
+		require.NoError(t, err)
+		require.Equal(t, existing.Secret, node.Secret)
+		require.Equal(t, existing.Host, node.Host)
+
+		var stored models.NodeEnrollmentToken
+		require.NoError(t, db.First(&stored, record.ID).Error)
+		require.Equal(t, 0, stored.UsedCount)
+	})
+
+	t.Run("过期、吊销和无效令牌被拒绝", func(t *testing.T) {
+		past := time.Now().Add(-time.Minute)
+		expired, _, err := service.CreateEnrollmentToken(EnrollmentTokenOptions{ExpiresAt: &past})
+		require.NoError(t, err)
+		_, err = service.EnrollNode(expired, "expired-node", "10.0.0.6", 0)
+		require.ErrorIs(t, err, ErrEnrollmentTokenExpired)
+
+		revoked, record, err := service.CreateEnrollmentToken(EnrollmentTokenOptions{})
+		require.NoError(t, err)
+		require.NoError(t, service.RevokeEnrollmentToken(record.ID))
+		_, err = service.EnrollNode(revoked, "revoked-node", "10.0.0.7", 0)
+		require.ErrorIs(t, err, ErrEnrollmentTokenRevoked)
+
+		_, err = service.EnrollNode("brt_not-a-token", "invalid-node", "10.0.0.8", 0)
+		require.ErrorIs(t, err, ErrEnrollmentTokenInvalid)
+
+		require.ErrorIs(t, service.RevokeEnrollmentToken(99999), ErrEnrollmentTokenNotFound)
+	})
+
+	t.Run("不存在的节点组无法签发令牌", func(t *testing.T) {
+		_, _, err := service.CreateEnrollmentToken(EnrollmentTokenOptions{NodeGroupID: group.ID + 100})
+		require.ErrorIs(t, err, ErrNodeGroupNotFound)
+	})
+}
@@ -0,0 +1,421 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"bakaray/internal/models"
+
+	"gorm.io/gorm"
+)
+
+const (
+	NodeGroupTypeEntry  = "entry"
+	NodeGroupTypeTarget = "target"
+
+	// RulePlacementAll 规则部署到入口节点组内的全部节点
+	RulePlacementAll = "all"
+	// RulePlacementHealthiest 规则部署到入口节点组内当前最健康的一个节点
+	RulePlacementHealthiest = "healthiest"
+)
+
+var (
+	ErrNodeGroupNotFound    = errors.New("节点组不存在")
+	ErrNodeGroupInUse       = errors.New("节点组仍被规则使用")
+	ErrInvalidNodeGroupType = errors.New("节点组类型仅支持 entry 或 target")
+)
+
+// ErrNodeGroupPortConflict 新成员上已有的监听与组内 all 部署规则的监听端口冲突
+var ErrNodeGroupPortConflict = errors.New("节点监听端口与组内规则冲突")
+
+// NodeGroupService 节点组服务
+type NodeGroupService struct {
+	db *gorm.DB
+}
+
+// NewNodeGroupService 创建节点组服务
+func NewNodeGroupService(db *gorm.DB) *NodeGroupService {
+	return &NodeGroupService{db: db}
+}
+
+// NodeGroupSummary 节点组及成员统计
+type NodeGroupSummary struct {
+	models.NodeGroup
+	MemberCount int64 `json:"member_count"`
+	OnlineCount int64 `json:"online_count"`
+}
+
+// NormalizeNodeGroupType 规范化节点组类型，不支持的类型返回空字符串
+func NormalizeNodeGroupType(groupType string) string {
+	switch t := strings.ToLower(strings.TrimSpace(groupType)); t {
+	case NodeGroupTypeEntry, NodeGroupTypeTarget:
+		return t
+	default:
+		return ""
+	}
+}
+
+// CreateNodeGroup 创建节点组
+func (s *NodeGroupService) CreateNodeGroup(name, groupType, description string) (*models.NodeGroup, error) {
+	groupType = NormalizeNodeGroupType(groupType)
+	if groupType == "" {
+		return nil, ErrInvalidNodeGroupType
+	}
+	group := &models.NodeGroup{
+		Name:        strings.TrimSpace(name),
+		Type:        groupType,
+		Description: description,
+	}
+	if err := s.db.Create(group).Error; err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// GetNodeGroupByID 根据ID获取节点组
+func (s *NodeGroupService) GetNodeGroupByID(id uint) (*models.NodeGroup, error) {
+	var group models.NodeGroup
+	if err := s.db.First(&group, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNodeGroupNotFound
+		}
+		return nil, err
+	}
+	return &group, nil
+}
+
+// ListNodeGroups 获取节点组列表及成员数
+func (s *NodeGroupService) ListNodeGroups() ([]NodeGroupSummary, error) {
+	var groups []models.NodeGroup
+	if err := s.db.Order("id asc").Find(&groups).Error; err != nil {
+		return nil, err
+	}
+
+	type countRow struct {
+		NodeGroupID uint
+		Status      string
+		Count       int64
+	}
+	var rows []countRow
+	if err := s.db.Model(&models.Node{}).
+		Select("node_group_id, status, COUNT(*) AS count").
+		Where("node_group_id <> 0").
+		Group("node_group_id, status").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	summaries := make([]NodeGroupSummary, len(groups))
+	index := make(map[uint]int, len(groups))
+	for i, group := range groups {
+		summaries[i] = NodeGroupSummary{NodeGroup: group}
+		index[group.ID] = i
+	}
+	for _, row := range rows {
+		i, ok := index[row.NodeGroupID]
+		if !ok {
+			continue
+		}
+		summaries[i].MemberCount += row.Count
+		if row.Status == NodeStatusOnline {
+			summaries[i].OnlineCount += row.Count
+		}
+	}
+	return summaries, nil
+}
+
+// UpdateNodeGroup 更新节点组。被规则引用的节点组不允许修改类型。
+func (s *NodeGroupService) UpdateNodeGroup(id uint, updates map[string]interface{}) error {
+	group, err := s.GetNodeGroupByID(id)
+	if err != nil {
+		return err
+	}
+
+	allowed := make(map[string]interface{}, len(updates))
+	for _, key := range []string{"name", "description"} {
+		if value, ok := updates[key]; ok {
+			allowed[key] = value
+		}
+	}
+	if raw, ok := updates["type"]; ok {
+		value, _ := raw.(string)
+		groupType := NormalizeNodeGroupType(value)
+		if groupType == "" {
+			return ErrInvalidNodeGroupType
+		}
+		if groupType != group.Type {
+			inUse, err := s.groupInUse(id)
+			if err != nil {
+				return err
+			}
+			if inUse {
+				return ErrNodeGroupInUse
+			}
+		}
+		allowed["type"] = groupType
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+	return s.db.Model(&models.NodeGroup{}).Where("id = ?", id).Updates(allowed).Error
+}
+
+// DeleteNodeGroup 删除节点组，成员节点移出该组。被规则引用时拒绝删除。
+func (s *NodeGroupService) DeleteNodeGroup(id uint) error {
+	if _, err := s.GetNodeGroupByID(id); err != nil {
+		return err
+	}
+	inUse, err := s.groupInUse(id)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return ErrNodeGroupInUse
+	}
+
+	var memberIDs []uint
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Node{}).Where("node_group_id = ?", id).Pluck("id", &memberIDs).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.Node{}).Where("node_group_id = ?", id).Update("node_group_id", 0).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&models.NodeGroup{}, id).Error
+	}); err != nil {
+		return err
+	}
+	return bumpConfigRevision(s.db, memberIDs...)
+}
+
+// ListMembers 获取节点组成员
+func (s *NodeGroupService) ListMembers(groupID uint) ([]models.Node, error) {
+	return listNodeGroupMembers(s.db, groupID)
+}
+
+// SetMembers 设置节点组成员。节点同一时间只属于一个节点组，
+// 列表中的节点会从原节点组移入；原成员不在列表中的移出。
+// 新加入的节点需要承载组内 all 部署的规则，监听端口与节点上已有规则冲突时拒绝修改。
+func (s *NodeGroupService) SetMembers(groupID uint, nodeIDs []uint) error {
+	if _, err := s.GetNodeGroupByID(groupID); err != nil {
+		return err
+	}
+	nodeIDs = uniqueNodeIDs(nodeIDs)
+
+	var changed []uint
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		if len(nodeIDs) > 0 {
+			var count int64
+			if err := tx.Model(&models.Node{}).Where("id IN ?", nodeIDs).Count(&count).Error; err != nil {
+				return err
+			}
+			if count != int64(len(nodeIDs)) {
+				return ErrNodeNotFound
+			}
+		}
+
+		var removed []uint
+		query := tx.Model(&models.Node{}).Where("node_group_id = ?", groupID)
+		if len(nodeIDs) > 0 {
+			query = query.Where("id NOT IN ?", nodeIDs)
+		}
+		if err := query.Pluck("id", &removed).Error; err != nil {
+			return err
+		}
+		if len(removed) > 0 {
+			if err := tx.Model(&models.Node{}).Where("id IN ?", removed).Update("node_group_id", 0).Error; err != nil {
+				return err
+			}
+		}
+
+		var added []uint
+		if len(nodeIDs) > 0 {
+			if err := tx.Model(&models.Node{}).Where("id IN ? AND node_group_id <> ?", nodeIDs, groupID).Pluck("id", &added).Error; err != nil {
+				return err
+			}
+			if len(added) > 0 {
+				if err := tx.Model(&models.Node{}).Where("id IN ?", added).Update("node_group_id", groupID).Error; err != nil {
+					return err
+				}
+				if err := checkGroupRulePorts(tx, groupID, added); err != nil {
+					return err
+				}
+			}
+		}
+
+		changed = append(removed, added...)
+		return nil
+	}); err != nil {
+		return err
+	}
+	return bumpConfigRevision(s.db, changed...)
+}
+
+// checkGroupRulePorts 检查节点组内启用的 all 部署规则在新成员上的监听端口是否空闲。
+// 需在成员关系更新后调用，组内规则彼此之间不视为冲突。
+func checkGroupRulePorts(db *gorm.DB, groupID uint, nodeIDs []uint) error {
+	var rules []models.ForwardingRule
+	if err := db.Where("enabled = ? AND node_group_id = ? AND placement = ?", true, groupID, RulePlacementAll).
+		Order("id asc").
+		Find(&rules).Error; err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	groupRuleIDs := make([]uint, 0, len(rules))
+	for _, rule := range rules {
+		groupRuleIDs = append(groupRuleIDs, rule.ID)
+	}
+
+	var nodes []models.Node
+	if err := db.Select("id", "name").Where("id IN ?", nodeIDs).Order("id asc").Find(&nodes).Error; err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		for i := range rules {
+			rule := &rules[i]
+			if !IsDirectProtocol(rule.Protocol) {
+				continue
+			}
+			network := DirectProtocolNetwork(rule.Protocol)
+			conflict, err := findPortConflict(db, node.ID, rule.ListenPort, RuleListenPortEnd(rule), network, rule.ListenIP, groupRuleIDs)
+			if err != nil {
+				return err
+			}
+			if conflict != nil {
+				ports := strconv.Itoa(rule.ListenPort)
+				if end := RuleListenPortEnd(rule); end > rule.ListenPort {
+					ports = fmt.Sprintf("%d-%d", rule.ListenPort, end)
+				}
+				return fmt.Errorf("%w: 规则 %s 的 %s 端口 %s 在节点 %s 上已被规则 %s 占用",
+					ErrNodeGroupPortConflict, rule.Name, strings.ToUpper(network), ports, node.Name, conflict.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// RemoveMember 将节点移出节点组
+func (s *NodeGroupService) RemoveMember(groupID, nodeID uint) error {
+	result := s.db.Model(&models.Node{}).
+		Where("id = ? AND node_group_id = ?", nodeID, groupID).
+		Update("node_group_id", 0)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNodeNotFound
+	}
+	return bumpConfigRevision(s.db, nodeID)
+}
+
+// AssignNode 将节点移入 groupID 节点组，groupID 为 0 时移出当前节点组。
+// 与 SetMembers 相同，节点上已有的监听与组内 all 部署规则冲突时拒绝移入。
+func (s *NodeGroupService) AssignNode(nodeID, groupID uint) error {
+	if groupID != 0 {
+		if _, err := s.GetNodeGroupByID(groupID); err != nil {
+			return err
+		}
+	}
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Node{}).Where("id = ?", nodeID).Update("node_group_id", groupID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNodeNotFound
+		}
+		if groupID == 0 {
+			return nil
+		}
+		return checkGroupRulePorts(tx, groupID, []uint{nodeID})
+	}); err != nil {
+		return err
+	}
+	return bumpConfigRevision(s.db, nodeID)
+}
+
+// RankPlacementCandidates 按健康度排序候选节点：在线优先，其次 preferID，
+// 再按启用规则数从少到多、最近心跳从新到旧排列。
+func (s *NodeGroupService) RankPlacementCandidates(nodes []models.Node, preferID uint) ([]models.Node, error) {
+	return rankPlacementCandidates(s.db, nodes, preferID)
+}
+
+func (s *NodeGroupService) groupInUse(id uint) (bool, error) {
+	var count int64
+	if err := s.db.Model(&models.ForwardingRule{}).
+		Where("node_group_id = ? OR exit_group_id = ?", id, id).
+		Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func listNodeGroupMembers(db *gorm.DB, groupID uint) ([]models.Node, error) {
+	var nodes []models.Node
+	if groupID == 0 {
+		return nodes, nil
+	}
+	if err := db.Where("node_group_id = ?", groupID).Order("id asc").Find(&nodes).Error; err != nil {
+		return nil, err
+	}
+	for i := range nodes {
+		nodes[i].Protocols = NormalizeNodeProtocols([]string(nodes[i].Protocols))
+	}
+	return nodes, nil
+}
+
+func rankPlacementCandidates(db *gorm.DB, nodes []models.Node, preferID uint) ([]models.Node, error) {
+	if len(nodes) == 0 {
+		return nodes, nil
+	}
+	ids := make([]uint, 0, len(nodes))
+	for _, node := range nodes {
+		ids = append(ids, node.ID)
+	}
+
+	loads := make(map[uint]int64, len(nodes))
+	var rules []models.ForwardingRule
+	if err := db.Select("id", "node_id", "node_group_id", "placement").
+		Where("enabled = ?", true).
+		Where("node_id IN ? OR placement = ?", ids, RulePlacementAll).
+		Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if rule.Placement == RulePlacementAll {
+			for _, node := range nodes {
+				if node.NodeGroupID != 0 && node.NodeGroupID == rule.NodeGroupID {
+					loads[node.ID]++
+				}
+			}
+			continue
+		}
+		loads[rule.NodeID]++
+	}
+
+	ranked := make([]models.Node, len(nodes))
+	copy(ranked, nodes)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		aOnline, bOnline := a.Status == NodeStatusOnline, b.Status == NodeStatusOnline
+		if aOnline != bOnline {
+			return aOnline
+		}
+		if (a.ID == preferID) != (b.ID == preferID) {
+			return a.ID == preferID
+		}
+		if loads[a.ID] != loads[b.ID] {
+			return loads[a.ID] < loads[b.ID]
+		}
+		if a.LastSeen == nil || b.LastSeen == nil {
+			return a.LastSeen != nil
+		}
+		return a.LastSeen.After(*b.LastSeen)
+	})
+	return ranked, nil
+}
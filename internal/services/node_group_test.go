@@ -0,0 +1,225 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"bakaray/internal/models"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeGroupService(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	service := NewNodeGroupService(db)
+	nodeService := NewNodeService(db, nil)
+
+	t.Run("创建节点组校验类型", func(t *testing.T) {
+		_, err := service.CreateNodeGroup("bad", "relay", "")
+		require.ErrorIs(t, err, ErrInvalidNodeGroupType)
+
+		group, err := service.CreateNodeGroup(" HK ", "Entry", "香港入口")
+		require.NoError(t, err)
+		require.Equal(t, "HK", group.Name)
+		require.Equal(t, NodeGroupTypeEntry, group.Type)
+	})
+
+	t.Run("设置成员并统计在线数", func(t *testing.T) {
+		group := createTestNodeGroup(t, db, "members", NodeGroupTypeEntry)
+		a := createTestNodeFull(t, db, "MemberA", "a.test", 8080, NodeStatusOnline)
+		b := createTestNodeFull(t, db, "MemberB", "b.test", 8080, NodeStatusOffline)
+		c := createTestNodeFull(t, db, "MemberC", "c.test", 8080, NodeStatusOnline)
+
+		require.NoError(t, service.SetMembers(group.ID, []uint{a.ID, b.ID}))
+		members, err := service.ListMembers(group.ID)
+		require.NoError(t, err)
+		require.Len(t, members, 2)
+
+		rev, err := nodeService.GetConfigRevision(a.ID)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), rev)
+
+		require.NoError(t, service.SetMembers(group.ID, []uint{b.ID, c.ID}))
+		members, err = service.ListMembers(group.ID)
+		require.NoError(t, err)
+		require.Equal(t, []uint{b.ID, c.ID}, []uint{members[0].ID, members[1].ID})
+
+		removed, err := nodeService.GetNodeByID(a.ID)
+		require.NoError(t, err)
+		require.Zero(t, removed.NodeGroupID)
+
+		summaries, err := service.ListNodeGroups()
+		require.NoError(t, err)
+		for _, summary := range summaries {
+			if summary.ID == group.ID {
+				require.Equal(t, int64(2), summary.MemberCount)
+				require.Equal(t, int64(1), summary.OnlineCount)
+			}
+		}
+
+		require.ErrorIs(t, service.SetMembers(group.ID, []uint{99999}), ErrNodeNotFound)
+		require.ErrorIs(t, service.RemoveMember(group.ID, a.ID), ErrNodeNotFound)
+		require.NoError(t, service.RemoveMember(group.ID, c.ID))
+	})
+
+	t.Run("被规则引用时拒绝删除与修改类型", func(t *testing.T) {
+		group := createTestNodeGroup(t, db, "in-use", NodeGroupTypeEntry)
+		node := createTestNode(t, db, "InUseNode")
+		require.NoError(t, service.SetMembers(group.ID, []uint{node.ID}))
+		rule := createTestRule(t, db, 0, "group-rule")
+		require.NoError(t, db.Model(rule).Updates(map[string]interface{}{"node_group_id": group.ID, "placement": RulePlacementAll}).Error)
+
+		require.ErrorIs(t, service.DeleteNodeGroup(group.ID), ErrNodeGroupInUse)
+		require.ErrorIs(t, service.UpdateNodeGroup(group.ID, map[string]interface{}{"type": "target"}), ErrNodeGroupInUse)
+		require.NoError(t, service.UpdateNodeGroup(group.ID, map[string]interface{}{"name": "renamed"}))
+
+		require.NoError(t, db.Delete(rule).Error)
+		require.NoError(t, service.DeleteNodeGroup(group.ID))
+		_, err := service.GetNodeGroupByID(group.ID)
+		require.ErrorIs(t, err, ErrNodeGroupNotFound)
+
+		member, err := nodeService.GetNodeByID(node.ID)
+		require.NoError(t, err)
+		require.Zero(t, member.NodeGroupID)
+	})
+
+	t.Run("新成员端口与组内规则冲突时拒绝加入", func(t *testing.T) {
+		group := createTestNodeGroup(t, db, "ports", NodeGroupTypeEntry)
+		a := createTestNode(t, db, "PortsA")
+		b := createTestNode(t, db, "PortsB")
+		require.NoError(t, service.SetMembers(group.ID, []uint{a.ID}))
+
+		groupRule := createTestRule(t, db, 0, "group-range")
+		require.NoError(t, db.Model(groupRule).Updates(map[string]interface{}{"node_group_id": group.ID, "placement": RulePlacementAll, "listen_port": 9100, "listen_port_end": 9110}).Error)
+		local := createTestRule(t, db, b.ID, "local")
+		require.NoError(t, db.Model(local).Update("listen_port", 9105).Error)
+
+		err := service.SetMembers(group.ID, []uint{a.ID, b.ID})
+		require.ErrorIs(t, err, ErrNodeGroupPortConflict)
+		require.Contains(t, err.Error(), "9100-9110")
+		member, err := nodeService.GetNodeByID(b.ID)
+		require.NoError(t, err)
+		require.Zero(t, member.NodeGroupID)
+
+		// 不同传输层的监听不冲突
+		require.NoError(t, db.Model(local).Update("protocol", "udp").Error)
+		require.NoError(t, service.SetMembers(group.ID, []uint{a.ID, b.ID}))
+	})
+
+	t.Run("单独修改节点所属组时同样检查端口冲突", func(t *testing.T) {
+		group := createTestNodeGroup(t, db, "assign", NodeGroupTypeEntry)
+		a := createTestNode(t, db, "AssignA")
+		require.NoError(t, service.SetMembers(group.ID, []uint{a.ID}))
+		groupRule := createTestRule(t, db, 0, "assign-group")
+		require.NoError(t, db.Model(groupRule).Updates(map[string]interface{}{"node_group_id": group.ID, "placement": RulePlacementAll, "listen_port": 9200}).Error)
+
+		c := createTestNode(t, db, "AssignC")
+		local := createTestRule(t, db, c.ID, "assign-local")
+		require.NoError(t, db.Model(local).Update("listen_port", 9200).Error)
+
+		// 通用的节点更新不再修改所属组
+		require.NoError(t, nodeService.UpdateNode(c.ID, map[string]interface{}{"node_group_id": group.ID, "region": "hk"}))
+		member, err := nodeService.GetNodeByID(c.ID)
+		require.NoError(t, err)
+		require.Zero(t, member.NodeGroupID)
+		require.Equal(t, "hk", member.Region)
+
+		require.ErrorIs(t, service.AssignNode(c.ID, group.ID), ErrNodeGroupPortConflict)
+		require.ErrorIs(t, service.AssignNode(c.ID, group.ID+1000), ErrNodeGroupNotFound)
+		member, err = nodeService.GetNodeByID(c.ID)
+		require.NoError(t, err)
+		require.Zero(t, member.NodeGroupID)
+
+		require.NoError(t, db.Model(local).Update("listen_port", 9201).Error)
+		require.NoError(t, service.AssignNode(c.ID, group.ID))
+		require.NoError(t, service.AssignNode(a.ID, 0))
+		members, err := service.ListMembers(group.ID)
+		require.NoError(t, err)
+		require.Len(t, members, 1)
+		require.Equal(t, c.ID, members[0].ID)
+	})
+}
+
+func TestGroupRulePlacement(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	groupService := NewNodeGroupService(db)
+	ruleService := NewRuleService(db, nil)
+	nodeService := NewNodeService(db, nil)
+
+	userGroup := createTestUserGroup(t, db, "placement")
+	user := createTestUser(t, db, "placement-user")
+	require.NoError(t, db.Model(user).Update("user_group_id", userGroup.ID).Error)
+
+	group := createTestNodeGroup(t, db, "entry", NodeGroupTypeEntry)
+	a := createTestNodeFull(t, db, "PlaceA", "a.test", 8080, NodeStatusOnline)
+	b := createTestNodeFull(t, db, "PlaceB", "b.test", 8080, NodeStatusOnline)
+	require.NoError(t, groupService.SetMembers(group.ID, []uint{a.ID, b.ID}))
+	for _, node := range []*models.Node{a, b} {
+		require.NoError(t, db.Create(&models.NodeAllowedGroup{NodeID: node.ID, UserGroupID: userGroup.ID}).Error)
+	}
+
+	t.Run("all 部署的规则下发到全部成员", func(t *testing.T) {
+		rule := &models.ForwardingRule{
+			UserID:      user.ID,
+			NodeGroupID: group.ID,
+			Placement:   RulePlacementAll,
+			Name:        "all",
+			Protocol:    "tcp",
+			Enabled:     true,
+			Mode:        "direct",
+			ListenPort:  30000,
+		}
+		require.NoError(t, ruleService.CreateRuleWithTargets(rule, []models.Target{{Host: "1.1.1.1", Port: 80, Weight: 1, Enabled: true}}))
+
+		for _, node := range []*models.Node{a, b} {
+			rules, err := ruleService.ListRulesByNode(node.ID, true)
+			require.NoError(t, err)
+			require.Len(t, rules, 1)
+			require.Equal(t, rule.ID, rules[0].ID)
+
+			rev, err := nodeService.GetConfigRevision(node.ID)
+			require.NoError(t, err)
+			require.Equal(t, int64(2), rev)
+		}
+
+		require.NoError(t, ruleService.DeleteRule(rule.ID))
+	})
+
+	t.Run("healthiest 部署在节点离线后迁移", func(t *testing.T) {
+		rule := &models.ForwardingRule{
+			UserID:      user.ID,
+			NodeID:      a.ID,
+			NodeGroupID: group.ID,
+			Placement:   RulePlacementHealthiest,
+			Name:        "healthiest",
+			Protocol:    "tcp",
+			Enabled:     true,
+			Mode:        "direct",
+			ListenPort:  30001,
+		}
+		require.NoError(t, ruleService.CreateRuleWithTargets(rule, []models.Target{{Host: "1.1.1.1", Port: 80, Weight: 1, Enabled: true}}))
+
+		moved, err := ruleService.RebalanceGroupRules()
+		require.NoError(t, err)
+		require.Zero(t, moved)
+
+		seen := time.Now().Add(-time.Hour)
+		require.NoError(t, db.Model(&models.Node{}).Where("id = ?", a.ID).Updates(map[string]interface{}{"status": NodeStatusOffline, "last_seen": &seen}).Error)
+
+		moved, err = ruleService.RebalanceGroupRules()
+		require.NoError(t, err)
+		require.Equal(t, 1, moved)
+
+		updated, err := ruleService.GetRuleByID(rule.ID)
+		require.NoError(t, err)
+		require.Equal(t, b.ID, updated.NodeID)
+
+		rules, err := ruleService.ListRulesByNode(a.ID, true)
+		require.NoError(t, err)
+		require.Empty(t, rules)
+	})
+}
@@ -74,6 +74,12 @@ func NormalizeNodeProtocols(protocols []string) models.StringSlice {
 	return models.StringSlice(out)
 }
 
+// IsSupportedNodeProtocol 判断协议是否为已知的节点能力（直接转发或隧道协议）
+func IsSupportedNodeProtocol(protocol string) bool {
+	_, ok := supportedNodeProtocols[NormalizeProtocol(protocol)]
+	return ok
+}
+
 func NormalizeProtocol(protocol string) string {
 	return strings.ToLower(strings.TrimSpace(protocol))
 }
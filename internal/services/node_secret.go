@@ -0,0 +1,152 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"bakaray/internal/models"
+)
+
+const (
+	// DefaultSecretRotationOverlap 密钥轮换默认重叠期
+	DefaultSecretRotationOverlap = time.Hour
+	// MaxSecretRotationOverlap 密钥轮换最长重叠期
+	MaxSecretRotationOverlap = 7 * 24 * time.Hour
+)
+
+var ErrNodeCredentialsRevoked = errors.New("节点凭据已吊销")
+
+// nodeCredentialFields 只能通过轮换/吊销接口修改的字段
+var nodeCredentialFields = []string{"secret", "next_secret", "secret_rotate_at", "secret_revoked_at"}
+
+// SecretRotation 待生效的节点密钥，随节点配置下发
+type SecretRotation struct {
+	Secret    string    `json:"secret"`
+	ExpiresAt time.Time `json:"expires_at"` // 旧密钥失效时间
+}
+
+// RotateNodeSecret 为节点生成新密钥。重叠期内新旧密钥均可使用，
+// 节点首次使用新密钥或重叠期结束后旧密钥失效。
+// 已吊销的节点直接替换密钥并恢复，需人工将新密钥下发到节点。
+func (s *NodeService) RotateNodeSecret(id uint, overlap time.Duration) (*SecretRotation, error) {
+	if overlap <= 0 {
+		overlap = DefaultSecretRotationOverlap
+	}
+	if overlap > MaxSecretRotationOverlap {
+		overlap = MaxSecretRotationOverlap
+	}
+
+	node, err := s.GetNodeByID(id)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := GenerateNodeSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var updates map[string]interface{}
+	rotation := &SecretRotation{Secret: secret}
+	if node.SecretRevokedAt != nil {
+		updates = map[string]interface{}{
+			"secret":            secret,
+			"next_secret":       "",
+			"secret_rotate_at":  nil,
+			"secret_revoked_at": nil,
+		}
+		rotation.ExpiresAt = now
+	} else {
+		deadline := now.Add(overlap)
+		updates = map[string]interface{}{
+			"next_secret":      secret,
+			"secret_rotate_at": &deadline,
+		}
+		rotation.ExpiresAt = deadline
+	}
+
+	if err := s.db.Model(&models.Node{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+		return nil, err
+	}
+	if err := bumpConfigRevision(s.db, id); err != nil {
+		return nil, err
+	}
+	return rotation, nil
+}
+
+// RevokeNodeCredentials 立即吊销节点凭据，包括轮换中的新密钥
+func (s *NodeService) RevokeNodeCredentials(id uint) error {
+	now := time.Now()
+	result := s.db.Model(&models.Node{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"next_secret":       "",
+		"secret_rotate_at":  nil,
+		"secret_revoked_at": &now,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNodeNotFound
+	}
+	// 唤醒长轮询中的配置请求，使其重新校验凭据
+	return bumpConfigRevision(s.db, id)
+}
+
+// PendingSecretRotation 返回节点尚未生效的密钥轮换
+func PendingSecretRotation(node *models.Node) *SecretRotation {
+	if node == nil || node.NextSecret == "" || node.SecretRotateAt == nil || !time.Now().Before(*node.SecretRotateAt) {
+		return nil
+	}
+	return &SecretRotation{Secret: node.NextSecret, ExpiresAt: *node.SecretRotateAt}
+}
+
+// resolveNodeCredential 依次用当前密钥和轮换中的新密钥校验请求。
+// 重叠期已过或节点已使用新密钥时，将新密钥提升为当前密钥。
+func (s *NodeService) resolveNodeCredential(node *models.Node, match func(secret string) bool) error {
+	if node.SecretRevokedAt != nil {
+		return ErrNodeCredentialsRevoked
+	}
+
+	if node.NextSecret != "" && node.SecretRotateAt != nil && !time.Now().Before(*node.SecretRotateAt) {
+		if err := s.promoteNodeSecret(node); err != nil {
+			return err
+		}
+	}
+
+	if node.Secret != "" && match(node.Secret) {
+		return nil
+	}
+	if node.NextSecret != "" && match(node.NextSecret) {
+		return s.promoteNodeSecret(node)
+	}
+	return ErrInvalidNodeCredential
+}
+
+// promoteNodeSecret 以新密钥替换当前密钥，并发请求只会生效一次
+func (s *NodeService) promoteNodeSecret(node *models.Node) error {
+	next := node.NextSecret
+	result := s.db.Model(&models.Node{}).
+		Where("id = ? AND next_secret = ?", node.ID, next).
+		Updates(map[string]interface{}{
+			"secret":           next,
+			"next_secret":      "",
+			"secret_rotate_at": nil,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	node.Secret = next
+	node.NextSecret = ""
+	node.SecretRotateAt = nil
+	if result.RowsAffected == 0 {
+		return nil
+	}
+	return bumpConfigRevision(s.db, node.ID)
+}
+
+// stripNodeCredentialFields 防止通用更新接口绕过轮换流程修改密钥
+func stripNodeCredentialFields(updates map[string]interface{}) {
+	for _, field := range nodeCredentialFields {
+		delete(updates, field)
+	}
+}
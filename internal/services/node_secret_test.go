@@ -0,0 +1,95 @@
+package services
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"bakaray/internal/models"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotateNodeSecret(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	service := NewNodeService(db, nil)
+
+	t.Run("重叠期内新旧密钥均有效，使用新密钥后旧密钥失效", func(t *testing.T) {
+		node := createTestNode(t, db, "rotate-node")
+		oldSecret := node.Secret
+
+		rotation, err := service.RotateNodeSecret(node.ID, time.Hour)
+		require.NoError(t, err)
+		require.NotEqual(t, oldSecret, rotation.Secret)
+
+		current, err := service.GetNodeByID(node.ID)
+		require.NoError(t, err)
+		require.NotNil(t, PendingSecretRotation(current))
+		require.Equal(t, int64(1), current.ConfigRevision)
+
+		_, err = service.AuthenticateNodeSecret(node.ID, oldSecret)
+		require.NoError(t, err)
+
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		signature := SignNodeRequest(rotation.Secret, "POST", "/api/node/heartbeat", "", ts, "rotate-1", nil)
+		authed, err := service.AuthenticateNodeSignature(node.ID, "POST", "/api/node/heartbeat", "", ts, "rotate-1", signature, nil)
+		require.NoError(t, err)
+		require.Equal(t, rotation.Secret, authed.Secret)
+
+		_, err = service.AuthenticateNodeSecret(node.ID, oldSecret)
+		require.ErrorIs(t, err, ErrInvalidNodeCredential)
+
+		current, err = service.GetNodeByID(node.ID)
+		require.NoError(t, err)
+		require.Equal(t, rotation.Secret, current.Secret)
+		require.Nil(t, PendingSecretRotation(current))
+	})
+
+	t.Run("重叠期结束后自动切换到新密钥", func(t *testing.T) {
+		node := createTestNode(t, db, "expire-node")
+		rotation, err := service.RotateNodeSecret(node.ID, time.Hour)
+		require.NoError(t, err)
+		require.NoError(t, db.Model(&models.Node{}).Where("id = ?", node.ID).Update("secret_rotate_at", time.Now().Add(-time.Second)).Error)
+
+		_, err = service.AuthenticateNodeSecret(node.ID, node.Secret)
+		require.ErrorIs(t, err, ErrInvalidNodeCredential)
+		_, err = service.AuthenticateNodeSecret(node.ID, rotation.Secret)
+		require.NoError(t, err)
+	})
+
+	t.Run("吊销后拒绝所有密钥，重新轮换后恢复", func(t *testing.T) {
+		node := createTestNode(t, db, "revoke-node")
+		rotation, err := service.RotateNodeSecret(node.ID, time.Hour)
+		require.NoError(t, err)
+		require.NoError(t, service.RevokeNodeCredentials(node.ID))
+
+		_, err = service.AuthenticateNodeSecret(node.ID, node.Secret)
+		require.ErrorIs(t, err, ErrNodeCredentialsRevoked)
+		_, err = service.AuthenticateNodeSecret(node.ID, rotation.Secret)
+		require.ErrorIs(t, err, ErrNodeCredentialsRevoked)
+
+		reissued, err := service.RotateNodeSecret(node.ID, time.Hour)
+		require.NoError(t, err)
+		_, err = service.AuthenticateNodeSecret(node.ID, reissued.Secret)
+		require.NoError(t, err)
+
+		current, err := service.GetNodeByID(node.ID)
+		require.NoError(t, err)
+		require.Nil(t, current.SecretRevokedAt)
+		require.Nil(t, PendingSecretRotation(current))
+
+		require.ErrorIs(t, service.RevokeNodeCredentials(99999), ErrNodeNotFound)
+	})
+
+	t.Run("通用更新接口不能修改密钥", func(t *testing.T) {
+		node := createTestNode(t, db, "update-secret-node")
+		require.NoError(t, service.UpdateNode(node.ID, map[string]interface{}{"secret": "hijacked", "region": "JP"}))
+
+		current, err := service.GetNodeByID(node.ID)
+		require.NoError(t, err)
+		require.Equal(t, node.Secret, current.Secret)
+		require.Equal(t, "JP", current.Region)
+	})
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"bakaray/internal/logger"
+	"bakaray/internal/models"
+
+	"gorm.io/gorm"
+)
+
+const (
+	NodeStatusOnline  = "online"
+	NodeStatusOffline = "offline"
+
+	NodeStatusReasonHeartbeat = "heartbeat"
+	NodeStatusReasonTimeout   = "timeout"
+
+	// NodeOfflineFactor 超过 N 个上报周期未收到心跳即判定节点离线
+	NodeOfflineFactor = 3
+	// NodeStatusSweepInterval 离线巡检执行周期
+	NodeStatusSweepInterval = 10 * time.Second
+	// NodeStatusEventRetention 上下线记录保留时长
+	NodeStatusEventRetention = 30 * 24 * time.Hour
+)
+
+// NodeOfflineThreshold 根据上报周期（秒）计算离线判定阈值
+func NodeOfflineThreshold(reportInterval int) time.Duration {
+	if reportInterval <= 0 {
+		reportInterval = 10
+	}
+	return time.Duration(reportInterval*NodeOfflineFactor) * time.Second
+}
+
+// MarkStaleNodesOffline 将 last_seen 早于 cutoff 的在线节点标记为离线，返回被标记的节点 ID
+func (s *NodeService) MarkStaleNodesOffline(cutoff time.Time) ([]uint, error) {
+	var candidates []models.Node
+	if err := s.db.Select("id", "last_seen").
+		Where("status = ? AND (last_seen IS NULL OR last_seen < ?)", NodeStatusOnline, cutoff).
+		Find(&candidates).Error; err != nil {
+		return nil, err
+	}
+
+	marked := make([]uint, 0, len(candidates))
+	for _, candidate := range candidates {
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			// 条件更新：若节点在巡检期间恢复心跳则跳过
+			result := tx.Model(&models.Node{}).
+				Where("id = ? AND status = ? AND (last_seen IS NULL OR last_seen < ?)", candidate.ID, NodeStatusOnline, cutoff).
+				Update("status", NodeStatusOffline)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return nil
+			}
+			if err := tx.Create(&models.NodeStatusEvent{
+				NodeID:     candidate.ID,
+				FromStatus: NodeStatusOnline,
+				ToStatus:   NodeStatusOffline,
+				Reason:     NodeStatusReasonTimeout,
+			}).Error; err != nil {
+				return err
+			}
+			marked = append(marked, candidate.ID)
+			return nil
+		})
+		if err != nil {
+			return marked, err
+		}
+	}
+	return marked, nil
+}
+
+// ListNodeStatusEvents 获取节点最近的上下线记录
+func (s *NodeService) ListNodeStatusEvents(nodeID uint, limit int) ([]models.NodeStatusEvent, error) {
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	var events []models.NodeStatusEvent
+	if err := s.db.Where("node_id = ?", nodeID).
+		Order("created_at DESC, id DESC").
+		Limit(limit).
+		Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// CountNodeStatusEvents 统计节点在 since 之后的状态切换次数，用于判断节点是否抖动
+func (s *NodeService) CountNodeStatusEvents(nodeID uint, since time.Time) (int64, error) {
+	var total int64
+	err := s.db.Model(&models.NodeStatusEvent{}).
+		Where("node_id = ? AND created_at >= ?", nodeID, since).
+		Count(&total).Error
+	return total, err
+}
+
+// PruneNodeStatusEvents 删除 before 之前的上下线记录
+func (s *NodeService) PruneNodeStatusEvents(before time.Time) (int64, error) {
+	result := s.db.Where("created_at < ?", before).Delete(&models.NodeStatusEvent{})
+	return result.RowsAffected, result.Error
+}
+
+// NodeStatusSweeper 节点离线巡检任务
+type NodeStatusSweeper struct {
+	nodeService       *NodeService
+	siteConfigService *SiteConfigService
+}
+
+// NewNodeStatusSweeper 创建节点离线巡检任务
+func NewNodeStatusSweeper(nodeService *NodeService, siteConfigService *SiteConfigService) *NodeStatusSweeper {
+	return &NodeStatusSweeper{
+		nodeService:       nodeService,
+		siteConfigService: siteConfigService,
+	}
+}
+
+// Run 执行一次巡检
+func (w *NodeStatusSweeper) Run(_ context.Context) error {
+	reportInterval := 0
+	if w.siteConfigService != nil {
+		site, err := w.siteConfigService.GetOrCreate()
+		if err != nil {
+			return err
+		}
+		reportInterval = site.NodeReportInterval
+	}
+
+	now := time.Now()
+	marked, err := w.nodeService.MarkStaleNodesOffline(now.Add(-NodeOfflineThreshold(reportInterval)))
+	if len(marked) > 0 {
+		logger.Info("NodeStatusSweeper: nodes marked offline", "node_ids", marked)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.nodeService.PruneNodeStatusEvents(now.Add(-NodeStatusEventRetention)); err != nil {
+		return err
+	}
+	return nil
+}
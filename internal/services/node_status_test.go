@@ -0,0 +1,108 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"bakaray/internal/logger"
+	"bakaray/internal/models"
+
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	_ = logger.Init("error")
+}
+
+func TestUpdateNodeStatusRecordsTransitions(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	service := NewNodeService(db, nil)
+	node := createTestNodeFull(t, db, "TransitionNode", "transition.test.com", 8080, "offline")
+
+	require.NoError(t, service.UpdateNodeStatus(node.ID, NodeStatusOnline))
+	require.NoError(t, service.UpdateNodeStatus(node.ID, NodeStatusOnline))
+
+	events, err := service.ListNodeStatusEvents(node.ID, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, NodeStatusOffline, events[0].FromStatus)
+	require.Equal(t, NodeStatusOnline, events[0].ToStatus)
+	require.Equal(t, NodeStatusReasonHeartbeat, events[0].Reason)
+}
+
+func TestMarkStaleNodesOffline(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	service := NewNodeService(db, nil)
+	now := time.Now()
+
+	stale := createTestNodeFull(t, db, "StaleNode", "stale.test.com", 8080, "online")
+	fresh := createTestNodeFull(t, db, "FreshNode", "fresh.test.com", 8080, "online")
+	neverSeen := createTestNodeFull(t, db, "NeverSeenNode", "never.test.com", 8080, "online")
+	offline := createTestNodeFull(t, db, "OfflineNode", "offline.test.com", 8080, "offline")
+
+	staleSeen := now.Add(-5 * time.Minute)
+	freshSeen := now.Add(-5 * time.Second)
+	require.NoError(t, db.Model(&models.Node{}).Where("id = ?", stale.ID).Update("last_seen", &staleSeen).Error)
+	require.NoError(t, db.Model(&models.Node{}).Where("id = ?", fresh.ID).Update("last_seen", &freshSeen).Error)
+	require.NoError(t, db.Model(&models.Node{}).Where("id = ?", offline.ID).Update("last_seen", &staleSeen).Error)
+
+	marked, err := service.MarkStaleNodesOffline(now.Add(-NodeOfflineThreshold(10)))
+	require.NoError(t, err)
+	require.ElementsMatch(t, []uint{stale.ID, neverSeen.ID}, marked)
+
+	got, err := service.GetNodeByID(stale.ID)
+	require.NoError(t, err)
+	require.Equal(t, NodeStatusOffline, got.Status)
+
+	got, err = service.GetNodeByID(fresh.ID)
+	require.NoError(t, err)
+	require.Equal(t, NodeStatusOnline, got.Status)
+
+	events, err := service.ListNodeStatusEvents(stale.ID, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, NodeStatusReasonTimeout, events[0].Reason)
+
+	t.Run("重复巡检不会重复记录", func(t *testing.T) {
+		marked, err := service.MarkStaleNodesOffline(now.Add(-NodeOfflineThreshold(10)))
+		require.NoError(t, err)
+		require.Empty(t, marked)
+
+		count, err := service.CountNodeStatusEvents(stale.ID, now.Add(-time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, int64(1), count)
+	})
+}
+
+func TestNodeStatusSweeperRun(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+	require.NoError(t, db.AutoMigrate(&models.SiteConfig{}))
+	require.NoError(t, db.Create(&models.SiteConfig{SiteName: "test", NodeReportInterval: 5}).Error)
+
+	nodeService := NewNodeService(db, nil)
+	node := createTestNodeFull(t, db, "SweepNode", "sweep.test.com", 8080, "online")
+	lastSeen := time.Now().Add(-20 * time.Second)
+	require.NoError(t, db.Model(&models.Node{}).Where("id = ?", node.ID).Update("last_seen", &lastSeen).Error)
+
+	old := models.NodeStatusEvent{NodeID: node.ID, FromStatus: "offline", ToStatus: "online", Reason: NodeStatusReasonHeartbeat}
+	require.NoError(t, db.Create(&old).Error)
+	require.NoError(t, db.Model(&old).Update("created_at", time.Now().Add(-NodeStatusEventRetention-time.Hour)).Error)
+
+	sweeper := NewNodeStatusSweeper(nodeService, NewSiteConfigService(db))
+	require.NoError(t, sweeper.Run(context.Background()))
+
+	got, err := nodeService.GetNodeByID(node.ID)
+	require.NoError(t, err)
+	require.Equal(t, NodeStatusOffline, got.Status)
+
+	events, err := nodeService.ListNodeStatusEvents(node.ID, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, NodeStatusOffline, events[0].ToStatus)
+}
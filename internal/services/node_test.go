@@ -79,37 +79,6 @@ func TestCreateNode(t *testing.T) {
 	})
 }
 
-func TestRegisterNode(t *testing.T) {
-	db := setupTestDB(t)
-	defer cleanupTestDB(db)
-
-	service := NewNodeService(db, nil)
-
-	t.Run("首次注册创建节点", func(t *testing.T) {
-		node, err := service.RegisterNode("auto-node", "10.0.0.1", 8081, "secret123")
-
-		require.NoError(t, err)
-		require.NotNil(t, node)
-		require.Equal(t, "auto-node", node.Name)
-		require.Equal(t, "10.0.0.1", node.Host)
-		require.Equal(t, 8081, node.Port)
-		require.Equal(t, "secret123", node.Secret)
-		require.Equal(t, models.StringSlice(SupportedNodeProtocols()), node.Protocols)
-	})
-
-	t.Run("重复注册复用原节点ID", func(t *testing.T) {
-		first, err := service.RegisterNode("repeat-node", "10.0.0.2", 8081, "secret123")
-		require.NoError(t, err)
-
-		second, err := service.RegisterNode("repeat-node", "10.0.0.3", 8082, "secret123")
-		require.NoError(t, err)
-		require.Equal(t, first.ID, second.ID)
-		require.Equal(t, "10.0.0.3", second.Host)
-		require.Equal(t, 8082, second.Port)
-		require.Equal(t, models.StringSlice(SupportedNodeProtocols()), second.Protocols)
-	})
-}
-
 // TestGetNodeByID 测试根据ID获取节点
 func TestGetNodeByID(t *testing.T) {
 	db := setupTestDB(t)
@@ -274,7 +243,7 @@ func TestSaveProbeData(t *testing.T) {
 	db := setupTestDB(t)
 	defer cleanupTestDB(db)
 
-	service := NewNodeService(db, redisClient)
+	service := NewNodeService(db, NewRedisStateStore(redisClient))
 	testNode := createTestNodeFull(t, db, "ProbeNode", "probe.test.com", 8080, "online")
 
 	probe := &models.ProbeData{
@@ -315,12 +284,14 @@ func TestSaveProbeData(t *testing.T) {
 		require.Len(t, savedProbe.Network, 1)
 	})
 
-	t.Run("Redis为空时跳过", func(t *testing.T) {
+	t.Run("未配置状态存储时使用进程内存储", func(t *testing.T) {
 		serviceNoRedis := NewNodeService(db, nil)
 		err := serviceNoRedis.SaveProbeData(testNode.ID, probe)
+		require.NoError(t, err)
 
-		// 应该不返回错误，直接跳过
+		savedProbe, err := serviceNoRedis.GetProbeData(testNode.ID)
 		require.NoError(t, err)
+		require.Equal(t, probe.CPU.UsagePercent, savedProbe.CPU.UsagePercent)
 	})
 }
 
@@ -335,7 +306,7 @@ func TestGetProbeData(t *testing.T) {
 	db := setupTestDB(t)
 	defer cleanupTestDB(db)
 
-	service := NewNodeService(db, redisClient)
+	service := NewNodeService(db, NewRedisStateStore(redisClient))
 	testNode := createTestNodeFull(t, db, "GetProbeNode", "getprobe.test.com", 8080, "online")
 
 	t.Run("成功获取探针数据", func(t *testing.T) {
@@ -368,11 +339,11 @@ func TestGetProbeData(t *testing.T) {
 		require.Nil(t, probe)
 	})
 
-	t.Run("Redis为空时返回nil", func(t *testing.T) {
+	t.Run("进程内存储未保存时返回错误", func(t *testing.T) {
 		serviceNoRedis := NewNodeService(db, nil)
 		probe, err := serviceNoRedis.GetProbeData(testNode.ID)
 
-		require.NoError(t, err)
+		require.ErrorIs(t, err, ErrStateNotFound)
 		require.Nil(t, probe)
 	})
 }
@@ -387,7 +358,7 @@ func TestDiagnosticsCache(t *testing.T) {
 	db := setupTestDB(t)
 	defer cleanupTestDB(db)
 
-	service := NewNodeService(db, redisClient)
+	service := NewNodeService(db, NewRedisStateStore(redisClient))
 	testNode := createTestNodeFull(t, db, "DiagnosticNode", "diagnostic.test.com", 8080, "online")
 
 	diagnostics := []models.NodeDiagnostic{
@@ -412,10 +383,10 @@ func TestDiagnosticsCache(t *testing.T) {
 		require.Equal(t, diagnostics[0].Message, savedDiagnostics[0].Message)
 	})
 
-	t.Run("Redis为空时返回nil", func(t *testing.T) {
+	t.Run("进程内存储未保存时返回错误", func(t *testing.T) {
 		serviceNoRedis := NewNodeService(db, nil)
 		savedDiagnostics, err := serviceNoRedis.GetDiagnostics(testNode.ID)
-		require.NoError(t, err)
+		require.ErrorIs(t, err, ErrStateNotFound)
 		require.Nil(t, savedDiagnostics)
 	})
 }
@@ -528,7 +499,7 @@ func TestUpdateNode(t *testing.T) {
 		require.Equal(t, models.StringSlice{"mtls", "grpc"}, updatedNode.Protocols)
 	})
 
-	t.Run("更新节点组ID", func(t *testing.T) {
+	t.Run("更新节点组ID被忽略", func(t *testing.T) {
 		err := service.UpdateNode(testNode.ID, map[string]interface{}{
 			"node_group_id": "5",
 		})
@@ -537,7 +508,7 @@ func TestUpdateNode(t *testing.T) {
 
 		updatedNode, err := service.GetNodeByID(testNode.ID)
 		require.NoError(t, err)
-		require.Equal(t, uint(5), updatedNode.NodeGroupID)
+		require.Zero(t, updatedNode.NodeGroupID, "所属节点组需通过节点组服务修改")
 	})
 
 	t.Run("批量更新节点属性", func(t *testing.T) {
@@ -557,7 +528,7 @@ func TestUpdateNode(t *testing.T) {
 		require.Equal(t, "batch.example.com", updatedNode.Host)
 		require.Equal(t, 2.5, updatedNode.Multiplier)
 		require.Equal(t, "EU", updatedNode.Region)
-		require.Equal(t, uint(3), updatedNode.NodeGroupID)
+		require.Zero(t, updatedNode.NodeGroupID)
 	})
 
 	t.Run("更新不存在的节点", func(t *testing.T) {
@@ -581,7 +552,7 @@ func TestComputeTrafficDeltas(t *testing.T) {
 	db := setupTestDB(t)
 	defer cleanupTestDB(db)
 
-	service := NewNodeService(db, redisClient)
+	service := NewNodeService(db, NewRedisStateStore(redisClient))
 	testNode := createTestNodeFull(t, db, "TrafficNode", "traffic.test.com", 8080, "online")
 
 	t.Run("计算流量增量", func(t *testing.T) {
@@ -606,15 +577,14 @@ func TestComputeTrafficDeltas(t *testing.T) {
 		require.Equal(t, int64(4000), deltas[2].BytesOut)
 	})
 
-	t.Run("Redis为空时返回空map", func(t *testing.T) {
+	t.Run("未配置Redis时仍计算增量", func(t *testing.T) {
 		serviceNoRedis := NewNodeService(db, nil)
 		deltas, err := serviceNoRedis.ComputeTrafficDeltas(testNode.ID, map[string]int64{
 			"rule_1_in": 1000,
 		})
 
 		require.NoError(t, err)
-		require.NotNil(t, deltas)
-		require.Empty(t, deltas)
+		require.Equal(t, int64(1000), deltas[1].BytesIn)
 	})
 
 	t.Run("无效的stats返回空map", func(t *testing.T) {
@@ -9,7 +9,6 @@ import (
 
 	"bakaray/internal/models"
 
-	"github.com/redis/go-redis/v9"
 	"gorm.io/gorm"
 )
 
@@ -19,12 +18,15 @@ var ErrOrderNotFound = errors.New("订单不存在")
 // PaymentService 支付服务
 type PaymentService struct {
 	db    *gorm.DB
-	redis *redis.Client
+	state StateStore
 }
 
-// NewPaymentService 创建支付服务
-func NewPaymentService(db *gorm.DB, redis *redis.Client) *PaymentService {
-	return &PaymentService{db: db, redis: redis}
+// NewPaymentService 创建支付服务，state 为 nil 时使用进程内状态存储
+func NewPaymentService(db *gorm.DB, state StateStore) *PaymentService {
+	if state == nil {
+		state = NewMemoryStateStore()
+	}
+	return &PaymentService{db: db, state: state}
 }
 
 // GetUserByID 获取用户（用于支付服务）
@@ -118,6 +120,7 @@ func (s *PaymentService) CreateAndCompleteOrder(userID, packageID uint, amount i
 
 	// 在事务中完成订单和扣款
 	var order *models.Order
+	var nodeIDs []uint
 	err = s.db.Transaction(func(tx *gorm.DB) error {
 		// 检查用户余额是否足够
 		var user models.User
@@ -146,11 +149,13 @@ func (s *PaymentService) CreateAndCompleteOrder(userID, packageID uint, amount i
 			return err
 		}
 
-		// 增加用户流量
+		// 增加用户流量，并恢复因流量耗尽被禁用的规则
 		if pkg.Traffic > 0 {
-			if err := tx.Model(&models.User{}).Where("id = ?", userID).Update("traffic_balance", gorm.Expr("traffic_balance + ?", pkg.Traffic)).Error; err != nil {
+			ids, err := addTrafficBalance(tx, userID, pkg.Traffic)
+			if err != nil {
 				return err
 			}
+			nodeIDs = ids
 		}
 
 		// 如果套餐指定了用户组，更新用户的用户组
@@ -166,6 +171,9 @@ func (s *PaymentService) CreateAndCompleteOrder(userID, packageID uint, amount i
 	if err != nil {
 		return nil, err
 	}
+	if err := bumpConfigRevision(s.db, nodeIDs...); err != nil {
+		return nil, err
+	}
 	return order, nil
 }
 
@@ -201,7 +209,8 @@ func (s *PaymentService) UpdateOrderStatus(tradeNo string, status string) error
 // CompleteOrder 完成订单（支付成功）
 func (s *PaymentService) CompleteOrder(tradeNo string, userID uint, traffic int64) error {
 	_ = traffic
-	return s.db.Transaction(func(tx *gorm.DB) error {
+	var nodeIDs []uint
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
 		var order models.Order
 		if err := tx.Where("trade_no = ?", tradeNo).First(&order).Error; err != nil {
 			return err
@@ -226,11 +235,13 @@ func (s *PaymentService) CompleteOrder(tradeNo string, userID uint, traffic int6
 		if err := tx.Model(&models.Order{}).Where("trade_no = ?", tradeNo).Update("status", "success").Error; err != nil {
 			return err
 		}
-		// 更新用户流量
+		// 更新用户流量，并恢复因流量耗尽被禁用的规则
 		if pkg.Traffic > 0 {
-			if err := tx.Model(&models.User{}).Where("id = ?", userID).Update("traffic_balance", gorm.Expr("traffic_balance + ?", pkg.Traffic)).Error; err != nil {
+			ids, err := addTrafficBalance(tx, userID, pkg.Traffic)
+			if err != nil {
 				return err
 			}
+			nodeIDs = ids
 		}
 		if pkg.UserGroupID > 0 {
 			if err := tx.Model(&models.User{}).Where("id = ?", userID).Update("user_group_id", pkg.UserGroupID).Error; err != nil {
@@ -238,24 +249,22 @@ func (s *PaymentService) CompleteOrder(tradeNo string, userID uint, traffic int6
 			}
 		}
 		return nil
-	})
+	}); err != nil {
+		return err
+	}
+	return bumpConfigRevision(s.db, nodeIDs...)
 }
 
 // CompleteOrderWithLock 幂等性完成订单（带分布式锁）
 func (s *PaymentService) CompleteOrderWithLock(tradeNo string, userID uint, traffic int64) error {
 	_ = traffic
-	// 如果没有 Redis，使用普通方法
-	if s.redis == nil {
-		return s.CompleteOrder(tradeNo, userID, traffic)
-	}
-
 	ctx := context.Background()
 	lockKey := "order:lock:" + tradeNo
 
-	// 获取分布式锁
-	lockAcquired, err := s.redis.SetNX(ctx, lockKey, "1", 10*time.Second).Result()
+	// 获取锁（Redis 或数据库状态存储时跨实例生效）
+	lockAcquired, err := s.state.SetNX(ctx, lockKey, []byte("1"), 10*time.Second)
 	if err != nil {
-		// 如果 Redis 错误，回退到普通方法
+		// 状态存储错误时回退到普通方法
 		return s.CompleteOrder(tradeNo, userID, traffic)
 	}
 
@@ -263,7 +272,7 @@ func (s *PaymentService) CompleteOrderWithLock(tradeNo string, userID uint, traf
 		// 锁已被持有，返回成功（幂等性）
 		return nil
 	}
-	defer s.redis.Del(ctx, lockKey)
+	defer s.state.Delete(ctx, lockKey)
 
 	// 检查订单是否已完成（幂等性检查）
 	var order models.Order
@@ -276,7 +285,8 @@ func (s *PaymentService) CompleteOrderWithLock(tradeNo string, userID uint, traf
 	}
 
 	// 在事务中完成订单
-	return s.db.Transaction(func(tx *gorm.DB) error {
+	var nodeIDs []uint
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
 		if order.PackageID == 0 {
 			if err := tx.Model(&models.Order{}).Where("trade_no = ?", tradeNo).Update("status", "success").Error; err != nil {
 				return err
@@ -296,11 +306,13 @@ func (s *PaymentService) CompleteOrderWithLock(tradeNo string, userID uint, traf
 		if err := tx.Model(&models.Order{}).Where("trade_no = ?", tradeNo).Update("status", "success").Error; err != nil {
 			return err
 		}
-		// 更新用户流量
+		// 更新用户流量，并恢复因流量耗尽被禁用的规则
 		if pkg.Traffic > 0 {
-			if err := tx.Model(&models.User{}).Where("id = ?", userID).Update("traffic_balance", gorm.Expr("traffic_balance + ?", pkg.Traffic)).Error; err != nil {
+			ids, err := addTrafficBalance(tx, userID, pkg.Traffic)
+			if err != nil {
 				return err
 			}
+			nodeIDs = ids
 		}
 		// 如果套餐指定了用户组，更新用户的用户组
 		if pkg.UserGroupID > 0 {
@@ -309,7 +321,19 @@ func (s *PaymentService) CompleteOrderWithLock(tradeNo string, userID uint, traf
 			}
 		}
 		return nil
-	})
+	}); err != nil {
+		return err
+	}
+	return bumpConfigRevision(s.db, nodeIDs...)
+}
+
+// addTrafficBalance 增加用户流量余额，并重新启用因余额耗尽被禁用的规则，返回需要刷新配置的节点
+func addTrafficBalance(tx *gorm.DB, userID uint, traffic int64) ([]uint, error) {
+	if err := tx.Model(&models.User{}).Where("id = ?", userID).Update("traffic_balance", gorm.Expr("traffic_balance + ?", traffic)).Error; err != nil {
+		return nil, err
+	}
+	nodeIDs, _, err := applyTrafficBalance(tx, userID)
+	return nodeIDs, err
 }
 
 // ListOrders 获取订单列表
@@ -0,0 +1,413 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"bakaray/internal/logger"
+	"bakaray/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// ProbeResolutionRaw 原始采样
+	ProbeResolutionRaw = 0
+	// ProbeResolutionMinute 1 分钟聚合
+	ProbeResolutionMinute = 60
+	// ProbeResolutionHour 1 小时聚合
+	ProbeResolutionHour = 3600
+
+	// ProbeRollupInterval 探针历史聚合与清理周期
+	ProbeRollupInterval = time.Minute
+	// ProbeHistoryMaxPoints 单次查询返回的最大点数
+	ProbeHistoryMaxPoints = 2000
+
+	probeRollupBatchSize = 500
+)
+
+var (
+	ErrInvalidProbeRange    = errors.New("无效的时间范围")
+	ErrProbeHistoryTooLarge = errors.New("查询点数过多，请增大 step 或缩小时间范围")
+)
+
+// probeRollupSources 聚合粒度及其数据来源粒度，按从细到粗的顺序执行
+var probeRollupSources = []struct{ Source, Target int }{
+	{ProbeResolutionRaw, ProbeResolutionMinute},
+	{ProbeResolutionMinute, ProbeResolutionHour},
+}
+
+// ProbeRetention 各粒度探针历史的保留时长
+type ProbeRetention struct {
+	Raw    time.Duration
+	Minute time.Duration
+	Hour   time.Duration
+}
+
+// DefaultProbeRetention 默认保留策略：原始 24 小时，1 分钟 7 天，1 小时 90 天
+var DefaultProbeRetention = ProbeRetention{
+	Raw:    24 * time.Hour,
+	Minute: 7 * 24 * time.Hour,
+	Hour:   90 * 24 * time.Hour,
+}
+
+func (r ProbeRetention) forResolution(resolution int) time.Duration {
+	switch resolution {
+	case ProbeResolutionRaw:
+		return r.Raw
+	case ProbeResolutionMinute:
+		return r.Minute
+	default:
+		return r.Hour
+	}
+}
+
+// ProbeHistoryService 探针历史服务，负责聚合（原始 → 1m → 1h）、清理与查询
+type ProbeHistoryService struct {
+	db        *gorm.DB
+	retention ProbeRetention
+}
+
+// NewProbeHistoryService 创建探针历史服务，保留时长未设置的粒度使用默认值
+func NewProbeHistoryService(db *gorm.DB, retention ProbeRetention) *ProbeHistoryService {
+	if retention.Raw <= 0 {
+		retention.Raw = DefaultProbeRetention.Raw
+	}
+	if retention.Minute <= 0 {
+		retention.Minute = DefaultProbeRetention.Minute
+	}
+	if retention.Hour <= 0 {
+		retention.Hour = DefaultProbeRetention.Hour
+	}
+	return &ProbeHistoryService{db: db, retention: retention}
+}
+
+// ProbeHistoryPoint 探针历史数据点
+type ProbeHistoryPoint struct {
+	Timestamp  int64   `json:"timestamp"`
+	Samples    int     `json:"samples"`
+	CPUPercent float64 `json:"cpu_percent"`
+	CPUMax     float64 `json:"cpu_max"`
+	MemPercent float64 `json:"mem_percent"`
+	MemUsed    uint64  `json:"mem_used"`
+	MemTotal   uint64  `json:"mem_total"`
+	RxSpeed    uint64  `json:"rx_speed"`
+	TxSpeed    uint64  `json:"tx_speed"`
+	RxSpeedMax uint64  `json:"rx_speed_max"`
+	TxSpeedMax uint64  `json:"tx_speed_max"`
+}
+
+// ProbeHistory 探针历史查询结果
+type ProbeHistory struct {
+	NodeID     uint                `json:"node_id"`
+	From       int64               `json:"from"`
+	To         int64               `json:"to"`
+	Step       int64               `json:"step"`       // 数据点间隔（秒）
+	Resolution int                 `json:"resolution"` // 数据来源粒度（秒），0 为原始采样
+	Points     []ProbeHistoryPoint `json:"points"`
+}
+
+// recordProbeSample 将探针上报保存为原始采样
+func recordProbeSample(db *gorm.DB, nodeID uint, probe *models.ProbeData, at time.Time) error {
+	if probe == nil {
+		return nil
+	}
+	var rx, tx uint64
+	for _, nic := range probe.Network {
+		if nic.Name == "lo" {
+			continue
+		}
+		rx += nic.RxSpeed
+		tx += nic.TxSpeed
+	}
+	sample := &models.NodeProbeSample{
+		NodeID:     nodeID,
+		Resolution: ProbeResolutionRaw,
+		SampledAt:  at.UTC(),
+		Samples:    1,
+		CPUPercent: probe.CPU.UsagePercent,
+		CPUMax:     probe.CPU.UsagePercent,
+		MemPercent: probe.Memory.UsagePercent,
+		MemUsed:    probe.Memory.Used,
+		MemTotal:   probe.Memory.Total,
+		RxSpeed:    rx,
+		TxSpeed:    tx,
+		RxSpeedMax: rx,
+		TxSpeedMax: tx,
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(sample).Error
+}
+
+// Rollup 将已结束时间桶的采样聚合到更粗的粒度。以目标粒度最新的桶为起点重算，
+// 可重复执行；调度中断超过源粒度保留期的部分无法补齐。
+func (s *ProbeHistoryService) Rollup(now time.Time) (int, error) {
+	now = now.UTC()
+	total := 0
+	for _, rollup := range probeRollupSources {
+		n, err := s.rollupResolution(rollup.Source, rollup.Target, now)
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func (s *ProbeHistoryService) rollupResolution(source, target int, now time.Time) (int, error) {
+	step := time.Duration(target) * time.Second
+	end := now.Truncate(step)
+	start := now.Add(-s.retention.forResolution(source)).Truncate(step)
+
+	var latest []models.NodeProbeSample
+	if err := s.db.Select("sampled_at").
+		Where("resolution = ?", target).
+		Order("sampled_at desc").
+		Limit(1).
+		Find(&latest).Error; err != nil {
+		return 0, err
+	}
+	if len(latest) > 0 {
+		if last := latest[0].SampledAt.UTC(); last.After(start) {
+			start = last
+		}
+	}
+	if !start.Before(end) {
+		return 0, nil
+	}
+
+	var samples []models.NodeProbeSample
+	if err := s.db.Where("resolution = ? AND sampled_at >= ? AND sampled_at < ?", source, start, end).
+		Order("node_id asc, sampled_at asc").
+		Find(&samples).Error; err != nil {
+		return 0, err
+	}
+	if len(samples) == 0 {
+		return 0, nil
+	}
+
+	buckets := aggregateProbeSamples(samples, step)
+	rows := make([]models.NodeProbeSample, 0, len(buckets))
+	for _, bucket := range buckets {
+		row := bucket.sample()
+		row.Resolution = target
+		rows = append(rows, row)
+	}
+
+	err := s.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "node_id"}, {Name: "resolution"}, {Name: "sampled_at"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"samples", "cpu_percent", "cpu_max", "mem_percent", "mem_used", "mem_total",
+			"rx_speed", "tx_speed", "rx_speed_max", "tx_speed_max",
+		}),
+	}).CreateInBatches(rows, probeRollupBatchSize).Error
+	if err != nil {
+		return 0, err
+	}
+	return len(rows), nil
+}
+
+// Prune 按保留策略删除过期采样
+func (s *ProbeHistoryService) Prune(now time.Time) (int64, error) {
+	now = now.UTC()
+	var deleted int64
+	for _, resolution := range []int{ProbeResolutionRaw, ProbeResolutionMinute, ProbeResolutionHour} {
+		cutoff := now.Add(-s.retention.forResolution(resolution))
+		result := s.db.Where("resolution = ? AND sampled_at < ?", resolution, cutoff).Delete(&models.NodeProbeSample{})
+		if result.Error != nil {
+			return deleted, result.Error
+		}
+		deleted += result.RowsAffected
+	}
+	return deleted, nil
+}
+
+// RunRollup 供调度器调用的聚合与清理任务
+func (s *ProbeHistoryService) RunRollup(ctx context.Context) error {
+	now := time.Now()
+	rolled, err := s.Rollup(now)
+	if err != nil {
+		return err
+	}
+	pruned, err := s.Prune(now)
+	if err != nil {
+		return err
+	}
+	if pruned > 0 {
+		logger.Info("Probe history rollup finished", "buckets", rolled, "pruned", pruned)
+	}
+	return nil
+}
+
+// History 查询节点探针历史。step 为 0 时按时间范围自动选择；
+// 数据来源取不大于 step 且保留期覆盖 from 的粒度，再按 step 重新分桶。
+func (s *ProbeHistoryService) History(nodeID uint, from, to time.Time, step time.Duration) (*ProbeHistory, error) {
+	from, to = from.UTC(), to.UTC()
+	if !from.Before(to) {
+		return nil, ErrInvalidProbeRange
+	}
+	span := to.Sub(from)
+	if step <= 0 {
+		step = (span + ProbeHistoryMaxPoints - 1) / ProbeHistoryMaxPoints
+		step = (step + time.Second - 1).Truncate(time.Second)
+		if step < 10*time.Second {
+			step = 10 * time.Second
+		}
+	}
+	step = step.Truncate(time.Second)
+	if step < time.Second {
+		step = time.Second
+	}
+	if int64(span/step) > ProbeHistoryMaxPoints {
+		return nil, ErrProbeHistoryTooLarge
+	}
+
+	resolution := s.sourceResolution(from, step)
+	var samples []models.NodeProbeSample
+	if err := s.db.Where("node_id = ? AND resolution = ? AND sampled_at >= ? AND sampled_at < ?", nodeID, resolution, from, to).
+		Order("sampled_at asc").
+		Find(&samples).Error; err != nil {
+		return nil, err
+	}
+
+	buckets := aggregateProbeSamples(samples, step)
+	points := make([]ProbeHistoryPoint, 0, len(buckets))
+	for _, bucket := range buckets {
+		points = append(points, bucket.point())
+	}
+
+	return &ProbeHistory{
+		NodeID:     nodeID,
+		From:       from.Unix(),
+		To:         to.Unix(),
+		Step:       int64(step / time.Second),
+		Resolution: resolution,
+		Points:     points,
+	}, nil
+}
+
+func (s *ProbeHistoryService) sourceResolution(from time.Time, step time.Duration) int {
+	age := time.Since(from)
+	resolution := ProbeResolutionRaw
+	for _, candidate := range []int{ProbeResolutionRaw, ProbeResolutionMinute, ProbeResolutionHour} {
+		if time.Duration(candidate)*time.Second <= step {
+			resolution = candidate
+		}
+	}
+	// 所选粒度已清理了 from 之前的数据时改用更粗的粒度
+	for resolution != ProbeResolutionHour && age > s.retention.forResolution(resolution) {
+		if resolution == ProbeResolutionRaw {
+			resolution = ProbeResolutionMinute
+		} else {
+			resolution = ProbeResolutionHour
+		}
+	}
+	return resolution
+}
+
+// probeBucket 聚合中的时间桶，均值按原始采样数加权
+type probeBucket struct {
+	nodeID  uint
+	start   time.Time
+	samples int
+	cpuSum  float64
+	cpuMax  float64
+	memSum  float64
+	memUsed float64
+	memTot  uint64
+	rxSum   float64
+	txSum   float64
+	rxMax   uint64
+	txMax   uint64
+}
+
+func (b *probeBucket) add(sample *models.NodeProbeSample) {
+	weight := sample.Samples
+	if weight <= 0 {
+		weight = 1
+	}
+	w := float64(weight)
+	b.samples += weight
+	b.cpuSum += sample.CPUPercent * w
+	b.memSum += sample.MemPercent * w
+	b.memUsed += float64(sample.MemUsed) * w
+	b.rxSum += float64(sample.RxSpeed) * w
+	b.txSum += float64(sample.TxSpeed) * w
+	if sample.CPUMax > b.cpuMax {
+		b.cpuMax = sample.CPUMax
+	}
+	if sample.RxSpeedMax > b.rxMax {
+		b.rxMax = sample.RxSpeedMax
+	}
+	if sample.TxSpeedMax > b.txMax {
+		b.txMax = sample.TxSpeedMax
+	}
+	if sample.MemTotal > 0 {
+		b.memTot = sample.MemTotal
+	}
+}
+
+func (b *probeBucket) sample() models.NodeProbeSample {
+	n := float64(b.samples)
+	return models.NodeProbeSample{
+		NodeID:     b.nodeID,
+		SampledAt:  b.start,
+		Samples:    b.samples,
+		CPUPercent: b.cpuSum / n,
+		CPUMax:     b.cpuMax,
+		MemPercent: b.memSum / n,
+		MemUsed:    uint64(b.memUsed / n),
+		MemTotal:   b.memTot,
+		RxSpeed:    uint64(b.rxSum / n),
+		TxSpeed:    uint64(b.txSum / n),
+		RxSpeedMax: b.rxMax,
+		TxSpeedMax: b.txMax,
+	}
+}
+
+func (b *probeBucket) point() ProbeHistoryPoint {
+	sample := b.sample()
+	return ProbeHistoryPoint{
+		Timestamp:  sample.SampledAt.Unix(),
+		Samples:    sample.Samples,
+		CPUPercent: sample.CPUPercent,
+		CPUMax:     sample.CPUMax,
+		MemPercent: sample.MemPercent,
+		MemUsed:    sample.MemUsed,
+		MemTotal:   sample.MemTotal,
+		RxSpeed:    sample.RxSpeed,
+		TxSpeed:    sample.TxSpeed,
+		RxSpeedMax: sample.RxSpeedMax,
+		TxSpeedMax: sample.TxSpeedMax,
+	}
+}
+
+// aggregateProbeSamples 按节点和 step 对齐的时间桶聚合采样，结果按节点、时间排序
+func aggregateProbeSamples(samples []models.NodeProbeSample, step time.Duration) []*probeBucket {
+	type bucketKey struct {
+		nodeID uint
+		start  int64
+	}
+	index := make(map[bucketKey]*probeBucket)
+	buckets := make([]*probeBucket, 0)
+	for i := range samples {
+		start := samples[i].SampledAt.UTC().Truncate(step)
+		key := bucketKey{nodeID: samples[i].NodeID, start: start.UnixNano()}
+		bucket, ok := index[key]
+		if !ok {
+			bucket = &probeBucket{nodeID: samples[i].NodeID, start: start}
+			index[key] = bucket
+			buckets = append(buckets, bucket)
+		}
+		bucket.add(&samples[i])
+	}
+	sort.SliceStable(buckets, func(i, j int) bool {
+		if buckets[i].nodeID != buckets[j].nodeID {
+			return buckets[i].nodeID < buckets[j].nodeID
+		}
+		return buckets[i].start.Before(buckets[j].start)
+	})
+	return buckets
+}
@@ -0,0 +1,131 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"bakaray/internal/models"
+
+	"github.com/stretchr/testify/require"
+)
+
+func probeSample(cpu float64, rx uint64) *models.ProbeData {
+	return &models.ProbeData{
+		CPU:    models.CPUInfo{UsagePercent: cpu, Cores: 2},
+		Memory: models.MemoryInfo{Total: 1000, Used: uint64(cpu * 10), UsagePercent: cpu},
+		Network: []models.NetworkInfo{
+			{Name: "eth0", RxSpeed: rx, TxSpeed: rx / 2},
+			{Name: "lo", RxSpeed: 999, TxSpeed: 999},
+		},
+	}
+}
+
+func TestProbeHistoryRollup(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	service := NewProbeHistoryService(db, DefaultProbeRetention)
+	node := createTestNode(t, db, "ProbeNode")
+
+	now := time.Now().UTC().Truncate(time.Hour).Add(-time.Minute)
+	hourStart := now.Add(-58 * time.Minute).Truncate(time.Hour)
+	minute := hourStart.Add(2 * time.Minute)
+	require.NoError(t, recordProbeSample(db, node.ID, probeSample(10, 100), minute.Add(5*time.Second)))
+	require.NoError(t, recordProbeSample(db, node.ID, probeSample(30, 300), minute.Add(35*time.Second)))
+	require.NoError(t, recordProbeSample(db, node.ID, probeSample(50, 500), minute.Add(time.Minute+5*time.Second)))
+
+	t.Run("原始采样聚合为 1 分钟", func(t *testing.T) {
+		_, err := service.Rollup(now)
+		require.NoError(t, err)
+
+		var rows []models.NodeProbeSample
+		require.NoError(t, db.Where("node_id = ? AND resolution = ?", node.ID, ProbeResolutionMinute).Order("sampled_at asc").Find(&rows).Error)
+		require.Len(t, rows, 2)
+		require.Equal(t, 2, rows[0].Samples)
+		require.InDelta(t, 20, rows[0].CPUPercent, 0.001)
+		require.InDelta(t, 30, rows[0].CPUMax, 0.001)
+		require.Equal(t, uint64(200), rows[0].RxSpeed)
+		require.Equal(t, uint64(300), rows[0].RxSpeedMax)
+		require.Equal(t, uint64(1000), rows[0].MemTotal)
+	})
+
+	t.Run("重复执行不产生重复数据", func(t *testing.T) {
+		_, err := service.Rollup(now)
+		require.NoError(t, err)
+
+		var count int64
+		require.NoError(t, db.Model(&models.NodeProbeSample{}).Where("resolution = ?", ProbeResolutionMinute).Count(&count).Error)
+		require.Equal(t, int64(2), count)
+	})
+
+	t.Run("小时结束后聚合为 1 小时并按采样数加权", func(t *testing.T) {
+		_, err := service.Rollup(hourStart.Add(time.Hour + time.Minute))
+		require.NoError(t, err)
+
+		var row models.NodeProbeSample
+		require.NoError(t, db.Where("node_id = ? AND resolution = ?", node.ID, ProbeResolutionHour).First(&row).Error)
+		require.Equal(t, 3, row.Samples)
+		require.InDelta(t, 30, row.CPUPercent, 0.001)
+		require.InDelta(t, 50, row.CPUMax, 0.001)
+		require.True(t, row.SampledAt.Equal(hourStart))
+	})
+
+	t.Run("按保留策略清理", func(t *testing.T) {
+		deleted, err := service.Prune(now.Add(DefaultProbeRetention.Raw + time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, int64(3), deleted)
+
+		var count int64
+		require.NoError(t, db.Model(&models.NodeProbeSample{}).Where("resolution <> ?", ProbeResolutionRaw).Count(&count).Error)
+		require.Equal(t, int64(3), count)
+	})
+}
+
+func TestProbeHistoryQuery(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	service := NewProbeHistoryService(db, DefaultProbeRetention)
+	node := createTestNode(t, db, "HistoryNode")
+
+	start := time.Now().UTC().Add(-30 * time.Minute).Truncate(time.Minute)
+	for i := 0; i < 12; i++ {
+		require.NoError(t, recordProbeSample(db, node.ID, probeSample(float64(i), uint64(i*10)), start.Add(time.Duration(i)*10*time.Second)))
+	}
+
+	t.Run("原始数据按 step 重新分桶", func(t *testing.T) {
+		history, err := service.History(node.ID, start, start.Add(2*time.Minute), 30*time.Second)
+		require.NoError(t, err)
+		require.Equal(t, ProbeResolutionRaw, history.Resolution)
+		require.Equal(t, int64(30), history.Step)
+		require.Len(t, history.Points, 4)
+		require.Equal(t, 3, history.Points[0].Samples)
+		require.InDelta(t, 1, history.Points[0].CPUPercent, 0.001)
+		require.Equal(t, start.Unix(), history.Points[0].Timestamp)
+	})
+
+	t.Run("超过原始数据保留期使用聚合数据", func(t *testing.T) {
+		history, err := service.History(node.ID, time.Now().Add(-48*time.Hour), time.Now(), 0)
+		require.NoError(t, err)
+		require.Equal(t, ProbeResolutionMinute, history.Resolution)
+		require.GreaterOrEqual(t, history.Step, int64(60))
+	})
+
+	t.Run("拒绝无效范围与过多点数", func(t *testing.T) {
+		_, err := service.History(node.ID, start, start, 0)
+		require.ErrorIs(t, err, ErrInvalidProbeRange)
+
+		_, err = service.History(node.ID, start.Add(-24*time.Hour), start, time.Second)
+		require.ErrorIs(t, err, ErrProbeHistoryTooLarge)
+	})
+
+	t.Run("上报探针写入原始采样", func(t *testing.T) {
+		nodeService := NewNodeService(db, nil)
+		require.NoError(t, nodeService.SaveProbeData(node.ID, probeSample(42, 10)))
+
+		var latest models.NodeProbeSample
+		require.NoError(t, db.Where("node_id = ? AND resolution = ?", node.ID, ProbeResolutionRaw).Order("sampled_at desc").First(&latest).Error)
+		require.InDelta(t, 42, latest.CPUPercent, 0.001)
+		require.Equal(t, uint64(10), latest.RxSpeed)
+	})
+}
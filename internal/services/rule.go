@@ -1,7 +1,10 @@
 package services
 
 import (
+	"context"
 	"errors"
+	"net"
+	"net/netip"
 	"time"
 
 	"bakaray/internal/models"
@@ -16,16 +19,80 @@ var ErrRuleNotFound = errors.New("规则不存在")
 type RuleService struct {
 	db    *gorm.DB
 	redis *redis.Client
+
+	// resolveHost 解析目标域名，测试时可替换
+	resolveHost func(ctx context.Context, host string) ([]netip.Addr, error)
 }
 
 // NewRuleService 创建规则服务
 func NewRuleService(db *gorm.DB, redis *redis.Client) *RuleService {
-	return &RuleService{db: db, redis: redis}
+	return &RuleService{
+		db:    db,
+		redis: redis,
+		resolveHost: func(ctx context.Context, host string) ([]netip.Addr, error) {
+			return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		},
+	}
 }
 
 // CreateRule 创建转发规则
 func (s *RuleService) CreateRule(rule *models.ForwardingRule) error {
-	return s.db.Create(rule).Error
+	if err := s.db.Create(rule).Error; err != nil {
+		return err
+	}
+	return bumpConfigRevision(s.db, ruleNodeIDs(s.db, rule)...)
+}
+
+// CreateRuleWithTargets 在同一事务中创建规则及其目标，避免节点拉取到没有目标的中间状态
+func (s *RuleService) CreateRuleWithTargets(rule *models.ForwardingRule, targets []models.Target) error {
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		// enabled 列带默认值，零值 false 不会写入且创建后会被回填为默认值，需要单独更新
+		enabled := rule.Enabled
+		if err := tx.Create(rule).Error; err != nil {
+			return err
+		}
+		if !enabled {
+			if err := tx.Model(rule).Update("enabled", false).Error; err != nil {
+				return err
+			}
+		}
+		return createTargets(tx, rule.ID, targets)
+	}); err != nil {
+		return err
+	}
+	return bumpConfigRevision(s.db, ruleNodeIDs(s.db, rule)...)
+}
+
+// CreateRulesWithTargets 在同一事务中批量创建规则及其目标，任一条失败时全部回滚
+func (s *RuleService) CreateRulesWithTargets(rules []*models.ForwardingRule, targets [][]models.Target) error {
+	if len(rules) != len(targets) {
+		return errors.New("规则与目标数量不一致")
+	}
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		for i, rule := range rules {
+			enabled := rule.Enabled
+			if err := tx.Create(rule).Error; err != nil {
+				return err
+			}
+			if !enabled {
+				if err := tx.Model(rule).Update("enabled", false).Error; err != nil {
+					return err
+				}
+			}
+			if err := createTargets(tx, rule.ID, targets[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	var nodeIDs []uint
+	for _, rule := range rules {
+		nodeIDs = append(nodeIDs, ruleNodeIDs(s.db, rule)...)
+	}
+	return bumpConfigRevision(s.db, nodeIDs...)
 }
 
 // GetRuleByID 根据ID获取规则
@@ -42,12 +109,46 @@ func (s *RuleService) GetRuleByID(id uint) (*models.ForwardingRule, error) {
 
 // UpdateRule 更新规则
 func (s *RuleService) UpdateRule(id uint, updates map[string]interface{}) error {
-	return s.db.Model(&models.ForwardingRule{}).Where("id = ?", id).Updates(updates).Error
+	return s.UpdateRuleWithTargets(id, updates, nil)
+}
+
+// UpdateRuleWithTargets 在同一事务中更新规则并替换目标（targets 为 nil 时保留原目标，
+// 地址与端口不变的目标保留 ID 与健康状态）
+func (s *RuleService) UpdateRuleWithTargets(id uint, updates map[string]interface{}, targets []models.Target) error {
+	before, _ := s.GetRuleByID(id)
+
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		if len(updates) > 0 {
+			if err := tx.Model(&models.ForwardingRule{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		if targets == nil {
+			return nil
+		}
+		// 新目标已通过地址策略校验，旧的违规记录不再适用
+		if err := tx.Where("rule_id = ?", id).Delete(&models.DestinationViolation{}).Error; err != nil {
+			return err
+		}
+		return replaceTargets(tx, id, targets)
+	}); err != nil {
+		return err
+	}
+
+	after, _ := s.GetRuleByID(id)
+	return bumpConfigRevision(s.db, append(ruleNodeIDs(s.db, before), ruleNodeIDs(s.db, after)...)...)
 }
 
 // DeleteRule 删除规则
 func (s *RuleService) DeleteRule(id uint) error {
-	return s.db.Delete(&models.ForwardingRule{}, id).Error
+	before, _ := s.GetRuleByID(id)
+	if err := s.db.Delete(&models.ForwardingRule{}, id).Error; err != nil {
+		return err
+	}
+	if err := s.db.Where("rule_id = ?", id).Delete(&models.DestinationViolation{}).Error; err != nil {
+		return err
+	}
+	return bumpConfigRevision(s.db, ruleNodeIDs(s.db, before)...)
 }
 
 // ListRulesByUser 获取用户的规则列表
@@ -62,10 +163,19 @@ func (s *RuleService) ListRulesByUser(userID uint, page, pageSize int) ([]models
 	return rules, total
 }
 
+// ListAllRulesByUser 获取用户的全部规则
+func (s *RuleService) ListAllRulesByUser(userID uint) ([]models.ForwardingRule, error) {
+	var rules []models.ForwardingRule
+	if err := s.db.Where("user_id = ?", userID).Order("id asc").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
 // ListRulesByNode 获取节点的规则列表
 func (s *RuleService) ListRulesByNode(nodeID uint, enabledOnly bool) ([]models.ForwardingRule, error) {
 	var rules []models.ForwardingRule
-	query := s.db.Where("node_id = ?", nodeID)
+	query := rulesOnNode(s.db, nodeID)
 	if enabledOnly {
 		query = query.Where("enabled = ?", true)
 	}
@@ -102,7 +212,10 @@ func (s *RuleService) ListTargets(ruleID uint, enabledOnly bool) ([]models.Targe
 
 // AddTarget 添加转发目标
 func (s *RuleService) AddTarget(target *models.Target) error {
-	return s.db.Create(target).Error
+	if err := s.db.Create(target).Error; err != nil {
+		return err
+	}
+	return s.bumpRuleNodes(target.RuleID)
 }
 
 // GetTargets 获取规则的目标列表
@@ -112,12 +225,108 @@ func (s *RuleService) GetTargets(ruleID uint) ([]models.Target, error) {
 
 // DeleteTarget 删除转发目标
 func (s *RuleService) DeleteTarget(id uint) error {
-	return s.db.Delete(&models.Target{}, id).Error
+	var target models.Target
+	if err := s.db.First(&target, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	if err := s.db.Delete(&models.Target{}, id).Error; err != nil {
+		return err
+	}
+	if err := s.db.Where("target_id = ?", id).Delete(&models.TargetHealth{}).Error; err != nil {
+		return err
+	}
+	return s.bumpRuleNodes(target.RuleID)
 }
 
 // DeleteTargetsByRuleID 删除规则的所有目标
 func (s *RuleService) DeleteTargetsByRuleID(ruleID uint) error {
-	return s.db.Where("rule_id = ?", ruleID).Delete(&models.Target{}).Error
+	if err := s.db.Where("rule_id = ?", ruleID).Delete(&models.Target{}).Error; err != nil {
+		return err
+	}
+	if err := s.db.Where("rule_id = ?", ruleID).Delete(&models.TargetHealth{}).Error; err != nil {
+		return err
+	}
+	return s.bumpRuleNodes(ruleID)
+}
+
+// bumpRuleNodes 递增规则所在节点的配置版本号，规则不存在时忽略
+func (s *RuleService) bumpRuleNodes(ruleID uint) error {
+	rule, err := s.GetRuleByID(ruleID)
+	if err != nil {
+		if errors.Is(err, ErrRuleNotFound) {
+			return nil
+		}
+		return err
+	}
+	return bumpConfigRevision(s.db, ruleNodeIDs(s.db, rule)...)
+}
+
+func createTargets(tx *gorm.DB, ruleID uint, targets []models.Target) error {
+	for i := range targets {
+		targets[i].ID = 0
+		targets[i].RuleID = ruleID
+		enabled := targets[i].Enabled
+		if err := tx.Create(&targets[i]).Error; err != nil {
+			return err
+		}
+		// enabled 列带默认值，零值 false 不会写入，需要单独更新
+		if !enabled {
+			if err := tx.Model(&targets[i]).Update("enabled", false).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replaceTargets 将规则的目标替换为 targets。地址与端口不变的目标保留原记录及其健康状态，
+// 只更新权重、优先级与启用状态；不再使用的目标连同健康状态一起删除
+func replaceTargets(tx *gorm.DB, ruleID uint, targets []models.Target) error {
+	type targetAddr struct {
+		host string
+		port int
+	}
+	var existing []models.Target
+	if err := tx.Where("rule_id = ?", ruleID).Order("id asc").Find(&existing).Error; err != nil {
+		return err
+	}
+	byAddr := make(map[targetAddr][]uint, len(existing))
+	for _, t := range existing {
+		addr := targetAddr{t.Host, t.Port}
+		byAddr[addr] = append(byAddr[addr], t.ID)
+	}
+
+	var added []models.Target
+	for _, t := range targets {
+		addr := targetAddr{t.Host, t.Port}
+		ids := byAddr[addr]
+		if len(ids) == 0 {
+			added = append(added, t)
+			continue
+		}
+		byAddr[addr] = ids[1:]
+		if err := tx.Model(&models.Target{}).Where("id = ?", ids[0]).
+			Updates(map[string]interface{}{"weight": t.Weight, "priority": t.Priority, "enabled": t.Enabled}).Error; err != nil {
+			return err
+		}
+	}
+
+	var removed []uint
+	for _, ids := range byAddr {
+		removed = append(removed, ids...)
+	}
+	if len(removed) > 0 {
+		if err := tx.Where("id IN ?", removed).Delete(&models.Target{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("target_id IN ?", removed).Delete(&models.TargetHealth{}).Error; err != nil {
+			return err
+		}
+	}
+	return createTargets(tx, ruleID, added)
 }
 
 // MaxTrafficLimit 单次更新流量上限（防止异常大流量），单位：字节
@@ -162,8 +371,9 @@ func (s *RuleService) UpdateTrafficUsedWithDisable(ruleID uint, bytes int64) (di
 		if rule.TrafficLimit > 0 && newUsed >= rule.TrafficLimit {
 			// 禁用规则
 			if err := tx.Model(&rule).Where("id = ?", ruleID).Updates(map[string]interface{}{
-				"traffic_used": rule.TrafficLimit,
-				"enabled":      false,
+				"traffic_used":    rule.TrafficLimit,
+				"enabled":         false,
+				"disabled_reason": RuleDisabledTrafficLimit,
 			}).Error; err != nil {
 				return err
 			}
@@ -175,11 +385,23 @@ func (s *RuleService) UpdateTrafficUsedWithDisable(ruleID uint, bytes int64) (di
 		return tx.Model(&rule).Where("id = ?", ruleID).
 			Update("traffic_used", gorm.Expr("traffic_used + ?", bytes)).Error
 	})
+	if err == nil && disabled {
+		err = s.bumpRuleNodes(ruleID)
+	}
 	return
 }
 
 // CreateTrafficLog records a traffic delta entry.
 func (s *RuleService) CreateTrafficLog(logEntry *models.TrafficLog) error {
+	if logEntry.UserID == 0 {
+		var owners []uint
+		if err := s.db.Model(&models.ForwardingRule{}).Where("id = ?", logEntry.RuleID).Pluck("user_id", &owners).Error; err != nil {
+			return err
+		}
+		if len(owners) > 0 {
+			logEntry.UserID = owners[0]
+		}
+	}
 	return s.db.Create(logEntry).Error
 }
 
@@ -195,23 +417,13 @@ func (s *RuleService) GetUserTrafficUsed(userID uint) (int64, error) {
 	return total, nil
 }
 
-// GetUserTrafficStats sums traffic logs for the user since the given time.
+// GetUserTrafficStats sums traffic for the user since the given time using the hourly/daily rollups.
 func (s *RuleService) GetUserTrafficStats(userID uint, since time.Time) (int64, int64, error) {
-	type agg struct {
-		In  int64 `gorm:"column:bytes_in"`
-		Out int64 `gorm:"column:bytes_out"`
-	}
-	var res agg
-
-	err := s.db.Table("traffic_logs").
-		Select("COALESCE(SUM(traffic_logs.bytes_in),0) AS bytes_in, COALESCE(SUM(traffic_logs.bytes_out),0) AS bytes_out").
-		Joins("JOIN forwarding_rules ON forwarding_rules.id = traffic_logs.rule_id").
-		Where("forwarding_rules.user_id = ? AND traffic_logs.timestamp >= ?", userID, since).
-		Scan(&res).Error
+	totals, err := sumTraffic(s.db, TrafficFilter{UserID: userID}, since, time.Now())
 	if err != nil {
 		return 0, 0, err
 	}
-	return res.In, res.Out, nil
+	return totals.BytesIn, totals.BytesOut, nil
 }
 
 // ListAllRules 获取所有规则（管理员用）
@@ -0,0 +1,100 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"bakaray/internal/models"
+)
+
+// 规则来源地址访问控制模式
+const (
+	RuleACLModeAllow = "allow" // 仅允许列表内的来源地址
+	RuleACLModeDeny  = "deny"  // 拒绝列表内的来源地址
+)
+
+// MaxRuleACLEntries 单条规则最多的访问控制条目数
+const MaxRuleACLEntries = 256
+
+var ErrInvalidRuleACL = errors.New("无效的访问控制配置")
+
+// NormalizeRuleACL 校验并规范化规则访问控制：条目为 IPv4/IPv6 地址或 CIDR，
+// 单个地址转换为 /32 或 /128，网段按掩码对齐并去重。mode 为空时清空条目。
+func NormalizeRuleACL(mode string, entries []string) (string, []string, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case "":
+		return "", nil, nil
+	case RuleACLModeAllow, RuleACLModeDeny:
+	default:
+		return "", nil, fmt.Errorf("%w: 模式仅支持 allow 或 deny", ErrInvalidRuleACL)
+	}
+
+	out := make([]string, 0, len(entries))
+	seen := make(map[string]struct{}, len(entries))
+	for _, raw := range entries {
+		entry := strings.TrimSpace(raw)
+		if entry == "" {
+			continue
+		}
+		prefix, err := parseACLPrefix(entry)
+		if err != nil {
+			return "", nil, fmt.Errorf("%w: %s 不是有效的 IP 地址或 CIDR", ErrInvalidRuleACL, entry)
+		}
+		key := prefix.String()
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		out = append(out, key)
+	}
+
+	if len(out) > MaxRuleACLEntries {
+		return "", nil, fmt.Errorf("%w: 最多 %d 条", ErrInvalidRuleACL, MaxRuleACLEntries)
+	}
+	if len(out) == 0 {
+		if mode == RuleACLModeAllow {
+			return "", nil, fmt.Errorf("%w: allow 模式至少需要一条地址", ErrInvalidRuleACL)
+		}
+		return "", nil, nil
+	}
+	return mode, out, nil
+}
+
+func parseACLPrefix(entry string) (netip.Prefix, error) {
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if prefix.Addr().Is4In6() {
+			return netip.Prefix{}, errors.New("ipv4-mapped address")
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if addr.Zone() != "" || addr.Is4In6() {
+		return netip.Prefix{}, errors.New("unsupported address")
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// UpdateRuleACL 保存规则的访问控制配置并通知相关节点刷新配置
+func (s *RuleService) UpdateRuleACL(ruleID uint, mode string, entries []string) error {
+	rule, err := s.GetRuleByID(ruleID)
+	if err != nil {
+		return err
+	}
+	if err := s.db.Model(&models.ForwardingRule{}).Where("id = ?", ruleID).Updates(map[string]interface{}{
+		"acl_mode":    mode,
+		"acl_entries": models.StringSlice(entries),
+	}).Error; err != nil {
+		return err
+	}
+	return bumpConfigRevision(s.db, ruleNodeIDs(s.db, rule)...)
+}
@@ -0,0 +1,78 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+
+	"bakaray/internal/models"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeRuleACL(t *testing.T) {
+	t.Run("规范化地址与网段并去重", func(t *testing.T) {
+		mode, entries, err := NormalizeRuleACL(" Allow ", []string{"10.1.2.3/8", "192.168.1.10", "2001:db8::1/32", " 10.0.0.0/8 ", "", "2001:DB8::5"})
+		require.NoError(t, err)
+		require.Equal(t, RuleACLModeAllow, mode)
+		require.Equal(t, []string{"10.0.0.0/8", "192.168.1.10/32", "2001:db8::/32", "2001:db8::5/128"}, entries)
+	})
+
+	t.Run("拒绝无效配置", func(t *testing.T) {
+		for _, tc := range []struct {
+			mode    string
+			entries []string
+		}{
+			{mode: "block", entries: []string{"1.1.1.1"}},
+			{mode: "deny", entries: []string{"example.com"}},
+			{mode: "deny", entries: []string{"10.0.0.0/33"}},
+			{mode: "deny", entries: []string{"fe80::1%eth0"}},
+			{mode: "allow"},
+		} {
+			_, _, err := NormalizeRuleACL(tc.mode, tc.entries)
+			require.ErrorIs(t, err, ErrInvalidRuleACL, "mode=%s entries=%v", tc.mode, tc.entries)
+		}
+	})
+
+	t.Run("条目数量上限", func(t *testing.T) {
+		entries := make([]string, 0, MaxRuleACLEntries+1)
+		for i := 0; i <= MaxRuleACLEntries; i++ {
+			entries = append(entries, fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+		}
+		_, _, err := NormalizeRuleACL(RuleACLModeDeny, entries)
+		require.ErrorIs(t, err, ErrInvalidRuleACL)
+		require.Contains(t, err.Error(), "最多")
+	})
+
+	t.Run("关闭访问控制时清空条目", func(t *testing.T) {
+		mode, entries, err := NormalizeRuleACL("", []string{"1.1.1.1"})
+		require.NoError(t, err)
+		require.Empty(t, mode)
+		require.Nil(t, entries)
+
+		mode, entries, err = NormalizeRuleACL(RuleACLModeDeny, nil)
+		require.NoError(t, err)
+		require.Empty(t, mode)
+		require.Nil(t, entries)
+	})
+}
+
+func TestUpdateRuleACL(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	service := NewRuleService(db, nil)
+	user := createTestUser(t, db, "acl-user")
+	node := createTestNode(t, db, "acl-node")
+	rule := createBillingRule(t, db, user.ID, node.ID, 9301)
+
+	require.NoError(t, service.UpdateRuleACL(rule.ID, RuleACLModeDeny, []string{"203.0.113.0/24"}))
+
+	saved, err := service.GetRuleByID(rule.ID)
+	require.NoError(t, err)
+	require.Equal(t, RuleACLModeDeny, saved.ACLMode)
+	require.Equal(t, models.StringSlice{"203.0.113.0/24"}, saved.ACLEntries)
+
+	var updated models.Node
+	require.NoError(t, db.First(&updated, node.ID).Error)
+	require.Equal(t, node.ConfigRevision+1, updated.ConfigRevision)
+}
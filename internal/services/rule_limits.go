@@ -0,0 +1,117 @@
+package services
+
+import (
+	"errors"
+
+	"bakaray/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// 规则限制的最大取值
+const (
+	MaxSpeedLimit      int64 = 100 * 1000 * 1000 // 限速，单位：kbps（100Gbps）
+	MaxRuleConnections int64 = 1000000           // 并发连接数
+	MaxRuleConnRate    int64 = 100000            // 每秒新建连接数
+)
+
+// 规则限制的来源
+const (
+	RuleLimitSourceGroup   = "group"
+	RuleLimitSourcePackage = "package"
+)
+
+// RuleLimits 用户创建、修改规则时适用的限制，限速单位为 kbps，0 表示不限制
+type RuleLimits struct {
+	Source                string `json:"source"` // 限速设置的来源：group, package；没有限速设置时为空
+	DefaultSpeedLimitUp   int64  `json:"default_speed_limit_up"`
+	DefaultSpeedLimitDown int64  `json:"default_speed_limit_down"`
+	MaxSpeedLimitUp       int64  `json:"max_speed_limit_up"`
+	MaxSpeedLimitDown     int64  `json:"max_speed_limit_down"`
+	MaxConnections        int64  `json:"max_connections"` // 连接数上限始终来自用户组
+	MaxConnRate           int64  `json:"max_conn_rate"`
+
+	// 用户组的监听端口策略，与节点的端口策略叠加
+	ListenPortRanges []string `json:"listen_port_ranges"`
+	ReservedPorts    []string `json:"reserved_ports"`
+
+	// 用户组的规则配额，0 或为空表示不限制
+	MaxRules          int      `json:"max_rules"`
+	MaxTargetsPerRule int      `json:"max_targets_per_rule"`
+	MaxTunnelRules    int      `json:"max_tunnel_rules"`
+	MaxTrafficLimit   int64    `json:"max_traffic_limit"`
+	AllowedProtocols  []string `json:"allowed_protocols"`
+	AllowedModes      []string `json:"allowed_modes"`
+}
+
+func (l *RuleLimits) hasSpeedLimits() bool {
+	return l.DefaultSpeedLimitUp > 0 || l.DefaultSpeedLimitDown > 0 || l.MaxSpeedLimitUp > 0 || l.MaxSpeedLimitDown > 0
+}
+
+// RuleLimitsForUser 返回用户适用的规则限制。
+// 最近一次购买成功的套餐设置了限速时限速以套餐为准，否则使用用户所在用户组的设置；连接数上限、端口策略与规则配额来自用户组。
+func (s *RuleService) RuleLimitsForUser(userID uint) (*RuleLimits, error) {
+	var user models.User
+	if err := s.db.Select("id", "user_group_id").First(&user, userID).Error; err != nil {
+		return nil, err
+	}
+
+	var group models.UserGroup
+	if user.UserGroupID != 0 {
+		if err := s.db.Where("id = ?", user.UserGroupID).Limit(1).Find(&group).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	limits := &RuleLimits{
+		MaxConnections:   group.MaxRuleConnections,
+		MaxConnRate:      group.MaxRuleConnRate,
+		ListenPortRanges: group.ListenPortRanges,
+		ReservedPorts:    group.ReservedPorts,
+	}
+	limits.MaxRules = group.MaxRules
+	limits.MaxTargetsPerRule = group.MaxTargetsPerRule
+	limits.MaxTunnelRules = group.MaxTunnelRules
+	limits.MaxTrafficLimit = group.MaxRuleTrafficLimit
+	limits.AllowedProtocols = group.AllowedProtocols
+	limits.AllowedModes = group.AllowedModes
+
+	var pkg models.Package
+	err := s.db.Model(&models.Package{}).Select("packages.*").
+		Joins("JOIN orders ON orders.package_id = packages.id").
+		Where("orders.user_id = ? AND orders.status = ?", userID, "success").
+		Order("orders.id desc").
+		Limit(1).
+		Take(&pkg).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if err == nil {
+		limits.DefaultSpeedLimitUp = pkg.DefaultSpeedLimitUp
+		limits.DefaultSpeedLimitDown = pkg.DefaultSpeedLimitDown
+		limits.MaxSpeedLimitUp = pkg.MaxSpeedLimitUp
+		limits.MaxSpeedLimitDown = pkg.MaxSpeedLimitDown
+		if limits.hasSpeedLimits() {
+			limits.Source = RuleLimitSourcePackage
+			return limits, nil
+		}
+	}
+
+	limits.DefaultSpeedLimitUp = group.DefaultSpeedLimitUp
+	limits.DefaultSpeedLimitDown = group.DefaultSpeedLimitDown
+	limits.MaxSpeedLimitUp = group.MaxSpeedLimitUp
+	limits.MaxSpeedLimitDown = group.MaxSpeedLimitDown
+	if limits.hasSpeedLimits() {
+		limits.Source = RuleLimitSourceGroup
+	}
+	return limits, nil
+}
+
+// RuleSpeedLimits 返回规则的上下行限速（kbps）。
+// 只设置了兼容字段 speed_limit 的旧规则按上下行相同处理。
+func RuleSpeedLimits(rule *models.ForwardingRule) (up, down int64) {
+	if rule.SpeedLimitUp == 0 && rule.SpeedLimitDown == 0 && rule.SpeedLimit > 0 {
+		return rule.SpeedLimit, rule.SpeedLimit
+	}
+	return rule.SpeedLimitUp, rule.SpeedLimitDown
+}
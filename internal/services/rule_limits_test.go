@@ -0,0 +1,62 @@
+package services
+
+import (
+	"testing"
+
+	"bakaray/internal/models"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleLimitsForUser(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	service := NewRuleService(db, nil)
+	group := &models.UserGroup{Name: "limited", DefaultSpeedLimitUp: 1024, DefaultSpeedLimitDown: 2048, MaxSpeedLimitUp: 4096, MaxSpeedLimitDown: 8192, MaxRuleConnections: 200}
+	require.NoError(t, db.Create(group).Error)
+	user := createTestUser(t, db, "limits-user")
+	require.NoError(t, db.Model(user).Update("user_group_id", group.ID).Error)
+
+	t.Run("使用用户组设置", func(t *testing.T) {
+		limits, err := service.RuleLimitsForUser(user.ID)
+		require.NoError(t, err)
+		require.Equal(t, RuleLimitSourceGroup, limits.Source)
+		require.Equal(t, int64(1024), limits.DefaultSpeedLimitUp)
+		require.Equal(t, int64(8192), limits.MaxSpeedLimitDown)
+	})
+
+	t.Run("未设置限速的套餐不覆盖用户组", func(t *testing.T) {
+		pkg := &models.Package{Name: "plain", Traffic: 1, Price: 1}
+		require.NoError(t, db.Create(pkg).Error)
+		require.NoError(t, db.Create(&models.Order{UserID: user.ID, PackageID: pkg.ID, Amount: 1, Status: "success", TradeNo: "limits-1"}).Error)
+
+		limits, err := service.RuleLimitsForUser(user.ID)
+		require.NoError(t, err)
+		require.Equal(t, RuleLimitSourceGroup, limits.Source)
+	})
+
+	t.Run("最近购买的限速套餐优先", func(t *testing.T) {
+		pkg := &models.Package{Name: "fast", Traffic: 1, Price: 1, MaxSpeedLimitUp: 100000, MaxSpeedLimitDown: 100000}
+		require.NoError(t, db.Create(pkg).Error)
+		require.NoError(t, db.Create(&models.Order{UserID: user.ID, PackageID: pkg.ID, Amount: 1, Status: "success", TradeNo: "limits-2"}).Error)
+		require.NoError(t, db.Create(&models.Order{UserID: user.ID, PackageID: pkg.ID, Amount: 1, Status: "pending", TradeNo: "limits-3"}).Error)
+
+		limits, err := service.RuleLimitsForUser(user.ID)
+		require.NoError(t, err)
+		require.Equal(t, RuleLimitSourcePackage, limits.Source)
+		require.Zero(t, limits.DefaultSpeedLimitUp)
+		require.Equal(t, int64(100000), limits.MaxSpeedLimitUp)
+		require.Equal(t, int64(200), limits.MaxConnections, "连接数上限始终来自用户组")
+	})
+
+	t.Run("旧规则的 speed_limit 按上下行相同处理", func(t *testing.T) {
+		up, down := RuleSpeedLimits(&models.ForwardingRule{SpeedLimit: 512})
+		require.Equal(t, int64(512), up)
+		require.Equal(t, int64(512), down)
+
+		up, down = RuleSpeedLimits(&models.ForwardingRule{SpeedLimit: 512, SpeedLimitUp: 100})
+		require.Equal(t, int64(100), up)
+		require.Zero(t, down)
+	})
+}
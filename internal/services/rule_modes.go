@@ -0,0 +1,49 @@
+package services
+
+import "strings"
+
+// 规则转发模式，决定节点如何在启用的目标中选择连接目标：
+//   - direct：只有一个启用目标，所有连接转发到该目标
+//   - rr：按 weight 加权轮询
+//   - lb：按 weight 加权负载均衡
+//   - least_conn：选择当前活动连接最少的目标，活动连接数按 weight 折算后比较
+//   - source_hash：按客户端 IP 做一致性哈希，同一来源固定到同一目标；目标增减时只有部分来源迁移
+//   - failover：按 priority 从小到大分层，只使用当前可用的最高优先级（数值最小）一层，层内按 weight 轮询；
+//     该层目标全部不可用时切换到下一层，高优先级目标恢复后切回
+const (
+	RuleModeDirect      = "direct"
+	RuleModeRoundRobin  = "rr"
+	RuleModeLoadBalance = "lb"
+	RuleModeLeastConn   = "least_conn"
+	RuleModeSourceHash  = "source_hash"
+	RuleModeFailover    = "failover"
+)
+
+// MaxTargetPriority 目标优先级的最大取值，仅 failover 模式使用
+const MaxTargetPriority = 100
+
+var ruleModes = []string{RuleModeDirect, RuleModeRoundRobin, RuleModeLoadBalance, RuleModeLeastConn, RuleModeSourceHash, RuleModeFailover}
+
+// NormalizeRuleMode 规范化转发模式，空值视为 direct，least-conn 等连字符写法视为下划线
+func NormalizeRuleMode(mode string) string {
+	mode = strings.ReplaceAll(strings.ToLower(strings.TrimSpace(mode)), "-", "_")
+	if mode == "" {
+		return RuleModeDirect
+	}
+	return mode
+}
+
+// IsRuleMode 判断是否为支持的转发模式
+func IsRuleMode(mode string) bool {
+	for _, m := range ruleModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// RuleModes 返回支持的转发模式
+func RuleModes() []string {
+	return append([]string(nil), ruleModes...)
+}
@@ -0,0 +1,221 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"bakaray/internal/logger"
+	"bakaray/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// RulePlacementSweepInterval 节点组规则重新调度周期
+const RulePlacementSweepInterval = 30 * time.Second
+
+// RebalanceGroupRules 为 healthiest 部署或使用出口节点组的规则重新选择节点：
+// 当前节点离线或已移出节点组时，改为组内最健康且无端口冲突的节点。返回迁移的规则数。
+func (s *RuleService) RebalanceGroupRules() (int, error) {
+	var rules []models.ForwardingRule
+	if err := s.db.Where("enabled = ?", true).
+		Where("(node_group_id <> 0 AND placement = ?) OR (tunnel_enabled = ? AND exit_group_id <> 0)", RulePlacementHealthiest, true).
+		Find(&rules).Error; err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for i := range rules {
+		rule := &rules[i]
+		allowed, err := userAllowedNodeIDs(s.db, rule.UserID)
+		if err != nil {
+			return moved, err
+		}
+
+		updates := map[string]interface{}{}
+		entryID := rule.NodeID
+		if rule.NodeGroupID != 0 && rule.Placement == RulePlacementHealthiest {
+			next, err := s.pickPlacementNode(rule, rule.NodeGroupID, rule.NodeID, allowed, false)
+			if err != nil {
+				return moved, err
+			}
+			if next != 0 && next != rule.NodeID {
+				updates["node_id"] = next
+				entryID = next
+			}
+		}
+		if rule.TunnelEnabled && rule.ExitGroupID != 0 {
+			next, err := s.pickPlacementNode(rule, rule.ExitGroupID, rule.ExitNodeID, allowed, true)
+			if err != nil {
+				return moved, err
+			}
+			if next != 0 && next != rule.ExitNodeID && next != entryID {
+				updates["exit_node_id"] = next
+			}
+		}
+		if len(updates) == 0 {
+			continue
+		}
+
+		before := *rule
+		if err := s.db.Model(&models.ForwardingRule{}).Where("id = ?", rule.ID).Updates(updates).Error; err != nil {
+			return moved, err
+		}
+		after, err := s.GetRuleByID(rule.ID)
+		if err != nil {
+			return moved, err
+		}
+		if err := bumpConfigRevision(s.db, append(ruleNodeIDs(s.db, &before), ruleNodeIDs(s.db, after)...)...); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// RunPlacementSweep 供调度器调用的节点组规则重新调度任务
+func (s *RuleService) RunPlacementSweep(ctx context.Context) error {
+	moved, err := s.RebalanceGroupRules()
+	if err != nil {
+		return err
+	}
+	if moved > 0 {
+		logger.Info("Rule placement sweep moved rules", "count", moved)
+	}
+	return nil
+}
+
+// pickPlacementNode 返回规则在节点组中应部署的节点。当前节点仍在线且属于该组时保持不变；
+// 没有可用节点时返回 0，规则保持原位等待节点恢复。
+func (s *RuleService) pickPlacementNode(rule *models.ForwardingRule, groupID, currentID uint, allowed map[uint]bool, exit bool) (uint, error) {
+	members, err := listNodeGroupMembers(s.db, groupID)
+	if err != nil {
+		return 0, err
+	}
+
+	candidates := make([]models.Node, 0, len(members))
+	for _, node := range members {
+		if !allowed[node.ID] || node.Status != NodeStatusOnline {
+			continue
+		}
+		if node.ID == currentID {
+			return currentID, nil
+		}
+		candidates = append(candidates, node)
+	}
+
+	ranked, err := rankPlacementCandidates(s.db, candidates, 0)
+	if err != nil {
+		return 0, err
+	}
+	for _, node := range ranked {
+		ok, err := s.nodeCanHostRule(&node, rule, exit)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return node.ID, nil
+		}
+	}
+	return 0, nil
+}
+
+// nodeCanHostRule 检查节点是否支持规则协议且监听端口无冲突
+func (s *RuleService) nodeCanHostRule(node *models.Node, rule *models.ForwardingRule, exit bool) (bool, error) {
+	protocols := []string(node.Protocols)
+	if exit {
+		if !NodeSupportsTunnelProtocol(protocols, rule.TunnelProtocol) {
+			return false, nil
+		}
+		return s.portFree(node.ID, rule.TunnelPort, rule.TunnelPort, TunnelProtocolNetwork(rule.TunnelProtocol), rule.ID)
+	}
+
+	if !NodeSupportsDirectProtocol(protocols, rule.Protocol) {
+		return false, nil
+	}
+	if rule.TunnelEnabled && !NodeSupportsTunnelProtocol(protocols, rule.TunnelProtocol) {
+		return false, nil
+	}
+	return s.portFree(node.ID, rule.ListenPort, RuleListenPortEnd(rule), DirectProtocolNetwork(rule.Protocol), rule.ID)
+}
+
+// portFree 检查节点上 port 至 portEnd 的端口/网络是否未被其他启用规则占用
+func (s *RuleService) portFree(nodeID uint, port, portEnd int, network string, excludeRuleID uint) (bool, error) {
+	conflict, err := findPortConflict(s.db, nodeID, port, portEnd, network, "", []uint{excludeRuleID})
+	return conflict == nil, err
+}
+
+// findPortConflict 返回节点上在 listenIP 的 port 至 portEnd 范围内占用同一传输层的启用规则，没有冲突时返回 nil。
+// 隧道出口监听全部地址；excludeRuleIDs 中的规则不计入。
+func findPortConflict(db *gorm.DB, nodeID uint, port, portEnd int, network, listenIP string, excludeRuleIDs []uint) (*models.ForwardingRule, error) {
+	var entryRules []models.ForwardingRule
+	if err := rulesOnNode(db, nodeID).
+		Where("enabled = ? AND id NOT IN ? AND listen_port <= ? AND (CASE WHEN listen_port_end > listen_port THEN listen_port_end ELSE listen_port END) >= ?", true, excludeRuleIDs, portEnd, port).
+		Find(&entryRules).Error; err != nil {
+		return nil, err
+	}
+	for i, r := range entryRules {
+		if IsDirectProtocol(r.Protocol) && DirectProtocolNetwork(r.Protocol) == network && ListenIPsOverlap(r.ListenIP, listenIP) {
+			return &entryRules[i], nil
+		}
+	}
+
+	var exitRules []models.ForwardingRule
+	if err := db.Where("enabled = ? AND tunnel_enabled = ? AND exit_node_id = ? AND id NOT IN ? AND tunnel_port BETWEEN ? AND ?", true, true, nodeID, excludeRuleIDs, port, portEnd).
+		Find(&exitRules).Error; err != nil {
+		return nil, err
+	}
+	for i, r := range exitRules {
+		if IsTunnelProtocol(r.TunnelProtocol) && TunnelProtocolNetwork(r.TunnelProtocol) == network {
+			return &exitRules[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// RuleDisabledPortConflict 规则自动恢复启用时监听端口已被其他规则占用，端口空闲后由生效时间检查任务自动恢复
+const RuleDisabledPortConflict = "port_conflict"
+
+// ruleListenConflict 返回与规则的入口监听或隧道出口监听冲突的启用规则，没有冲突时返回 nil。
+// 规则禁用期间其端口可能已分配给其他规则，自动恢复启用前需要重新检查
+func ruleListenConflict(db *gorm.DB, rule *models.ForwardingRule) (*models.ForwardingRule, error) {
+	exclude := []uint{rule.ID}
+	if IsDirectProtocol(rule.Protocol) {
+		nodeIDs, err := ruleEntryNodeIDs(db, rule)
+		if err != nil {
+			return nil, err
+		}
+		for _, nodeID := range nodeIDs {
+			conflict, err := findPortConflict(db, nodeID, rule.ListenPort, max(rule.ListenPort, rule.ListenPortEnd), DirectProtocolNetwork(rule.Protocol), rule.ListenIP, exclude)
+			if err != nil || conflict != nil {
+				return conflict, err
+			}
+		}
+	}
+	if rule.TunnelEnabled && rule.ExitNodeID > 0 && IsTunnelProtocol(rule.TunnelProtocol) {
+		return findPortConflict(db, rule.ExitNodeID, rule.TunnelPort, rule.TunnelPort, TunnelProtocolNetwork(rule.TunnelProtocol), "", exclude)
+	}
+	return nil, nil
+}
+
+// userAllowedNodeIDs 返回用户所在用户组可使用的节点
+func userAllowedNodeIDs(db *gorm.DB, userID uint) (map[uint]bool, error) {
+	var user models.User
+	if err := db.Select("id", "user_group_id").First(&user, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return map[uint]bool{}, nil
+		}
+		return nil, err
+	}
+	var nodeIDs []uint
+	if err := db.Model(&models.NodeAllowedGroup{}).
+		Where("user_group_id = ?", user.UserGroupID).
+		Pluck("node_id", &nodeIDs).Error; err != nil {
+		return nil, err
+	}
+	allowed := make(map[uint]bool, len(nodeIDs))
+	for _, id := range nodeIDs {
+		allowed[id] = true
+	}
+	return allowed, nil
+}
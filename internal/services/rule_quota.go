@@ -0,0 +1,99 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"bakaray/internal/models"
+)
+
+var ErrInvalidRuleQuota = errors.New("无效的规则配额")
+
+// RuleUsage 用户当前的规则用量，用于检查用户组的规则配额
+type RuleUsage struct {
+	Rules       int64 `json:"rules"`
+	TunnelRules int64 `json:"tunnel_rules"`
+}
+
+// RuleUsageForUser 统计用户的规则数与启用隧道的规则数，已禁用的规则同样计入
+func (s *RuleService) RuleUsageForUser(userID uint) (*RuleUsage, error) {
+	usage := &RuleUsage{}
+	if err := s.db.Model(&models.ForwardingRule{}).Where("user_id = ?", userID).Count(&usage.Rules).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&models.ForwardingRule{}).Where("user_id = ? AND tunnel_enabled = ?", userID, true).Count(&usage.TunnelRules).Error; err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// QuotaAllows 判断配额白名单是否允许该取值，白名单为空表示不限制
+func QuotaAllows(allowed []string, value string) bool {
+	return len(allowed) == 0 || slices.Contains(allowed, value)
+}
+
+// NormalizeAllowedProtocols 校验并规范化用户组允许使用的协议，可包含 TCP/UDP 与隧道协议
+func NormalizeAllowedProtocols(entries []string) (models.StringSlice, error) {
+	out := make(models.StringSlice, 0, len(entries))
+	for _, raw := range entries {
+		protocol := NormalizeProtocol(raw)
+		if protocol == "" || slices.Contains(out, protocol) {
+			continue
+		}
+		if !IsDirectProtocol(protocol) && !IsTunnelProtocol(protocol) {
+			return nil, fmt.Errorf("%w: 不支持的协议 %s", ErrInvalidRuleQuota, protocol)
+		}
+		out = append(out, protocol)
+	}
+	return out, nil
+}
+
+// NormalizeAllowedModes 校验并规范化用户组允许使用的转发模式
+func NormalizeAllowedModes(entries []string) (models.StringSlice, error) {
+	out := make(models.StringSlice, 0, len(entries))
+	for _, raw := range entries {
+		if raw == "" {
+			continue
+		}
+		mode := NormalizeRuleMode(raw)
+		if slices.Contains(out, mode) {
+			continue
+		}
+		if !IsRuleMode(mode) {
+			return nil, fmt.Errorf("%w: 不支持的转发模式 %s", ErrInvalidRuleQuota, mode)
+		}
+		out = append(out, mode)
+	}
+	return out, nil
+}
+
+// normalizeRuleQuotaUpdates 校验用户组更新中的规则配额字段，并规范化协议与转发模式白名单
+func normalizeRuleQuotaUpdates(updates map[string]interface{}) error {
+	for _, key := range []string{"max_rules", "max_targets_per_rule", "max_tunnel_rules", "max_rule_traffic_limit"} {
+		if value, ok := updates[key].(float64); ok && value < 0 {
+			return fmt.Errorf("%w: %s 不能为负数", ErrInvalidRuleQuota, key)
+		}
+	}
+
+	normalizers := map[string]func([]string) (models.StringSlice, error){
+		"allowed_protocols": NormalizeAllowedProtocols,
+		"allowed_modes":     NormalizeAllowedModes,
+	}
+	for key, normalize := range normalizers {
+		raw, ok := updates[key]
+		if !ok {
+			continue
+		}
+		entries, ok := stringListUpdate(raw)
+		if !ok {
+			return fmt.Errorf("%w: %s 格式错误", ErrInvalidRuleQuota, key)
+		}
+		normalized, err := normalize(entries)
+		if err != nil {
+			return err
+		}
+		updates[key] = normalized
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package services
+
+import (
+	"testing"
+
+	"bakaray/internal/models"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeRuleQuotaUpdates(t *testing.T) {
+	updates := map[string]interface{}{
+		"max_rules":         float64(10),
+		"allowed_protocols": []interface{}{" TCP", "ws", "tcp"},
+		"allowed_modes":     "direct,least-conn",
+	}
+	require.NoError(t, normalizeRuleQuotaUpdates(updates))
+	require.Equal(t, models.StringSlice{"tcp", "ws"}, updates["allowed_protocols"])
+	require.Equal(t, models.StringSlice{"direct", "least_conn"}, updates["allowed_modes"])
+
+	for _, invalid := range []map[string]interface{}{
+		{"max_rules": float64(-1)},
+		{"allowed_protocols": []interface{}{"http"}},
+		{"allowed_modes": []interface{}{"random"}},
+		{"allowed_modes": float64(1)},
+	} {
+		require.ErrorIs(t, normalizeRuleQuotaUpdates(invalid), ErrInvalidRuleQuota, invalid)
+	}
+}
+
+func TestRuleUsageForUser(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	service := NewRuleService(db, nil)
+	user := createTestUser(t, db, "quota-user")
+	other := createTestUser(t, db, "quota-other")
+	node := createTestNode(t, db, "quota-node")
+
+	createBillingRule(t, db, user.ID, node.ID, 9701)
+	disabled := createBillingRule(t, db, user.ID, node.ID, 9702)
+	require.NoError(t, db.Model(disabled).Updates(map[string]interface{}{"enabled": false, "tunnel_enabled": true}).Error)
+	createBillingRule(t, db, other.ID, node.ID, 9703)
+
+	usage, err := service.RuleUsageForUser(user.ID)
+	require.NoError(t, err)
+	require.Equal(t, &RuleUsage{Rules: 2, TunnelRules: 1}, usage)
+}
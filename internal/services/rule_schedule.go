@@ -0,0 +1,346 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // 精简镜像中可能没有系统时区数据
+
+	"bakaray/internal/logger"
+	"bakaray/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// 规则因生效时间设置被调度器禁用的原因，进入生效时间后自动恢复
+const (
+	RuleDisabledNotStarted    = "schedule_pending" // 尚未到生效时间
+	RuleDisabledExpired       = "expired"          // 已过到期时间
+	RuleDisabledOutsideWindow = "outside_window"   // 不在每周生效时段内
+)
+
+// RuleScheduleSweepInterval 规则生效时间检查周期
+const RuleScheduleSweepInterval = 30 * time.Second
+
+// MaxRuleScheduleWindows 每条规则最多的每周生效时段数
+const MaxRuleScheduleWindows = 32
+
+var ErrInvalidRuleSchedule = errors.New("无效的生效时间设置")
+
+// scheduleDayNames 按 time.Weekday 索引的星期缩写
+var scheduleDayNames = [7]string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// scheduleWindow 解析后的每周生效时段。End 不大于 Start 时跨越午夜，结束于次日
+type scheduleWindow struct {
+	Days  [7]bool // 按 time.Weekday 索引，时段开始的星期
+	Start int     // 开始时间，当天的分钟数
+	End   int     // 结束时间，当天的分钟数，24:00 为 1440
+}
+
+// IsScheduleDisabledReason 判断禁用原因是否来自生效时间设置
+func IsScheduleDisabledReason(reason string) bool {
+	return reason == RuleDisabledNotStarted || reason == RuleDisabledExpired || reason == RuleDisabledOutsideWindow
+}
+
+// NormalizeRuleSchedule 校验并规范化规则的生效时间设置：时间统一为 UTC，生效时段转为规范写法，
+// 未设置生效时段时清空时区
+func NormalizeRuleSchedule(schedule models.RuleSchedule) (models.RuleSchedule, error) {
+	if schedule.StartsAt != nil {
+		startsAt := schedule.StartsAt.UTC()
+		schedule.StartsAt = &startsAt
+	}
+	if schedule.ExpiresAt != nil {
+		expiresAt := schedule.ExpiresAt.UTC()
+		schedule.ExpiresAt = &expiresAt
+	}
+	if schedule.StartsAt != nil && schedule.ExpiresAt != nil && !schedule.ExpiresAt.After(*schedule.StartsAt) {
+		return schedule, fmt.Errorf("%w: 到期时间必须晚于生效时间", ErrInvalidRuleSchedule)
+	}
+
+	windows := make(models.StringSlice, 0, len(schedule.Windows))
+	for _, entry := range schedule.Windows {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		window, err := parseScheduleWindow(entry)
+		if err != nil {
+			return schedule, err
+		}
+		if value := window.String(); !slices.Contains(windows, value) {
+			windows = append(windows, value)
+		}
+	}
+	if len(windows) > MaxRuleScheduleWindows {
+		return schedule, fmt.Errorf("%w: 生效时段最多 %d 个", ErrInvalidRuleSchedule, MaxRuleScheduleWindows)
+	}
+	if len(windows) == 0 {
+		schedule.Windows = nil
+		schedule.Timezone = ""
+		return schedule, nil
+	}
+	schedule.Windows = windows
+
+	schedule.Timezone = strings.TrimSpace(schedule.Timezone)
+	if schedule.Timezone != "" {
+		if _, err := time.LoadLocation(schedule.Timezone); err != nil {
+			return schedule, fmt.Errorf("%w: 未知的时区 %s", ErrInvalidRuleSchedule, schedule.Timezone)
+		}
+	}
+	return schedule, nil
+}
+
+// parseScheduleWindow 解析 "mon-fri 09:00-18:00" 形式的生效时段。星期部分可用逗号分隔多个星期或范围，
+// 省略或为 daily 表示每天；结束时间不晚于开始时间时跨越午夜
+func parseScheduleWindow(entry string) (scheduleWindow, error) {
+	var window scheduleWindow
+	invalid := fmt.Errorf("%w: 生效时段 %q 格式应为 \"mon-fri 09:00-18:00\"", ErrInvalidRuleSchedule, entry)
+
+	fields := strings.Fields(strings.ToLower(entry))
+	var days, clock string
+	switch len(fields) {
+	case 1:
+		days, clock = "daily", fields[0]
+	case 2:
+		days, clock = fields[0], fields[1]
+	default:
+		return window, invalid
+	}
+
+	if days == "daily" || days == "*" {
+		for i := range window.Days {
+			window.Days[i] = true
+		}
+	} else {
+		for _, part := range strings.Split(days, ",") {
+			from, to, isRange := strings.Cut(part, "-")
+			first := slices.Index(scheduleDayNames[:], from)
+			last := first
+			if isRange {
+				last = slices.Index(scheduleDayNames[:], to)
+			}
+			if first < 0 || last < 0 {
+				return window, invalid
+			}
+			// 范围可以跨越周末，如 sat-mon
+			for day := first; ; day = (day + 1) % 7 {
+				window.Days[day] = true
+				if day == last {
+					break
+				}
+			}
+		}
+	}
+
+	start, end, ok := strings.Cut(clock, "-")
+	if !ok {
+		return window, invalid
+	}
+	var err error
+	if window.Start, err = parseScheduleClock(start); err != nil || window.Start == 24*60 {
+		return window, invalid
+	}
+	if window.End, err = parseScheduleClock(end); err != nil || window.End == window.Start {
+		return window, invalid
+	}
+	return window, nil
+}
+
+// parseScheduleClock 解析 HH:MM，返回当天的分钟数，允许 24:00
+func parseScheduleClock(value string) (int, error) {
+	hh, mm, ok := strings.Cut(value, ":")
+	if !ok || len(hh) == 0 || len(hh) > 2 || len(mm) != 2 {
+		return 0, ErrInvalidRuleSchedule
+	}
+	hour, err := strconv.Atoi(hh)
+	if err != nil {
+		return 0, ErrInvalidRuleSchedule
+	}
+	minute, err := strconv.Atoi(mm)
+	if err != nil || hour < 0 || minute < 0 || minute > 59 || hour > 24 || (hour == 24 && minute != 0) {
+		return 0, ErrInvalidRuleSchedule
+	}
+	return hour*60 + minute, nil
+}
+
+// String 返回生效时段的规范写法，连续的星期合并为范围
+func (w scheduleWindow) String() string {
+	var days string
+	if !slices.Contains(w.Days[:], false) {
+		days = "daily"
+	} else {
+		// 从周一开始输出，周日排在最后
+		order := [7]int{1, 2, 3, 4, 5, 6, 0}
+		var parts []string
+		for i := 0; i < len(order); i++ {
+			if !w.Days[order[i]] {
+				continue
+			}
+			j := i
+			for j+1 < len(order) && w.Days[order[j+1]] {
+				j++
+			}
+			part := scheduleDayNames[order[i]]
+			if j > i {
+				part += "-" + scheduleDayNames[order[j]]
+			}
+			parts = append(parts, part)
+			i = j
+		}
+		days = strings.Join(parts, ",")
+	}
+	return fmt.Sprintf("%s %02d:%02d-%02d:%02d", days, w.Start/60, w.Start%60, w.End/60, w.End%60)
+}
+
+// contains 判断时刻是否在时段内：当天开始的时段，或前一天开始、跨越午夜的时段
+func (w scheduleWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := int(t.Weekday())
+	if w.End > w.Start {
+		return w.Days[day] && minute >= w.Start && minute < w.End
+	}
+	return (w.Days[day] && minute >= w.Start) || (w.Days[(day+6)%7] && minute < w.End)
+}
+
+// scheduleLocation 返回生效时段使用的时区，未设置或无法识别时为 UTC
+func scheduleLocation(name string) *time.Location {
+	if name == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// RuleScheduleReason 返回规则在 now 时刻因生效时间设置应被禁用的原因，处于生效时间内时返回空字符串
+func RuleScheduleReason(rule *models.ForwardingRule, now time.Time) string {
+	schedule := &rule.Schedule
+	if schedule.ExpiresAt != nil && !now.Before(*schedule.ExpiresAt) {
+		return RuleDisabledExpired
+	}
+	if schedule.StartsAt != nil && now.Before(*schedule.StartsAt) {
+		return RuleDisabledNotStarted
+	}
+	if len(schedule.Windows) == 0 {
+		return ""
+	}
+	local := now.In(scheduleLocation(schedule.Timezone))
+	for _, entry := range schedule.Windows {
+		window, err := parseScheduleWindow(entry)
+		if err == nil && window.contains(local) {
+			return ""
+		}
+	}
+	return RuleDisabledOutsideWindow
+}
+
+// ruleReenableReason 返回因生效时间以外原因被禁用的规则重新进入生效时间后仍需保持禁用的原因：
+// 规则流量达到上限、用户流量余额耗尽或监听端口已被其他规则占用
+func ruleReenableReason(tx *gorm.DB, rule *models.ForwardingRule) (string, error) {
+	if rule.TrafficLimit > 0 && rule.TrafficUsed >= rule.TrafficLimit {
+		return RuleDisabledTrafficLimit, nil
+	}
+	var balances []int64
+	if err := tx.Model(&models.User{}).Where("id = ?", rule.UserID).Pluck("traffic_balance", &balances).Error; err != nil {
+		return "", err
+	}
+	if len(balances) > 0 && balances[0] <= 0 {
+		return RuleDisabledBalanceExhausted, nil
+	}
+	conflict, err := ruleListenConflict(tx, rule)
+	if err != nil {
+		return "", err
+	}
+	if conflict != nil {
+		return RuleDisabledPortConflict, nil
+	}
+	return "", nil
+}
+
+// RuleScheduleResult 一次生效时间检查的结果
+type RuleScheduleResult struct {
+	Disabled []uint // 离开生效时间被禁用的规则
+	Enabled  []uint // 进入生效时间恢复启用的规则
+}
+
+// ApplyRuleSchedules 按生效时间设置启停规则：启用中且不在生效时间内的规则被禁用并标记原因；
+// 因生效时间被禁用、现已进入生效时间的规则恢复启用（规则流量达到上限、流量余额耗尽或端口已被占用时改为对应原因），
+// 因端口冲突保持禁用的规则在每次检查时重试。手动禁用的规则不会被自动启用
+func (s *RuleService) ApplyRuleSchedules(now time.Time) (*RuleScheduleResult, error) {
+	var rules []models.ForwardingRule
+	err := s.db.Where("schedule_starts_at IS NOT NULL OR schedule_expires_at IS NOT NULL OR (schedule_windows IS NOT NULL AND schedule_windows NOT IN ?) OR disabled_reason IN ?",
+		[]string{"", "[]", "null"}, []string{RuleDisabledNotStarted, RuleDisabledExpired, RuleDisabledOutsideWindow, RuleDisabledPortConflict}).
+		Order("id asc").Find(&rules).Error
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RuleScheduleResult{Disabled: []uint{}, Enabled: []uint{}}
+	var nodeIDs []uint
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		for i := range rules {
+			rule := &rules[i]
+			reason := RuleScheduleReason(rule, now)
+			pending := !rule.Enabled && (IsScheduleDisabledReason(rule.DisabledReason) || rule.DisabledReason == RuleDisabledPortConflict)
+
+			updates := map[string]interface{}{}
+			switch {
+			case reason != "" && rule.Enabled:
+				updates["enabled"] = false
+				updates["disabled_reason"] = reason
+				result.Disabled = append(result.Disabled, rule.ID)
+			case reason != "" && pending && rule.DisabledReason != reason:
+				// 仅更新原因（如生效时段外的规则已到期），节点配置不变
+				if err := tx.Model(&models.ForwardingRule{}).Where("id = ?", rule.ID).Update("disabled_reason", reason).Error; err != nil {
+					return err
+				}
+				continue
+			case reason == "" && pending:
+				held, err := ruleReenableReason(tx, rule)
+				if err != nil {
+					return err
+				}
+				if held != "" {
+					if held == RuleDisabledPortConflict && rule.DisabledReason != held {
+						logger.Warn("ApplyRuleSchedules: listen port taken, rule kept disabled", "rule_id", rule.ID, "listen_port", rule.ListenPort)
+					}
+					if err := tx.Model(&models.ForwardingRule{}).Where("id = ?", rule.ID).Update("disabled_reason", held).Error; err != nil {
+						return err
+					}
+					continue
+				}
+				updates["enabled"] = true
+				updates["disabled_reason"] = ""
+				result.Enabled = append(result.Enabled, rule.ID)
+			default:
+				continue
+			}
+			if err := tx.Model(&models.ForwardingRule{}).Where("id = ?", rule.ID).Updates(updates).Error; err != nil {
+				return err
+			}
+			nodeIDs = append(nodeIDs, ruleNodeIDs(tx, rule)...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, bumpConfigRevision(s.db, nodeIDs...)
+}
+
+// RunScheduleSweep 供调度器调用的规则生效时间检查任务
+func (s *RuleService) RunScheduleSweep(ctx context.Context) error {
+	result, err := s.ApplyRuleSchedules(time.Now())
+	if err != nil {
+		return err
+	}
+	if len(result.Disabled) > 0 || len(result.Enabled) > 0 {
+		logger.Info("Rule schedule sweep toggled rules", "disabled", len(result.Disabled), "enabled", len(result.Enabled))
+	}
+	return nil
+}
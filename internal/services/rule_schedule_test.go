@@ -0,0 +1,171 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"bakaray/internal/models"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeRuleSchedule(t *testing.T) {
+	schedule, err := NormalizeRuleSchedule(models.RuleSchedule{
+		Windows:  models.StringSlice{" MON-FRI  09:00-18:00", "sun,sat 20:00-2:00", "", "mon,tue,wed,thu,fri 09:00-18:00", "08:00-24:00"},
+		Timezone: "Asia/Shanghai",
+	})
+	require.NoError(t, err)
+	require.Equal(t, models.StringSlice{"mon-fri 09:00-18:00", "sat-sun 20:00-02:00", "daily 08:00-24:00"}, schedule.Windows)
+	require.Equal(t, "Asia/Shanghai", schedule.Timezone)
+
+	// 未设置生效时段时不保留时区
+	schedule, err = NormalizeRuleSchedule(models.RuleSchedule{Timezone: "Asia/Shanghai"})
+	require.NoError(t, err)
+	require.Empty(t, schedule.Timezone)
+
+	startsAt := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	_, err = NormalizeRuleSchedule(models.RuleSchedule{StartsAt: &startsAt, ExpiresAt: &startsAt})
+	require.ErrorIs(t, err, ErrInvalidRuleSchedule)
+
+	for _, invalid := range []string{"mon", "someday 09:00-18:00", "mon 09:00", "mon 25:00-26:00", "mon 09:00-09:00", "mon 24:00-01:00"} {
+		_, err := NormalizeRuleSchedule(models.RuleSchedule{Windows: models.StringSlice{invalid}})
+		require.ErrorIs(t, err, ErrInvalidRuleSchedule, invalid)
+	}
+	_, err = NormalizeRuleSchedule(models.RuleSchedule{Windows: models.StringSlice{"daily 00:00-24:00"}, Timezone: "Mars/Olympus"})
+	require.ErrorIs(t, err, ErrInvalidRuleSchedule)
+}
+
+func TestRuleScheduleReason(t *testing.T) {
+	startsAt := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC) // 周四
+	expiresAt := startsAt.AddDate(0, 0, 30)
+	rule := &models.ForwardingRule{Schedule: models.RuleSchedule{
+		StartsAt:  &startsAt,
+		ExpiresAt: &expiresAt,
+		Windows:   models.StringSlice{"fri 22:00-02:00"},
+		Timezone:  "Asia/Shanghai",
+	}}
+
+	require.Equal(t, RuleDisabledNotStarted, RuleScheduleReason(rule, startsAt.Add(-time.Minute)))
+	require.Equal(t, RuleDisabledExpired, RuleScheduleReason(rule, expiresAt))
+
+	shanghai := scheduleLocation("Asia/Shanghai")
+	require.Equal(t, "", RuleScheduleReason(rule, time.Date(2026, 10, 2, 22, 0, 0, 0, shanghai)))
+	// 跨越午夜的时段在次日凌晨仍然生效
+	require.Equal(t, "", RuleScheduleReason(rule, time.Date(2026, 10, 3, 1, 59, 0, 0, shanghai)))
+	require.Equal(t, RuleDisabledOutsideWindow, RuleScheduleReason(rule, time.Date(2026, 10, 3, 2, 0, 0, 0, shanghai)))
+	require.Equal(t, RuleDisabledOutsideWindow, RuleScheduleReason(rule, time.Date(2026, 10, 2, 21, 59, 0, 0, shanghai)))
+
+	require.Equal(t, "", RuleScheduleReason(&models.ForwardingRule{}, startsAt))
+}
+
+func TestApplyRuleSchedules(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	service := NewRuleService(db, nil)
+	user := createTestUser(t, db, "schedule-user")
+	require.NoError(t, db.Model(user).Update("traffic_balance", 1000).Error)
+	node := createTestNode(t, db, "schedule-node")
+
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+
+	expired := createBillingRule(t, db, user.ID, node.ID, 9601)
+	require.NoError(t, db.Model(expired).Update("schedule_expires_at", past).Error)
+	pending := createBillingRule(t, db, user.ID, node.ID, 9602)
+	require.NoError(t, db.Model(pending).Updates(map[string]interface{}{"enabled": false, "disabled_reason": RuleDisabledNotStarted, "schedule_starts_at": past}).Error)
+	manual := createBillingRule(t, db, user.ID, node.ID, 9603)
+	require.NoError(t, db.Model(manual).Updates(map[string]interface{}{"enabled": false, "schedule_starts_at": past}).Error)
+	window := createBillingRule(t, db, user.ID, node.ID, 9604)
+	require.NoError(t, db.Model(window).Update("schedule_windows", models.StringSlice{"daily 13:00-14:00"}).Error)
+	active := createBillingRule(t, db, user.ID, node.ID, 9605)
+	require.NoError(t, db.Model(active).Update("schedule_expires_at", future).Error)
+
+	var before models.Node
+	require.NoError(t, db.First(&before, node.ID).Error)
+
+	result, err := service.ApplyRuleSchedules(now)
+	require.NoError(t, err)
+	require.Equal(t, []uint{expired.ID, window.ID}, result.Disabled)
+	require.Equal(t, []uint{pending.ID}, result.Enabled)
+
+	saved, err := service.GetRuleByID(expired.ID)
+	require.NoError(t, err)
+	require.False(t, saved.Enabled)
+	require.Equal(t, RuleDisabledExpired, saved.DisabledReason)
+
+	saved, err = service.GetRuleByID(window.ID)
+	require.NoError(t, err)
+	require.Equal(t, RuleDisabledOutsideWindow, saved.DisabledReason)
+
+	// 手动禁用的规则不会被自动启用
+	saved, err = service.GetRuleByID(manual.ID)
+	require.NoError(t, err)
+	require.False(t, saved.Enabled)
+
+	var after models.Node
+	require.NoError(t, db.First(&after, node.ID).Error)
+	require.Greater(t, after.ConfigRevision, before.ConfigRevision)
+
+	// 进入生效时段后恢复；流量余额耗尽时改为等待购买流量
+	require.NoError(t, db.Model(user).Update("traffic_balance", 0).Error)
+	result, err = service.ApplyRuleSchedules(now.Add(90 * time.Minute))
+	require.NoError(t, err)
+	require.Empty(t, result.Enabled)
+	saved, err = service.GetRuleByID(window.ID)
+	require.NoError(t, err)
+	require.False(t, saved.Enabled)
+	require.Equal(t, RuleDisabledBalanceExhausted, saved.DisabledReason)
+
+	// 余额恢复时不在生效时间内的规则继续等待调度器启用
+	require.NoError(t, db.Model(&models.ForwardingRule{}).Where("id = ?", expired.ID).Update("disabled_reason", RuleDisabledBalanceExhausted).Error)
+	require.NoError(t, db.Model(user).Update("traffic_balance", 1000).Error)
+	require.NoError(t, service.SyncTrafficBalanceRules(user.ID))
+	saved, err = service.GetRuleByID(expired.ID)
+	require.NoError(t, err)
+	require.False(t, saved.Enabled)
+	require.Equal(t, RuleDisabledExpired, saved.DisabledReason)
+}
+
+func TestApplyRuleSchedulesPortConflict(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	service := NewRuleService(db, nil)
+	user := createTestUser(t, db, "schedule-port-user")
+	require.NoError(t, db.Model(user).Update("traffic_balance", 1000).Error)
+	node := createTestNode(t, db, "schedule-port-node")
+
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	window := createBillingRule(t, db, user.ID, node.ID, 9701)
+	require.NoError(t, db.Model(window).Updates(map[string]interface{}{"enabled": false, "disabled_reason": RuleDisabledOutsideWindow, "schedule_windows": models.StringSlice{"daily 12:00-13:00"}}).Error)
+	// 规则禁用期间同一端口被其他规则占用
+	other := createBillingRule(t, db, user.ID, node.ID, 9701)
+
+	result, err := service.ApplyRuleSchedules(now)
+	require.NoError(t, err)
+	require.Empty(t, result.Enabled)
+	saved, err := service.GetRuleByID(window.ID)
+	require.NoError(t, err)
+	require.False(t, saved.Enabled)
+	require.Equal(t, RuleDisabledPortConflict, saved.DisabledReason)
+
+	// 离开生效时段时改回生效时间原因
+	result, err = service.ApplyRuleSchedules(now.Add(2 * time.Hour))
+	require.NoError(t, err)
+	require.Empty(t, result.Disabled)
+	saved, err = service.GetRuleByID(window.ID)
+	require.NoError(t, err)
+	require.Equal(t, RuleDisabledOutsideWindow, saved.DisabledReason)
+
+	// 端口空闲后下一次检查自动恢复
+	require.NoError(t, db.Model(other).Update("listen_port", 9702).Error)
+	result, err = service.ApplyRuleSchedules(now.Add(24 * time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, []uint{window.ID}, result.Enabled)
+	saved, err = service.GetRuleByID(window.ID)
+	require.NoError(t, err)
+	require.True(t, saved.Enabled)
+	require.Empty(t, saved.DisabledReason)
+}
@@ -209,3 +209,51 @@ func TestTargets(t *testing.T) {
 	require.Empty(t, allTargets)
 
 }
+
+func TestCreateRuleWithTargetsKeepsDisabled(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	service := NewRuleService(db, nil)
+	user := createTestUser(t, db, "rule-disabled-user")
+	node := createTestNode(t, db, "rule-disabled-node")
+
+	rule := &models.ForwardingRule{
+		NodeID:         node.ID,
+		UserID:         user.ID,
+		Name:           "disabled",
+		Protocol:       "tcp",
+		Mode:           "direct",
+		ListenPort:     8401,
+		DisabledReason: RuleDisabledBalanceExhausted,
+	}
+	require.NoError(t, service.CreateRuleWithTargets(rule, []models.Target{{Host: "10.0.0.1", Port: 80, Weight: 1, Enabled: true}}))
+
+	stored, err := service.GetRuleByID(rule.ID)
+	require.NoError(t, err)
+	require.False(t, stored.Enabled)
+	require.Equal(t, RuleDisabledBalanceExhausted, stored.DisabledReason)
+}
+
+func TestCreateRulesWithTargetsKeepsDisabled(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	service := NewRuleService(db, nil)
+	user := createTestUser(t, db, "rules-disabled-user")
+	node := createTestNode(t, db, "rules-disabled-node")
+
+	rules := []*models.ForwardingRule{
+		{NodeID: node.ID, UserID: user.ID, Name: "enabled", Protocol: "tcp", Mode: "direct", ListenPort: 8501, Enabled: true},
+		{NodeID: node.ID, UserID: user.ID, Name: "disabled", Protocol: "tcp", Mode: "direct", ListenPort: 8502},
+	}
+	target := []models.Target{{Host: "10.0.0.1", Port: 80, Weight: 1, Enabled: true}}
+	require.NoError(t, service.CreateRulesWithTargets(rules, [][]models.Target{target, target}))
+
+	stored, err := service.GetRuleByID(rules[0].ID)
+	require.NoError(t, err)
+	require.True(t, stored.Enabled)
+	stored, err = service.GetRuleByID(rules[1].ID)
+	require.NoError(t, err)
+	require.False(t, stored.Enabled)
+}
@@ -0,0 +1,139 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"bakaray/internal/logger"
+	"bakaray/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ScheduledJob 定时任务
+type ScheduledJob struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context) error
+}
+
+// Scheduler 进程内定时任务调度器。每次执行前通过数据库租约抢占任务，
+// 多个面板副本同时运行时同一任务同一时刻只会有一个副本执行。
+type Scheduler struct {
+	db     *gorm.DB
+	holder string
+	jobs   []ScheduledJob
+	wg     sync.WaitGroup
+}
+
+// NewScheduler 创建定时任务调度器
+func NewScheduler(db *gorm.DB) *Scheduler {
+	return &Scheduler{
+		db:     db,
+		holder: newLeaseHolderID(),
+	}
+}
+
+// Register 注册定时任务
+func (s *Scheduler) Register(name string, interval time.Duration, run func(ctx context.Context) error) {
+	s.jobs = append(s.jobs, ScheduledJob{Name: name, Interval: interval, Run: run})
+}
+
+// Holder 返回当前实例的租约持有者标识
+func (s *Scheduler) Holder() string {
+	return s.holder
+}
+
+// Start 启动所有已注册任务，ctx 取消后退出
+func (s *Scheduler) Start(ctx context.Context) {
+	for _, job := range s.jobs {
+		s.wg.Add(1)
+		go s.loop(ctx, job)
+	}
+}
+
+// Wait 等待所有任务退出并释放租约，在 Start 的 ctx 取消后调用
+func (s *Scheduler) Wait() {
+	s.wg.Wait()
+}
+
+func (s *Scheduler) loop(ctx context.Context, job ScheduledJob) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.release(job.Name)
+			return
+		case <-ticker.C:
+			if _, err := s.RunOnce(ctx, job); err != nil {
+				logger.Warn("Scheduler: job failed", "job", job.Name, "error", err)
+			}
+		}
+	}
+}
+
+// RunOnce 抢占租约后执行一次任务，未抢到租约时返回 false
+func (s *Scheduler) RunOnce(ctx context.Context, job ScheduledJob) (bool, error) {
+	acquired, err := s.TryAcquire(job.Name, leaseTTL(job.Interval))
+	if err != nil {
+		return false, err
+	}
+	if !acquired {
+		return false, nil
+	}
+	return true, job.Run(ctx)
+}
+
+// TryAcquire 尝试获取或续期指定名称的租约
+func (s *Scheduler) TryAcquire(name string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+
+	result := s.db.Model(&models.SchedulerLease{}).
+		Where("name = ? AND (holder = ? OR expires_at < ?)", name, s.holder, now).
+		Updates(map[string]interface{}{
+			"holder":     s.holder,
+			"expires_at": expiresAt,
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected > 0 {
+		return true, nil
+	}
+
+	result = s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.SchedulerLease{
+		Name:      name,
+		Holder:    s.holder,
+		ExpiresAt: expiresAt,
+	})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (s *Scheduler) release(name string) {
+	_ = s.db.Where("name = ? AND holder = ?", name, s.holder).Delete(&models.SchedulerLease{}).Error
+}
+
+// leaseTTL 租约有效期为三个执行周期，持有者宕机后其他副本最多等待三个周期接管
+func leaseTTL(interval time.Duration) time.Duration {
+	return 3 * interval
+}
+
+func newLeaseHolderID() string {
+	hostname, _ := os.Hostname()
+	buf := make([]byte, 4)
+	_, _ = rand.Read(buf)
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(buf))
+}
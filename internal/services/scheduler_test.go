@@ -0,0 +1,92 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedulerLease(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	first := NewScheduler(db)
+	second := NewScheduler(db)
+	require.NotEqual(t, first.Holder(), second.Holder())
+
+	acquired, err := first.TryAcquire("job", time.Minute)
+	require.NoError(t, err)
+	require.True(t, acquired)
+
+	t.Run("其他副本无法抢占未过期租约", func(t *testing.T) {
+		acquired, err := second.TryAcquire("job", time.Minute)
+		require.NoError(t, err)
+		require.False(t, acquired)
+	})
+
+	t.Run("持有者可以续期", func(t *testing.T) {
+		acquired, err := first.TryAcquire("job", time.Minute)
+		require.NoError(t, err)
+		require.True(t, acquired)
+	})
+
+	t.Run("租约过期后可被接管", func(t *testing.T) {
+		acquired, err := first.TryAcquire("short", -time.Second)
+		require.NoError(t, err)
+		require.True(t, acquired)
+
+		acquired, err = second.TryAcquire("short", time.Minute)
+		require.NoError(t, err)
+		require.True(t, acquired)
+	})
+}
+
+func TestSchedulerRunOnce(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	first := NewScheduler(db)
+	second := NewScheduler(db)
+
+	runs := 0
+	job := ScheduledJob{
+		Name:     "count",
+		Interval: time.Minute,
+		Run: func(context.Context) error {
+			runs++
+			return nil
+		},
+	}
+
+	ran, err := first.RunOnce(context.Background(), job)
+	require.NoError(t, err)
+	require.True(t, ran)
+
+	ran, err = second.RunOnce(context.Background(), job)
+	require.NoError(t, err)
+	require.False(t, ran)
+	require.Equal(t, 1, runs)
+}
+
+func TestSchedulerWaitReleasesLeases(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	first := NewScheduler(db)
+	first.Register("job", time.Hour, func(context.Context) error { return nil })
+	acquired, err := first.TryAcquire("job", time.Hour)
+	require.NoError(t, err)
+	require.True(t, acquired)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first.Start(ctx)
+	cancel()
+	first.Wait()
+
+	// 退出后租约已释放，其他副本可以立即接管
+	acquired, err = NewScheduler(db).TryAcquire("job", time.Hour)
+	require.NoError(t, err)
+	require.True(t, acquired)
+}
@@ -32,7 +32,6 @@ func (s *SiteConfigService) GetOrCreate() (*models.SiteConfig, error) {
 	site := models.SiteConfig{
 		SiteName:           cfg.Site.Name,
 		SiteDomain:         cfg.Site.Domain,
-		NodeSecret:         cfg.Site.NodeSecret,
 		NodeReportInterval: cfg.Site.NodeReportInterval,
 	}
 	if site.SiteName == "" {
@@ -57,6 +56,11 @@ func (s *SiteConfigService) Update(updates map[string]any) (*models.SiteConfig,
 	if err := s.db.Model(site).Updates(updates).Error; err != nil {
 		return nil, err
 	}
+	if _, ok := updates["node_report_interval"]; ok {
+		if err := bumpAllConfigRevisions(s.db); err != nil {
+			return nil, err
+		}
+	}
 
 	if err := s.db.First(site, site.ID).Error; err != nil {
 		return nil, err
@@ -0,0 +1,394 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"bakaray/internal/models"
+
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	StateBackendAuto     = "auto"
+	StateBackendRedis    = "redis"
+	StateBackendDatabase = "database"
+	StateBackendMemory   = "memory"
+
+	// StateStorePruneInterval 清理过期状态的周期
+	StateStorePruneInterval = 10 * time.Minute
+
+	// nodeStateTTL 节点探针与诊断缓存有效期
+	nodeStateTTL = 5 * time.Minute
+	// trafficBaselineTTL 节点流量计数基线有效期
+	trafficBaselineTTL = 7 * 24 * time.Hour
+)
+
+var (
+	ErrStateNotFound       = errors.New("state not found")
+	ErrUnknownStateBackend = errors.New("unknown state backend")
+)
+
+// StateStore 运行时状态存储：探针/诊断缓存、流量计数基线、nonce 与订单锁等。
+// ttl 为 0 表示不过期。
+type StateStore interface {
+	// Name 返回存储后端名称
+	Name() string
+	// Get 读取键值，键不存在或已过期时 ok 为 false
+	Get(ctx context.Context, key string) (value []byte, ok bool, err error)
+	// Set 写入键值
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// SetNX 键不存在时写入，返回是否写入成功
+	SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+	// Delete 删除键
+	Delete(ctx context.Context, key string) error
+	// HGetAll 读取哈希的全部字段
+	HGetAll(ctx context.Context, key string) (map[string]string, error)
+	// HSet 合并写入哈希字段并刷新过期时间
+	HSet(ctx context.Context, key string, fields map[string]string, ttl time.Duration) error
+	// PruneExpired 清理已过期的键
+	PruneExpired(ctx context.Context) error
+}
+
+// NewStateStore 按配置创建状态存储。auto 在 Redis 可用时使用 Redis，否则使用数据库，
+// 以便单机 SQLite 部署在重启后仍保留流量计数基线。
+func NewStateStore(backend string, db *gorm.DB, client *redis.Client) (StateStore, error) {
+	switch strings.ToLower(strings.TrimSpace(backend)) {
+	case "", StateBackendAuto:
+		if client != nil {
+			return NewRedisStateStore(client), nil
+		}
+		return NewDatabaseStateStore(db), nil
+	case StateBackendRedis:
+		if client == nil {
+			return nil, errors.New("state backend redis requires a redis connection")
+		}
+		return NewRedisStateStore(client), nil
+	case StateBackendDatabase, "sql":
+		return NewDatabaseStateStore(db), nil
+	case StateBackendMemory:
+		return NewMemoryStateStore(), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownStateBackend, backend)
+	}
+}
+
+// --- Redis ---
+
+// RedisStateStore 基于 Redis 的状态存储，多实例部署时共享
+type RedisStateStore struct {
+	client *redis.Client
+}
+
+// NewRedisStateStore 创建 Redis 状态存储
+func NewRedisStateStore(client *redis.Client) *RedisStateStore {
+	return &RedisStateStore{client: client}
+}
+
+func (s *RedisStateStore) Name() string { return StateBackendRedis }
+
+func (s *RedisStateStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	data, err := s.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+func (s *RedisStateStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return s.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (s *RedisStateStore) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	return s.client.SetNX(ctx, key, value, ttl).Result()
+}
+
+func (s *RedisStateStore) Delete(ctx context.Context, key string) error {
+	return s.client.Del(ctx, key).Err()
+}
+
+func (s *RedisStateStore) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	return s.client.HGetAll(ctx, key).Result()
+}
+
+func (s *RedisStateStore) HSet(ctx context.Context, key string, fields map[string]string, ttl time.Duration) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	pipe := s.client.TxPipeline()
+	pipe.HSet(ctx, key, fields)
+	if ttl > 0 {
+		pipe.Expire(ctx, key, ttl)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// PruneExpired Redis 自行处理过期
+func (s *RedisStateStore) PruneExpired(ctx context.Context) error { return nil }
+
+// --- 数据库 ---
+
+// DatabaseStateStore 基于数据库表的状态存储，适用于没有 Redis 的单机部署
+type DatabaseStateStore struct {
+	db *gorm.DB
+}
+
+// NewDatabaseStateStore 创建数据库状态存储
+func NewDatabaseStateStore(db *gorm.DB) *DatabaseStateStore {
+	return &DatabaseStateStore{db: db}
+}
+
+func (s *DatabaseStateStore) Name() string { return StateBackendDatabase }
+
+func (s *DatabaseStateStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	entry, err := s.load(s.db.WithContext(ctx), key)
+	if err != nil || entry == nil {
+		return nil, false, err
+	}
+	return entry.Value, true, nil
+}
+
+func (s *DatabaseStateStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return s.upsert(s.db.WithContext(ctx), key, value, ttl)
+}
+
+func (s *DatabaseStateStore) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	created := false
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("state_key = ? AND expires_at IS NOT NULL AND expires_at <= ?", key, time.Now().UTC()).
+			Delete(&models.StateEntry{}).Error; err != nil {
+			return err
+		}
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.StateEntry{
+			Key:       key,
+			Value:     value,
+			ExpiresAt: stateExpiry(ttl),
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		created = result.RowsAffected == 1
+		return nil
+	})
+	return created, err
+}
+
+func (s *DatabaseStateStore) Delete(ctx context.Context, key string) error {
+	return s.db.WithContext(ctx).Where("state_key = ?", key).Delete(&models.StateEntry{}).Error
+}
+
+func (s *DatabaseStateStore) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	entry, err := s.load(s.db.WithContext(ctx), key)
+	if err != nil {
+		return nil, err
+	}
+	return decodeStateHash(entry)
+}
+
+func (s *DatabaseStateStore) HSet(ctx context.Context, key string, fields map[string]string, ttl time.Duration) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		entry, err := s.load(tx, key)
+		if err != nil {
+			return err
+		}
+		hash, err := decodeStateHash(entry)
+		if err != nil {
+			return err
+		}
+		for field, value := range fields {
+			hash[field] = value
+		}
+		data, err := json.Marshal(hash)
+		if err != nil {
+			return err
+		}
+		return s.upsert(tx, key, data, ttl)
+	})
+}
+
+func (s *DatabaseStateStore) PruneExpired(ctx context.Context) error {
+	return s.db.WithContext(ctx).
+		Where("expires_at IS NOT NULL AND expires_at <= ?", time.Now().UTC()).
+		Delete(&models.StateEntry{}).Error
+}
+
+// load 读取未过期的状态，不存在时返回 nil
+func (s *DatabaseStateStore) load(db *gorm.DB, key string) (*models.StateEntry, error) {
+	var entries []models.StateEntry
+	if err := db.Where("state_key = ?", key).Limit(1).Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	entry := &entries[0]
+	if entry.ExpiresAt != nil && !time.Now().Before(*entry.ExpiresAt) {
+		return nil, nil
+	}
+	return entry, nil
+}
+
+func (s *DatabaseStateStore) upsert(db *gorm.DB, key string, value []byte, ttl time.Duration) error {
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "state_key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"value", "expires_at", "updated_at"}),
+	}).Create(&models.StateEntry{
+		Key:       key,
+		Value:     value,
+		ExpiresAt: stateExpiry(ttl),
+	}).Error
+}
+
+func stateExpiry(ttl time.Duration) *time.Time {
+	if ttl <= 0 {
+		return nil
+	}
+	expiresAt := time.Now().UTC().Add(ttl)
+	return &expiresAt
+}
+
+func decodeStateHash(entry *models.StateEntry) (map[string]string, error) {
+	hash := make(map[string]string)
+	if entry == nil || len(entry.Value) == 0 {
+		return hash, nil
+	}
+	if err := json.Unmarshal(entry.Value, &hash); err != nil {
+		return nil, err
+	}
+	return hash, nil
+}
+
+// --- 进程内 ---
+
+// MemoryStateStore 进程内状态存储，重启后丢失，仅适用于开发和测试
+type MemoryStateStore struct {
+	mu      sync.Mutex
+	entries map[string]*memoryStateEntry
+}
+
+type memoryStateEntry struct {
+	value     []byte
+	hash      map[string]string
+	expiresAt time.Time
+}
+
+func (e *memoryStateEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+// NewMemoryStateStore 创建进程内状态存储
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{entries: make(map[string]*memoryStateEntry)}
+}
+
+func (s *MemoryStateStore) Name() string { return StateBackendMemory }
+
+func (s *MemoryStateStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := s.live(key)
+	if entry == nil || entry.hash != nil {
+		return nil, false, nil
+	}
+	return append([]byte(nil), entry.value...), true, nil
+}
+
+func (s *MemoryStateStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = &memoryStateEntry{value: append([]byte(nil), value...), expiresAt: memoryExpiry(ttl)}
+	return nil
+}
+
+func (s *MemoryStateStore) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.live(key) != nil {
+		return false, nil
+	}
+	s.entries[key] = &memoryStateEntry{value: append([]byte(nil), value...), expiresAt: memoryExpiry(ttl)}
+	return true, nil
+}
+
+func (s *MemoryStateStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *MemoryStateStore) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hash := make(map[string]string)
+	if entry := s.live(key); entry != nil {
+		for field, value := range entry.hash {
+			hash[field] = value
+		}
+	}
+	return hash, nil
+}
+
+func (s *MemoryStateStore) HSet(ctx context.Context, key string, fields map[string]string, ttl time.Duration) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := s.live(key)
+	if entry == nil || entry.hash == nil {
+		entry = &memoryStateEntry{hash: make(map[string]string)}
+		s.entries[key] = entry
+	}
+	for field, value := range fields {
+		entry.hash[field] = value
+	}
+	entry.expiresAt = memoryExpiry(ttl)
+	return nil
+}
+
+func (s *MemoryStateStore) PruneExpired(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for key, entry := range s.entries {
+		if entry.expired(now) {
+			delete(s.entries, key)
+		}
+	}
+	return nil
+}
+
+// live 返回未过期的条目，调用方需持有锁
+func (s *MemoryStateStore) live(key string) *memoryStateEntry {
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	if entry.expired(time.Now()) {
+		delete(s.entries, key)
+		return nil
+	}
+	return entry
+}
+
+func memoryExpiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
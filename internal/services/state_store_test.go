@@ -0,0 +1,141 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"bakaray/internal/models"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateStores(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	stores := []StateStore{NewMemoryStateStore(), NewDatabaseStateStore(db)}
+	for _, store := range stores {
+		store := store
+		t.Run(store.Name(), func(t *testing.T) {
+			ctx := context.Background()
+
+			_, ok, err := store.Get(ctx, "missing")
+			require.NoError(t, err)
+			require.False(t, ok)
+
+			require.NoError(t, store.Set(ctx, "key", []byte("v1"), 0))
+			require.NoError(t, store.Set(ctx, "key", []byte("v2"), 0))
+			value, ok, err := store.Get(ctx, "key")
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, "v2", string(value))
+
+			created, err := store.SetNX(ctx, "lock", []byte("1"), time.Minute)
+			require.NoError(t, err)
+			require.True(t, created)
+			created, err = store.SetNX(ctx, "lock", []byte("1"), time.Minute)
+			require.NoError(t, err)
+			require.False(t, created)
+			require.NoError(t, store.Delete(ctx, "lock"))
+			created, err = store.SetNX(ctx, "lock", []byte("1"), time.Minute)
+			require.NoError(t, err)
+			require.True(t, created)
+
+			// 已过期的键视为不存在，SetNX 可以重新获取
+			require.NoError(t, store.Set(ctx, "short", []byte("x"), time.Millisecond))
+			time.Sleep(5 * time.Millisecond)
+			_, ok, err = store.Get(ctx, "short")
+			require.NoError(t, err)
+			require.False(t, ok)
+			created, err = store.SetNX(ctx, "short", []byte("y"), time.Minute)
+			require.NoError(t, err)
+			require.True(t, created)
+
+			require.NoError(t, store.HSet(ctx, "hash", map[string]string{"a": "1", "b": "2"}, time.Hour))
+			require.NoError(t, store.HSet(ctx, "hash", map[string]string{"b": "3"}, time.Hour))
+			hash, err := store.HGetAll(ctx, "hash")
+			require.NoError(t, err)
+			require.Equal(t, map[string]string{"a": "1", "b": "3"}, hash)
+
+			require.NoError(t, store.Set(ctx, "expired", []byte("x"), time.Millisecond))
+			time.Sleep(5 * time.Millisecond)
+			require.NoError(t, store.PruneExpired(ctx))
+		})
+	}
+
+	t.Run("数据库存储清理过期记录", func(t *testing.T) {
+		var count int64
+		require.NoError(t, db.Model(&models.StateEntry{}).Where("state_key = ?", "expired").Count(&count).Error)
+		require.Zero(t, count)
+	})
+}
+
+func TestNewStateStore(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	store, err := NewStateStore("", db, nil)
+	require.NoError(t, err)
+	require.Equal(t, StateBackendDatabase, store.Name())
+
+	store, err = NewStateStore("memory", db, nil)
+	require.NoError(t, err)
+	require.Equal(t, StateBackendMemory, store.Name())
+
+	_, err = NewStateStore("redis", db, nil)
+	require.Error(t, err)
+
+	_, err = NewStateStore("etcd", db, nil)
+	require.ErrorIs(t, err, ErrUnknownStateBackend)
+}
+
+func TestTrafficDeltasSurviveRestart(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	node := createTestNode(t, db, "StateNode")
+
+	first := NewNodeService(db, NewDatabaseStateStore(db))
+	deltas, err := first.ComputeTrafficDeltas(node.ID, map[string]int64{"rule_1_in": 1000, "rule_1_out": 2000})
+	require.NoError(t, err)
+	require.Equal(t, TrafficDelta{BytesIn: 1000, BytesOut: 2000}, deltas[1])
+
+	// 重建服务模拟进程重启，基线保存在数据库中
+	restarted := NewNodeService(db, NewDatabaseStateStore(db))
+	deltas, err = restarted.ComputeTrafficDeltas(node.ID, map[string]int64{"rule_1_in": 1500, "rule_1_out": 2000})
+	require.NoError(t, err)
+	require.Len(t, deltas, 1)
+	require.Equal(t, TrafficDelta{BytesIn: 500}, deltas[1])
+
+	// 计数器归零（节点重启）时按当前值计
+	deltas, err = restarted.ComputeTrafficDeltas(node.ID, map[string]int64{"rule_1_in": 100, "rule_1_out": 50})
+	require.NoError(t, err)
+	require.Equal(t, TrafficDelta{BytesIn: 100, BytesOut: 50}, deltas[1])
+
+	// 端口范围规则按端口分别上报时累加到规则
+	deltas, err = restarted.ComputeTrafficDeltas(node.ID, map[string]int64{"rule_2_20000_in": 300, "rule_2_20001_in": 200, "rule_2_20001_out": 70, "rule_2_x_in": 999})
+	require.NoError(t, err)
+	require.Equal(t, TrafficDelta{BytesIn: 500, BytesOut: 70}, deltas[2])
+}
+
+func TestCompleteOrderWithLockWithoutRedis(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	user := createTestUser(t, db, "lock-user")
+	order := &models.Order{UserID: user.ID, Amount: 500, Status: "pending", TradeNo: "lock-trade"}
+	require.NoError(t, db.Create(order).Error)
+
+	service := NewPaymentService(db, NewDatabaseStateStore(db))
+	require.NoError(t, service.CompleteOrderWithLock(order.TradeNo, user.ID, 0))
+	require.NoError(t, service.CompleteOrderWithLock(order.TradeNo, user.ID, 0))
+
+	var updated models.User
+	require.NoError(t, db.First(&updated, user.ID).Error)
+	require.Equal(t, user.Balance+500, updated.Balance)
+
+	var lockCount int64
+	require.NoError(t, db.Model(&models.StateEntry{}).Where("state_key = ?", "order:lock:"+order.TradeNo).Count(&lockCount).Error)
+	require.Zero(t, lockCount)
+}
@@ -0,0 +1,228 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"bakaray/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 健康检查方式
+const (
+	HealthCheckTCP = "tcp" // 建立 TCP 连接，成功即健康
+	HealthCheckUDP = "udp" // 发送 UDP 探测包，超时内收到响应即健康，仅用于 UDP 规则
+)
+
+// 健康检查参数的默认值与取值范围
+const (
+	DefaultHealthCheckInterval = 10 // 秒
+	DefaultHealthCheckTimeout  = 3  // 秒
+	DefaultHealthCheckRise     = 2
+	DefaultHealthCheckFall     = 3
+	MinHealthCheckInterval     = 2
+	MaxHealthCheckInterval     = 300
+	MaxHealthCheckThreshold    = 10
+)
+
+// 目标健康状态
+const (
+	TargetHealthHealthy   = "healthy"   // 所有上报节点都判定健康
+	TargetHealthUnhealthy = "unhealthy" // 所有上报节点都判定不健康
+	TargetHealthDegraded  = "degraded"  // 部分节点判定不健康
+	TargetHealthUnknown   = "unknown"   // 未开启健康检查或没有近期上报
+)
+
+// minTargetHealthStale 健康上报的最短有效期，实际有效期取检查间隔的 3 倍与该值的较大者
+const minTargetHealthStale = 30 * time.Second
+
+var ErrInvalidHealthCheck = errors.New("无效的健康检查配置")
+
+// NormalizeHealthCheck 校验健康检查设置并补齐默认值，Type 为空时关闭健康检查
+func NormalizeHealthCheck(hc models.HealthCheck, protocol string) (models.HealthCheck, error) {
+	hc.Type = strings.ToLower(strings.TrimSpace(hc.Type))
+	switch hc.Type {
+	case "":
+		return models.HealthCheck{}, nil
+	case HealthCheckTCP:
+	case HealthCheckUDP:
+		if DirectProtocolNetwork(protocol) != "udp" {
+			return hc, fmt.Errorf("%w: udp 检查仅适用于 UDP 规则", ErrInvalidHealthCheck)
+		}
+	default:
+		return hc, fmt.Errorf("%w: 检查方式仅支持 tcp 或 udp", ErrInvalidHealthCheck)
+	}
+
+	if hc.Interval == 0 {
+		hc.Interval = DefaultHealthCheckInterval
+	}
+	if hc.Timeout == 0 {
+		hc.Timeout = min(DefaultHealthCheckTimeout, hc.Interval-1)
+	}
+	if hc.Rise == 0 {
+		hc.Rise = DefaultHealthCheckRise
+	}
+	if hc.Fall == 0 {
+		hc.Fall = DefaultHealthCheckFall
+	}
+
+	if hc.Interval < MinHealthCheckInterval || hc.Interval > MaxHealthCheckInterval {
+		return hc, fmt.Errorf("%w: 检查间隔必须在 %d-%d 秒之间", ErrInvalidHealthCheck, MinHealthCheckInterval, MaxHealthCheckInterval)
+	}
+	if hc.Timeout < 1 || hc.Timeout >= hc.Interval {
+		return hc, fmt.Errorf("%w: 超时必须至少 1 秒且小于检查间隔", ErrInvalidHealthCheck)
+	}
+	if hc.Rise < 1 || hc.Rise > MaxHealthCheckThreshold || hc.Fall < 1 || hc.Fall > MaxHealthCheckThreshold {
+		return hc, fmt.Errorf("%w: 判定次数必须在 1-%d 之间", ErrInvalidHealthCheck, MaxHealthCheckThreshold)
+	}
+	return hc, nil
+}
+
+// TargetHealthReport 节点心跳上报的单个目标检查结果
+type TargetHealthReport struct {
+	RuleID    uint   `json:"rule_id"`
+	TargetID  uint   `json:"target_id"`
+	Healthy   bool   `json:"healthy"` // 按 rise/fall 判定后的状态
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error"`
+	CheckedAt int64  `json:"checked_at"` // 最近一次检查的 Unix 时间戳（秒），为 0 时使用接收时间
+}
+
+// RecordTargetHealth 保存节点上报的目标健康状态。
+// 只接受部署在该节点上的规则的目标，规则或目标已删除的上报直接忽略，返回保存的条数。
+func (s *RuleService) RecordTargetHealth(node *models.Node, reports []TargetHealthReport, now time.Time) (int, error) {
+	if len(reports) == 0 {
+		return 0, nil
+	}
+
+	targetIDs := make([]uint, 0, len(reports))
+	for _, r := range reports {
+		targetIDs = append(targetIDs, r.TargetID)
+	}
+	var targets []models.Target
+	if err := s.db.Where("id IN ?", uniqueNodeIDs(targetIDs)).Find(&targets).Error; err != nil {
+		return 0, err
+	}
+	targetRules := make(map[uint]uint, len(targets))
+	ruleIDs := make([]uint, 0, len(targets))
+	for _, t := range targets {
+		targetRules[t.ID] = t.RuleID
+		ruleIDs = append(ruleIDs, t.RuleID)
+	}
+
+	var rules []models.ForwardingRule
+	if err := s.db.Where("id IN ?", uniqueNodeIDs(ruleIDs)).Find(&rules).Error; err != nil {
+		return 0, err
+	}
+	onNode := make(map[uint]bool, len(rules))
+	for i := range rules {
+		onNode[rules[i].ID] = ruleEntersAt(&rules[i], node) || (rules[i].TunnelEnabled && rules[i].ExitNodeID == node.ID)
+	}
+
+	saved := 0
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		for _, r := range reports {
+			ruleID, ok := targetRules[r.TargetID]
+			if !ok || ruleID != r.RuleID || !onNode[ruleID] {
+				continue
+			}
+			checkedAt := now.UTC()
+			if r.CheckedAt > 0 && r.CheckedAt <= now.Unix() {
+				checkedAt = time.Unix(r.CheckedAt, 0).UTC()
+			}
+			message := r.Error
+			if len(message) > 255 {
+				message = message[:255]
+			}
+			row := models.TargetHealth{
+				TargetID:  r.TargetID,
+				NodeID:    node.ID,
+				RuleID:    ruleID,
+				Healthy:   r.Healthy,
+				LatencyMs: r.LatencyMs,
+				Error:     message,
+				CheckedAt: checkedAt,
+			}
+			if err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "target_id"}, {Name: "node_id"}},
+				DoUpdates: clause.AssignmentColumns([]string{"rule_id", "healthy", "latency_ms", "error", "checked_at"}),
+			}).Create(&row).Error; err != nil {
+				return err
+			}
+			saved++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return saved, nil
+}
+
+// TargetHealthView 目标及其汇总后的健康状态
+type TargetHealthView struct {
+	models.Target
+	Status     string                `json:"status"`      // healthy, unhealthy, degraded, unknown
+	InRotation bool                  `json:"in_rotation"` // 是否参与转发：目标已启用，且未因开启自动摘除而被判定不健康
+	Nodes      []models.TargetHealth `json:"nodes"`       // 各节点最近的检查结果（不含过期上报）
+}
+
+// RuleTargetHealth 汇总规则各目标在各节点上的健康状态，超过检查间隔 3 倍未更新的上报视为过期
+func (s *RuleService) RuleTargetHealth(rule *models.ForwardingRule, now time.Time) ([]TargetHealthView, error) {
+	targets, err := s.ListTargets(rule.ID, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []models.TargetHealth
+	if rule.HealthCheck.Type != "" {
+		stale := 3 * time.Duration(rule.HealthCheck.Interval) * time.Second
+		if stale < minTargetHealthStale {
+			stale = minTargetHealthStale
+		}
+		if err := s.db.Where("rule_id = ? AND checked_at >= ?", rule.ID, now.Add(-stale).UTC()).
+			Order("node_id asc").Find(&rows).Error; err != nil {
+			return nil, err
+		}
+	}
+	byTarget := make(map[uint][]models.TargetHealth)
+	for _, row := range rows {
+		byTarget[row.TargetID] = append(byTarget[row.TargetID], row)
+	}
+
+	views := make([]TargetHealthView, 0, len(targets))
+	for _, t := range targets {
+		nodes := byTarget[t.ID]
+		if nodes == nil {
+			nodes = []models.TargetHealth{}
+		}
+		view := TargetHealthView{Target: t, Status: aggregateTargetHealth(nodes), Nodes: nodes}
+		view.InRotation = t.Enabled && !(rule.HealthCheck.AutoRemove && view.Status == TargetHealthUnhealthy)
+		views = append(views, view)
+	}
+	return views, nil
+}
+
+func aggregateTargetHealth(nodes []models.TargetHealth) string {
+	if len(nodes) == 0 {
+		return TargetHealthUnknown
+	}
+	healthy := 0
+	for _, n := range nodes {
+		if n.Healthy {
+			healthy++
+		}
+	}
+	switch healthy {
+	case len(nodes):
+		return TargetHealthHealthy
+	case 0:
+		return TargetHealthUnhealthy
+	default:
+		return TargetHealthDegraded
+	}
+}
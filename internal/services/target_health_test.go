@@ -0,0 +1,154 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"bakaray/internal/models"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeHealthCheck(t *testing.T) {
+	t.Run("补齐默认值", func(t *testing.T) {
+		hc, err := NormalizeHealthCheck(models.HealthCheck{Type: " TCP ", AutoRemove: true}, "tcp")
+		require.NoError(t, err)
+		require.Equal(t, models.HealthCheck{
+			Type:       HealthCheckTCP,
+			Interval:   DefaultHealthCheckInterval,
+			Timeout:    DefaultHealthCheckTimeout,
+			Rise:       DefaultHealthCheckRise,
+			Fall:       DefaultHealthCheckFall,
+			AutoRemove: true,
+		}, hc)
+	})
+
+	t.Run("关闭时清空设置", func(t *testing.T) {
+		hc, err := NormalizeHealthCheck(models.HealthCheck{Interval: 30, AutoRemove: true}, "tcp")
+		require.NoError(t, err)
+		require.Equal(t, models.HealthCheck{}, hc)
+	})
+
+	t.Run("拒绝无效配置", func(t *testing.T) {
+		for _, tc := range []struct {
+			hc       models.HealthCheck
+			protocol string
+		}{
+			{hc: models.HealthCheck{Type: "http"}, protocol: "tcp"},
+			{hc: models.HealthCheck{Type: "udp"}, protocol: "tcp"},
+			{hc: models.HealthCheck{Type: "tcp", Interval: 1}, protocol: "tcp"},
+			{hc: models.HealthCheck{Type: "tcp", Interval: 5, Timeout: 5}, protocol: "tcp"},
+			{hc: models.HealthCheck{Type: "tcp", Rise: 11}, protocol: "tcp"},
+			{hc: models.HealthCheck{Type: "udp", Fall: -1}, protocol: "udp"},
+		} {
+			_, err := NormalizeHealthCheck(tc.hc, tc.protocol)
+			require.ErrorIs(t, err, ErrInvalidHealthCheck, "hc=%+v protocol=%s", tc.hc, tc.protocol)
+		}
+	})
+}
+
+func TestTargetHealth(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	service := NewRuleService(db, nil)
+	user := createTestUser(t, db, "health-user")
+	entry := createTestNode(t, db, "health-entry")
+	exit := createTestNode(t, db, "health-exit")
+	other := createTestNode(t, db, "health-other")
+
+	rule := createBillingRule(t, db, user.ID, entry.ID, 9401)
+	require.NoError(t, db.Model(rule).Updates(map[string]interface{}{
+		"tunnel_enabled":           true,
+		"exit_node_id":             exit.ID,
+		"health_check_type":        HealthCheckTCP,
+		"health_check_interval":    10,
+		"health_check_auto_remove": true,
+	}).Error)
+	require.NoError(t, service.UpdateRuleWithTargets(rule.ID, nil, []models.Target{
+		{Host: "10.0.0.1", Port: 80, Weight: 1, Enabled: true},
+		{Host: "10.0.0.2", Port: 80, Weight: 1, Enabled: true},
+		{Host: "10.0.0.3", Port: 80, Weight: 1},
+	}))
+	require.NoError(t, db.Model(&models.Target{}).Where("rule_id = ? AND host = ?", rule.ID, "10.0.0.3").Update("enabled", false).Error)
+	rule, err := service.GetRuleByID(rule.ID)
+	require.NoError(t, err)
+	targets, err := service.ListTargets(rule.ID, false)
+	require.NoError(t, err)
+	require.Len(t, targets, 3)
+
+	now := time.Now()
+	saved, err := service.RecordTargetHealth(entry, []TargetHealthReport{
+		{RuleID: rule.ID, TargetID: targets[0].ID, Healthy: true, LatencyMs: 12},
+		{RuleID: rule.ID, TargetID: targets[1].ID, Healthy: false, Error: "connection refused"},
+		{RuleID: rule.ID + 1, TargetID: targets[0].ID, Healthy: false},
+		{RuleID: rule.ID, TargetID: 9999, Healthy: false},
+	}, now)
+	require.NoError(t, err)
+	require.Equal(t, 2, saved)
+
+	saved, err = service.RecordTargetHealth(exit, []TargetHealthReport{
+		{RuleID: rule.ID, TargetID: targets[0].ID, Healthy: false},
+	}, now)
+	require.NoError(t, err)
+	require.Equal(t, 1, saved)
+
+	// 规则不在该节点上的上报被忽略
+	saved, err = service.RecordTargetHealth(other, []TargetHealthReport{
+		{RuleID: rule.ID, TargetID: targets[1].ID, Healthy: true},
+	}, now)
+	require.NoError(t, err)
+	require.Zero(t, saved)
+
+	// 同一节点再次上报时覆盖原记录
+	saved, err = service.RecordTargetHealth(entry, []TargetHealthReport{
+		{RuleID: rule.ID, TargetID: targets[1].ID, Healthy: false, Error: "timeout", CheckedAt: now.Unix()},
+	}, now)
+	require.NoError(t, err)
+	require.Equal(t, 1, saved)
+
+	views, err := service.RuleTargetHealth(rule, now)
+	require.NoError(t, err)
+	require.Len(t, views, 3)
+
+	require.Equal(t, TargetHealthDegraded, views[0].Status)
+	require.True(t, views[0].InRotation)
+	require.Len(t, views[0].Nodes, 2)
+
+	require.Equal(t, TargetHealthUnhealthy, views[1].Status)
+	require.False(t, views[1].InRotation)
+	require.Len(t, views[1].Nodes, 1)
+	require.Equal(t, "timeout", views[1].Nodes[0].Error)
+
+	require.Equal(t, TargetHealthUnknown, views[2].Status)
+	require.False(t, views[2].InRotation)
+
+	// 过期的上报不再计入
+	views, err = service.RuleTargetHealth(rule, now.Add(time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, TargetHealthUnknown, views[1].Status)
+	require.True(t, views[1].InRotation)
+
+	// 地址与端口不变的目标保留 ID 与健康状态，只更新权重；移除的目标清理健康状态
+	require.NoError(t, service.UpdateRuleWithTargets(rule.ID, map[string]interface{}{"name": "renamed"}, []models.Target{
+		{Host: "10.0.0.1", Port: 80, Weight: 5, Enabled: true},
+		{Host: "10.0.0.5", Port: 80, Weight: 1, Enabled: true},
+	}))
+	kept, err := service.ListTargets(rule.ID, false)
+	require.NoError(t, err)
+	require.Len(t, kept, 2)
+	require.Equal(t, targets[0].ID, kept[0].ID)
+	require.Equal(t, 5, kept[0].Weight)
+	require.Equal(t, "10.0.0.5", kept[1].Host)
+	var targetIDs []uint
+	require.NoError(t, db.Model(&models.TargetHealth{}).Where("rule_id = ?", rule.ID).Distinct().Pluck("target_id", &targetIDs).Error)
+	require.Equal(t, []uint{targets[0].ID}, targetIDs)
+
+	// 目标全部替换后清理旧的健康状态
+	require.NoError(t, service.UpdateRuleWithTargets(rule.ID, nil, []models.Target{
+		{Host: "10.0.0.4", Port: 80, Weight: 1, Enabled: true},
+	}))
+	var count int64
+	require.NoError(t, db.Model(&models.TargetHealth{}).Where("rule_id = ?", rule.ID).Count(&count).Error)
+	require.Zero(t, count)
+}
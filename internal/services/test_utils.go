@@ -28,12 +28,23 @@ func setupTestDB(t *testing.T) *gorm.DB {
 		&models.NodeAllowedGroup{},
 		&models.ForwardingRule{},
 		&models.Target{},
+		&models.TargetHealth{},
+		&models.DestinationPolicy{},
+		&models.DestinationViolation{},
 		&models.Package{},
 		&models.Order{},
 		&models.UserGroup{},
 		&models.NodeGroup{},
 		&models.PaymentConfig{},
 		&models.TrafficLog{},
+		&models.TrafficRollup{},
+		&models.NodeStatusEvent{},
+		&models.NodeProbeSample{},
+		&models.StateEntry{},
+		&models.NodeEnrollmentToken{},
+		&models.SchedulerLease{},
+		&models.ListenPortReservation{},
+		&models.SiteConfig{},
 	)
 	require.NoError(t, err)
 
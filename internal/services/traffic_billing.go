@@ -0,0 +1,276 @@
+package services
+
+import (
+	"math"
+	"time"
+
+	"bakaray/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// 规则被系统自动禁用的原因
+const (
+	RuleDisabledTrafficLimit     = "traffic_limit"     // 达到规则流量上限
+	RuleDisabledBalanceExhausted = "balance_exhausted" // 用户流量余额耗尽，购买流量后自动恢复
+)
+
+// TrafficRecordResult 一次心跳流量入账的结果
+type TrafficRecordResult struct {
+	Rules          int    // 入账的规则数
+	Billed         int64  // 本次从用户流量余额扣除的字节数合计
+	LimitDisabled  []uint // 因规则流量上限被禁用的规则
+	ExhaustedUsers []uint // 流量余额耗尽、规则被全部禁用的用户
+}
+
+// billingMultiplier 返回节点计费倍率，未设置或非法时按 1 计
+func billingMultiplier(multiplier float64) float64 {
+	if multiplier <= 0 || math.IsNaN(multiplier) || math.IsInf(multiplier, 0) {
+		return 1
+	}
+	return multiplier
+}
+
+// billedBytes 按倍率计算计费流量，不足 1 字节的部分向上取整
+func billedBytes(bytes int64, multiplier float64) int64 {
+	if bytes <= 0 {
+		return 0
+	}
+	return int64(math.Ceil(float64(bytes) * multiplier))
+}
+
+// ruleEntersAt 判断节点是否为规则的入口节点（出口节点上报的隧道流量不计费）
+func ruleEntersAt(rule *models.ForwardingRule, node *models.Node) bool {
+	if rule.NodeID == node.ID {
+		return true
+	}
+	return rule.Placement == RulePlacementAll && rule.NodeGroupID != 0 && rule.NodeGroupID == node.NodeGroupID
+}
+
+// RecordNodeTraffic 将节点上报的流量增量入账：累计规则已用流量、写入流量日志，
+// 并按入口节点倍率（站点开启时叠加出口节点倍率）扣除规则所属用户的流量余额。
+// 出口节点上报的隧道流量只记录不计费，避免同一份流量被入口和出口重复扣除。
+func (s *RuleService) RecordNodeTraffic(node *models.Node, deltas map[uint]TrafficDelta, at time.Time) (*TrafficRecordResult, error) {
+	result := &TrafficRecordResult{}
+
+	ids := make([]uint, 0, len(deltas))
+	for ruleID, d := range deltas {
+		if d.BytesIn+d.BytesOut > 0 {
+			ids = append(ids, ruleID)
+		}
+	}
+	if len(ids) == 0 {
+		return result, nil
+	}
+
+	var rules []models.ForwardingRule
+	if err := s.db.Where("id IN ?", ids).Order("id asc").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+
+	exitMultipliers, err := s.exitMultipliers(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	var firstErr error
+	userBilled := make(map[uint]int64)
+	var userOrder []uint
+	for i := range rules {
+		rule := &rules[i]
+		d := deltas[rule.ID]
+		total := d.BytesIn + d.BytesOut
+		if total > MaxTrafficLimit {
+			total = MaxTrafficLimit
+		}
+
+		disabled, err := s.UpdateTrafficUsedWithDisable(rule.ID, total)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if disabled {
+			result.LimitDisabled = append(result.LimitDisabled, rule.ID)
+		}
+
+		var billed int64
+		if ruleEntersAt(rule, node) {
+			multiplier := billingMultiplier(node.Multiplier)
+			if m, ok := exitMultipliers[rule.ExitNodeID]; ok && rule.TunnelEnabled {
+				multiplier *= m
+			}
+			billed = billedBytes(total, multiplier)
+		}
+
+		if err := s.CreateTrafficLog(&models.TrafficLog{
+			RuleID:    rule.ID,
+			NodeID:    node.ID,
+			UserID:    rule.UserID,
+			BytesIn:   d.BytesIn,
+			BytesOut:  d.BytesOut,
+			Billed:    billed,
+			Timestamp: at.UTC(),
+		}); err != nil && firstErr == nil {
+			firstErr = err
+		}
+
+		result.Rules++
+		if billed > 0 {
+			if _, ok := userBilled[rule.UserID]; !ok {
+				userOrder = append(userOrder, rule.UserID)
+			}
+			userBilled[rule.UserID] += billed
+		}
+	}
+
+	for _, userID := range userOrder {
+		exhausted, err := s.DebitTrafficBalance(userID, userBilled[userID])
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		result.Billed += userBilled[userID]
+		if exhausted {
+			result.ExhaustedUsers = append(result.ExhaustedUsers, userID)
+		}
+	}
+	return result, firstErr
+}
+
+// exitMultipliers 站点开启出口倍率计费时，返回隧道规则出口节点的倍率
+func (s *RuleService) exitMultipliers(rules []models.ForwardingRule) (map[uint]float64, error) {
+	var site models.SiteConfig
+	if err := s.db.Order("id asc").Limit(1).Find(&site).Error; err != nil {
+		return nil, err
+	}
+	if !site.BillExitMultiplier {
+		return nil, nil
+	}
+
+	var exitIDs []uint
+	for i := range rules {
+		if rules[i].TunnelEnabled && rules[i].ExitNodeID > 0 {
+			exitIDs = append(exitIDs, rules[i].ExitNodeID)
+		}
+	}
+	exitIDs = uniqueNodeIDs(exitIDs)
+	if len(exitIDs) == 0 {
+		return nil, nil
+	}
+
+	var nodes []models.Node
+	if err := s.db.Select("id", "multiplier").Where("id IN ?", exitIDs).Find(&nodes).Error; err != nil {
+		return nil, err
+	}
+	multipliers := make(map[uint]float64, len(nodes))
+	for _, n := range nodes {
+		multipliers[n.ID] = billingMultiplier(n.Multiplier)
+	}
+	return multipliers, nil
+}
+
+// DebitTrafficBalance 原子扣除用户流量余额（最低扣至 0），余额耗尽时禁用该用户的全部规则。
+// 返回本次是否因余额耗尽禁用了规则。
+func (s *RuleService) DebitTrafficBalance(userID uint, bytes int64) (exhausted bool, err error) {
+	if bytes <= 0 {
+		return false, nil
+	}
+	var nodeIDs []uint
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("id = ?", userID).
+			UpdateColumn("traffic_balance", gorm.Expr("CASE WHEN traffic_balance > ? THEN traffic_balance - ? ELSE 0 END", bytes, bytes)).Error; err != nil {
+			return err
+		}
+		var err error
+		nodeIDs, exhausted, err = applyTrafficBalance(tx, userID)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return exhausted, bumpConfigRevision(s.db, nodeIDs...)
+}
+
+// applyTrafficBalance 按用户当前流量余额同步其规则启用状态：
+// 余额耗尽时禁用全部已启用规则并标记原因；余额恢复时重新启用因余额耗尽被禁用的规则，
+// 不在生效时间内或监听端口已被占用的规则改为等待调度器启用。
+// 返回需要刷新配置的节点，以及本次是否因余额耗尽禁用了规则。
+func applyTrafficBalance(tx *gorm.DB, userID uint) (nodeIDs []uint, exhausted bool, err error) {
+	var balances []int64
+	if err := tx.Model(&models.User{}).Where("id = ?", userID).Pluck("traffic_balance", &balances).Error; err != nil {
+		return nil, false, err
+	}
+	if len(balances) == 0 {
+		return nil, false, nil
+	}
+
+	var rules []models.ForwardingRule
+	updates := map[string]interface{}{}
+	if balances[0] > 0 {
+		err = tx.Where("user_id = ? AND enabled = ? AND disabled_reason = ?", userID, false, RuleDisabledBalanceExhausted).Find(&rules).Error
+		updates["enabled"] = true
+		updates["disabled_reason"] = ""
+	} else {
+		err = tx.Where("user_id = ? AND enabled = ?", userID, true).Find(&rules).Error
+		updates["enabled"] = false
+		updates["disabled_reason"] = RuleDisabledBalanceExhausted
+	}
+	if err != nil || len(rules) == 0 {
+		return nil, false, err
+	}
+
+	now := time.Now()
+	ruleIDs := make([]uint, 0, len(rules))
+	for i := range rules {
+		if balances[0] > 0 {
+			reason := RuleScheduleReason(&rules[i], now)
+			if reason == "" {
+				// 余额耗尽期间端口可能已分配给其他规则
+				conflict, err := ruleListenConflict(tx, &rules[i])
+				if err != nil {
+					return nil, false, err
+				}
+				if conflict != nil {
+					reason = RuleDisabledPortConflict
+				}
+			}
+			if reason != "" {
+				if err := tx.Model(&models.ForwardingRule{}).Where("id = ?", rules[i].ID).Update("disabled_reason", reason).Error; err != nil {
+					return nil, false, err
+				}
+				continue
+			}
+			// 逐条启用，之后规则的端口检查能看到已恢复的规则
+			if err := tx.Model(&models.ForwardingRule{}).Where("id = ?", rules[i].ID).Updates(updates).Error; err != nil {
+				return nil, false, err
+			}
+		} else {
+			ruleIDs = append(ruleIDs, rules[i].ID)
+		}
+		nodeIDs = append(nodeIDs, ruleNodeIDs(tx, &rules[i])...)
+	}
+	if len(ruleIDs) == 0 {
+		return nodeIDs, false, nil
+	}
+	if err := tx.Model(&models.ForwardingRule{}).Where("id IN ?", ruleIDs).Updates(updates).Error; err != nil {
+		return nil, false, err
+	}
+	return nodeIDs, true, nil
+}
+
+// SyncTrafficBalanceRules 按用户流量余额同步规则启用状态（管理员直接调整流量余额后调用）
+func (s *RuleService) SyncTrafficBalanceRules(userID uint) error {
+	var nodeIDs []uint
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		nodeIDs, _, err = applyTrafficBalance(tx, userID)
+		return err
+	}); err != nil {
+		return err
+	}
+	return bumpConfigRevision(s.db, nodeIDs...)
+}
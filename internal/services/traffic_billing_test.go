@@ -0,0 +1,150 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"bakaray/internal/models"
+
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func createBillingRule(t *testing.T, db *gorm.DB, userID, nodeID uint, port int) *models.ForwardingRule {
+	t.Helper()
+	rule := &models.ForwardingRule{
+		NodeID:     nodeID,
+		UserID:     userID,
+		Name:       "billing",
+		Protocol:   "tcp",
+		Enabled:    true,
+		Mode:       "direct",
+		ListenPort: port,
+	}
+	require.NoError(t, db.Create(rule).Error)
+	return rule
+}
+
+func TestRecordNodeTraffic(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	service := NewRuleService(db, nil)
+	user := createTestUser(t, db, "billing-user")
+	require.NoError(t, db.Model(user).Update("traffic_balance", 10000).Error)
+
+	node := createTestNode(t, db, "billing-entry")
+	require.NoError(t, db.Model(node).Update("multiplier", 1.5).Error)
+	node.Multiplier = 1.5
+	exit := createTestNode(t, db, "billing-exit")
+	require.NoError(t, db.Model(exit).Update("multiplier", 2).Error)
+
+	rule := createBillingRule(t, db, user.ID, node.ID, 9001)
+	tunnel := createBillingRule(t, db, user.ID, node.ID, 9002)
+	require.NoError(t, db.Model(tunnel).Updates(map[string]interface{}{"tunnel_enabled": true, "exit_node_id": exit.ID}).Error)
+	other := createBillingRule(t, db, user.ID, node.ID, 9003)
+
+	balance := func() int64 {
+		var u models.User
+		require.NoError(t, db.First(&u, user.ID).Error)
+		return u.TrafficBalance
+	}
+
+	t.Run("按入口节点倍率扣除流量余额", func(t *testing.T) {
+		result, err := service.RecordNodeTraffic(node, map[uint]TrafficDelta{
+			rule.ID:   {BytesIn: 600, BytesOut: 400},
+			tunnel.ID: {BytesIn: 100},
+		}, time.Now())
+		require.NoError(t, err)
+		require.Equal(t, 2, result.Rules)
+		require.Equal(t, int64(1650), result.Billed)
+		require.Equal(t, int64(10000-1650), balance())
+
+		var logEntry models.TrafficLog
+		require.NoError(t, db.Where("rule_id = ?", rule.ID).First(&logEntry).Error)
+		require.Equal(t, int64(1500), logEntry.Billed)
+
+		stored, err := service.GetRuleByID(rule.ID)
+		require.NoError(t, err)
+		require.Equal(t, int64(1000), stored.TrafficUsed)
+	})
+
+	t.Run("开启后叠加出口节点倍率", func(t *testing.T) {
+		require.NoError(t, db.Create(&models.SiteConfig{SiteName: "test", BillExitMultiplier: true}).Error)
+		result, err := service.RecordNodeTraffic(node, map[uint]TrafficDelta{tunnel.ID: {BytesOut: 100}}, time.Now())
+		require.NoError(t, err)
+		require.Equal(t, int64(300), result.Billed)
+	})
+
+	t.Run("出口节点上报的流量不计费", func(t *testing.T) {
+		before := balance()
+		result, err := service.RecordNodeTraffic(exit, map[uint]TrafficDelta{tunnel.ID: {BytesOut: 100}}, time.Now())
+		require.NoError(t, err)
+		require.Equal(t, 1, result.Rules)
+		require.Zero(t, result.Billed)
+		require.Equal(t, before, balance())
+	})
+
+	t.Run("余额耗尽时禁用用户全部规则", func(t *testing.T) {
+		require.NoError(t, db.Model(other).Update("enabled", false).Error)
+		revision := node.ConfigRevision
+
+		result, err := service.RecordNodeTraffic(node, map[uint]TrafficDelta{rule.ID: {BytesIn: 1 << 20}}, time.Now())
+		require.NoError(t, err)
+		require.Equal(t, []uint{user.ID}, result.ExhaustedUsers)
+		require.Zero(t, balance())
+
+		var rules []models.ForwardingRule
+		require.NoError(t, db.Where("user_id = ?", user.ID).Order("id asc").Find(&rules).Error)
+		require.False(t, rules[0].Enabled)
+		require.Equal(t, RuleDisabledBalanceExhausted, rules[0].DisabledReason)
+		require.False(t, rules[1].Enabled)
+		require.Equal(t, RuleDisabledBalanceExhausted, rules[1].DisabledReason)
+		// 用户手动禁用的规则不标记，购买流量后也不会被启用
+		require.Empty(t, rules[2].DisabledReason)
+
+		var stored models.Node
+		require.NoError(t, db.First(&stored, node.ID).Error)
+		require.Greater(t, stored.ConfigRevision, revision)
+
+		// 已耗尽后继续上报不会重复标记
+		result, err = service.RecordNodeTraffic(node, map[uint]TrafficDelta{rule.ID: {BytesIn: 10}}, time.Now())
+		require.NoError(t, err)
+		require.Empty(t, result.ExhaustedUsers)
+	})
+
+	t.Run("购买套餐后恢复规则", func(t *testing.T) {
+		pkg := createTestPackage(t, db, "billing-package")
+		payment := NewPaymentService(db, nil)
+		_, err := payment.CreateAndCompleteOrder(user.ID, pkg.ID, pkg.Price)
+		require.NoError(t, err)
+
+		var rules []models.ForwardingRule
+		require.NoError(t, db.Where("user_id = ?", user.ID).Order("id asc").Find(&rules).Error)
+		require.True(t, rules[0].Enabled)
+		require.Empty(t, rules[0].DisabledReason)
+		require.True(t, rules[1].Enabled)
+		require.False(t, rules[2].Enabled)
+		require.Equal(t, pkg.Traffic, balance())
+	})
+
+	t.Run("余额恢复时端口已被占用的规则保持禁用", func(t *testing.T) {
+		require.NoError(t, db.Model(user).Update("traffic_balance", 0).Error)
+		require.NoError(t, service.SyncTrafficBalanceRules(user.ID))
+
+		// 余额耗尽期间其他用户占用了同一端口
+		otherUser := createTestUser(t, db, "billing-other")
+		createBillingRule(t, db, otherUser.ID, node.ID, 9001)
+
+		require.NoError(t, db.Model(user).Update("traffic_balance", 1000).Error)
+		require.NoError(t, service.SyncTrafficBalanceRules(user.ID))
+
+		saved, err := service.GetRuleByID(rule.ID)
+		require.NoError(t, err)
+		require.False(t, saved.Enabled)
+		require.Equal(t, RuleDisabledPortConflict, saved.DisabledReason)
+		saved, err = service.GetRuleByID(tunnel.ID)
+		require.NoError(t, err)
+		require.True(t, saved.Enabled)
+	})
+}
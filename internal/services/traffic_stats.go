@@ -0,0 +1,458 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"bakaray/internal/logger"
+	"bakaray/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// TrafficResolutionHour 1 小时聚合
+	TrafficResolutionHour = 3600
+	// TrafficResolutionDay 1 天聚合（UTC 零点对齐）
+	TrafficResolutionDay = 86400
+
+	// TrafficRollupInterval 流量日志聚合与清理周期
+	TrafficRollupInterval = time.Minute
+
+	// TrafficSeriesMaxPoints 时间序列单个分组的最大点数
+	TrafficSeriesMaxPoints = 2000
+
+	trafficRollupBatchSize = 1000
+	// trafficRollupMaxBatches 单次任务最多处理的批次数，积压部分留给下一周期
+	trafficRollupMaxBatches = 50
+)
+
+var (
+	ErrInvalidTrafficRange    = errors.New("无效的时间范围")
+	ErrInvalidTrafficInterval = errors.New("interval 仅支持 hour 或 day")
+	ErrTrafficSeriesTooLarge  = errors.New("查询点数过多，请使用 day 粒度或缩小时间范围")
+)
+
+// TrafficRetention 流量日志与各粒度聚合的保留时长，Day 为 0 表示永久保留
+type TrafficRetention struct {
+	Raw  time.Duration
+	Hour time.Duration
+	Day  time.Duration
+}
+
+// DefaultTrafficRetention 默认保留策略：原始日志 30 天，小时聚合 90 天，天聚合 2 年
+var DefaultTrafficRetention = TrafficRetention{
+	Raw:  30 * 24 * time.Hour,
+	Hour: 90 * 24 * time.Hour,
+	Day:  730 * 24 * time.Hour,
+}
+
+// TrafficFilter 流量统计过滤条件，零值字段不过滤
+type TrafficFilter struct {
+	UserID uint
+	RuleID uint
+	NodeID uint
+}
+
+func (f TrafficFilter) apply(query *gorm.DB, table string) *gorm.DB {
+	if f.UserID > 0 {
+		query = query.Where(table+".user_id = ?", f.UserID)
+	}
+	if f.RuleID > 0 {
+		query = query.Where(table+".rule_id = ?", f.RuleID)
+	}
+	if f.NodeID > 0 {
+		query = query.Where(table+".node_id = ?", f.NodeID)
+	}
+	return query
+}
+
+// TrafficTotals 流量合计
+type TrafficTotals struct {
+	BytesIn  int64 `json:"bytes_in" gorm:"column:bytes_in"`
+	BytesOut int64 `json:"bytes_out" gorm:"column:bytes_out"`
+	Billed   int64 `json:"billed" gorm:"column:billed"`
+}
+
+func (t *TrafficTotals) add(o TrafficTotals) {
+	t.BytesIn += o.BytesIn
+	t.BytesOut += o.BytesOut
+	t.Billed += o.Billed
+}
+
+// TrafficStatsService 流量统计服务，负责流量日志的小时/天聚合、清理与查询
+type TrafficStatsService struct {
+	db        *gorm.DB
+	retention TrafficRetention
+}
+
+// NewTrafficStatsService 创建流量统计服务，原始日志与小时聚合保留时长未设置时使用默认值
+func NewTrafficStatsService(db *gorm.DB, retention TrafficRetention) *TrafficStatsService {
+	if retention.Raw <= 0 {
+		retention.Raw = DefaultTrafficRetention.Raw
+	}
+	if retention.Hour <= 0 {
+		retention.Hour = DefaultTrafficRetention.Hour
+	}
+	if retention.Day < 0 {
+		retention.Day = 0
+	}
+	return &TrafficStatsService{db: db, retention: retention}
+}
+
+func trafficBucket(t time.Time, resolution int) time.Time {
+	t = t.UTC()
+	if resolution == TrafficResolutionDay {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return t.Truncate(time.Duration(resolution) * time.Second)
+}
+
+type trafficRollupKey struct {
+	RuleID     uint
+	NodeID     uint
+	Resolution int
+	BucketAt   time.Time
+}
+
+// Rollup 将尚未聚合的流量日志累加到小时和天聚合中。每批日志的累加与标记在同一事务内完成，
+// 可重复执行且不会重复计数；升级前的历史日志会在首次执行时逐批补齐。
+func (s *TrafficStatsService) Rollup() (int, error) {
+	total := 0
+	for i := 0; i < trafficRollupMaxBatches; i++ {
+		n, err := s.rollupBatch()
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < trafficRollupBatchSize {
+			break
+		}
+	}
+	return total, nil
+}
+
+func (s *TrafficStatsService) rollupBatch() (int, error) {
+	processed := 0
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var logs []models.TrafficLog
+		if err := tx.Where("rolled_up = ?", false).Order("id asc").Limit(trafficRollupBatchSize).Find(&logs).Error; err != nil {
+			return err
+		}
+		if len(logs) == 0 {
+			return nil
+		}
+
+		owners, err := trafficLogOwners(tx, logs)
+		if err != nil {
+			return err
+		}
+
+		buckets := make(map[trafficRollupKey]*models.TrafficRollup)
+		var order []trafficRollupKey
+		ids := make([]uint, 0, len(logs))
+		for _, entry := range logs {
+			ids = append(ids, entry.ID)
+			userID := entry.UserID
+			if userID == 0 {
+				userID = owners[entry.RuleID]
+			}
+			for _, resolution := range []int{TrafficResolutionHour, TrafficResolutionDay} {
+				key := trafficRollupKey{entry.RuleID, entry.NodeID, resolution, trafficBucket(entry.Timestamp, resolution)}
+				row, ok := buckets[key]
+				if !ok {
+					row = &models.TrafficRollup{RuleID: key.RuleID, NodeID: key.NodeID, Resolution: resolution, BucketAt: key.BucketAt, UserID: userID}
+					buckets[key] = row
+					order = append(order, key)
+				}
+				row.BytesIn += entry.BytesIn
+				row.BytesOut += entry.BytesOut
+				row.Billed += entry.Billed
+			}
+		}
+
+		for _, key := range order {
+			row := buckets[key]
+			if err := tx.Clauses(clause.OnConflict{
+				Columns: []clause.Column{{Name: "rule_id"}, {Name: "node_id"}, {Name: "resolution"}, {Name: "bucket_at"}},
+				DoUpdates: clause.Assignments(map[string]interface{}{
+					"bytes_in":  gorm.Expr("traffic_rollups.bytes_in + ?", row.BytesIn),
+					"bytes_out": gorm.Expr("traffic_rollups.bytes_out + ?", row.BytesOut),
+					"billed":    gorm.Expr("traffic_rollups.billed + ?", row.Billed),
+				}),
+			}).Create(row).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Model(&models.TrafficLog{}).Where("id IN ?", ids).UpdateColumn("rolled_up", true).Error; err != nil {
+			return err
+		}
+		processed = len(logs)
+		return nil
+	})
+	return processed, err
+}
+
+// trafficLogOwners 为未记录用户的历史日志查找规则所属用户
+func trafficLogOwners(db *gorm.DB, logs []models.TrafficLog) (map[uint]uint, error) {
+	var ruleIDs []uint
+	for _, entry := range logs {
+		if entry.UserID == 0 {
+			ruleIDs = append(ruleIDs, entry.RuleID)
+		}
+	}
+	owners := make(map[uint]uint)
+	if len(ruleIDs) == 0 {
+		return owners, nil
+	}
+	var rules []models.ForwardingRule
+	if err := db.Select("id", "user_id").Where("id IN ?", uniqueNodeIDs(ruleIDs)).Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		owners[rule.ID] = rule.UserID
+	}
+	return owners, nil
+}
+
+// Prune 按保留策略删除过期的原始日志和聚合，尚未聚合的原始日志不会被删除
+func (s *TrafficStatsService) Prune(now time.Time) (int64, error) {
+	now = now.UTC()
+	var deleted int64
+
+	result := s.db.Where("rolled_up = ? AND timestamp < ?", true, now.Add(-s.retention.Raw)).Delete(&models.TrafficLog{})
+	if result.Error != nil {
+		return deleted, result.Error
+	}
+	deleted += result.RowsAffected
+
+	retention := map[int]time.Duration{TrafficResolutionHour: s.retention.Hour, TrafficResolutionDay: s.retention.Day}
+	for _, resolution := range []int{TrafficResolutionHour, TrafficResolutionDay} {
+		if retention[resolution] <= 0 {
+			continue
+		}
+		result := s.db.Where("resolution = ? AND bucket_at < ?", resolution, now.Add(-retention[resolution])).Delete(&models.TrafficRollup{})
+		if result.Error != nil {
+			return deleted, result.Error
+		}
+		deleted += result.RowsAffected
+	}
+	return deleted, nil
+}
+
+// RunRollup 供调度器调用的聚合与清理任务
+func (s *TrafficStatsService) RunRollup(ctx context.Context) error {
+	rolled, err := s.Rollup()
+	if err != nil {
+		return err
+	}
+	pruned, err := s.Prune(time.Now())
+	if err != nil {
+		return err
+	}
+	if pruned > 0 {
+		logger.Info("Traffic log rollup finished", "logs", rolled, "pruned", pruned)
+	}
+	return nil
+}
+
+// Totals 统计 [from, to) 内的流量合计
+func (s *TrafficStatsService) Totals(filter TrafficFilter, from, to time.Time) (*TrafficTotals, error) {
+	return sumTraffic(s.db, filter, from, to)
+}
+
+// sumTraffic 统计 [from, to) 内的流量合计，自动选择粒度：整天部分使用天聚合，
+// 首尾不足一天的部分使用小时聚合，再加上尚未聚合的原始日志。聚合部分的首尾按小时对齐。
+func sumTraffic(db *gorm.DB, filter TrafficFilter, from, to time.Time) (*TrafficTotals, error) {
+	from = trafficBucket(from, TrafficResolutionHour)
+	to = to.UTC()
+	totals := &TrafficTotals{}
+	if !from.Before(to) {
+		return totals, nil
+	}
+
+	type span struct {
+		resolution int
+		from, to   time.Time
+	}
+	var spans []span
+	dayStart := trafficBucket(from, TrafficResolutionDay)
+	if dayStart.Before(from) {
+		dayStart = dayStart.Add(24 * time.Hour)
+	}
+	dayEnd := trafficBucket(to, TrafficResolutionDay)
+	if dayStart.Before(dayEnd) {
+		spans = append(spans,
+			span{TrafficResolutionHour, from, dayStart},
+			span{TrafficResolutionDay, dayStart, dayEnd},
+			span{TrafficResolutionHour, dayEnd, to},
+		)
+	} else {
+		spans = append(spans, span{TrafficResolutionHour, from, to})
+	}
+
+	for _, sp := range spans {
+		if !sp.from.Before(sp.to) {
+			continue
+		}
+		var part TrafficTotals
+		query := db.Model(&models.TrafficRollup{}).
+			Select("COALESCE(SUM(bytes_in),0) AS bytes_in, COALESCE(SUM(bytes_out),0) AS bytes_out, COALESCE(SUM(billed),0) AS billed").
+			Where("resolution = ? AND bucket_at >= ? AND bucket_at < ?", sp.resolution, sp.from, sp.to)
+		if err := filter.apply(query, "traffic_rollups").Scan(&part).Error; err != nil {
+			return nil, err
+		}
+		totals.add(part)
+	}
+
+	var pending TrafficTotals
+	query := db.Model(&models.TrafficLog{}).
+		Select("COALESCE(SUM(bytes_in),0) AS bytes_in, COALESCE(SUM(bytes_out),0) AS bytes_out, COALESCE(SUM(billed),0) AS billed").
+		Where("rolled_up = ? AND timestamp >= ? AND timestamp < ?", false, from, to)
+	if err := filter.apply(query, "traffic_logs").Scan(&pending).Error; err != nil {
+		return nil, err
+	}
+	totals.add(pending)
+	return totals, nil
+}
+
+// TrafficSeriesQuery 流量时间序列查询条件
+type TrafficSeriesQuery struct {
+	Filter      TrafficFilter
+	From        time.Time
+	To          time.Time
+	Interval    int  // TrafficResolutionHour 或 TrafficResolutionDay
+	GroupByRule bool // 按规则分组
+	GroupByNode bool // 按节点分组
+}
+
+// TrafficSeriesPoint 流量时间序列数据点，Timestamp 为时间桶起点（Unix 秒）
+type TrafficSeriesPoint struct {
+	Timestamp int64 `json:"timestamp"`
+	BytesIn   int64 `json:"bytes_in"`
+	BytesOut  int64 `json:"bytes_out"`
+	Billed    int64 `json:"billed"`
+}
+
+// TrafficSeriesGroup 一个分组的时间序列，未按规则/节点分组时对应字段为 0
+type TrafficSeriesGroup struct {
+	RuleID uint                 `json:"rule_id,omitempty"`
+	NodeID uint                 `json:"node_id,omitempty"`
+	Totals TrafficTotals        `json:"totals"`
+	Points []TrafficSeriesPoint `json:"points"`
+}
+
+// TrafficSeries 流量时间序列查询结果
+type TrafficSeries struct {
+	From     int64                `json:"from"`
+	To       int64                `json:"to"`
+	Interval int64                `json:"interval"` // 时间桶长度（秒）
+	GroupBy  []string             `json:"group_by"`
+	Totals   TrafficTotals        `json:"totals"`
+	Series   []TrafficSeriesGroup `json:"series"`
+}
+
+type trafficSeriesKey struct {
+	RuleID uint
+	NodeID uint
+}
+
+// Series 按小时或天返回 [from, to) 内的流量时间序列，可按规则、节点分组。
+// 数据来自对应粒度的聚合，并补上尚未聚合的原始日志；每个分组的时间桶连续，无流量的桶为 0。
+func (s *TrafficStatsService) Series(q TrafficSeriesQuery) (*TrafficSeries, error) {
+	if q.Interval != TrafficResolutionHour && q.Interval != TrafficResolutionDay {
+		return nil, ErrInvalidTrafficInterval
+	}
+	if !q.From.Before(q.To) {
+		return nil, ErrInvalidTrafficRange
+	}
+	from := trafficBucket(q.From, q.Interval)
+	to := q.To.UTC()
+	step := time.Duration(q.Interval) * time.Second
+	buckets := int((to.Sub(from) + step - 1) / step)
+	if buckets > TrafficSeriesMaxPoints {
+		return nil, ErrTrafficSeriesTooLarge
+	}
+
+	groups := make(map[trafficSeriesKey][]TrafficSeriesPoint)
+	add := func(ruleID, nodeID uint, at time.Time, in, out, billed int64) {
+		key := trafficSeriesKey{}
+		if q.GroupByRule {
+			key.RuleID = ruleID
+		}
+		if q.GroupByNode {
+			key.NodeID = nodeID
+		}
+		idx := int(trafficBucket(at, q.Interval).Sub(from) / step)
+		if idx < 0 || idx >= buckets {
+			return
+		}
+		points, ok := groups[key]
+		if !ok {
+			points = make([]TrafficSeriesPoint, buckets)
+			for i := range points {
+				points[i].Timestamp = from.Add(time.Duration(i) * step).Unix()
+			}
+			groups[key] = points
+		}
+		points[idx].BytesIn += in
+		points[idx].BytesOut += out
+		points[idx].Billed += billed
+	}
+
+	var rollups []models.TrafficRollup
+	query := s.db.Where("resolution = ? AND bucket_at >= ? AND bucket_at < ?", q.Interval, from, to)
+	if err := q.Filter.apply(query, "traffic_rollups").Find(&rollups).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rollups {
+		add(row.RuleID, row.NodeID, row.BucketAt, row.BytesIn, row.BytesOut, row.Billed)
+	}
+
+	var pending []models.TrafficLog
+	query = s.db.Where("rolled_up = ? AND timestamp >= ? AND timestamp < ?", false, from, to)
+	if err := q.Filter.apply(query, "traffic_logs").Find(&pending).Error; err != nil {
+		return nil, err
+	}
+	for _, entry := range pending {
+		add(entry.RuleID, entry.NodeID, entry.Timestamp, entry.BytesIn, entry.BytesOut, entry.Billed)
+	}
+
+	// 未分组时始终返回一条（可能全为 0 的）序列
+	if !q.GroupByRule && !q.GroupByNode && len(groups) == 0 {
+		add(0, 0, from, 0, 0, 0)
+	}
+
+	result := &TrafficSeries{
+		From:     from.Unix(),
+		To:       to.Unix(),
+		Interval: int64(q.Interval),
+		GroupBy:  []string{},
+		Series:   make([]TrafficSeriesGroup, 0, len(groups)),
+	}
+	if q.GroupByRule {
+		result.GroupBy = append(result.GroupBy, "rule")
+	}
+	if q.GroupByNode {
+		result.GroupBy = append(result.GroupBy, "node")
+	}
+	for key, points := range groups {
+		group := TrafficSeriesGroup{RuleID: key.RuleID, NodeID: key.NodeID, Points: points}
+		for _, p := range points {
+			group.Totals.add(TrafficTotals{BytesIn: p.BytesIn, BytesOut: p.BytesOut, Billed: p.Billed})
+		}
+		result.Totals.add(group.Totals)
+		result.Series = append(result.Series, group)
+	}
+	sort.Slice(result.Series, func(i, j int) bool {
+		if result.Series[i].RuleID != result.Series[j].RuleID {
+			return result.Series[i].RuleID < result.Series[j].RuleID
+		}
+		return result.Series[i].NodeID < result.Series[j].NodeID
+	})
+	return result, nil
+}
@@ -0,0 +1,184 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"bakaray/internal/models"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrafficRollup(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	service := NewTrafficStatsService(db, DefaultTrafficRetention)
+	user := createTestUser(t, db, "rollup-user")
+	node := createTestNode(t, db, "rollup-node")
+	rule := createBillingRule(t, db, user.ID, node.ID, 9101)
+
+	day := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -3)
+	logs := []models.TrafficLog{
+		{RuleID: rule.ID, NodeID: node.ID, UserID: user.ID, BytesIn: 100, BytesOut: 10, Billed: 110, Timestamp: day.Add(time.Hour + time.Minute)},
+		{RuleID: rule.ID, NodeID: node.ID, UserID: user.ID, BytesIn: 200, BytesOut: 20, Billed: 220, Timestamp: day.Add(time.Hour + 30*time.Minute)},
+		{RuleID: rule.ID, NodeID: node.ID, UserID: user.ID, BytesIn: 300, BytesOut: 30, Billed: 330, Timestamp: day.Add(5 * time.Hour)},
+		// 升级前的历史日志未记录用户，聚合时按规则补齐
+		{RuleID: rule.ID, NodeID: node.ID, BytesIn: 400, BytesOut: 40, Timestamp: day.Add(26 * time.Hour)},
+	}
+	require.NoError(t, db.Create(&logs).Error)
+
+	t.Run("原始日志累加到小时和天聚合", func(t *testing.T) {
+		n, err := service.Rollup()
+		require.NoError(t, err)
+		require.Equal(t, 4, n)
+
+		var hours []models.TrafficRollup
+		require.NoError(t, db.Where("resolution = ?", TrafficResolutionHour).Order("bucket_at asc").Find(&hours).Error)
+		require.Len(t, hours, 3)
+		require.Equal(t, int64(300), hours[0].BytesIn)
+		require.Equal(t, int64(330), hours[0].Billed)
+		require.Equal(t, user.ID, hours[2].UserID)
+
+		var days []models.TrafficRollup
+		require.NoError(t, db.Where("resolution = ?", TrafficResolutionDay).Order("bucket_at asc").Find(&days).Error)
+		require.Len(t, days, 2)
+		require.Equal(t, int64(600), days[0].BytesIn)
+		require.True(t, days[0].BucketAt.Equal(day))
+	})
+
+	t.Run("重复执行不重复计数，新日志增量累加", func(t *testing.T) {
+		n, err := service.Rollup()
+		require.NoError(t, err)
+		require.Zero(t, n)
+
+		require.NoError(t, db.Create(&models.TrafficLog{RuleID: rule.ID, NodeID: node.ID, UserID: user.ID, BytesIn: 1, Timestamp: day.Add(5*time.Hour + time.Minute)}).Error)
+		_, err = service.Rollup()
+		require.NoError(t, err)
+
+		var row models.TrafficRollup
+		require.NoError(t, db.Where("resolution = ? AND bucket_at = ?", TrafficResolutionHour, day.Add(5*time.Hour)).First(&row).Error)
+		require.Equal(t, int64(301), row.BytesIn)
+	})
+
+	t.Run("合计自动组合天、小时聚合与未聚合日志", func(t *testing.T) {
+		require.NoError(t, db.Create(&models.TrafficLog{RuleID: rule.ID, NodeID: node.ID, UserID: user.ID, BytesIn: 5, Timestamp: time.Now().UTC().Add(-time.Minute)}).Error)
+
+		totals, err := service.Totals(TrafficFilter{UserID: user.ID}, day.Add(-time.Hour), time.Now())
+		require.NoError(t, err)
+		require.Equal(t, int64(100+200+300+400+1+5), totals.BytesIn)
+		require.Equal(t, int64(660), totals.Billed)
+
+		// 跨天边界的部分使用小时聚合
+		totals, err = service.Totals(TrafficFilter{RuleID: rule.ID}, day.Add(2*time.Hour), day.Add(27*time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, int64(301+400), totals.BytesIn)
+
+		totals, err = service.Totals(TrafficFilter{UserID: user.ID + 1}, day, time.Now())
+		require.NoError(t, err)
+		require.Zero(t, totals.BytesIn)
+
+		bytesIn, _, err := NewRuleService(db, nil).GetUserTrafficStats(user.ID, day)
+		require.NoError(t, err)
+		require.Equal(t, int64(1006), bytesIn)
+	})
+
+	t.Run("按保留策略清理", func(t *testing.T) {
+		_, err := service.Rollup()
+		require.NoError(t, err)
+
+		short := NewTrafficStatsService(db, TrafficRetention{Raw: 24 * time.Hour, Hour: 48 * time.Hour})
+		deleted, err := short.Prune(time.Now())
+		require.NoError(t, err)
+		require.Positive(t, deleted)
+
+		var raw int64
+		require.NoError(t, db.Model(&models.TrafficLog{}).Count(&raw).Error)
+		require.Equal(t, int64(1), raw)
+
+		var days int64
+		require.NoError(t, db.Model(&models.TrafficRollup{}).Where("resolution = ?", TrafficResolutionDay).Count(&days).Error)
+		require.Equal(t, int64(3), days)
+	})
+}
+
+func TestTrafficSeries(t *testing.T) {
+	db := setupTestDB(t)
+	defer cleanupTestDB(db)
+
+	service := NewTrafficStatsService(db, DefaultTrafficRetention)
+	user := createTestUser(t, db, "series-user")
+	nodeA := createTestNode(t, db, "series-a")
+	nodeB := createTestNode(t, db, "series-b")
+	ruleA := createBillingRule(t, db, user.ID, nodeA.ID, 9201)
+	ruleB := createBillingRule(t, db, user.ID, nodeB.ID, 9202)
+
+	start := time.Now().UTC().Truncate(time.Hour).Add(-5 * time.Hour)
+	require.NoError(t, db.Create(&[]models.TrafficLog{
+		{RuleID: ruleA.ID, NodeID: nodeA.ID, UserID: user.ID, BytesIn: 10, BytesOut: 1, Timestamp: start.Add(10 * time.Minute)},
+		{RuleID: ruleA.ID, NodeID: nodeA.ID, UserID: user.ID, BytesIn: 20, BytesOut: 2, Timestamp: start.Add(2*time.Hour + time.Minute)},
+		{RuleID: ruleB.ID, NodeID: nodeB.ID, UserID: user.ID, BytesIn: 30, BytesOut: 3, Timestamp: start.Add(2*time.Hour + 2*time.Minute)},
+	}).Error)
+	_, err := service.Rollup()
+	require.NoError(t, err)
+	// 尚未聚合的日志也计入
+	require.NoError(t, db.Create(&models.TrafficLog{RuleID: ruleB.ID, NodeID: nodeB.ID, UserID: user.ID, BytesIn: 40, Timestamp: start.Add(3 * time.Hour)}).Error)
+
+	t.Run("按小时返回连续的时间桶", func(t *testing.T) {
+		series, err := service.Series(TrafficSeriesQuery{
+			Filter:   TrafficFilter{UserID: user.ID},
+			From:     start.Add(5 * time.Minute),
+			To:       start.Add(4 * time.Hour),
+			Interval: TrafficResolutionHour,
+		})
+		require.NoError(t, err)
+		require.Equal(t, start.Unix(), series.From)
+		require.Len(t, series.Series, 1)
+		points := series.Series[0].Points
+		require.Len(t, points, 4)
+		require.Equal(t, int64(10), points[0].BytesIn)
+		require.Zero(t, points[1].BytesIn)
+		require.Equal(t, int64(50), points[2].BytesIn)
+		require.Equal(t, int64(40), points[3].BytesIn)
+		require.Equal(t, int64(100), series.Totals.BytesIn)
+	})
+
+	t.Run("按规则和节点分组", func(t *testing.T) {
+		series, err := service.Series(TrafficSeriesQuery{
+			Filter:      TrafficFilter{UserID: user.ID},
+			From:        start,
+			To:          start.Add(4 * time.Hour),
+			Interval:    TrafficResolutionHour,
+			GroupByRule: true,
+			GroupByNode: true,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"rule", "node"}, series.GroupBy)
+		require.Len(t, series.Series, 2)
+		require.Equal(t, ruleA.ID, series.Series[0].RuleID)
+		require.Equal(t, nodeA.ID, series.Series[0].NodeID)
+		require.Equal(t, int64(30), series.Series[0].Totals.BytesIn)
+		require.Equal(t, int64(70), series.Series[1].Totals.BytesIn)
+	})
+
+	t.Run("按天聚合与过滤", func(t *testing.T) {
+		series, err := service.Series(TrafficSeriesQuery{
+			Filter:   TrafficFilter{RuleID: ruleA.ID},
+			From:     start.Add(-48 * time.Hour),
+			To:       time.Now(),
+			Interval: TrafficResolutionDay,
+		})
+		require.NoError(t, err)
+		require.Equal(t, int64(30), series.Totals.BytesIn)
+		require.Equal(t, int64(TrafficResolutionDay), series.Interval)
+	})
+
+	t.Run("拒绝无效参数", func(t *testing.T) {
+		_, err := service.Series(TrafficSeriesQuery{From: start, To: start, Interval: TrafficResolutionHour})
+		require.ErrorIs(t, err, ErrInvalidTrafficRange)
+		_, err = service.Series(TrafficSeriesQuery{From: start, To: start.Add(time.Hour), Interval: 60})
+		require.ErrorIs(t, err, ErrInvalidTrafficInterval)
+		_, err = service.Series(TrafficSeriesQuery{From: start.AddDate(-1, 0, 0), To: start, Interval: TrafficResolutionHour})
+		require.ErrorIs(t, err, ErrTrafficSeriesTooLarge)
+	})
+}
@@ -55,6 +55,12 @@ func (s *UserGroupService) ListUserGroups() ([]models.UserGroup, error) {
 
 // UpdateUserGroup 更新用户组
 func (s *UserGroupService) UpdateUserGroup(id uint, updates map[string]interface{}) error {
+	if err := normalizePortRangeUpdates(updates); err != nil {
+		return err
+	}
+	if err := normalizeRuleQuotaUpdates(updates); err != nil {
+		return err
+	}
 	return s.db.Model(&models.UserGroup{}).Where("id = ?", id).Updates(updates).Error
 }
 
@@ -17,6 +17,7 @@ func Setup(
 	paymentHandler *handlers.PaymentHandler,
 	adminHandler *handlers.AdminHandler,
 	authMiddleware *middleware.AuthMiddleware,
+	nodeAuthMiddleware *middleware.NodeAuthMiddleware,
 ) {
 	// 健康检查
 	r.GET("/health", func(c *gin.Context) {
@@ -48,14 +49,22 @@ func Setup(
 			nodes := protected.Group("/nodes")
 			nodes.GET("", nodeHandler.GetNodes)
 			nodes.GET("/:id", nodeHandler.GetNode)
+			nodes.GET("/:id/probe/history", nodeHandler.GetNodeProbeHistory)
 
 			// 转发规则模块
 			rules := protected.Group("/rules")
 			rules.GET("", ruleHandler.GetRules)
 			rules.POST("", ruleHandler.CreateRule)
+			rules.GET("/export", ruleHandler.ExportRules)
+			rules.POST("/import", ruleHandler.ImportRules)
+			rules.GET("/free-ports", ruleHandler.GetFreePorts)
 			rules.GET("/:id", ruleHandler.GetRule)
 			rules.PUT("/:id", ruleHandler.UpdateRule)
 			rules.DELETE("/:id", ruleHandler.DeleteRule)
+			rules.GET("/:id/traffic", ruleHandler.GetRuleTraffic)
+			rules.GET("/:id/acl", ruleHandler.GetRuleACL)
+			rules.PUT("/:id/acl", ruleHandler.UpdateRuleACL)
+			rules.GET("/:id/targets/health", ruleHandler.GetRuleTargetHealth)
 
 			// 套餐模块
 			protected.GET("/packages", paymentHandler.GetPackages)
@@ -71,20 +80,24 @@ func Setup(
 
 			// 流量统计
 			protected.GET("/statistics/traffic", userHandler.GetTrafficStats)
+			protected.GET("/statistics/traffic/series", ruleHandler.GetTrafficSeries)
 		}
 
 		// 支付回调（第三方通知/前端回跳，不需要用户认证）
 		api.GET("/deposit/callback", paymentHandler.PaymentCallback)
 		api.POST("/deposit/callback", paymentHandler.PaymentCallback)
 
-		// 节点通信接口（不需要用户认证，使用节点密钥验证）
+		// 节点通信接口（不需要用户认证，使用节点签名验证）
 		nodeAPI := api.Group("/node")
 		{
 			nodeAPI.POST("/register", nodeHandler.NodeRegister)
-			nodeAPI.POST("/heartbeat", nodeHandler.NodeHeartbeat)
-			nodeAPI.GET("/config", nodeHandler.NodeConfig)
-			nodeAPI.POST("/config", nodeHandler.NodeConfig)
-			nodeAPI.POST("/report", nodeHandler.NodeReport)
+
+			signed := nodeAPI.Group("")
+			signed.Use(nodeAuthMiddleware.Authenticate())
+			signed.POST("/heartbeat", nodeHandler.NodeHeartbeat)
+			signed.GET("/config", nodeHandler.NodeConfig)
+			signed.POST("/config", nodeHandler.NodeConfig)
+			signed.POST("/report", nodeHandler.NodeReport)
 		}
 
 		// 后台管理接口
@@ -94,6 +107,8 @@ func Setup(
 			// 管理员统计
 			admin.GET("/stats/overview", adminHandler.GetOverviewStats)
 			admin.GET("/rules/count", ruleHandler.CountRules)
+			admin.POST("/rules/import-config", ruleHandler.ImportNodeConfig)
+			admin.GET("/statistics/traffic/series", ruleHandler.GetAdminTrafficSeries)
 
 			// 站点配置
 			site := admin.Group("/site")
@@ -102,6 +117,15 @@ func Setup(
 				site.PUT("", adminHandler.UpdateSiteConfig)
 			}
 
+			// 目标地址策略
+			destinationPolicy := admin.Group("/destination-policy")
+			{
+				destinationPolicy.GET("", adminHandler.GetDestinationPolicy)
+				destinationPolicy.PUT("", adminHandler.UpdateDestinationPolicy)
+				destinationPolicy.POST("/recheck", adminHandler.RecheckDestinations)
+				destinationPolicy.GET("/violations", adminHandler.GetDestinationViolations)
+			}
+
 			// 支付配置
 			payments := admin.Group("/payments")
 			{
@@ -116,10 +140,34 @@ func Setup(
 			{
 				adminNodes.GET("", adminHandler.GetAdminNodes)
 				adminNodes.GET("/:id", adminHandler.GetAdminNodeDetail)
+				adminNodes.GET("/:id/status-events", adminHandler.GetNodeStatusEvents)
+				adminNodes.GET("/:id/probe/history", nodeHandler.GetNodeProbeHistory)
 				adminNodes.PUT("/:id", adminHandler.UpdateNode)
+				adminNodes.POST("/:id/rotate-secret", adminHandler.RotateNodeSecret)
+				adminNodes.POST("/:id/revoke-credentials", adminHandler.RevokeNodeCredentials)
 				adminNodes.DELETE("/:id", adminHandler.DeleteNode)
 			}
 
+			// 节点注册令牌
+			enrollmentTokens := admin.Group("/node-enrollment-tokens")
+			{
+				enrollmentTokens.GET("", adminHandler.GetNodeEnrollmentTokens)
+				enrollmentTokens.POST("", adminHandler.CreateNodeEnrollmentToken)
+				enrollmentTokens.DELETE("/:id", adminHandler.RevokeNodeEnrollmentToken)
+			}
+
+			// 节点组
+			nodeGroups := admin.Group("/node-groups")
+			{
+				nodeGroups.GET("", adminHandler.GetNodeGroups)
+				nodeGroups.POST("", adminHandler.CreateNodeGroup)
+				nodeGroups.PUT("/:id", adminHandler.UpdateNodeGroup)
+				nodeGroups.DELETE("/:id", adminHandler.DeleteNodeGroup)
+				nodeGroups.GET("/:id/members", adminHandler.GetNodeGroupMembers)
+				nodeGroups.PUT("/:id/members", adminHandler.SetNodeGroupMembers)
+				nodeGroups.DELETE("/:id/members/:node_id", adminHandler.RemoveNodeGroupMember)
+			}
+
 			// 用户组
 			userGroups := admin.Group("/user-groups")
 			{